@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+)
+
+//defaultAuditLimit is how many of the latest entries an
+// audit query without limit returns
+const defaultAuditLimit = 100
+
+func handleV1Audit(trail *audit.Trail) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		query := audit.Query{
+			Source: audit.Source(params.Get("source")),
+			Actor:  params.Get("actor"),
+			Target: params.Get("target"),
+			Limit:  defaultAuditLimit,
+		}
+		var err error
+		if from := params.Get("from"); from != "" {
+			if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+				writeError(resp, http.StatusBadRequest, fmt.Errorf("from must be RFC3339: %v", err))
+				return
+			}
+		}
+		if to := params.Get("to"); to != "" {
+			if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+				writeError(resp, http.StatusBadRequest, fmt.Errorf("to must be RFC3339: %v", err))
+				return
+			}
+		}
+		if limit := params.Get("limit"); limit != "" {
+			if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 {
+				writeError(resp, http.StatusBadRequest, fmt.Errorf("limit must be a positive whole number"))
+				return
+			}
+		}
+		found, err := trail.Query(query)
+		if err != nil {
+			writeError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, found)
+	}
+}
@@ -0,0 +1,260 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+//auditBody is how much of a change request is logged
+const auditBody = 1024
+
+type principalKey struct{}
+
+type peerKey struct{}
+
+//rememberPeer keeps the address of the connection itself, which unlike
+// the one RealIP takes from the headers cannot be made up
+func rememberPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), peerKey{}, req.RemoteAddr)))
+	})
+}
+
+//peer is the host req came from as rememberPeer kept it,
+// rather than the one RealIP put in RemoteAddr
+func peer(req *http.Request) string {
+	address, _ := req.Context().Value(peerKey{}).(string)
+	if address == "" {
+		address = req.RemoteAddr
+	}
+	return remoteHost(address)
+}
+
+//principal is who req is from, Anonymous when the API is open
+func principal(req *http.Request) *auth.Principal {
+	if found, ok := req.Context().Value(principalKey{}).(*auth.Principal); ok {
+		return found
+	}
+	return auth.Anonymous
+}
+
+//authenticate refuses requests without valid credentials and tells
+// the rest of the chain who each request is from. Failed attempts
+// are limited by address, and an address which has used them up is
+// refused before its credentials are checked, so passwords cannot be
+// guessed quickly even when a guess is right.
+func (server *Server) authenticate(next http.Handler) http.Handler {
+	if server.Auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		address := "address " + peer(req)
+		if exhausted, wait := server.Auth.Limiter.Exhausted(address, time.Now()); exhausted {
+			refuse(resp, wait, fmt.Errorf("too many failed logins, try again in %s", wait.Round(time.Second)))
+			return
+		}
+		found, ok := server.Auth.Authenticate(req)
+		if !ok {
+			log.WithFields(log.Fields{
+				"remote": peer(req),
+				"path":   req.URL.Path,
+			}).Warn("API request refused, no valid credentials")
+			if !server.limit(resp, address) {
+				return
+			}
+			resp.Header().Set("WWW-Authenticate", server.Auth.Challenge())
+			writeError(resp, http.StatusUnauthorized, fmt.Errorf("credentials are missing or wrong"))
+			return
+		}
+		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), principalKey{}, found)))
+	})
+}
+
+//limit takes a write from key, answering 429 and returning
+// false when key has none left
+func (server *Server) limit(resp http.ResponseWriter, key string) bool {
+	if server.Auth == nil {
+		return true
+	}
+	allowed, wait := server.Auth.Limiter.Allow(key, time.Now())
+	if !allowed {
+		refuse(resp, wait, fmt.Errorf("too many changes, try again in %s", wait.Round(time.Second)))
+	}
+	return allowed
+}
+
+//refuse answers 429, telling the client to wait
+func refuse(resp http.ResponseWriter, wait time.Duration, err error) {
+	resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(resp, http.StatusTooManyRequests, err)
+}
+
+//scope is whether a principal may use what req is for
+type scope func(*auth.Principal, *http.Request) bool
+
+//anything is every request, for routes which name nothing
+func anything(*auth.Principal, *http.Request) bool {
+	return true
+}
+
+//unscoped is a request only a principal limited to nothing may make,
+// as it reaches devices and zones of every sort
+func unscoped(found *auth.Principal, req *http.Request) bool {
+	return !found.Scoped()
+}
+
+//namedDevice is a request for the device named in the path
+func (server *Server) namedDevice(found *auth.Principal, req *http.Request) bool {
+	return server.device(found, chi.URLParam(req, "name"))
+}
+
+//namedZone is a request for the zone named in the path
+func (server *Server) namedZone(found *auth.Principal, req *http.Request) bool {
+	return found.Zone(chi.URLParam(req, "name"))
+}
+
+//singleHVAC is a request for the one HVAC system, which is a
+// zone named after it or hvac when unnamed
+func (server *Server) singleHVAC(found *auth.Principal, req *http.Request) bool {
+	name := server.HVAC.Name
+	if name == "" {
+		name = "hvac"
+	}
+	return found.Zone(name)
+}
+
+//queriedDevice is a history request, which a scoped principal
+// has to make for a device they may use
+func (server *Server) queriedDevice(found *auth.Principal, req *http.Request) bool {
+	device := req.URL.Query().Get("device")
+	return !found.Scoped() || (device != "" && server.device(found, device))
+}
+
+//device is whether found may use the device name
+func (server *Server) device(found *auth.Principal, name string) bool {
+	return found.Device(name, func(zone string) []string {
+		if controller := server.zone(zone); controller != nil {
+			return controller.Devices()
+		}
+		return nil
+	})
+}
+
+//view is a route anyone authenticated may read within allowed
+func (server *Server) view(allowed scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if !allowed(principal(req), req) {
+				writeError(resp, http.StatusForbidden, fmt.Errorf("%s may not read %s", principal(req).Name, req.URL.Path))
+				return
+			}
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+//change is a route which changes something, open to role and above
+// within allowed. Changes are limited per principal and each is logged
+// and audited with who made it, what they asked for and how it went.
+func (server *Server) change(role auth.Role, allowed scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			found := principal(req)
+			if !found.Role.Allows(role) || !allowed(found, req) {
+				writeError(resp, http.StatusForbidden, fmt.Errorf("%s may not change %s", found.Name, req.URL.Path))
+				return
+			}
+			if !server.limit(resp, "principal "+found.Name) {
+				return
+			}
+			var body, result bytes.Buffer
+			req.Body = ioutil.NopCloser(io.TeeReader(req.Body, &limitedWriter{&body, auditBody}))
+			writer := middleware.NewWrapResponseWriter(resp, req.ProtoMajor)
+			writer.Tee(&limitedWriter{&result, auditBody})
+			next.ServeHTTP(writer, req)
+			log.WithFields(log.Fields{
+				"actor":     found.Name,
+				"role":      found.Role,
+				"method":    req.Method,
+				"path":      req.URL.Path,
+				"request":   body.String(),
+				"status":    writer.Status(),
+				"remote":    peer(req),
+				"requestID": middleware.GetReqID(req.Context()),
+			}).Printf("API change")
+			entry := audit.Entry{
+				Source:    audit.SourceAPI,
+				Actor:     found.Name,
+				Action:    req.Method + " " + chi.RouteContext(req.Context()).RoutePattern(),
+				Target:    server.target(req),
+				Requested: strings.TrimSpace(body.String()),
+				Reason:    fmt.Sprintf("from %s, request %s", peer(req), middleware.GetReqID(req.Context())),
+			}
+			outcome := strings.TrimSpace(result.String())
+			if outcome == "" {
+				outcome = http.StatusText(writer.Status())
+			}
+			if writer.Status() >= http.StatusBadRequest {
+				entry.Error = fmt.Sprintf("%d %s", writer.Status(), outcome)
+			} else {
+				entry.Result = outcome
+			}
+			server.Audit.Record(entry)
+		})
+	}
+}
+
+//target is the device, zone or scene a change is for
+func (server *Server) target(req *http.Request) string {
+	if name := chi.URLParam(req, "name"); name != "" {
+		return name
+	}
+	if server.HVAC != nil && strings.HasPrefix(req.URL.Path, "/v1/hvac/") {
+		if server.HVAC.Name == "" {
+			return "hvac"
+		}
+		return server.HVAC.Name
+	}
+	return ""
+}
+
+//limitedWriter keeps the first n bytes written to it
+type limitedWriter struct {
+	buffer *bytes.Buffer
+	n      int
+}
+
+func (writer *limitedWriter) Write(p []byte) (int, error) {
+	if left := writer.n - writer.buffer.Len(); left > 0 {
+		if len(p) > left {
+			writer.buffer.Write(p[:left])
+		} else {
+			writer.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+//remoteHost is address without its port
+func remoteHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,344 @@
+package api_test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/certs"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Auth", func() {
+	const (
+		tabletToken  = "tablet-0123456789abcdef"
+		grafanaToken = "grafana-0123456789abcdef"
+	)
+	var (
+		lamp      *switcher.MockSwitch
+		apiServer Server
+		server    *httptest.Server
+	)
+	BeforeEach(func() {
+		lamp = &switcher.MockSwitch{Status: "OFF"}
+		thermostats := map[string]thermostat.ThermostatDevice{
+			"upstairs":   &thermostat.MockThermostat{Temperature: 70},
+			"downstairs": &thermostat.MockThermostat{Temperature: 68},
+		}
+		switches := map[string]switcher.SwitchDevice{
+			"lamp":    lamp,
+			"furnace": &switcher.MockSwitch{Status: "OFF"},
+		}
+		zones, err := hvac.NewZones(
+			[]hvac.Config{
+				{Name: "upstairs", Mode: "heat", Setpoint: 70, Sensor: "upstairs", Heat: []string{"furnace"}},
+				{Name: "downstairs", Mode: "heat", Setpoint: 68, Sensor: "downstairs", Heat: []string{"furnace"}},
+			},
+			thermostats,
+			switches,
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		scenes, err := scene.NewManager(
+			[]scene.Scene{{Name: "away", Switches: map[string]string{"lamp": "OFF"}}},
+			"",
+			thermostats,
+			switches,
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		authenticator, err := auth.New(auth.Config{
+			Tokens: []auth.Token{
+				{Name: "tablet", Token: tabletToken, Role: auth.Operator, Scope: auth.Scope{Zones: []string{"upstairs"}}},
+				{Name: "grafana", Token: grafanaToken, Role: auth.Viewer},
+			},
+			Users:           []auth.User{{Username: "oskar", Password: "hunter2", Role: auth.Admin}},
+			WritesPerMinute: 3,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		apiServer = Server{
+			Home:   &home.Home{Thermostats: thermostats, Switches: switches},
+			Zones:  zones,
+			Scenes: scenes,
+			Auth:   authenticator,
+		}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	do := func(method string, path string, body string, credentials func(*http.Request)) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		Expect(err).ShouldNot(HaveOccurred())
+		credentials(req)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		return resp
+	}
+	token := func(token string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	nobody := func(*http.Request) {}
+	oskar := func(req *http.Request) {
+		req.SetBasicAuth("oskar", "hunter2")
+	}
+	Context("without credentials", func() {
+		It("should challenge for a login", func() {
+			resp := do(http.MethodGet, "/v1/devices", "", nobody)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(resp.Header.Get("WWW-Authenticate")).To(ContainSubstring(`Basic realm="mi-casa"`))
+		})
+		It("should protect the dashboard and metrics too", func() {
+			for _, path := range []string{"/", "/metrics"} {
+				resp := do(http.MethodGet, path, "", nobody)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+		})
+	})
+	Context("as a viewer", func() {
+		It("should read", func() {
+			resp := do(http.MethodGet, "/v1/devices", "", token(grafanaToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+		It("should not change anything", func() {
+			resp := do(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, token(grafanaToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(lamp.Status).To(Equal("OFF"))
+		})
+	})
+	Context("as an operator scoped to a zone", func() {
+		It("should set that zone", func() {
+			resp := do(http.MethodPost, "/v1/zones/upstairs/temperature", `{"set_temperature": 72}`, token(tabletToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+		It("should not set another zone", func() {
+			resp := do(http.MethodPost, "/v1/zones/downstairs/temperature", `{"set_temperature": 72}`, token(tabletToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+		It("should only list what is in scope", func() {
+			resp := do(http.MethodGet, "/v1/devices", "", token(tabletToken))
+			defer resp.Body.Close()
+			var devices DevicesStatus
+			Expect(json.NewDecoder(resp.Body).Decode(&devices)).Should(Succeed())
+			Expect(devices.Thermostats).To(HaveLen(1))
+			Expect(devices.Thermostats[0].Name).To(Equal("upstairs"))
+			Expect(devices.Switches).To(HaveLen(1))
+			Expect(devices.Switches[0].Name).To(Equal("furnace"))
+
+			zonesResp := do(http.MethodGet, "/v1/zones", "", token(tabletToken))
+			defer zonesResp.Body.Close()
+			var statuses []hvac.Status
+			Expect(json.NewDecoder(zonesResp.Body).Decode(&statuses)).Should(Succeed())
+			Expect(statuses).To(HaveLen(1))
+		})
+		It("should not switch a device outside the zone", func() {
+			resp := do(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, token(tabletToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+		It("should not apply a scene, which may reach any device", func() {
+			resp := do(http.MethodPost, "/v1/scenes/away/apply", "", token(tabletToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+	Context("as an admin", func() {
+		It("should switch any device and manage scenes", func() {
+			resp := do(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, oskar)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(lamp.Status).To(Equal("ON"))
+			resp = do(http.MethodPut, "/v1/scenes/evening", `{"devices": ["lamp"]}`, oskar)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			resp = do(http.MethodDelete, "/v1/scenes/evening", "", oskar)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+	})
+	Context("with a client certificate over mutual TLS", func() {
+		var (
+			directory string
+			authority *certs.Authority
+			tlsServer *httptest.Server
+		)
+		BeforeEach(func() {
+			var err error
+			directory, err = ioutil.TempDir("", "api")
+			Expect(err).ShouldNot(HaveOccurred())
+			manager, err := certs.New(certs.Config{Directory: directory, Clients: certs.ClientsOptional})
+			Expect(err).ShouldNot(HaveOccurred())
+			tlsConfig, err := manager.TLSConfig(time.Now())
+			Expect(err).ShouldNot(HaveOccurred())
+			authority, err = certs.OpenAuthority(directory, time.Now())
+			Expect(err).ShouldNot(HaveOccurred())
+			tlsServer = httptest.NewUnstartedServer(apiServer.Router())
+			tlsServer.TLS = tlsConfig
+			tlsServer.StartTLS()
+		})
+		AfterEach(func() {
+			tlsServer.Close()
+			os.RemoveAll(directory)
+		})
+		client := func(certificates ...tls.Certificate) *http.Client {
+			return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      authority.Pool(),
+				ServerName:   "localhost",
+				Certificates: certificates,
+			}}}
+		}
+		It("should log in as the token named by the certificate", func() {
+			certificate, err := authority.Issue("tablet", nil, time.Now())
+			Expect(err).ShouldNot(HaveOccurred())
+			resp, err := client(certificate).Post(tlsServer.URL+"/v1/zones/upstairs/temperature", "application/json", strings.NewReader(`{"set_temperature": 72}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+		It("should still ask anyone without one to log in", func() {
+			resp, err := client().Get(tlsServer.URL + "/v1/devices")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+	Describe("auditing", func() {
+		var (
+			directory     string
+			auditedServer *httptest.Server
+		)
+		BeforeEach(func() {
+			var err error
+			directory, err = ioutil.TempDir("", "api")
+			Expect(err).ShouldNot(HaveOccurred())
+			apiServer.Audit = audit.Open(audit.Config{File: filepath.Join(directory, "audit.jsonl")})
+			auditedServer = httptest.NewServer(apiServer.Router())
+		})
+		AfterEach(func() {
+			auditedServer.Close()
+			os.RemoveAll(directory)
+		})
+		auditedDo := func(method string, path string, body string, credentials func(*http.Request)) *http.Response {
+			req, err := http.NewRequest(method, auditedServer.URL+path, strings.NewReader(body))
+			Expect(err).ShouldNot(HaveOccurred())
+			credentials(req)
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			return resp
+		}
+		It("should record changes with who asked and serve them", func() {
+			resp := auditedDo(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, oskar)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			resp = auditedDo(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, token(grafanaToken))
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			resp = auditedDo(http.MethodGet, "/v1/audit?actor=oskar", "", token(grafanaToken))
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var entries []audit.Entry
+			Expect(json.NewDecoder(resp.Body).Decode(&entries)).To(Succeed())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Source).To(Equal(audit.SourceAPI))
+			Expect(entries[0].Action).To(Equal("PUT /v1/switches/{name}"))
+			Expect(entries[0].Target).To(Equal("lamp"))
+			Expect(entries[0].Requested).To(Equal(`{"status": "ON"}`))
+			Expect(entries[0].Error).To(BeEmpty())
+		})
+		It("should record the address of the connection, whatever the headers claim", func() {
+			resp := auditedDo(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, func(req *http.Request) {
+				oskar(req)
+				req.Header.Set("X-Forwarded-For", "10.0.0.9")
+			})
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			entries, err := apiServer.Audit.Query(audit.Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Reason).To(HavePrefix("from 127.0.0.1, request "))
+		})
+		It("should reject a malformed query", func() {
+			resp := auditedDo(http.MethodGet, "/v1/audit?limit=none", "", oskar)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+	Describe("limiting", func() {
+		It("should refuse changes past the limit", func() {
+			for i := 0; i < 3; i++ {
+				resp := do(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, oskar)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+			resp := do(http.MethodPut, "/v1/switches/lamp", `{"status": "ON"}`, oskar)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("20"))
+		})
+		It("should not limit reading", func() {
+			for i := 0; i < 5; i++ {
+				resp := do(http.MethodGet, "/v1/scenes", "", oskar)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+		})
+		It("should refuse even the right password once too many were wrong", func() {
+			for i := 0; i < 3; i++ {
+				resp := do(http.MethodGet, "/v1/devices", "", func(req *http.Request) {
+					req.SetBasicAuth("oskar", "guess")
+				})
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+			resp := do(http.MethodGet, "/v1/devices", "", oskar)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("20"))
+		})
+		It("should not count logins which succeed", func() {
+			for i := 0; i < 5; i++ {
+				resp := do(http.MethodGet, "/v1/devices", "", oskar)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+		})
+		It("should limit failed logins by connection, whatever the headers claim", func() {
+			for i := 0; i < 3; i++ {
+				resp := do(http.MethodGet, "/v1/devices", "", func(req *http.Request) {
+					req.SetBasicAuth("oskar", "guess")
+					req.Header.Set("X-Forwarded-For", "10.0.0."+string(rune('1'+i)))
+				})
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+			resp := do(http.MethodGet, "/v1/devices", "", func(req *http.Request) {
+				req.SetBasicAuth("oskar", "guess")
+				req.Header.Set("X-Forwarded-For", "10.0.0.9")
+			})
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		})
+	})
+})
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//ThermostatStatus is what a thermostat device last read, State and
+// Commands are set for devices which accept raw state changes
+type ThermostatStatus struct {
+	Name        string             `json:"name"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	Humidity    *float64           `json:"humidity,omitempty"`
+	AirQuality  map[string]float64 `json:"airQuality,omitempty"`
+	State       map[string]string  `json:"state,omitempty"`
+	Commands    bool               `json:"commands"`
+	Error       string             `json:"error,omitempty"`
+}
+
+//SwitchStatus is the status a switch reported, ON or OFF
+type SwitchStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+//DevicesStatus is every device of the home, each sorted by name
+type DevicesStatus struct {
+	Thermostats []ThermostatStatus `json:"thermostats"`
+	Switches    []SwitchStatus     `json:"switches"`
+}
+
+type switchSetRequest struct {
+	Status string `json:"status"`
+}
+
+func readThermostat(name string, device thermostat.ThermostatDevice) ThermostatStatus {
+	status := ThermostatStatus{Name: name}
+	temp, err := device.CurrentTemp()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Temperature = temp
+	if sensor, ok := device.(thermostat.HumiditySensor); ok {
+		status.Humidity, _ = sensor.CurrentHumidity()
+	}
+	if sensor, ok := device.(thermostat.AirQualitySensor); ok {
+		status.AirQuality, _ = sensor.AirQuality()
+	}
+	if reporter, ok := device.(thermostat.StateReporter); ok {
+		status.State, _ = reporter.CurrentState()
+	}
+	_, status.Commands = device.(thermostat.Commander)
+	return status
+}
+
+func readSwitch(name string, device switcher.SwitchDevice) SwitchStatus {
+	status := SwitchStatus{Name: name}
+	current, err := device.UpdateStatus()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Status = *current
+	return status
+}
+
+//handleV1Devices reads every device the request may see
+func handleV1Devices(myHome *home.Home, visible func(*http.Request, string) bool) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		devices := DevicesStatus{Thermostats: []ThermostatStatus{}, Switches: []SwitchStatus{}}
+		thermostats, switches := myHome.Devices()
+		for name, device := range thermostats {
+			if !visible(req, name) {
+				continue
+			}
+			devices.Thermostats = append(devices.Thermostats, readThermostat(name, device))
+		}
+		// switches may need a request each, so read them all at once
+		var reading sync.WaitGroup
+		var lock sync.Mutex
+		for name, device := range switches {
+			if !visible(req, name) {
+				continue
+			}
+			reading.Add(1)
+			go func(name string, device switcher.SwitchDevice) {
+				defer reading.Done()
+				status := readSwitch(name, device)
+				lock.Lock()
+				defer lock.Unlock()
+				devices.Switches = append(devices.Switches, status)
+			}(name, device)
+		}
+		reading.Wait()
+		sort.Slice(devices.Thermostats, func(i, j int) bool {
+			return devices.Thermostats[i].Name < devices.Thermostats[j].Name
+		})
+		sort.Slice(devices.Switches, func(i, j int) bool {
+			return devices.Switches[i].Name < devices.Switches[j].Name
+		})
+		writeJSON(resp, http.StatusOK, devices)
+	}
+}
+
+func handleV1SwitchSet(myHome *home.Home) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		device, ok := myHome.Switch(name)
+		if !ok {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("switch %s not found", name))
+			return
+		}
+		var setReq switchSetRequest
+		if err := readJSON(req, &setReq); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		var err error
+		switch strings.ToUpper(setReq.Status) {
+		case "ON":
+			err = device.TurnOn()
+		case "OFF":
+			err = device.TurnOff()
+		default:
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("status must be ON or OFF"))
+			return
+		}
+		if err != nil {
+			writeError(resp, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, readSwitch(name, device))
+	}
+}
+
+func handleV1ThermostatState(myHome *home.Home) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		device, ok := myHome.Thermostat(name)
+		if !ok {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("thermostat %s not found", name))
+			return
+		}
+		commander, ok := device.(thermostat.Commander)
+		if !ok {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("thermostat %s does not accept commands", name))
+			return
+		}
+		state := map[string]string{}
+		if err := readJSON(req, &state); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		if len(state) == 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("state not set"))
+			return
+		}
+		if err := commander.SendCommand(state); err != nil {
+			writeError(resp, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, readThermostat(name, device))
+	}
+}
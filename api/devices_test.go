@@ -0,0 +1,115 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Devices", func() {
+	var (
+		office *thermostat.MockThermostat
+		dyson  *thermostat.MockThermostat
+		lamp   *switcher.MockSwitch
+		heater *switcher.MockSwitch
+		server *httptest.Server
+	)
+	BeforeEach(func() {
+		office = &thermostat.MockThermostat{Temperature: 70, Humidity: 40}
+		dyson = &thermostat.MockThermostat{Temperature: 68, State: map[string]string{"fmod": "HEAT", "hmax": "2950"}}
+		lamp = &switcher.MockSwitch{Status: "OFF"}
+		heater = &switcher.MockSwitch{Status: "ON", Err: errors.New("unreachable")}
+		apiServer := Server{Home: &home.Home{
+			Thermostats: map[string]thermostat.ThermostatDevice{"office": office, "dyson": dyson},
+			Switches:    map[string]switcher.SwitchDevice{"lamp": lamp, "heater": heater},
+		}}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	put := func(path string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, server.URL+path, strings.NewReader(body))
+		Expect(err).ShouldNot(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		return resp
+	}
+	Describe("listing devices", func() {
+		It("should read every thermostat and switch", func() {
+			resp, err := http.Get(server.URL + "/v1/devices")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			var devices DevicesStatus
+			Expect(json.NewDecoder(resp.Body).Decode(&devices)).Should(Succeed())
+			Expect(devices.Thermostats).Should(HaveLen(2))
+			Expect(devices.Thermostats[0].Name).Should(Equal("dyson"))
+			Expect(devices.Thermostats[0].State).Should(Equal(map[string]string{"fmod": "HEAT", "hmax": "2950"}))
+			Expect(devices.Thermostats[0].Commands).Should(BeTrue())
+			Expect(*devices.Thermostats[1].Temperature).Should(Equal(70.0))
+			Expect(*devices.Thermostats[1].Humidity).Should(Equal(40.0))
+			Expect(devices.Switches).Should(Equal([]SwitchStatus{
+				{Name: "heater", Error: "unreachable"},
+				{Name: "lamp", Status: "OFF"},
+			}))
+		})
+	})
+	Describe("switching", func() {
+		It("should turn the switch on or off", func() {
+			resp := put("/v1/switches/lamp", `{"status": "on"}`)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			Expect(lamp.Status).Should(Equal("ON"))
+			var status SwitchStatus
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).Should(Succeed())
+			Expect(status.Status).Should(Equal("ON"))
+		})
+		It("should reject an unknown status or switch", func() {
+			resp := put("/v1/switches/lamp", `{"status": "dim"}`)
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+			resp = put("/v1/switches/attic", `{"status": "ON"}`)
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+		It("should report a switch which cannot be reached", func() {
+			resp := put("/v1/switches/heater", `{"status": "OFF"}`)
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadGateway))
+		})
+	})
+	Describe("commanding a thermostat", func() {
+		It("should send the state to the device", func() {
+			resp := put("/v1/thermostats/dyson/state", `{"fmod": "FAN"}`)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			Expect(dyson.Commands).Should(ConsistOf(map[string]string{"fmod": "FAN"}))
+			var status ThermostatStatus
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).Should(Succeed())
+			Expect(status.State["fmod"]).Should(Equal("FAN"))
+		})
+		It("should reject an empty state", func() {
+			resp := put("/v1/thermostats/dyson/state", `{}`)
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+	})
+	It("should serve the dashboard", func() {
+		resp, err := http.Get(server.URL + "/")
+		Expect(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(HavePrefix("text/html"))
+	})
+})
@@ -1,42 +1,47 @@
 package api
 
-// import (
-// 	"encoding/json"
-// 	"io/ioutil"
-// 	"net/http"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
 
-// 	"github.com/oskoss/mi-casa/home"
-// 	log "github.com/sirupsen/logrus"
-// )
+	log "github.com/sirupsen/logrus"
+)
 
-// func handleV1HVACTemperature(myHome *home.Home) func(http.ResponseWriter, *http.Request) {
-// 	return func(resp http.ResponseWriter, req *http.Request) {
-// 		defer req.Body.Close()
-// 		bodyString, err := ioutil.ReadAll(req.Body)
-// 		if err != nil {
-// 			log.WithFields(log.Fields{
-// 				"err":      err,
-// 				"req.Body": req.Body,
-// 			}).Printf("could not read request")
-// 			resp.WriteHeader(http.StatusBadRequest)
-// 			return
-// 		}
-// 		byteBody := []byte(bodyString)
-// 		var HVACTempReq HVACSetTemp
-// 		err = json.Unmarshal(byteBody, &HVACTempReq)
-// 		if err != nil {
-// 			log.WithFields(log.Fields{
-// 				"err":      err,
-// 				"req.Body": req.Body,
-// 			}).Printf("could not un-marshal request")
-// 			resp.WriteHeader(http.StatusBadRequest)
-// 			return
-// 		}
-// 		myHome.SetTemperature(HVACTempReq.Temperature)
-// 		return
-// 	}
-// }
+type errorResponse struct {
+	Error string `json:"error"`
+}
 
-// type HVACSetTemp struct {
-// 	Temperature float64 `json:"set_temperature"`
-// }
+func writeJSON(resp http.ResponseWriter, status int, body interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(body); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Printf("could not write response")
+	}
+}
+
+func writeError(resp http.ResponseWriter, status int, err error) {
+	writeJSON(resp, status, errorResponse{Error: err.Error()})
+}
+
+func readJSON(req *http.Request, body interface{}) error {
+	defer req.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Printf("could not read request")
+		return err
+	}
+	err = json.Unmarshal(bodyBytes, body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"req.Body": string(bodyBytes),
+		}).Printf("could not un-marshal request")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/history"
+)
+
+//defaultHistoryWindow is how far back a history query without from goes
+const defaultHistoryWindow = 24 * time.Hour
+
+func handleV1History(store *history.Store) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		query := history.Query{
+			Device: params.Get("device"),
+			Metric: params.Get("metric"),
+			Kind:   events.Kind(params.Get("kind")),
+			To:     time.Now(),
+		}
+		var err error
+		if to := params.Get("to"); to != "" {
+			if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+				writeError(resp, http.StatusBadRequest, fmt.Errorf("to must be RFC3339: %v", err))
+				return
+			}
+		}
+		query.From = query.To.Add(-defaultHistoryWindow)
+		if from := params.Get("from"); from != "" {
+			if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+				writeError(resp, http.StatusBadRequest, fmt.Errorf("from must be RFC3339: %v", err))
+				return
+			}
+		}
+		if query.From.After(query.To) {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+			return
+		}
+		found, err := store.Query(query)
+		if err != nil {
+			writeError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, found)
+	}
+}
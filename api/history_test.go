@@ -0,0 +1,72 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/history"
+)
+
+var _ = Describe("History", func() {
+	var (
+		directory string
+		store     *history.Store
+		server    *httptest.Server
+		now       time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "history")
+		Expect(err).ShouldNot(HaveOccurred())
+		store, err = history.Open(history.Config{Directory: directory})
+		Expect(err).ShouldNot(HaveOccurred())
+		now = time.Now().Truncate(time.Second)
+		Expect(store.Record(events.Event{Time: now.Add(-48 * time.Hour), Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 68})).Should(Succeed())
+		Expect(store.Record(events.Event{Time: now.Add(-time.Hour), Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 70})).Should(Succeed())
+		Expect(store.Record(events.Event{Time: now.Add(-time.Hour), Kind: events.KindSwitch, Device: "blower", State: "ON"})).Should(Succeed())
+		apiServer := Server{History: store}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+		store.Close()
+		os.RemoveAll(directory)
+	})
+	query := func(params string) (int, []events.Event) {
+		resp, err := http.Get(server.URL + "/v1/history" + params)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		found := []events.Event{}
+		if resp.StatusCode == http.StatusOK {
+			Expect(json.NewDecoder(resp.Body).Decode(&found)).Should(Succeed())
+		}
+		return resp.StatusCode, found
+	}
+	It("should default to the last day", func() {
+		status, found := query("?device=office")
+		Expect(status).Should(Equal(http.StatusOK))
+		Expect(found).Should(HaveLen(1))
+		Expect(found[0].Value).Should(Equal(70.0))
+	})
+	It("should use the from and to given", func() {
+		from := now.Add(-72 * time.Hour).UTC().Format(time.RFC3339)
+		to := now.Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+		status, found := query("?device=office&from=" + from + "&to=" + to)
+		Expect(status).Should(Equal(http.StatusOK))
+		Expect(found).Should(HaveLen(1))
+		Expect(found[0].Value).Should(Equal(68.0))
+	})
+	It("should reject a malformed time", func() {
+		status, _ := query("?from=yesterday")
+		Expect(status).Should(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/oskoss/mi-casa/hvac"
+)
+
+type HVACSetTemp struct {
+	Temperature float64 `json:"set_temperature"`
+}
+
+type HVACSetMode struct {
+	Mode string `json:"mode"`
+}
+
+func handleV1HVACStatus(controller *hvac.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJSON(resp, http.StatusOK, controller.Status())
+	}
+}
+
+func handleV1HVACTemperature(controller *hvac.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var HVACTempReq HVACSetTemp
+		if err := readJSON(req, &HVACTempReq); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		if err := controller.SetSetpoint(HVACTempReq.Temperature); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, controller.Status())
+	}
+}
+
+func handleV1HVACMode(controller *hvac.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var HVACModeReq HVACSetMode
+		if err := readJSON(req, &HVACModeReq); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		if err := controller.SetMode(hvac.Mode(HVACModeReq.Mode)); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, controller.Status())
+	}
+}
@@ -0,0 +1,79 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("HVAC", func() {
+	var (
+		controller *hvac.Controller
+		server     *httptest.Server
+	)
+	BeforeEach(func() {
+		var err error
+		controller, err = hvac.NewController(
+			hvac.Config{Mode: "heat", Setpoint: 70, Sensor: "office", Heat: []string{"furnace"}},
+			map[string]thermostat.ThermostatDevice{"office": &thermostat.MockThermostat{Temperature: 70}},
+			map[string]switcher.SwitchDevice{"furnace": &switcher.MockSwitch{Status: "OFF"}},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		apiServer := Server{HVAC: controller}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	Describe("setting the temperature", func() {
+		It("should change the controller setpoint", func() {
+			resp, err := http.Post(server.URL+"/v1/hvac/temperature", "application/json", strings.NewReader(`{"set_temperature": 72.5}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			Expect(controller.Status().Setpoint).Should(Equal(72.5))
+		})
+		It("should reject a setpoint outside the limits", func() {
+			resp, err := http.Post(server.URL+"/v1/hvac/temperature", "application/json", strings.NewReader(`{"set_temperature": 720}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(controller.Status().Setpoint).Should(Equal(70.0))
+		})
+		It("should reject a malformed request", func() {
+			resp, err := http.Post(server.URL+"/v1/hvac/temperature", "application/json", strings.NewReader(`72`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+	})
+	Describe("setting the mode", func() {
+		It("should reject a mode the equipment cannot run", func() {
+			resp, err := http.Post(server.URL+"/v1/hvac/mode", "application/json", strings.NewReader(`{"mode": "cool"}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(controller.Status().Mode).Should(Equal(hvac.ModeHeat))
+		})
+	})
+	Describe("getting the status", func() {
+		It("should return the mode and setpoint", func() {
+			resp, err := http.Get(server.URL + "/v1/hvac/status")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			var status hvac.Status
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).Should(Succeed())
+			Expect(status.Mode).Should(Equal(hvac.ModeHeat))
+			Expect(status.Setpoint).Should(Equal(70.0))
+		})
+	})
+})
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/metrics"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func newDesc(name string, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", name), help, labels, nil)
+}
+
+var (
+	temperatureDesc = newDesc("thermostat_temperature_fahrenheit", "Temperature read by the thermostat.", "device")
+	humidityDesc    = newDesc("thermostat_humidity_percent", "Relative humidity read by the thermostat.", "device")
+	airQualityDesc  = newDesc("thermostat_air_quality", "Air quality read by the thermostat, by metric.", "device", "metric")
+	switchUpDesc    = newDesc("switch_up", "Whether the switch could be reached.", "device")
+	switchOnDesc    = newDesc("switch_on", "Whether the switch is on.", "device")
+	rssiDesc        = newDesc("tasmota_wifi_rssi_percent", "Wifi signal quality reported by the Tasmota device.", "device")
+	loadAvgDesc     = newDesc("tasmota_load_average", "Load average reported by the Tasmota device.", "device")
+	vccDesc         = newDesc("tasmota_vcc_volts", "Supply voltage reported by the Tasmota device.", "device")
+	setpointDesc    = newDesc("hvac_setpoint_fahrenheit", "Target temperature of the HVAC zone.", "zone")
+	hvacTempDesc    = newDesc("hvac_temperature_fahrenheit", "Temperature the HVAC zone last decided on.", "zone")
+	modeDesc        = newDesc("hvac_mode", "Mode of the HVAC zone, 1 for the current mode.", "zone", "mode")
+	heatStagesDesc  = newDesc("hvac_heat_stages", "Heat stages the HVAC zone is calling for.", "zone")
+	callDesc        = newDesc("hvac_call", "Whether the HVAC zone is calling for the equipment.", "zone", "equipment")
+)
+
+var modes = []hvac.Mode{hvac.ModeOff, hvac.ModeHeat, hvac.ModeCool, hvac.ModeAuto, hvac.ModeFan}
+
+//collector reads every device and controller of the server when scraped
+type collector struct {
+	server *Server
+}
+
+func (c collector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		temperatureDesc, humidityDesc, airQualityDesc,
+		switchUpDesc, switchOnDesc, rssiDesc, loadAvgDesc, vccDesc,
+		setpointDesc, hvacTempDesc, modeDesc, heatStagesDesc, callDesc,
+	} {
+		descs <- desc
+	}
+}
+
+func (c collector) Collect(collected chan<- prometheus.Metric) {
+	if c.server.Home != nil {
+		thermostats, switches := c.server.Home.Devices()
+		for name, device := range thermostats {
+			collectThermostat(collected, name, device)
+		}
+		// switches may need a request each, so read them all at once
+		var reading sync.WaitGroup
+		for name, device := range switches {
+			reading.Add(1)
+			go func(name string, device switcher.SwitchDevice) {
+				defer reading.Done()
+				collectSwitch(collected, name, device)
+			}(name, device)
+		}
+		reading.Wait()
+	}
+	controllers := []*hvac.Controller{}
+	if c.server.HVAC != nil {
+		controllers = append(controllers, c.server.HVAC)
+	}
+	if c.server.Zones != nil {
+		controllers = append(controllers, c.server.Zones.Controllers...)
+	}
+	for _, controller := range controllers {
+		collectController(collected, controller.Status())
+	}
+}
+
+func gauge(desc *prometheus.Desc, value float64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func collectThermostat(collected chan<- prometheus.Metric, name string, device thermostat.ThermostatDevice) {
+	if temp, err := device.CurrentTemp(); err == nil {
+		collected <- gauge(temperatureDesc, *temp, name)
+	}
+	if sensor, ok := device.(thermostat.HumiditySensor); ok {
+		if humidity, err := sensor.CurrentHumidity(); err == nil {
+			collected <- gauge(humidityDesc, *humidity, name)
+		}
+	}
+	if sensor, ok := device.(thermostat.AirQualitySensor); ok {
+		if quality, err := sensor.AirQuality(); err == nil {
+			for metric, value := range quality {
+				collected <- gauge(airQualityDesc, value, name, metric)
+			}
+		}
+	}
+}
+
+func collectSwitch(collected chan<- prometheus.Metric, name string, device switcher.SwitchDevice) {
+	status, err := device.UpdateStatus()
+	collected <- gauge(switchUpDesc, boolValue(err == nil), name)
+	if err != nil {
+		return
+	}
+	collected <- gauge(switchOnDesc, boolValue(strings.EqualFold(*status, "ON")), name)
+	if tasmota, ok := switcher.Unwrap(device).(*switcher.TasmotaT1); ok {
+		last := tasmota.LastStatus()
+		collected <- gauge(rssiDesc, float64(last.Wifi.RSSI), name)
+		collected <- gauge(loadAvgDesc, float64(last.LoadAvg), name)
+		collected <- gauge(vccDesc, last.Vcc, name)
+	}
+}
+
+func collectController(collected chan<- prometheus.Metric, status hvac.Status) {
+	zone := status.Name
+	call := status.LastDecision.Call
+	collected <- gauge(setpointDesc, status.Setpoint, zone)
+	if status.LastDecision.Error == "" && !status.LastDecision.Time.IsZero() {
+		collected <- gauge(hvacTempDesc, status.LastDecision.Temperature, zone)
+	}
+	for _, mode := range modes {
+		collected <- gauge(modeDesc, boolValue(status.Mode == mode), zone, string(mode))
+	}
+	collected <- gauge(heatStagesDesc, float64(call.HeatStages), zone)
+	collected <- gauge(callDesc, boolValue(call.Heating()), zone, "heat")
+	collected <- gauge(callDesc, boolValue(call.Aux), zone, "aux")
+	collected <- gauge(callDesc, boolValue(call.Cool), zone, "cool")
+	collected <- gauge(callDesc, boolValue(call.Fan), zone, "fan")
+}
+
+//instrument records the latency of every API request by route
+func instrument(registry *prometheus.Registry) func(http.Handler) http.Handler {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "How long API requests took, by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	registry.MustRegister(duration)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			started := time.Now()
+			wrapped := middleware.NewWrapResponseWriter(resp, req.ProtoMajor)
+			next.ServeHTTP(wrapped, req)
+			route := "unmatched"
+			if routeContext := chi.RouteContext(req.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+				route = routeContext.RoutePattern()
+			}
+			code := wrapped.Status()
+			if code == 0 {
+				code = http.StatusOK
+			}
+			duration.WithLabelValues(req.Method, route, strconv.Itoa(code)).Observe(time.Since(started).Seconds())
+		})
+	}
+}
+
+//metricsHandler serves the device, controller and request metrics
+func (server *Server) metricsHandler(registry *prometheus.Registry) http.Handler {
+	registry.MustRegister(collector{server: server})
+	registry.MustRegister(prometheus.NewGoCollector())
+	for _, requests := range metrics.Collectors() {
+		registry.MustRegister(requests)
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
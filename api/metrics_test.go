@@ -0,0 +1,77 @@
+package api_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		server *httptest.Server
+		lamp   *switcher.MockSwitch
+	)
+	BeforeEach(func() {
+		office := &thermostat.MockThermostat{Temperature: 68.5, Humidity: 41, Quality: map[string]float64{"voc": 2}}
+		furnace := &switcher.MockSwitch{Status: "OFF"}
+		lamp = &switcher.MockSwitch{Status: "ON"}
+		myHome := &home.Home{
+			Thermostats: map[string]thermostat.ThermostatDevice{"office": office},
+			Switches:    map[string]switcher.SwitchDevice{"furnace": furnace, "lamp": lamp},
+		}
+		controller, err := hvac.NewController(
+			hvac.Config{Mode: "heat", Setpoint: 70, Sensor: "office", Heat: []string{"furnace"}},
+			myHome.Thermostats,
+			myHome.Switches,
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(controller.SetSetpoint(72)).Should(Succeed())
+		apiServer := Server{Home: myHome, HVAC: controller}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	scrape := func() string {
+		resp, err := http.Get(server.URL + "/metrics")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		return string(body)
+	}
+	It("should report thermostat readings", func() {
+		body := scrape()
+		Expect(body).Should(ContainSubstring(`micasa_thermostat_temperature_fahrenheit{device="office"} 68.5`))
+		Expect(body).Should(ContainSubstring(`micasa_thermostat_humidity_percent{device="office"} 41`))
+		Expect(body).Should(ContainSubstring(`micasa_thermostat_air_quality{device="office",metric="voc"} 2`))
+	})
+	It("should report switch states", func() {
+		lamp.Err = errors.New("unreachable")
+		body := scrape()
+		Expect(body).Should(ContainSubstring(`micasa_switch_on{device="furnace"} 0`))
+		Expect(body).Should(ContainSubstring(`micasa_switch_up{device="lamp"} 0`))
+		Expect(body).ShouldNot(ContainSubstring(`micasa_switch_on{device="lamp"}`))
+	})
+	It("should report the controller", func() {
+		body := scrape()
+		Expect(body).Should(ContainSubstring(`micasa_hvac_setpoint_fahrenheit{zone=""} 72`))
+		Expect(body).Should(ContainSubstring(`micasa_hvac_mode{mode="heat",zone=""} 1`))
+		Expect(body).Should(ContainSubstring(`micasa_hvac_call{equipment="heat",zone=""} 0`))
+	})
+	It("should report API request latencies", func() {
+		scrape()
+		Expect(scrape()).Should(ContainSubstring(`micasa_api_request_duration_seconds_count{code="200",method="GET",route="/metrics"}`))
+	})
+})
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/oskoss/mi-casa/scene"
+)
+
+type sceneCaptureRequest struct {
+	Devices []string `json:"devices"`
+}
+
+type sceneApplyResponse struct {
+	Scene   string         `json:"scene"`
+	Results []scene.Result `json:"results"`
+	Error   string         `json:"error,omitempty"`
+}
+
+func handleV1ScenesList(scenes *scene.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJSON(resp, http.StatusOK, scenes.List())
+	}
+}
+
+func handleV1SceneGet(scenes *scene.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		myScene, ok := scenes.Get(name)
+		if !ok {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("scene %s not found", name))
+			return
+		}
+		writeJSON(resp, http.StatusOK, myScene)
+	}
+}
+
+func handleV1SceneCapture(scenes *scene.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var captureReq sceneCaptureRequest
+		if err := readJSON(req, &captureReq); err != nil {
+			writeError(resp, http.StatusBadRequest, err)
+			return
+		}
+		if len(captureReq.Devices) == 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("devices not set"))
+			return
+		}
+		myScene, err := scenes.Capture(chi.URLParam(req, "name"), captureReq.Devices)
+		if err != nil {
+			writeError(resp, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, myScene)
+	}
+}
+
+func handleV1SceneDelete(scenes *scene.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		if _, ok := scenes.Get(name); !ok {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("scene %s not found", name))
+			return
+		}
+		if err := scenes.Delete(name); err != nil {
+			writeError(resp, http.StatusConflict, err)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleV1SceneApply(scenes *scene.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		if _, ok := scenes.Get(name); !ok {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("scene %s not found", name))
+			return
+		}
+		results, err := scenes.Apply(name)
+		applyResp := sceneApplyResponse{Scene: name, Results: results}
+		if err != nil {
+			applyResp.Error = err.Error()
+			writeJSON(resp, http.StatusBadGateway, applyResp)
+			return
+		}
+		writeJSON(resp, http.StatusOK, applyResp)
+	}
+}
@@ -0,0 +1,86 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Scenes", func() {
+	var (
+		lamp   *switcher.MockSwitch
+		server *httptest.Server
+	)
+	BeforeEach(func() {
+		lamp = &switcher.MockSwitch{Status: "ON"}
+		scenes, err := scene.NewManager(
+			[]scene.Scene{{Name: "away", Switches: map[string]string{"lamp": "OFF"}}},
+			"",
+			map[string]thermostat.ThermostatDevice{},
+			map[string]switcher.SwitchDevice{"lamp": lamp},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		apiServer := Server{Scenes: scenes}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	Describe("listing scenes", func() {
+		It("should return every scene", func() {
+			resp, err := http.Get(server.URL + "/v1/scenes")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			var scenes []scene.Scene
+			Expect(json.NewDecoder(resp.Body).Decode(&scenes)).Should(Succeed())
+			Expect(scenes).Should(HaveLen(1))
+			Expect(scenes[0].Name).Should(Equal("away"))
+		})
+	})
+	Describe("applying a scene", func() {
+		It("should set the devices and return the results", func() {
+			resp, err := http.Post(server.URL+"/v1/scenes/away/apply", "application/json", nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			Expect(lamp.Status).Should(Equal("OFF"))
+		})
+		It("should return not found for an unknown scene", func() {
+			resp, err := http.Post(server.URL+"/v1/scenes/doesnotexist/apply", "application/json", nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+	})
+	Describe("capturing a scene", func() {
+		It("should store the current state", func() {
+			req, err := http.NewRequest("PUT", server.URL+"/v1/scenes/evening", strings.NewReader(`{"devices": ["lamp"]}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			var captured scene.Scene
+			Expect(json.NewDecoder(resp.Body).Decode(&captured)).Should(Succeed())
+			Expect(captured.Switches).Should(Equal(map[string]string{"lamp": "ON"}))
+		})
+		It("should reject a request without devices", func() {
+			req, err := http.NewRequest("PUT", server.URL+"/v1/scenes/evening", strings.NewReader(`{}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -1,47 +1,191 @@
 package api
 
-// import (
-// 	"net/http"
-// 	"os"
-// 	"os/signal"
-// 	"time"
-
-// 	"github.com/go-chi/chi"
-// 	"github.com/go-chi/chi/middleware"
-// 	"github.com/oskoss/mi-casa/home"
-// 	log "github.com/sirupsen/logrus"
-// )
-
-// func Start(port string, myHome *home.Home) {
-
-// 	router := chi.NewRouter()
-// 	router.Use(middleware.RequestID)
-// 	router.Use(middleware.RealIP)
-// 	router.Use(middleware.Logger)
-// 	router.Use(middleware.Recoverer)
-// 	router.Use(middleware.Timeout(60 * time.Second))
-// 	router.Route("/v1/hvac", func(router chi.Router) {
-// 		//TODO ADD STATUS
-// 		// router.Get("/status", handleV1HVACStatus)
-// 		router.Post("/temperature", handleV1HVACTemperature(myHome))
-// 	})
-// 	webServer := &http.Server{
-// 		Addr:         "0.0.0.0:" + port,
-// 		WriteTimeout: time.Second * 15,
-// 		ReadTimeout:  time.Second * 15,
-// 		IdleTimeout:  time.Second * 60,
-// 		Handler:      router,
-// 	}
-// 	go func() {
-// 		if err := webServer.ListenAndServe(); err != nil {
-// 			log.WithFields(log.Fields{
-// 				"err": err,
-// 			}).Fatalf("server crashed")
-// 		}
-// 	}()
-
-// 	channel := make(chan os.Signal, 1)
-// 	signal.Notify(channel, os.Interrupt)
-
-// 	<-channel
-// }
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/dashboard"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/history"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+//Server is the mi-casa HTTP API, any of its
+// subsystems left nil are simply not routed
+type Server struct {
+	Address string
+	Home    *home.Home
+	HVAC    *hvac.Controller
+	Zones   *hvac.Zones
+	Scenes  *scene.Manager
+	History *history.Store
+	Events  *events.Bus
+	//Auth is who may do what, nil leaves the API open to anyone
+	Auth *auth.Authenticator
+	//TLS serves the API over HTTPS, nil serves plain HTTP
+	TLS *tls.Config
+	//Audit records every change made through the API and
+	// is served at /v1/audit when set
+	Audit    *audit.Trail
+	listener net.Listener
+}
+
+//Router returns the handler for every API route, including
+// the Prometheus metrics at /metrics and the dashboard at /
+func (server *Server) Router() http.Handler {
+	registry := prometheus.NewRegistry()
+	router := chi.NewRouter()
+	router.Use(instrument(registry))
+	router.Use(middleware.RequestID)
+	router.Use(rememberPeer)
+	router.Use(middleware.RealIP)
+	router.Use(middleware.Logger)
+	router.Use(middleware.Recoverer)
+	router.Use(server.authenticate)
+	if server.Events != nil {
+		// streams stay open, so they are routed outside the timeout,
+		// scoped principals only see events of what they may use
+		router.Get("/v1/stream", server.handleV1Stream)
+		router.Get("/v1/stream/ws", server.handleV1StreamWebSocket)
+	}
+	router.Group(func(router chi.Router) {
+		router.Use(middleware.Timeout(60 * time.Second))
+		server.route(router, registry)
+	})
+	return router
+}
+
+//route routes every subsystem, anyone authenticated may read
+// and changes need the role given with change
+func (server *Server) route(router chi.Router, registry *prometheus.Registry) {
+	read := server.view(anything)
+	router.With(server.view(unscoped)).Method(http.MethodGet, "/metrics", server.metricsHandler(registry))
+	router.With(read).Method(http.MethodGet, "/", dashboard.Handler())
+	router.With(read).Method(http.MethodGet, "/dashboard/*", dashboard.Handler())
+	if server.Home != nil {
+		router.With(read).Get("/v1/devices", handleV1Devices(server.Home, server.visibleDevice))
+		router.With(server.change(auth.Operator, server.namedDevice)).Put("/v1/switches/{name}", handleV1SwitchSet(server.Home))
+		router.With(server.change(auth.Operator, server.namedDevice)).Put("/v1/thermostats/{name}/state", handleV1ThermostatState(server.Home))
+	}
+	if server.HVAC != nil {
+		router.Route("/v1/hvac", func(router chi.Router) {
+			router.With(server.view(server.singleHVAC)).Get("/status", handleV1HVACStatus(server.HVAC))
+			router.With(server.change(auth.Operator, server.singleHVAC)).Post("/temperature", handleV1HVACTemperature(server.HVAC))
+			router.With(server.change(auth.Operator, server.singleHVAC)).Post("/mode", handleV1HVACMode(server.HVAC))
+		})
+	}
+	if server.Zones != nil {
+		router.Route("/v1/zones", func(router chi.Router) {
+			router.With(read).Get("/", handleV1ZonesList(server.Zones, server.visibleZone))
+			router.With(server.view(server.namedZone)).Get("/{name}", withZone(server.Zones, handleV1HVACStatus))
+			router.With(server.change(auth.Operator, server.namedZone)).Post("/{name}/temperature", withZone(server.Zones, handleV1HVACTemperature))
+			router.With(server.change(auth.Operator, server.namedZone)).Post("/{name}/mode", withZone(server.Zones, handleV1HVACMode))
+		})
+	}
+	if server.Scenes != nil {
+		// a scene may reach any device, so only principals
+		// limited to nothing may use them
+		router.Route("/v1/scenes", func(router chi.Router) {
+			router.With(read).Get("/", handleV1ScenesList(server.Scenes))
+			router.With(read).Get("/{name}", handleV1SceneGet(server.Scenes))
+			router.With(server.change(auth.Admin, unscoped)).Put("/{name}", handleV1SceneCapture(server.Scenes))
+			router.With(server.change(auth.Admin, unscoped)).Delete("/{name}", handleV1SceneDelete(server.Scenes))
+			router.With(server.change(auth.Operator, unscoped)).Post("/{name}/apply", handleV1SceneApply(server.Scenes))
+		})
+	}
+	if server.History != nil {
+		router.With(server.view(server.queriedDevice)).Get("/v1/history", handleV1History(server.History))
+	}
+	if server.Audit != nil {
+		// changes of every device and zone, like the metrics
+		router.With(server.view(unscoped)).Get("/v1/audit", handleV1Audit(server.Audit))
+	}
+}
+
+//visibleDevice is whether the principal of req may see the device name
+func (server *Server) visibleDevice(req *http.Request, name string) bool {
+	return server.device(principal(req), name)
+}
+
+//visibleZone is whether the principal of req may see the zone name
+func (server *Server) visibleZone(req *http.Request, name string) bool {
+	return principal(req).Zone(name)
+}
+
+//Listen binds Address, so an address which cannot be served
+// is known before Start
+func (server *Server) Listen() error {
+	listener, err := net.Listen("tcp", server.Address)
+	if err != nil {
+		return err
+	}
+	server.listener = listener
+	scheme := "http"
+	if server.TLS != nil {
+		scheme = "https"
+	}
+	log.WithFields(log.Fields{
+		"address": listener.Addr().String(),
+		"scheme":  scheme,
+	}).Printf("API server listening")
+	return nil
+}
+
+//Start serves the API until stop is closed, which also
+// ends any event streams still open, listening first
+// unless Listen was called already
+func (server *Server) Start(stop <-chan struct{}) error {
+	if server.listener == nil {
+		if err := server.Listen(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// only the headers have a deadline, a server wide read or write
+	// timeout would cut event streams off, the other routes are
+	// bounded by the timeout middleware
+	webServer := &http.Server{
+		Addr:              server.Address,
+		ReadHeaderTimeout: time.Second * 15,
+		IdleTimeout:       time.Second * 60,
+		Handler:           server.Router(),
+		TLSConfig:         server.TLS,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-stop
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := webServer.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Printf("server did not shut down cleanly")
+		}
+	}()
+	var err error
+	if server.TLS != nil {
+		// the certificates are in TLSConfig
+		err = webServer.ServeTLS(server.listener, "", "")
+	} else {
+		err = webServer.Serve(server.listener)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/hvac"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//streamKeepalive is how often an idle stream is written to,
+	// keeping proxies from closing it and noticing gone clients
+	streamKeepalive = 15 * time.Second
+	//streamBuffer is how many events a slow client can fall behind
+	// before missed events are caught up from the bus backlog
+	streamBuffer = 256
+)
+
+//gap tells a stream client that events after After were missed
+// and are no longer kept, its history has a hole
+type gap struct {
+	Kind  string `json:"kind"`
+	After uint64 `json:"after"`
+}
+
+//streamFilter picks the events a stream client asked for,
+// no devices or no kinds means all of them, allowed is set
+// when the client may only see some devices
+type streamFilter struct {
+	devices map[string]bool
+	kinds   map[events.Kind]bool
+	allowed func(device string) bool
+}
+
+func (filter streamFilter) matches(event events.Event) bool {
+	if filter.allowed != nil && !filter.allowed(event.Device) {
+		return false
+	}
+	if len(filter.devices) > 0 && !filter.devices[event.Device] {
+		return false
+	}
+	if len(filter.kinds) > 0 && !filter.kinds[event.Kind] {
+		return false
+	}
+	return true
+}
+
+//streamWriter sends to one client, over SSE or a WebSocket
+type streamWriter interface {
+	event(events.Event) error
+	gap(after uint64) error
+	keepalive() error
+}
+
+//streamRequest is a parsed stream request, resuming after the
+// event numbered since when resume is set
+type streamRequest struct {
+	filter streamFilter
+	since  uint64
+	resume bool
+}
+
+//parseStream reads the device, zone and kind filters and where to
+// resume from, since in the query or Last-Event-ID sent by a
+// reconnecting EventSource
+func (server *Server) parseStream(req *http.Request) (streamRequest, int, error) {
+	params := req.URL.Query()
+	stream := streamRequest{filter: streamFilter{
+		devices: map[string]bool{},
+		kinds:   map[events.Kind]bool{},
+	}}
+	for _, device := range params["device"] {
+		stream.filter.devices[device] = true
+	}
+	for _, name := range params["zone"] {
+		controller := server.zone(name)
+		if controller == nil {
+			return stream, http.StatusNotFound, fmt.Errorf("zone %s not found", name)
+		}
+		// decisions are published under the zone name
+		stream.filter.devices[name] = true
+		for _, device := range controller.Devices() {
+			stream.filter.devices[device] = true
+		}
+	}
+	for _, kind := range params["kind"] {
+		stream.filter.kinds[events.Kind(kind)] = true
+	}
+	if found := principal(req); found.Scoped() {
+		stream.filter.allowed = func(device string) bool {
+			return server.device(found, device) || found.Zone(device)
+		}
+	}
+	since := params.Get("since")
+	if since == "" {
+		since = req.Header.Get("Last-Event-ID")
+	}
+	if since != "" {
+		var err error
+		if stream.since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return stream, http.StatusBadRequest, fmt.Errorf("since must be an event id: %v", err)
+		}
+		stream.resume = true
+	}
+	return stream, http.StatusOK, nil
+}
+
+//zone finds the controller named name, the single HVAC
+// system answering to its name or to hvac when unnamed
+func (server *Server) zone(name string) *hvac.Controller {
+	if server.HVAC != nil {
+		if server.HVAC.Name == name || (server.HVAC.Name == "" && name == "hvac") {
+			return server.HVAC
+		}
+	}
+	if server.Zones != nil {
+		return server.Zones.Zone(name)
+	}
+	return nil
+}
+
+//follow writes the events stream asks for from received until done is
+// closed or writing fails. The bus is subscribed to before replaying
+// so nothing published in between is lost, events seen in both are
+// sent once. Events dropped because the client fell behind are caught
+// up from the backlog, a gap is sent when they are no longer kept or
+// the client resumes from before micasa restarted.
+func (server *Server) follow(stream streamRequest, received <-chan events.Event, writer streamWriter, done <-chan struct{}) error {
+	last := stream.since
+	catchUp := func() error {
+		missed, complete := server.Events.Since(last)
+		if !complete {
+			if err := writer.gap(last); err != nil {
+				return err
+			}
+			// after a restart last is ahead of the bus, count from what it kept
+			last = 0
+		}
+		for _, event := range missed {
+			last = event.ID
+			if stream.filter.matches(event) {
+				if err := writer.event(event); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if stream.resume {
+		if err := catchUp(); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if err := writer.keepalive(); err != nil {
+				return err
+			}
+		case event, ok := <-received:
+			if !ok {
+				return nil
+			}
+			if last != 0 && event.ID > last+1 {
+				if err := catchUp(); err != nil {
+					return err
+				}
+			}
+			if event.ID <= last {
+				continue
+			}
+			last = event.ID
+			if stream.filter.matches(event) {
+				if err := writer.event(event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+//sseWriter sends Server-Sent Events, the id of each event
+// lets the browser resume with Last-Event-ID on reconnect
+type sseWriter struct {
+	resp    http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (writer sseWriter) send(id uint64, kind string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		if _, err := fmt.Fprintf(writer.resp, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(writer.resp, "event: %s\ndata: %s\n\n", kind, data); err != nil {
+		return err
+	}
+	writer.flusher.Flush()
+	return nil
+}
+
+func (writer sseWriter) event(event events.Event) error {
+	return writer.send(event.ID, string(event.Kind), event)
+}
+
+func (writer sseWriter) gap(after uint64) error {
+	return writer.send(0, "gap", gap{Kind: "gap", After: after})
+}
+
+func (writer sseWriter) keepalive() error {
+	if _, err := fmt.Fprint(writer.resp, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	writer.flusher.Flush()
+	return nil
+}
+
+func (server *Server) handleV1Stream(resp http.ResponseWriter, req *http.Request) {
+	stream, status, err := server.parseStream(req)
+	if err != nil {
+		writeError(resp, status, err)
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		writeError(resp, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	received, unsubscribe := server.Events.Subscribe(streamBuffer)
+	defer unsubscribe()
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	if err := server.follow(stream, received, sseWriter{resp: resp, flusher: flusher}, req.Context().Done()); err != nil {
+		log.WithFields(log.Fields{
+			"remote": peer(req),
+			"err":    err,
+		}).Debugf("event stream closed")
+	}
+}
+
+//wsWriter sends each event as a JSON text message
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (writer wsWriter) write(body interface{}) error {
+	writer.conn.SetWriteDeadline(time.Now().Add(streamKeepalive))
+	return writer.conn.WriteJSON(body)
+}
+
+func (writer wsWriter) event(event events.Event) error {
+	return writer.write(event)
+}
+
+func (writer wsWriter) gap(after uint64) error {
+	return writer.write(gap{Kind: "gap", After: after})
+}
+
+func (writer wsWriter) keepalive() error {
+	return writer.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepalive))
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+func (server *Server) handleV1StreamWebSocket(resp http.ResponseWriter, req *http.Request) {
+	stream, status, err := server.parseStream(req)
+	if err != nil {
+		writeError(resp, status, err)
+		return
+	}
+	received, unsubscribe := server.Events.Subscribe(streamBuffer)
+	defer unsubscribe()
+	conn, err := upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		// the upgrader has already answered the request
+		return
+	}
+	defer conn.Close()
+	// clients only ever close, reading is how that is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-closed:
+		case <-req.Context().Done():
+		}
+		close(done)
+	}()
+	if err := server.follow(stream, received, wsWriter{conn: conn}, done); err != nil {
+		log.WithFields(log.Fields{
+			"remote": peer(req),
+			"err":    err,
+		}).Debugf("event stream closed")
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+}
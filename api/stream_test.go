@@ -0,0 +1,189 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//sseMessage is one Server-Sent Event read back from a stream
+type sseMessage struct {
+	id    string
+	event string
+	data  string
+}
+
+var _ = Describe("Stream", func() {
+	var (
+		bus    *events.Bus
+		zones  *hvac.Zones
+		server *httptest.Server
+	)
+	BeforeEach(func() {
+		var err error
+		zones, err = hvac.NewZones(
+			[]hvac.Config{
+				{Name: "upstairs", Mode: "heat", Setpoint: 70, Sensor: "upstairs", Heat: []string{"furnace"}},
+				{Name: "downstairs", Mode: "heat", Setpoint: 68, Sensor: "downstairs", Heat: []string{"baseboard"}},
+			},
+			map[string]thermostat.ThermostatDevice{
+				"upstairs":   &thermostat.MockThermostat{Temperature: 70},
+				"downstairs": &thermostat.MockThermostat{Temperature: 68},
+			},
+			map[string]switcher.SwitchDevice{
+				"furnace":   &switcher.MockSwitch{Status: "OFF"},
+				"baseboard": &switcher.MockSwitch{Status: "OFF"},
+			},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		bus = events.NewBus()
+		apiServer := Server{Zones: zones, Events: bus}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	open := func(params string, lastEventID string) (*http.Response, <-chan sseMessage) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/stream"+params, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		messages := make(chan sseMessage, 10)
+		go func() {
+			defer GinkgoRecover()
+			defer close(messages)
+			scanner := bufio.NewScanner(resp.Body)
+			message := sseMessage{}
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case line == "" && message.event != "":
+					messages <- message
+					message = sseMessage{}
+				case strings.HasPrefix(line, "id: "):
+					message.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					message.event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					message.data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+		}()
+		return resp, messages
+	}
+	decode := func(message sseMessage) events.Event {
+		event := events.Event{}
+		Expect(json.Unmarshal([]byte(message.data), &event)).Should(Succeed())
+		return event
+	}
+	It("should stream the events for a device as they happen", func() {
+		resp, messages := open("?device=furnace", "")
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+		bus.Publish(events.Event{Kind: events.KindReading, Device: "upstairs", Metric: "temperature", Value: 70})
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		message := <-messages
+		Expect(message.id).Should(Equal("2"))
+		Expect(message.event).Should(Equal("switch"))
+		event := decode(message)
+		Expect(event.Device).Should(Equal("furnace"))
+		Expect(event.State).Should(Equal("ON"))
+		Consistently(messages).ShouldNot(Receive())
+	})
+	It("should stream the sensors, switches and decisions of a zone", func() {
+		resp, messages := open("?zone=upstairs", "")
+		defer resp.Body.Close()
+		bus.Publish(events.Event{Kind: events.KindReading, Device: "downstairs", Metric: "temperature", Value: 68})
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "baseboard", State: "ON"})
+		bus.Publish(events.Event{Kind: events.KindReading, Device: "upstairs", Metric: "temperature", Value: 70})
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		bus.Publish(events.Event{Kind: events.KindDecision, Device: "upstairs", State: "heat"})
+		devices := []string{}
+		for i := 0; i < 3; i++ {
+			devices = append(devices, decode(<-messages).Device)
+		}
+		Expect(devices).Should(Equal([]string{"upstairs", "furnace", "upstairs"}))
+		Consistently(messages).ShouldNot(Receive())
+	})
+	It("should filter by kind", func() {
+		resp, messages := open("?kind=health", "")
+		defer resp.Body.Close()
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		bus.Publish(events.Event{Kind: events.KindHealth, Device: "furnace", State: "down", Reason: "unreachable"})
+		event := decode(<-messages)
+		Expect(event.Kind).Should(Equal(events.KindHealth))
+		Expect(event.Reason).Should(Equal("unreachable"))
+	})
+	It("should resume after the last event seen", func() {
+		for _, state := range []string{"ON", "OFF", "ON"} {
+			bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: state})
+		}
+		resp, messages := open("", "1")
+		defer resp.Body.Close()
+		Expect((<-messages).id).Should(Equal("2"))
+		Expect((<-messages).id).Should(Equal("3"))
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "OFF"})
+		Expect((<-messages).id).Should(Equal("4"))
+		Consistently(messages).ShouldNot(Receive())
+	})
+	It("should say when events to resume from are no longer kept", func() {
+		for i := 0; i < events.Backlog+1; i++ {
+			bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		}
+		resp, messages := open("?since=0&device=none", "")
+		defer resp.Body.Close()
+		message := <-messages
+		Expect(message.event).Should(Equal("gap"))
+		Expect(message.data).Should(MatchJSON(`{"kind": "gap", "after": 0}`))
+	})
+	It("should start over from an event id of before a restart", func() {
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		resp, messages := open("", "500")
+		defer resp.Body.Close()
+		message := <-messages
+		Expect(message.event).Should(Equal("gap"))
+		Expect(message.data).Should(MatchJSON(`{"kind": "gap", "after": 500}`))
+		Expect((<-messages).id).Should(Equal("1"))
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "OFF"})
+		Expect((<-messages).id).Should(Equal("2"))
+		Consistently(messages).ShouldNot(Receive())
+	})
+	It("should reject an unknown zone or a bad event id", func() {
+		resp, err := http.Get(server.URL + "/v1/stream?zone=attic")
+		Expect(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		resp, err = http.Get(server.URL + "/v1/stream?since=latest")
+		Expect(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+	})
+	It("should stream events over a WebSocket", func() {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/stream/ws?device=furnace"
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "baseboard", State: "ON"})
+		bus.Publish(events.Event{Kind: events.KindSwitch, Device: "furnace", State: "ON"})
+		event := events.Event{}
+		Expect(conn.ReadJSON(&event)).Should(Succeed())
+		Expect(event.ID).Should(Equal(uint64(2)))
+		Expect(event.Device).Should(Equal("furnace"))
+	})
+})
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/oskoss/mi-casa/hvac"
+)
+
+//handleV1ZonesList lists every zone the request may see
+func handleV1ZonesList(zones *hvac.Zones, visible func(*http.Request, string) bool) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		statuses := []hvac.Status{}
+		for _, status := range zones.Status() {
+			if visible(req, status.Name) {
+				statuses = append(statuses, status)
+			}
+		}
+		writeJSON(resp, http.StatusOK, statuses)
+	}
+}
+
+//withZone looks up the zone named in the path and hands its
+// controller to the same handler used for a single HVAC system
+func withZone(zones *hvac.Zones, handler func(*hvac.Controller) func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		controller := zones.Zone(name)
+		if controller == nil {
+			writeError(resp, http.StatusNotFound, fmt.Errorf("zone %s not found", name))
+			return
+		}
+		handler(controller)(resp, req)
+	}
+}
@@ -0,0 +1,70 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Zones", func() {
+	var (
+		zones  *hvac.Zones
+		server *httptest.Server
+	)
+	BeforeEach(func() {
+		var err error
+		zones, err = hvac.NewZones(
+			[]hvac.Config{
+				{Name: "upstairs", Mode: "heat", Setpoint: 70, Sensor: "upstairs", Heat: []string{"furnace"}},
+				{Name: "downstairs", Mode: "heat", Setpoint: 68, Sensor: "downstairs", Heat: []string{"furnace"}},
+			},
+			map[string]thermostat.ThermostatDevice{
+				"upstairs":   &thermostat.MockThermostat{Temperature: 70},
+				"downstairs": &thermostat.MockThermostat{Temperature: 68},
+			},
+			map[string]switcher.SwitchDevice{"furnace": &switcher.MockSwitch{Status: "OFF"}},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		apiServer := Server{Zones: zones}
+		server = httptest.NewServer(apiServer.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	Describe("listing zones", func() {
+		It("should return every zone", func() {
+			resp, err := http.Get(server.URL + "/v1/zones")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			var statuses []hvac.Status
+			Expect(json.NewDecoder(resp.Body).Decode(&statuses)).Should(Succeed())
+			Expect(statuses).Should(HaveLen(2))
+			Expect(statuses[1].Name).Should(Equal("downstairs"))
+		})
+	})
+	Describe("setting a zone temperature", func() {
+		It("should only change that zone", func() {
+			resp, err := http.Post(server.URL+"/v1/zones/downstairs/temperature", "application/json", strings.NewReader(`{"set_temperature": 66}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+			Expect(zones.Zone("downstairs").Status().Setpoint).Should(Equal(66.0))
+			Expect(zones.Zone("upstairs").Status().Setpoint).Should(Equal(70.0))
+		})
+		It("should not find an unknown zone", func() {
+			resp, err := http.Post(server.URL+"/v1/zones/attic/temperature", "application/json", strings.NewReader(`{"set_temperature": 66}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+	})
+})
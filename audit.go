@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+	log "github.com/sirupsen/logrus"
+)
+
+const auditUsage = `usage: micasa audit [--since 24h] [--source s] [--actor a] [--target t] [--limit n]
+
+sources are api, cli, rule, schedule, controller, manual, homeKit, homeAssistant and hue`
+
+//auditCommand shows the latest changes recorded to the audit log
+func auditCommand(opts *options, args []string) int {
+	flags := newFlagSet("audit", opts)
+	since := flags.Duration("since", 0, "only show changes made within this long")
+	source := flags.String("source", "", "only show changes from this source")
+	actor := flags.String("actor", "", "only show changes by this actor")
+	target := flags.String("target", "", "only show changes to this device, zone or scene")
+	limit := flags.Int("limit", 50, "show at most this many of the latest changes, 0 for all")
+	if !flagsOnly(flags, args, auditUsage) {
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, err := loadConfig(opts)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	if micasaConfig.Audit.Disabled {
+		return failed(opts, exitConfig, fmt.Errorf("the audit log is disabled by the config"))
+	}
+	query := audit.Query{
+		Source: audit.Source(*source),
+		Actor:  *actor,
+		Target: *target,
+		Limit:  *limit,
+	}
+	if *since > 0 {
+		query.From = time.Now().Add(-*since)
+	}
+	entries, err := audit.Open(micasaConfig.Audit).Query(query)
+	if err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	output(opts, entries, func() {
+		for _, entry := range entries {
+			fmt.Println(describeEntry(entry))
+		}
+	})
+	return exitOK
+}
+
+//describeEntry is entry on one line, when then who did what
+func describeEntry(entry audit.Entry) string {
+	line := []string{entry.Time.Local().Format("2006-01-02 15:04:05"), string(entry.Source), entry.Actor, entry.Action}
+	if entry.Target != "" {
+		line = append(line, entry.Target)
+	}
+	change := entry.Requested
+	if entry.Result != "" && entry.Result != entry.Requested {
+		change = strings.TrimSpace(change + " -> " + entry.Result)
+	}
+	if change != "" {
+		line = append(line, change)
+	}
+	if entry.Reason != "" {
+		line = append(line, "("+entry.Reason+")")
+	}
+	if entry.Error != "" {
+		line = append(line, "failed: "+entry.Error)
+	}
+	return strings.Join(line, "\t")
+}
@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultFile = "audit.jsonl"
+
+//Source is what made a change
+type Source string
+
+const (
+	//SourceAPI is a request to the HTTP API, Actor is the principal
+	SourceAPI Source = "api"
+	//SourceCLI is a micasa command, Actor is the user running it
+	SourceCLI Source = "cli"
+	//SourceRule is an automation rule firing, Actor is the rule
+	SourceRule Source = "rule"
+	//SourceSchedule is a schedule point of an HVAC zone taking effect
+	SourceSchedule Source = "schedule"
+	//SourceController is an HVAC controller changing what it calls for
+	SourceController Source = "controller"
+	//SourceManual is a switch found changed by something other than
+	// mi-casa, such as its button or its own app
+	SourceManual Source = "manual"
+	//SourceHomeKit is a command from a HomeKit controller
+	SourceHomeKit Source = "homeKit"
+	//SourceHomeAssistant is a command from Home Assistant over MQTT
+	SourceHomeAssistant Source = "homeAssistant"
+	//SourceHue is a command to the emulated Hue bridge
+	SourceHue Source = "hue"
+)
+
+//Entry is one change, Requested is what was asked for and Result
+// what came of it, Error is set when it failed
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Source    Source    `json:"source"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Requested string    `json:"requested,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+//Command is the entry for a command, which was carried out unless err
+// says why not. Result is then what read reports the device came to,
+// or Error why it could not be read back.
+func Command(source Source, actor string, action string, target string, requested string, err error, read func() (string, error)) Entry {
+	entry := Entry{
+		Time:      time.Now(),
+		Source:    source,
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Requested: requested,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	result, err := read()
+	if err != nil {
+		entry.Error = fmt.Sprintf("reading back: %v", err)
+		return entry
+	}
+	entry.Result = result
+	return entry
+}
+
+//Config is the audit section of the mi-casa YAML config,
+// entries are appended to File unless Disabled
+type Config struct {
+	File     string `yaml:"file,omitempty"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+}
+
+//Query selects entries, empty fields match everything.
+// Limit keeps only the latest entries when set.
+type Query struct {
+	Source Source
+	Actor  string
+	Target string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+func (query Query) matches(entry Entry) bool {
+	switch {
+	case query.Source != "" && entry.Source != query.Source:
+		return false
+	case query.Actor != "" && entry.Actor != query.Actor:
+		return false
+	case query.Target != "" && entry.Target != query.Target:
+		return false
+	case !query.From.IsZero() && entry.Time.Before(query.From):
+		return false
+	case !query.To.IsZero() && entry.Time.After(query.To):
+		return false
+	}
+	return true
+}
+
+//Trail is the audit log, a JSON lines file which is only ever
+// appended to, by serve and by every micasa command changing
+// something. A nil Trail records nothing.
+type Trail struct {
+	Config Config
+	file   *os.File
+	lock   sync.Mutex
+}
+
+//Open fills in the defaults of conf, returning nil when
+// auditing is disabled. The file is created on the first Record.
+func Open(conf Config) *Trail {
+	if conf.Disabled {
+		return nil
+	}
+	if conf.File == "" {
+		conf.File = defaultFile
+	}
+	return &Trail{Config: conf}
+}
+
+//Record appends entry, a failure is logged rather than
+// returned so it never stops the change being made
+func (trail *Trail) Record(entry Entry) {
+	if trail == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if err := trail.write(entry); err != nil {
+		log.WithFields(log.Fields{
+			"file":   trail.Config.File,
+			"source": entry.Source,
+			"actor":  entry.Actor,
+			"action": entry.Action,
+			"target": entry.Target,
+			"err":    err,
+		}).Error("could not record audit entry")
+	}
+}
+
+func (trail *Trail) write(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	trail.lock.Lock()
+	defer trail.lock.Unlock()
+	if trail.file == nil {
+		file, err := os.OpenFile(trail.Config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		trail.file = file
+	}
+	// one write per line, so lines appended by other processes never interleave
+	_, err = trail.file.Write(append(line, '\n'))
+	return err
+}
+
+//Query returns the matching entries oldest first
+func (trail *Trail) Query(query Query) ([]Entry, error) {
+	found := []Entry{}
+	if trail == nil {
+		return found, nil
+	}
+	file, err := os.Open(trail.Config.File)
+	if os.IsNotExist(err) {
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a line cut short by a crash loses that entry only
+			log.WithFields(log.Fields{
+				"file": trail.Config.File,
+				"err":  err,
+			}).Warn("skipping unreadable audit line")
+			continue
+		}
+		if query.matches(entry) {
+			found = append(found, entry)
+		}
+	}
+	if query.Limit > 0 && len(found) > query.Limit {
+		found = found[len(found)-query.Limit:]
+	}
+	return found, scanner.Err()
+}
+
+//Close closes the file being appended to
+func (trail *Trail) Close() error {
+	if trail == nil {
+		return nil
+	}
+	trail.lock.Lock()
+	defer trail.lock.Unlock()
+	if trail.file == nil {
+		return nil
+	}
+	err := trail.file.Close()
+	trail.file = nil
+	return err
+}
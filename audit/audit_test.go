@@ -0,0 +1,101 @@
+package audit_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/audit"
+)
+
+var _ = Describe("Audit", func() {
+	var (
+		directory string
+		trail     *Trail
+		start     time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "audit")
+		Expect(err).ShouldNot(HaveOccurred())
+		trail = Open(Config{File: filepath.Join(directory, "audit.jsonl")})
+		start = time.Date(2026, 1, 12, 3, 0, 0, 0, time.UTC)
+		trail.Record(Entry{Time: start, Source: SourceController, Actor: "upstairs", Action: "call", Target: "upstairs", Requested: "heat", Result: "heat", Reason: "below setpoint"})
+		trail.Record(Entry{Time: start.Add(time.Minute), Source: SourceRule, Actor: "night fan", Action: "switch", Target: "fan", Requested: "ON", Result: "ON"})
+		trail.Record(Entry{Time: start.Add(2 * time.Minute), Source: SourceManual, Actor: "unknown", Action: "switch", Target: "furnace", Result: "OFF"})
+	})
+	AfterEach(func() {
+		trail.Close()
+		os.RemoveAll(directory)
+	})
+	It("should return every entry oldest first", func() {
+		entries, err := trail.Query(Query{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(3))
+		Expect(entries[0].Reason).To(Equal("below setpoint"))
+		Expect(entries[2].Source).To(Equal(SourceManual))
+	})
+	It("should filter by source, actor, target and time", func() {
+		entries, err := trail.Query(Query{Source: SourceRule})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Actor).To(Equal("night fan"))
+
+		entries, err = trail.Query(Query{Target: "upstairs", Actor: "upstairs"})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+
+		entries, err = trail.Query(Query{From: start.Add(30 * time.Second), To: start.Add(90 * time.Second)})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Target).To(Equal("fan"))
+	})
+	It("should keep the latest entries within the limit", func() {
+		entries, err := trail.Query(Query{Limit: 2})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Target).To(Equal("fan"))
+	})
+	It("should only append, alongside other writers", func() {
+		other := Open(Config{File: trail.Config.File})
+		other.Record(Command(SourceCLI, "oskar", "switch", "lamp", "ON", nil, func() (string, error) { return "ON", nil }))
+		other.Close()
+		trail.Record(Command(SourceAPI, "tablet", "POST /v1/zones/{name}/temperature", "upstairs", `{"set_temperature": 72}`, fmt.Errorf("sensor down"), nil))
+		entries, err := trail.Query(Query{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(5))
+		Expect(entries[3].Requested).To(Equal("ON"))
+		Expect(entries[3].Result).To(Equal("ON"))
+		Expect(entries[4].Result).To(BeEmpty())
+		Expect(entries[4].Error).To(Equal("sensor down"))
+	})
+	It("should record why a command could not be read back", func() {
+		entry := Command(SourceCLI, "oskar", "switch", "lamp", "ON", nil, func() (string, error) { return "", fmt.Errorf("unreachable") })
+		Expect(entry.Result).To(BeEmpty())
+		Expect(entry.Error).To(Equal("reading back: unreachable"))
+	})
+	It("should skip a line cut short", func() {
+		file, err := os.OpenFile(trail.Config.File, os.O_APPEND|os.O_WRONLY, 0600)
+		Expect(err).ShouldNot(HaveOccurred())
+		file.WriteString(`{"time":"2026-01-12T03:05:00Z","sou` + "\n")
+		file.Close()
+		trail.Record(Entry{Source: SourceSchedule, Actor: "schedule 06:00", Action: "schedule"})
+		entries, err := trail.Query(Query{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(4))
+		Expect(entries[3].Time).NotTo(BeZero())
+	})
+	It("should record nothing when disabled", func() {
+		disabled := Open(Config{Disabled: true})
+		Expect(disabled).To(BeNil())
+		disabled.Record(Entry{Source: SourceCLI})
+		entries, err := disabled.Query(Query{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/secret"
+)
+
+const (
+	//Realm is sent with a Basic challenge, browsers show it in their login prompt
+	Realm = "mi-casa"
+	//MinTokenLength keeps tokens too long to guess
+	MinTokenLength = 16
+	//defaultWritesPerMinute is how many changes each caller may make
+	// a minute unless the config says otherwise
+	defaultWritesPerMinute = 60
+)
+
+//Role is what a caller may do, each role may do everything
+// the roles before it may
+type Role string
+
+const (
+	//Viewer may read every device, zone, scene and the history
+	Viewer Role = "viewer"
+	//Operator may also switch devices, set zones and apply scenes
+	Operator Role = "operator"
+	//Admin may also capture and delete scenes
+	Admin Role = "admin"
+)
+
+//Roles are every role, least allowed first
+var Roles = []Role{Viewer, Operator, Admin}
+
+func (role Role) rank() int {
+	for i, known := range Roles {
+		if role == known {
+			return i
+		}
+	}
+	return -1
+}
+
+//Valid is whether role is one of Roles
+func (role Role) Valid() bool {
+	return role.rank() >= 0
+}
+
+//Allows is whether role may do what required may
+func (role Role) Allows(required Role) bool {
+	return role.Valid() && role.rank() >= required.rank()
+}
+
+//Config is the auth section of the API config. Without any Tokens or
+// Users the API is open to anyone who can reach it.
+type Config struct {
+	Tokens []Token `yaml:"tokens,omitempty"`
+	Users  []User  `yaml:"users,omitempty"`
+	//WritesPerMinute is how many changes each caller may make a
+	// minute, 60 when not set. Failed logins count against the address
+	// they came from.
+	WritesPerMinute int `yaml:"writesPerMinute,omitempty"`
+}
+
+//HasToken is whether one of the tokens is named name
+func (conf Config) HasToken(name string) bool {
+	for _, token := range conf.Tokens {
+		if token.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Scope limits a token or user to some devices and zones, an empty
+// scope allows all of them. A zone includes the devices it drives.
+type Scope struct {
+	Devices []string `yaml:"devices,omitempty"`
+	Zones   []string `yaml:"zones,omitempty"`
+}
+
+//Token is an API token for machines, sent as Authorization: Bearer.
+// A client certificate whose common name is the token's Name logs in
+// as the token too, so with mutual TLS the Token itself may be left out.
+type Token struct {
+	Name  string        `yaml:"name"`
+	Token secret.String `yaml:"token"`
+	Role  Role          `yaml:"role"`
+	Scope `yaml:",inline"`
+}
+
+//User is a login for people, sent with HTTP basic auth
+// which browsers prompt for
+type User struct {
+	Username string        `yaml:"username"`
+	Password secret.String `yaml:"password"`
+	Role     Role          `yaml:"role"`
+	Scope    `yaml:",inline"`
+}
+
+//Principal is who made a request and what they may do
+type Principal struct {
+	Name string
+	Role Role
+	Scope
+}
+
+//Anonymous is everyone when no tokens or users are configured
+var Anonymous = &Principal{Name: "anonymous", Role: Admin}
+
+//Scoped is whether principal is limited to some devices or zones
+func (principal *Principal) Scoped() bool {
+	return len(principal.Devices) > 0 || len(principal.Zones) > 0
+}
+
+//Device is whether principal may use the device name, devices
+// of the zones they may use are given by zoneDevices
+func (principal *Principal) Device(name string, zoneDevices func(zone string) []string) bool {
+	if !principal.Scoped() || contains(principal.Devices, name) {
+		return true
+	}
+	for _, zone := range principal.Zones {
+		if contains(zoneDevices(zone), name) {
+			return true
+		}
+	}
+	return false
+}
+
+//Zone is whether principal may use the zone name
+func (principal *Principal) Zone(name string) bool {
+	return !principal.Scoped() || contains(principal.Zones, name)
+}
+
+func contains(names []string, name string) bool {
+	for _, known := range names {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Authenticator tells who a request is from
+type Authenticator struct {
+	tokens []Token
+	users  []User
+	//Limiter is shared by every caller, keyed by principal
+	// name or by address for failed logins
+	Limiter *Limiter
+}
+
+//New checks conf and returns its Authenticator, secrets must
+// already be resolved
+func New(conf Config) (*Authenticator, error) {
+	names := map[string]bool{}
+	for _, token := range conf.Tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("token name not set")
+		}
+		if names[token.Name] {
+			return nil, fmt.Errorf("token %s is configured twice", token.Name)
+		}
+		names[token.Name] = true
+		if token.Token != "" && len(token.Token.Reveal()) < MinTokenLength {
+			return nil, fmt.Errorf("token %s must be at least %d characters", token.Name, MinTokenLength)
+		}
+		if !token.Role.Valid() {
+			return nil, fmt.Errorf("token %s role %q is not one of %v", token.Name, token.Role, Roles)
+		}
+	}
+	for _, user := range conf.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("username not set")
+		}
+		if names[user.Username] {
+			return nil, fmt.Errorf("%s is configured twice", user.Username)
+		}
+		names[user.Username] = true
+		if user.Password == "" {
+			return nil, fmt.Errorf("user %s password not set", user.Username)
+		}
+		if !user.Role.Valid() {
+			return nil, fmt.Errorf("user %s role %q is not one of %v", user.Username, user.Role, Roles)
+		}
+	}
+	writes := conf.WritesPerMinute
+	if writes <= 0 {
+		writes = defaultWritesPerMinute
+	}
+	return &Authenticator{
+		tokens:  conf.Tokens,
+		users:   conf.Users,
+		Limiter: NewLimiter(writes, time.Minute),
+	}, nil
+}
+
+//Open is whether there are no tokens or users, so
+// every request is from Anonymous
+func (authenticator *Authenticator) Open() bool {
+	return len(authenticator.tokens) == 0 && len(authenticator.users) == 0
+}
+
+//Challenge is the WWW-Authenticate header for a request which
+// was refused, Basic when there are users so browsers prompt
+func (authenticator *Authenticator) Challenge() string {
+	if len(authenticator.users) > 0 {
+		return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", Realm)
+	}
+	return fmt.Sprintf("Bearer realm=%q", Realm)
+}
+
+//Authenticate returns who req is from, ok is false when it has no
+// credentials or they are wrong. A verified client certificate is
+// checked first, then a bearer token or basic auth.
+func (authenticator *Authenticator) Authenticate(req *http.Request) (principal *Principal, ok bool) {
+	if authenticator.Open() {
+		return Anonymous, true
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range authenticator.tokens {
+			if token := &authenticator.tokens[i]; token.Name == name {
+				return &Principal{Name: token.Name, Role: token.Role, Scope: token.Scope}, true
+			}
+		}
+	}
+	header := req.Header.Get("Authorization")
+	if i := strings.Index(header, " "); i > 0 && strings.EqualFold(header[:i], "Bearer") {
+		presented := strings.TrimSpace(header[i+1:])
+		// every token is compared so the time taken does not tell which matched
+		var found *Token
+		for i := range authenticator.tokens {
+			token := &authenticator.tokens[i]
+			if token.Token != "" && equal(presented, token.Token.Reveal()) && found == nil {
+				found = token
+			}
+		}
+		if found == nil {
+			return nil, false
+		}
+		return &Principal{Name: found.Name, Role: found.Role, Scope: found.Scope}, true
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	for i := range authenticator.users {
+		user := &authenticator.users[i]
+		if user.Username == username {
+			if !equal(password, user.Password.Reveal()) {
+				return nil, false
+			}
+			return &Principal{Name: user.Username, Role: user.Role, Scope: user.Scope}, true
+		}
+	}
+	return nil, false
+}
+
+func equal(presented string, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) == 1
+}
@@ -0,0 +1,180 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/auth"
+)
+
+var _ = Describe("Auth", func() {
+	Describe("roles", func() {
+		It("should allow what every lesser role may do", func() {
+			Expect(Admin.Allows(Operator)).To(BeTrue())
+			Expect(Operator.Allows(Operator)).To(BeTrue())
+			Expect(Operator.Allows(Admin)).To(BeFalse())
+			Expect(Viewer.Allows(Operator)).To(BeFalse())
+			Expect(Role("root").Allows(Viewer)).To(BeFalse())
+		})
+	})
+	Describe("scopes", func() {
+		zoneDevices := func(zone string) []string {
+			if zone == "upstairs" {
+				return []string{"bedroom", "blower"}
+			}
+			return nil
+		}
+		It("should allow everything when unscoped", func() {
+			principal := Principal{Name: "house", Role: Operator}
+			Expect(principal.Device("heater", zoneDevices)).To(BeTrue())
+			Expect(principal.Zone("downstairs")).To(BeTrue())
+		})
+		It("should allow the devices listed and those of the zones listed", func() {
+			principal := Principal{Name: "tablet", Role: Operator, Scope: Scope{Devices: []string{"lamp"}, Zones: []string{"upstairs"}}}
+			Expect(principal.Device("lamp", zoneDevices)).To(BeTrue())
+			Expect(principal.Device("blower", zoneDevices)).To(BeTrue())
+			Expect(principal.Device("heater", zoneDevices)).To(BeFalse())
+			Expect(principal.Zone("upstairs")).To(BeTrue())
+			Expect(principal.Zone("downstairs")).To(BeFalse())
+		})
+	})
+	Describe("authenticating", func() {
+		var authenticator *Authenticator
+		request := func(setup func(*http.Request)) *http.Request {
+			req, err := http.NewRequest(http.MethodGet, "http://micasa.local/v1/devices", nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			setup(req)
+			return req
+		}
+		BeforeEach(func() {
+			var err error
+			authenticator, err = New(Config{
+				Tokens: []Token{
+					{Name: "tablet", Token: "0123456789abcdef", Role: Operator, Scope: Scope{Zones: []string{"upstairs"}}},
+					{Name: "grafana", Token: "fedcba9876543210", Role: Viewer},
+				},
+				Users: []User{{Username: "oskar", Password: "hunter2", Role: Admin}},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should know a token", func() {
+			principal, ok := authenticator.Authenticate(request(func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer fedcba9876543210")
+			}))
+			Expect(ok).To(BeTrue())
+			Expect(principal.Name).To(Equal("grafana"))
+			Expect(principal.Role).To(Equal(Viewer))
+		})
+		It("should carry the scope of a token", func() {
+			principal, ok := authenticator.Authenticate(request(func(req *http.Request) {
+				req.Header.Set("Authorization", "bearer 0123456789abcdef")
+			}))
+			Expect(ok).To(BeTrue())
+			Expect(principal.Zones).To(Equal([]string{"upstairs"}))
+		})
+		It("should know a user", func() {
+			principal, ok := authenticator.Authenticate(request(func(req *http.Request) {
+				req.SetBasicAuth("oskar", "hunter2")
+			}))
+			Expect(ok).To(BeTrue())
+			Expect(principal.Role).To(Equal(Admin))
+		})
+		It("should refuse a wrong token or password", func() {
+			_, ok := authenticator.Authenticate(request(func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer 0123456789abcdeX")
+			}))
+			Expect(ok).To(BeFalse())
+			_, ok = authenticator.Authenticate(request(func(req *http.Request) {
+				req.SetBasicAuth("oskar", "hunter3")
+			}))
+			Expect(ok).To(BeFalse())
+		})
+		It("should know a client certificate named after a token", func() {
+			certified := func(name string) func(*http.Request) {
+				return func(req *http.Request) {
+					req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: name}}}}}
+				}
+			}
+			principal, ok := authenticator.Authenticate(request(certified("tablet")))
+			Expect(ok).To(BeTrue())
+			Expect(principal.Name).To(Equal("tablet"))
+			Expect(principal.Zones).To(Equal([]string{"upstairs"}))
+			_, ok = authenticator.Authenticate(request(certified("oskar")))
+			Expect(ok).To(BeFalse())
+		})
+		It("should not match an empty bearer to a token left out for a client certificate", func() {
+			certOnly, err := New(Config{Tokens: []Token{{Name: "tablet", Role: Operator}}})
+			Expect(err).ShouldNot(HaveOccurred())
+			_, ok := certOnly.Authenticate(request(func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer ")
+			}))
+			Expect(ok).To(BeFalse())
+		})
+		It("should refuse a request without credentials", func() {
+			_, ok := authenticator.Authenticate(request(func(*http.Request) {}))
+			Expect(ok).To(BeFalse())
+			Expect(authenticator.Challenge()).To(HavePrefix("Basic"))
+		})
+		It("should let everyone in when nothing is configured", func() {
+			open, err := New(Config{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(open.Open()).To(BeTrue())
+			principal, ok := open.Authenticate(request(func(*http.Request) {}))
+			Expect(ok).To(BeTrue())
+			Expect(principal).To(Equal(Anonymous))
+		})
+	})
+	Describe("checking the config", func() {
+		It("should refuse a short token", func() {
+			_, err := New(Config{Tokens: []Token{{Name: "tablet", Token: "1234", Role: Operator}}})
+			Expect(err).To(MatchError(ContainSubstring("at least 16 characters")))
+		})
+		It("should refuse an unknown role", func() {
+			_, err := New(Config{Users: []User{{Username: "oskar", Password: "hunter2", Role: "root"}}})
+			Expect(err).To(MatchError(ContainSubstring(`role "root"`)))
+		})
+		It("should refuse a name used twice", func() {
+			_, err := New(Config{
+				Tokens: []Token{{Name: "oskar", Token: "0123456789abcdef", Role: Operator}},
+				Users:  []User{{Username: "oskar", Password: "hunter2", Role: Admin}},
+			})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("limiting", func() {
+		It("should allow a burst then refill steadily", func() {
+			limiter := NewLimiter(3, time.Minute)
+			now := time.Now()
+			for i := 0; i < 3; i++ {
+				allowed, _ := limiter.Allow("tablet", now)
+				Expect(allowed).To(BeTrue())
+			}
+			allowed, wait := limiter.Allow("tablet", now)
+			Expect(allowed).To(BeFalse())
+			Expect(wait).To(BeNumerically("~", 20*time.Second, time.Millisecond))
+			allowed, _ = limiter.Allow("grafana", now)
+			Expect(allowed).To(BeTrue())
+			allowed, _ = limiter.Allow("tablet", now.Add(20*time.Second))
+			Expect(allowed).To(BeTrue())
+		})
+		It("should tell when a key is exhausted without taking from it", func() {
+			limiter := NewLimiter(1, time.Minute)
+			now := time.Now()
+			exhausted, _ := limiter.Exhausted("tablet", now)
+			Expect(exhausted).To(BeFalse())
+			allowed, _ := limiter.Allow("tablet", now)
+			Expect(allowed).To(BeTrue())
+			exhausted, wait := limiter.Exhausted("tablet", now)
+			Expect(exhausted).To(BeTrue())
+			Expect(wait).To(BeNumerically("~", time.Minute, time.Millisecond))
+			exhausted, _ = limiter.Exhausted("tablet", now.Add(time.Minute))
+			Expect(exhausted).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+//Limiter allows each key so many actions per period, refilling
+// steadily so a burst of the whole allowance is possible
+type Limiter struct {
+	allowance float64
+	period    time.Duration
+	buckets   map[string]*bucket
+	lock      sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//NewLimiter allows allowance actions each period per key
+func NewLimiter(allowance int, period time.Duration) *Limiter {
+	return &Limiter{
+		allowance: float64(allowance),
+		period:    period,
+		buckets:   map[string]*bucket{},
+	}
+}
+
+//Allow takes an action from key at now, when there is none left it
+// returns false and how long until there is
+func (limiter *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	b := limiter.refill(key, now)
+	if b.tokens < 1 {
+		return false, limiter.wait(b)
+	}
+	b.tokens--
+	limiter.forget(now)
+	return true, 0
+}
+
+//Exhausted is whether key has no action left at now, and how long
+// until it has, without taking one
+func (limiter *Limiter) Exhausted(key string, now time.Time) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	b, ok := limiter.buckets[key]
+	if !ok {
+		return false, 0
+	}
+	b = limiter.refill(key, now)
+	if b.tokens < 1 {
+		return true, limiter.wait(b)
+	}
+	return false, 0
+}
+
+//refill returns the bucket of key topped up to now
+func (limiter *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.allowance, last: now}
+		limiter.buckets[key] = b
+	}
+	if now.After(b.last) {
+		b.tokens += float64(now.Sub(b.last)) * limiter.allowance / float64(limiter.period)
+		if b.tokens > limiter.allowance {
+			b.tokens = limiter.allowance
+		}
+		b.last = now
+	}
+	return b
+}
+
+func (limiter *Limiter) wait(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) * float64(limiter.period) / limiter.allowance)
+}
+
+//forget drops keys whose buckets have refilled, so addresses
+// seen once are not kept forever
+func (limiter *Limiter) forget(now time.Time) {
+	if len(limiter.buckets) < 1024 {
+		return
+	}
+	for key, b := range limiter.buckets {
+		if now.Sub(b.last) > limiter.period {
+			delete(limiter.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,649 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/secret"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAddress = ":1883"
+	connectTimeout = 10 * time.Second
+	outboundBuffer = 256
+	//maxPending is how many QoS 1 messages are kept
+	// for a persistent session while its client is away
+	maxPending = 1000
+	//maxInflight is how many QoS 1 messages may wait for a PUBACK,
+	// past it a client which does not acknowledge gets them at QoS 0
+	maxInflight = 1000
+	//defaultMaxPacketSize is the largest packet a client may send
+	// unless MaxPacketSize says otherwise
+	defaultMaxPacketSize = 256 * 1024
+	//maxConnectSize is the largest first packet, read before
+	// anyone has logged in
+	maxConnectSize = 8 * 1024
+	//largestPacket is the most the MQTT remaining length can say
+	largestPacket = 268435455
+)
+
+//Config is the broker section of the mi-casa YAML config. Without
+// any Users every client may connect and use every topic, with Users
+// each client has to log in as one of them. A client sending a packet
+// larger than MaxPacketSize bytes is disconnected.
+type Config struct {
+	Address       string `yaml:"address"`
+	Users         []User `yaml:"users,omitempty"`
+	MaxPacketSize int    `yaml:"maxPacketSize,omitempty"`
+}
+
+func (conf Config) maxPacketSize() int {
+	if conf.MaxPacketSize > 0 {
+		return conf.MaxPacketSize
+	}
+	return defaultMaxPacketSize
+}
+
+//User is a login for the broker, Publish and Subscribe are
+// the topic filters the user may publish to and subscribe to,
+// "#" allows every topic
+type User struct {
+	Username  string        `yaml:"username"`
+	Password  secret.String `yaml:"password"`
+	Publish   []string      `yaml:"publish,omitempty"`
+	Subscribe []string      `yaml:"subscribe,omitempty"`
+}
+
+func (user *User) canPublish(topic string) bool {
+	if user == nil {
+		return true
+	}
+	for _, filter := range user.Publish {
+		if matches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) canSubscribe(filter string) bool {
+	if user == nil {
+		return true
+	}
+	for _, allowed := range user.Subscribe {
+		if covers(allowed, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+//Broker is an in-process MQTT 3.1.1 broker so Tasmota devices,
+// Home Assistant and mi-casa can talk without an outside service.
+// Messages are delivered at QoS 0 or 1, a QoS 2 publish is accepted
+// but delivered at QoS 1. Sessions and retained messages last as long
+// as the process.
+type Broker struct {
+	Config    Config
+	users     map[string]*User
+	listener  net.Listener
+	sessions  map[string]*session
+	retained  map[string]message
+	clients   map[*client]bool
+	anonymous int
+	lock      sync.Mutex
+}
+
+//session is what the broker keeps for a client ID, across
+// connections unless the client asked for a clean session
+type session struct {
+	id            string
+	username      string
+	clean         bool
+	subscriptions map[string]byte
+	client        *client
+	pending       []message
+	inflight      map[uint16]message
+	nextID        uint16
+}
+
+//packetID returns the next identifier not waiting for a PUBACK,
+// maxInflight keeps some free
+func (s *session) packetID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.nextID]; !used {
+			return s.nextID
+		}
+	}
+}
+
+//client is one network connection
+type client struct {
+	conn     net.Conn
+	user     *User
+	session  *session
+	will     *message
+	released map[uint16]bool
+	outbound chan packet
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (c *client) send(p packet) {
+	select {
+	case c.outbound <- p:
+	case <-c.done:
+	default:
+		log.WithFields(log.Fields{
+			"client": c.session.id,
+		}).Warn("MQTT client is not keeping up, dropping packet")
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) write() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case p := <-c.outbound:
+			c.conn.SetWriteDeadline(time.Now().Add(connectTimeout))
+			if _, err := c.conn.Write(p.encode()); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+//New checks the users of conf and returns a broker ready to Start
+func New(conf Config) (*Broker, error) {
+	if conf.Address == "" {
+		conf.Address = defaultAddress
+	}
+	if conf.MaxPacketSize < 0 || conf.MaxPacketSize > largestPacket {
+		return nil, fmt.Errorf("broker maxPacketSize must be between 1 and %d bytes", largestPacket)
+	}
+	users := map[string]*User{}
+	for i := range conf.Users {
+		user := conf.Users[i]
+		if user.Username == "" {
+			return nil, fmt.Errorf("broker user %d has no username", i)
+		}
+		if _, duplicate := users[user.Username]; duplicate {
+			return nil, fmt.Errorf("broker user %s configured twice", user.Username)
+		}
+		for _, filter := range append(append([]string{}, user.Publish...), user.Subscribe...) {
+			if err := validateFilter(filter); err != nil {
+				return nil, fmt.Errorf("broker user %s: %v", user.Username, err)
+			}
+		}
+		users[user.Username] = &user
+	}
+	return &Broker{
+		Config:   conf,
+		users:    users,
+		sessions: map[string]*session{},
+		retained: map[string]message{},
+		clients:  map[*client]bool{},
+	}, nil
+}
+
+//Listen binds the configured address, so clients can connect
+// as soon as it returns even before Serve is running
+func (broker *Broker) Listen() error {
+	listener, err := net.Listen("tcp", broker.Config.Address)
+	if err != nil {
+		return err
+	}
+	broker.listener = listener
+	log.WithFields(log.Fields{
+		"address": listener.Addr().String(),
+	}).Printf("MQTT broker listening")
+	return nil
+}
+
+//Addr is the address the broker is listening on
+func (broker *Broker) Addr() net.Addr {
+	return broker.listener.Addr()
+}
+
+//Serve accepts clients until stop is closed, then disconnects them all
+func (broker *Broker) Serve(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		broker.listener.Close()
+		broker.lock.Lock()
+		defer broker.lock.Unlock()
+		for c := range broker.clients {
+			c.close()
+		}
+	}()
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("MQTT broker could not accept connection")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go broker.serveConn(conn)
+	}
+}
+
+//Start listens and serves until stop is closed
+func (broker *Broker) Start(stop <-chan struct{}) error {
+	if err := broker.Listen(); err != nil {
+		return err
+	}
+	broker.Serve(stop)
+	return nil
+}
+
+func (broker *Broker) serveConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	limit := broker.Config.maxPacketSize()
+	if limit > maxConnectSize {
+		limit = maxConnectSize
+	}
+	first, err := readPacket(reader, limit)
+	if err != nil || first.kind != typeConnect {
+		if _, ok := err.(tooLarge); ok {
+			log.WithFields(log.Fields{
+				"remote": conn.RemoteAddr().String(),
+				"err":    err,
+			}).Warn("MQTT client refused")
+		}
+		conn.Close()
+		return
+	}
+	request, err := decodeConnect(first.body)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c, code := broker.accept(conn, request)
+	if c == nil {
+		conn.Write(packet{kind: typeConnack, body: []byte{0, code}}.encode())
+		conn.Close()
+		log.WithFields(log.Fields{
+			"client": request.clientID,
+			"user":   request.username,
+			"remote": conn.RemoteAddr().String(),
+			"code":   code,
+		}).Warn("MQTT client refused")
+		return
+	}
+	log.WithFields(log.Fields{
+		"client": c.session.id,
+		"user":   request.username,
+		"remote": conn.RemoteAddr().String(),
+	}).Printf("MQTT client connected")
+	graceful := broker.read(c, reader, request.keepAlive)
+	c.close()
+	broker.disconnected(c, graceful)
+}
+
+//accept authenticates the CONNECT and attaches its session, returning
+// a nil client and the CONNACK return code when it is refused
+func (broker *Broker) accept(conn net.Conn, request connect) (*client, byte) {
+	if !(request.protocol == "MQTT" && request.level == 4) && !(request.protocol == "MQIsdp" && request.level == 3) {
+		return nil, connBadProtocol
+	}
+	var user *User
+	if len(broker.users) > 0 {
+		user = broker.users[request.username]
+		if !request.hasUsername || user == nil || subtle.ConstantTimeCompare([]byte(user.Password.Reveal()), []byte(request.password)) != 1 {
+			return nil, connBadCredentials
+		}
+	}
+	if request.will != nil {
+		if validateTopic(request.will.topic) != nil || request.will.qos > 2 {
+			return nil, connNotAuthorized
+		}
+		if !user.canPublish(request.will.topic) {
+			return nil, connNotAuthorized
+		}
+	}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if request.clientID == "" {
+		if !request.cleanSession {
+			return nil, connIdentifierRejected
+		}
+		broker.anonymous++
+		request.clientID = fmt.Sprintf("mi-casa-anonymous-%d", broker.anonymous)
+	}
+	existing := broker.sessions[request.clientID]
+	if existing != nil && existing.client != nil {
+		// the newest connection for a client ID wins
+		existing.client.will = nil
+		existing.client.close()
+		existing.client = nil
+	}
+	// a session only carries over to the user it belongs to,
+	// anyone else with its client ID starts afresh
+	present := existing != nil && !request.cleanSession && !existing.clean && existing.username == request.username
+	current := existing
+	if !present {
+		current = &session{
+			id:            request.clientID,
+			username:      request.username,
+			subscriptions: map[string]byte{},
+			inflight:      map[uint16]message{},
+		}
+		broker.sessions[request.clientID] = current
+	}
+	for filter := range current.subscriptions {
+		if !user.canSubscribe(filter) {
+			delete(current.subscriptions, filter)
+		}
+	}
+	current.clean = request.cleanSession
+	c := &client{
+		conn:     conn,
+		user:     user,
+		session:  current,
+		will:     request.will,
+		released: map[uint16]bool{},
+		outbound: make(chan packet, outboundBuffer),
+		done:     make(chan struct{}),
+	}
+	current.client = c
+	broker.clients[c] = true
+	go c.write()
+	acknowledge := byte(0)
+	if present {
+		acknowledge = 1
+	}
+	c.send(packet{kind: typeConnack, body: []byte{acknowledge, connAccepted}})
+	for id, msg := range current.inflight {
+		c.send(publishPacket(msg, id, true))
+	}
+	for _, msg := range current.pending {
+		broker.deliver(current, msg)
+	}
+	current.pending = nil
+	return c, connAccepted
+}
+
+//read handles packets from c until it disconnects, returning
+// true when it sent DISCONNECT rather than dropping away
+func (broker *Broker) read(c *client, reader *bufio.Reader, keepAlive uint16) bool {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(time.Duration(keepAlive) * 1500 * time.Millisecond))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(reader, broker.Config.maxPacketSize())
+		if err != nil {
+			if _, ok := err.(tooLarge); ok {
+				broker.protocolError(c, err)
+			}
+			return false
+		}
+		switch p.kind {
+		case typePublish:
+			if err := broker.handlePublish(c, p); err != nil {
+				broker.protocolError(c, err)
+				return false
+			}
+		case typePuback:
+			d := &decoder{body: p.body}
+			id := d.uint16()
+			broker.lock.Lock()
+			delete(c.session.inflight, id)
+			broker.lock.Unlock()
+		case typePubrel:
+			d := &decoder{body: p.body}
+			id := d.uint16()
+			delete(c.released, id)
+			c.send(ackPacket(typePubcomp, id))
+		case typePubrec, typePubcomp:
+			// only QoS 2 deliveries use these and the broker never sends one
+		case typeSubscribe:
+			if err := broker.handleSubscribe(c, p); err != nil {
+				broker.protocolError(c, err)
+				return false
+			}
+		case typeUnsubscribe:
+			if err := broker.handleUnsubscribe(c, p); err != nil {
+				broker.protocolError(c, err)
+				return false
+			}
+		case typePingreq:
+			c.send(packet{kind: typePingresp})
+		case typeDisconnect:
+			return true
+		default:
+			broker.protocolError(c, fmt.Errorf("unexpected packet type %d", p.kind))
+			return false
+		}
+	}
+}
+
+func (broker *Broker) protocolError(c *client, err error) {
+	log.WithFields(log.Fields{
+		"client": c.session.id,
+		"err":    err,
+	}).Warn("MQTT client broke protocol, disconnecting")
+}
+
+//disconnected detaches c from its session and publishes
+// its will unless it said goodbye
+func (broker *Broker) disconnected(c *client, graceful bool) {
+	broker.lock.Lock()
+	delete(broker.clients, c)
+	if c.session.client == c {
+		c.session.client = nil
+		if c.session.clean {
+			delete(broker.sessions, c.session.id)
+		}
+	}
+	will := c.will
+	broker.lock.Unlock()
+	log.WithFields(log.Fields{
+		"client":   c.session.id,
+		"graceful": graceful,
+	}).Printf("MQTT client disconnected")
+	if !graceful && will != nil {
+		broker.publish(*will)
+	}
+}
+
+func (broker *Broker) handlePublish(c *client, p packet) error {
+	msg, id, err := decodePublish(p)
+	if err != nil {
+		return err
+	}
+	if err := validateTopic(msg.topic); err != nil {
+		return err
+	}
+	duplicate := msg.qos == 2 && c.released[id]
+	if !c.user.canPublish(msg.topic) {
+		// MQTT 3.1.1 cannot refuse a publish, it is acknowledged and dropped
+		log.WithFields(log.Fields{
+			"client": c.session.id,
+			"topic":  msg.topic,
+		}).Warn("MQTT client not allowed to publish")
+	} else if !duplicate {
+		broker.publish(msg)
+	}
+	switch msg.qos {
+	case 1:
+		c.send(ackPacket(typePuback, id))
+	case 2:
+		c.released[id] = true
+		c.send(ackPacket(typePubrec, id))
+	}
+	return nil
+}
+
+//publish retains msg when asked and routes it to every subscriber
+func (broker *Broker) publish(msg message) {
+	if msg.qos > 1 {
+		msg.qos = 1
+	}
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if msg.retain {
+		if len(msg.payload) == 0 {
+			delete(broker.retained, msg.topic)
+		} else {
+			broker.retained[msg.topic] = msg
+		}
+	}
+	msg.retain = false
+	for _, s := range broker.sessions {
+		granted, subscribed := s.granted(msg.topic)
+		if !subscribed {
+			continue
+		}
+		delivered := msg
+		if granted < delivered.qos {
+			delivered.qos = granted
+		}
+		broker.deliver(s, delivered)
+	}
+}
+
+//granted returns the highest QoS of the subscriptions matching topic
+func (s *session) granted(topic string) (byte, bool) {
+	granted := byte(0)
+	subscribed := false
+	for filter, qos := range s.subscriptions {
+		if matches(filter, topic) {
+			subscribed = true
+			if qos > granted {
+				granted = qos
+			}
+		}
+	}
+	return granted, subscribed
+}
+
+//deliver sends msg to the client of s, or keeps it for later
+// when s is a persistent session without a client. Call with lock held.
+func (broker *Broker) deliver(s *session, msg message) {
+	if s.client == nil {
+		if s.clean || msg.qos == 0 {
+			return
+		}
+		if len(s.pending) >= maxPending {
+			s.pending = s.pending[1:]
+		}
+		s.pending = append(s.pending, msg)
+		return
+	}
+	if msg.qos > 0 && len(s.inflight) >= maxInflight {
+		msg.qos = 0
+	}
+	id := uint16(0)
+	if msg.qos > 0 {
+		id = s.packetID()
+		s.inflight[id] = msg
+	}
+	s.client.send(publishPacket(msg, id, false))
+}
+
+func (broker *Broker) handleSubscribe(c *client, p packet) error {
+	if p.flags != 0x02 {
+		return fmt.Errorf("malformed subscribe flags")
+	}
+	d := &decoder{body: p.body}
+	id := d.uint16()
+	codes := []byte{}
+	accepted := []string{}
+	for d.err == nil && len(d.body) > 0 {
+		filter := d.string()
+		qos := d.byte()
+		if d.err != nil {
+			break
+		}
+		if qos > 2 {
+			return fmt.Errorf("invalid QoS %d for %s", qos, filter)
+		}
+		if qos > 1 {
+			qos = 1
+		}
+		if validateFilter(filter) != nil || !c.user.canSubscribe(filter) {
+			log.WithFields(log.Fields{
+				"client": c.session.id,
+				"filter": filter,
+			}).Warn("MQTT client not allowed to subscribe")
+			codes = append(codes, subscribeFailure)
+			continue
+		}
+		codes = append(codes, qos)
+		accepted = append(accepted, filter)
+		broker.lock.Lock()
+		c.session.subscriptions[filter] = qos
+		broker.lock.Unlock()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(codes) == 0 {
+		return fmt.Errorf("subscribe without any topic filter")
+	}
+	c.send(packet{kind: typeSuback, body: append((&encoder{}).uint16(id).body, codes...)})
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	for _, filter := range accepted {
+		granted := c.session.subscriptions[filter]
+		for topic, msg := range broker.retained {
+			if !matches(filter, topic) {
+				continue
+			}
+			if granted < msg.qos {
+				msg.qos = granted
+			}
+			broker.deliver(c.session, msg)
+		}
+	}
+	return nil
+}
+
+func (broker *Broker) handleUnsubscribe(c *client, p packet) error {
+	if p.flags != 0x02 {
+		return fmt.Errorf("malformed unsubscribe flags")
+	}
+	d := &decoder{body: p.body}
+	id := d.uint16()
+	broker.lock.Lock()
+	for d.err == nil && len(d.body) > 0 {
+		filter := d.string()
+		delete(c.session.subscriptions, filter)
+	}
+	broker.lock.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	c.send(ackPacket(typeUnsuback, id))
+	return nil
+}
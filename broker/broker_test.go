@@ -0,0 +1,310 @@
+package broker_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/broker"
+)
+
+type received struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+//connect returns a paho client logged in to address
+func connect(address string, clientID string, username string, password string, clean bool, messages chan received) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + address)
+	opts.SetClientID(clientID)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetCleanSession(clean)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetProtocolVersion(4)
+	if messages != nil {
+		opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			messages <- received{topic: msg.Topic(), payload: string(msg.Payload()), retained: msg.Retained()}
+		})
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.WaitTimeout(5 * time.Second)
+	return client, token.Error()
+}
+
+func subscribe(client mqtt.Client, filter string) byte {
+	token := client.Subscribe(filter, 1, nil)
+	Expect(token.WaitTimeout(5 * time.Second)).Should(BeTrue())
+	Expect(token.Error()).ShouldNot(HaveOccurred())
+	return token.(*mqtt.SubscribeToken).Result()[filter]
+}
+
+func publish(client mqtt.Client, topic string, retained bool, payload string) {
+	token := client.Publish(topic, 1, retained, payload)
+	Expect(token.WaitTimeout(5 * time.Second)).Should(BeTrue())
+	Expect(token.Error()).ShouldNot(HaveOccurred())
+}
+
+//mqttString is a length prefixed string as MQTT encodes it
+func mqttString(value string) []byte {
+	return append([]byte{byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+var _ = Describe("Broker", func() {
+	var (
+		conf     Config
+		broker   *Broker
+		stop     chan struct{}
+		address  string
+		messages chan received
+	)
+	BeforeEach(func() {
+		conf = Config{Address: "127.0.0.1:0"}
+		messages = make(chan received, 16)
+	})
+	JustBeforeEach(func() {
+		var err error
+		broker, err = New(conf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(broker.Listen()).Should(Succeed())
+		address = broker.Addr().String()
+		stop = make(chan struct{})
+		go broker.Serve(stop)
+	})
+	AfterEach(func() {
+		close(stop)
+	})
+
+	Describe("without users", func() {
+		It("should route messages to matching subscriptions", func() {
+			listener, err := connect(address, "listener", "", "", true, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Disconnect(0)
+			Expect(subscribe(listener, "tele/+/STATE")).Should(Equal(byte(1)))
+
+			device, err := connect(address, "porch", "", "", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			publish(device, "tele/hall/SENSOR", false, "ignored")
+			publish(device, "tele/porch/STATE", false, `{"POWER":"ON"}`)
+			Eventually(messages).Should(Receive(Equal(received{topic: "tele/porch/STATE", payload: `{"POWER":"ON"}`})))
+			Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+		})
+		It("should hand retained messages to later subscribers until cleared", func() {
+			device, err := connect(address, "porch", "", "", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			publish(device, "tele/porch/LWT", true, "Online")
+
+			listener, err := connect(address, "listener", "", "", true, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			subscribe(listener, "tele/#")
+			Eventually(messages).Should(Receive(Equal(received{topic: "tele/porch/LWT", payload: "Online", retained: true})))
+			listener.Disconnect(0)
+
+			publish(device, "tele/porch/LWT", true, "")
+			late, err := connect(address, "late", "", "", true, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer late.Disconnect(0)
+			subscribe(late, "tele/#")
+			Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+		})
+		It("should keep messages for a persistent session while it is away", func() {
+			listener, err := connect(address, "home-assistant", "", "", false, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			subscribe(listener, "stat/porch/POWER")
+			listener.Disconnect(100)
+
+			device, err := connect(address, "porch", "", "", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			publish(device, "stat/porch/POWER", false, "OFF")
+
+			listener, err = connect(address, "home-assistant", "", "", false, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Disconnect(0)
+			Eventually(messages).Should(Receive(Equal(received{topic: "stat/porch/POWER", payload: "OFF"})))
+		})
+		It("should publish the will of a client which drops off", func() {
+			listener, err := connect(address, "listener", "", "", true, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Disconnect(0)
+			subscribe(listener, "tele/porch/LWT")
+
+			conn, err := net.Dial("tcp", address)
+			Expect(err).ShouldNot(HaveOccurred())
+			body := mqttString("MQTT")
+			body = append(body, 4, 0x02|0x04, 0, 60)
+			body = append(body, mqttString("porch")...)
+			body = append(body, mqttString("tele/porch/LWT")...)
+			body = append(body, mqttString("Offline")...)
+			_, err = conn.Write(append([]byte{0x10, byte(len(body))}, body...))
+			Expect(err).ShouldNot(HaveOccurred())
+			connack := make([]byte, 4)
+			_, err = conn.Read(connack)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(connack).Should(Equal([]byte{0x20, 2, 0, 0}))
+			conn.Close()
+			Eventually(messages).Should(Receive(Equal(received{topic: "tele/porch/LWT", payload: "Offline"})))
+		})
+	})
+
+	Describe("limiting packet size", func() {
+		BeforeEach(func() {
+			conf.MaxPacketSize = 1024
+		})
+		//closed is whether the broker hung up on conn rather than waiting
+		closed := func(conn net.Conn) bool {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := conn.Read(make([]byte, 16))
+			return err == io.EOF
+		}
+		It("should disconnect a client sending a packet over the limit", func() {
+			client, err := connect(address, "porch", "", "", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer client.Disconnect(0)
+			publish(client, "tele/porch/STATE", false, "small")
+			client.Publish("tele/porch/STATE", 0, false, make([]byte, 2048)).WaitTimeout(5 * time.Second)
+			Eventually(client.IsConnectionOpen).Should(BeFalse())
+		})
+		It("should hang up on a large first packet before it is sent", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			// CONNECT claiming a 1MB body, of which nothing follows
+			_, err = conn.Write([]byte{0x10, 0x80, 0x80, 0x40})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(closed(conn)).Should(BeTrue())
+		})
+	})
+
+	Describe("with users", func() {
+		BeforeEach(func() {
+			conf.Users = []User{
+				{Username: "mi-casa", Password: "casa", Publish: []string{"#"}, Subscribe: []string{"#"}},
+				{Username: "porch", Password: "tasmota", Publish: []string{"tele/porch/#", "stat/porch/#"}, Subscribe: []string{"cmnd/porch/#"}},
+			}
+		})
+		It("should refuse unknown users and wrong passwords", func() {
+			_, err := connect(address, "anonymous", "", "", true, nil)
+			Expect(err).Should(HaveOccurred())
+			_, err = connect(address, "stranger", "stranger", "casa", true, nil)
+			Expect(err).Should(HaveOccurred())
+			_, err = connect(address, "mi-casa", "mi-casa", "tasmota", true, nil)
+			Expect(err).Should(HaveOccurred())
+			client, err := connect(address, "mi-casa", "mi-casa", "casa", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			client.Disconnect(0)
+		})
+		It("should only route what the user may publish", func() {
+			listener, err := connect(address, "mi-casa", "mi-casa", "casa", true, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Disconnect(0)
+			subscribe(listener, "#")
+
+			device, err := connect(address, "porch", "porch", "tasmota", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			publish(device, "cmnd/hall/POWER", false, "ON")
+			publish(device, "stat/porch/POWER", false, "ON")
+			Eventually(messages).Should(Receive(Equal(received{topic: "stat/porch/POWER", payload: "ON"})))
+			Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+		})
+		It("should refuse subscriptions beyond what the user may read", func() {
+			device, err := connect(address, "porch", "porch", "tasmota", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			Expect(subscribe(device, "cmnd/porch/POWER")).Should(Equal(byte(1)))
+			Expect(subscribe(device, "cmnd/+/POWER")).Should(Equal(byte(0x80)))
+			Expect(subscribe(device, "#")).Should(Equal(byte(0x80)))
+		})
+		It("should not hand a persistent session to another user", func() {
+			owner, err := connect(address, "shared", "mi-casa", "casa", false, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			subscribe(owner, "#")
+			owner.Disconnect(0)
+			sender, err := connect(address, "sender", "mi-casa", "casa", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer sender.Disconnect(0)
+			publish(sender, "cmnd/hall/POWER", false, "while away")
+
+			device, err := connect(address, "shared", "porch", "tasmota", false, messages)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer device.Disconnect(0)
+			publish(sender, "cmnd/hall/POWER", false, "ON")
+			Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Describe("a client which never acknowledges", func() {
+		//readPacket reads the type and flags of the next packet on reader
+		readPacket := func(reader *bufio.Reader) byte {
+			header, err := reader.ReadByte()
+			Expect(err).ShouldNot(HaveOccurred())
+			length := 0
+			for multiplier := 1; ; multiplier *= 128 {
+				digit, err := reader.ReadByte()
+				Expect(err).ShouldNot(HaveOccurred())
+				length += int(digit&127) * multiplier
+				if digit&128 == 0 {
+					break
+				}
+			}
+			_, err = io.ReadFull(reader, make([]byte, length))
+			Expect(err).ShouldNot(HaveOccurred())
+			return header
+		}
+		It("should get the messages past the inflight limit at QoS 0", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			body := mqttString("MQTT")
+			body = append(body, 4, 0x02, 0, 0)
+			body = append(body, mqttString("sluggish")...)
+			_, err = conn.Write(append([]byte{0x10, byte(len(body))}, body...))
+			Expect(err).ShouldNot(HaveOccurred())
+			body = append([]byte{0, 1}, mqttString("tele/#")...)
+			body = append(body, 1)
+			_, err = conn.Write(append([]byte{0x82, byte(len(body))}, body...))
+			Expect(err).ShouldNot(HaveOccurred())
+			reader := bufio.NewReader(conn)
+			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+			Expect(readPacket(reader)).Should(Equal(byte(0x20)))
+			Expect(readPacket(reader)).Should(Equal(byte(0x90)))
+
+			sender, err := connect(address, "sender", "", "", true, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer sender.Disconnect(0)
+			qos := map[byte]int{}
+			for i := 0; i < 1010; i++ {
+				publish(sender, "tele/porch/STATE", false, "state")
+				qos[readPacket(reader)&0x06>>1]++
+			}
+			Expect(qos).Should(Equal(map[byte]int{1: 1000, 0: 10}))
+		})
+	})
+
+	Describe("configuring", func() {
+		It("should reject invalid users", func() {
+			_, err := New(Config{Users: []User{{Password: "nameless"}}})
+			Expect(err).Should(HaveOccurred())
+			_, err = New(Config{Users: []User{{Username: "a"}, {Username: "a"}}})
+			Expect(err).Should(HaveOccurred())
+			_, err = New(Config{Users: []User{{Username: "a", Publish: []string{"tele/#/STATE"}}}})
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should reject a negative packet size", func() {
+			_, err := New(Config{MaxPacketSize: -1})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//packet types of MQTT 3.1.1
+const (
+	typeConnect     byte = 1
+	typeConnack     byte = 2
+	typePublish     byte = 3
+	typePuback      byte = 4
+	typePubrec      byte = 5
+	typePubrel      byte = 6
+	typePubcomp     byte = 7
+	typeSubscribe   byte = 8
+	typeSuback      byte = 9
+	typeUnsubscribe byte = 10
+	typeUnsuback    byte = 11
+	typePingreq     byte = 12
+	typePingresp    byte = 13
+	typeDisconnect  byte = 14
+)
+
+//CONNACK return codes
+const (
+	connAccepted           byte = 0
+	connBadProtocol        byte = 1
+	connIdentifierRejected byte = 2
+	connBadCredentials     byte = 4
+	connNotAuthorized      byte = 5
+)
+
+//subscribeFailure is the SUBACK return code for a refused filter
+const subscribeFailure byte = 0x80
+
+//packet is one control packet, body is everything after the fixed header
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+//tooLarge is the error for a packet over the size limit, nothing
+// past its fixed header has been read so the connection is useless
+type tooLarge struct {
+	length int
+	limit  int
+}
+
+func (err tooLarge) Error() string {
+	return fmt.Sprintf("packet of %d bytes is over the limit of %d", err.length, err.limit)
+}
+
+//readPacket reads the next packet from reader, refusing
+// one longer than limit before allocating anything for it
+func readPacket(reader *bufio.Reader, limit int) (packet, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		if multiplier > 128*128*128 {
+			return packet{}, fmt.Errorf("malformed remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(digit&127) * multiplier
+		if digit&128 == 0 {
+			break
+		}
+	}
+	if length > limit {
+		return packet{}, tooLarge{length: length, limit: limit}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+//encode returns the packet ready to write, fixed header included
+func (p packet) encode() []byte {
+	encoded := []byte{p.kind<<4 | p.flags}
+	length := len(p.body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(encoded, p.body...)
+}
+
+//decoder reads the fields of a packet body in order, the first
+// field which runs past the end of the body sets err
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.fail()
+		return 0
+	}
+	value := d.body[0]
+	d.body = d.body[1:]
+	return value
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.fail()
+		return 0
+	}
+	value := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return value
+}
+
+func (d *decoder) bytes() []byte {
+	length := int(d.uint16())
+	if d.err != nil || len(d.body) < length {
+		d.fail()
+		return nil
+	}
+	value := d.body[:length]
+	d.body = d.body[length:]
+	return value
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("packet too short")
+	}
+}
+
+//encoder builds a packet body
+type encoder struct {
+	body []byte
+}
+
+func (e *encoder) uint16(value uint16) *encoder {
+	e.body = append(e.body, byte(value>>8), byte(value))
+	return e
+}
+
+func (e *encoder) string(value string) *encoder {
+	e.uint16(uint16(len(value)))
+	e.body = append(e.body, value...)
+	return e
+}
+
+//connect is a decoded CONNECT packet
+type connect struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	will         *message
+	username     string
+	password     string
+	hasUsername  bool
+}
+
+func decodeConnect(body []byte) (connect, error) {
+	d := &decoder{body: body}
+	var conn connect
+	conn.protocol = d.string()
+	conn.level = d.byte()
+	flags := d.byte()
+	conn.keepAlive = d.uint16()
+	conn.clientID = d.string()
+	conn.cleanSession = flags&0x02 != 0
+	if flags&0x04 != 0 {
+		conn.will = &message{
+			qos:    (flags >> 3) & 0x03,
+			retain: flags&0x20 != 0,
+		}
+		conn.will.topic = d.string()
+		conn.will.payload = append([]byte{}, d.bytes()...)
+	}
+	if flags&0x80 != 0 {
+		conn.hasUsername = true
+		conn.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		conn.password = d.string()
+	}
+	if d.err != nil {
+		return connect{}, d.err
+	}
+	if flags&0x01 != 0 {
+		return connect{}, fmt.Errorf("reserved connect flag set")
+	}
+	return conn, nil
+}
+
+//message is an application message being routed
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+//decodePublish returns the message and packet identifier of a PUBLISH
+func decodePublish(p packet) (message, uint16, error) {
+	msg := message{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+	}
+	if msg.qos > 2 {
+		return message{}, 0, fmt.Errorf("invalid QoS %d", msg.qos)
+	}
+	d := &decoder{body: p.body}
+	msg.topic = d.string()
+	var id uint16
+	if msg.qos > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil {
+		return message{}, 0, d.err
+	}
+	msg.payload = append([]byte{}, d.body...)
+	return msg, id, nil
+}
+
+//publishPacket encodes msg for delivery, id is only sent for QoS 1 and 2
+func publishPacket(msg message, id uint16, duplicate bool) packet {
+	flags := msg.qos << 1
+	if msg.retain {
+		flags |= 0x01
+	}
+	if duplicate {
+		flags |= 0x08
+	}
+	e := &encoder{}
+	e.string(msg.topic)
+	if msg.qos > 0 {
+		e.uint16(id)
+	}
+	e.body = append(e.body, msg.payload...)
+	return packet{kind: typePublish, flags: flags, body: e.body}
+}
+
+//ackPacket is a PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK
+func ackPacket(kind byte, id uint16) packet {
+	flags := byte(0)
+	if kind == typePubrel {
+		flags = 0x02
+	}
+	return packet{kind: kind, flags: flags, body: (&encoder{}).uint16(id).body}
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+//validateTopic checks a topic name messages are published to
+func validateTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	if strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("topic %q contains a wildcard", topic)
+	}
+	return nil
+}
+
+//validateFilter checks a topic filter, '+' must fill a whole level
+// and '#' a whole last level
+func validateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("topic filter is empty")
+	}
+	if strings.Contains(filter, "\x00") {
+		return fmt.Errorf("topic filter %q contains a null character", filter)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return fmt.Errorf("topic filter %q has # before the last level", filter)
+		case level != "+" && level != "#" && strings.ContainsAny(level, "+#"):
+			return fmt.Errorf("topic filter %q mixes a wildcard into a level", filter)
+		}
+	}
+	return nil
+}
+
+//matches reports whether topic matches filter. Wildcards
+// at the first level do not match topics starting with $.
+func matches(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+//covers reports whether every topic matching requested also matches
+// allowed, so a subscription to requested stays within allowed
+func covers(allowed string, requested string) bool {
+	allowedLevels := strings.Split(allowed, "/")
+	requestedLevels := strings.Split(requested, "/")
+	for i, level := range allowedLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(requestedLevels) {
+			return false
+		}
+		switch requestedLevels[i] {
+		case "#":
+			return false
+		case "+":
+			if level != "+" {
+				return false
+			}
+		default:
+			if level != "+" && level != requestedLevels[i] {
+				return false
+			}
+		}
+	}
+	return len(allowedLevels) == len(requestedLevels)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oskoss/mi-casa/certs"
+	log "github.com/sirupsen/logrus"
+)
+
+const certUsage = `usage:
+  micasa cert ca                        show the local CA, creating it if missing
+  micasa cert issue <name> [--out dir]  issue a client certificate for mutual TLS
+
+a client certificate logs in as the API token with the same name`
+
+//certCommand manages the local CA kept in the directory
+// named by api.tls, or tls when the API has no tls section
+func certCommand(opts *options, args []string) int {
+	flags := newFlagSet("cert", opts)
+	out := flags.String("out", ".", "directory to write the certificate and key to")
+	args, ok := commandArgs(flags, args, certUsage)
+	if !ok {
+		return exitUsage
+	}
+	if len(args) == 0 || (args[0] == "ca") != (len(args) == 1) || (args[0] != "ca" && args[0] != "issue") {
+		fmt.Fprintln(os.Stderr, certUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, err := loadConfig(opts)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	conf := certs.Config{}
+	if micasaConfig.API.TLS != nil {
+		conf = *micasaConfig.API.TLS
+	}
+	manager, err := certs.New(conf)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	authority, err := certs.OpenAuthority(manager.Config.Directory, time.Now())
+	if err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	caFile := filepath.Join(authority.Directory, certs.AuthorityFile)
+	if args[0] == "ca" {
+		output(opts, map[string]interface{}{
+			"file":        caFile,
+			"fingerprint": certs.Fingerprint(authority.Certificate),
+			"expires":     authority.Certificate.NotAfter,
+		}, func() {
+			fmt.Printf("%s\nSHA-256 %s\nexpires %s\n", caFile, certs.Fingerprint(authority.Certificate), authority.Certificate.NotAfter.Format(time.RFC3339))
+		})
+		return exitOK
+	}
+	name := args[1]
+	// an open API lets anyone in, certificate or not
+	authConfig := micasaConfig.API.Auth
+	if (len(authConfig.Tokens) > 0 || len(authConfig.Users) > 0) && !authConfig.HasToken(name) {
+		return failed(opts, exitNotFound, fmt.Errorf("no API token is named %s, add one to api.auth.tokens for the certificate to log in as", name))
+	}
+	certificate, err := authority.Issue(name, nil, time.Now())
+	if err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	certPEM, keyPEM, err := certs.EncodePair(certificate)
+	if err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	certFile, keyFile := filepath.Join(*out, name+".crt"), filepath.Join(*out, name+".key")
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	output(opts, map[string]interface{}{
+		"cert":    certFile,
+		"key":     keyFile,
+		"ca":      caFile,
+		"expires": certificate.Leaf.NotAfter,
+	}, func() {
+		fmt.Printf("%s and %s issued for %s until %s, the client should trust %s\n",
+			certFile, keyFile, name, certificate.Leaf.NotAfter.Format("2006-01-02"), caFile)
+	})
+	return exitOK
+}
@@ -0,0 +1,242 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	//AuthorityFile is the local CA certificate within the directory,
+	// which clients install to trust the API
+	AuthorityFile = "ca.crt"
+	authorityKey  = "ca.key"
+	//authorityValidity is how long the local CA lasts, clients
+	// would all have to trust a new one after it
+	authorityValidity = 10 * 365 * 24 * time.Hour
+	//validity is how long issued certificates last, within
+	// what browsers accept for a server certificate
+	validity = 397 * 24 * time.Hour
+	//renewBefore is how long before it expires a server
+	// certificate is issued again
+	renewBefore = 30 * 24 * time.Hour
+)
+
+//Authority is the local CA, created on first use, which signs the
+// generated server certificate and client certificates for devices
+type Authority struct {
+	Directory   string
+	Certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+//OpenAuthority loads the CA kept in directory, creating it
+// and the directory when there is none
+func OpenAuthority(directory string, now time.Time) (*Authority, error) {
+	authority := &Authority{Directory: directory}
+	certificate, err := readPair(filepath.Join(directory, AuthorityFile), filepath.Join(directory, authorityKey))
+	if err == nil {
+		authority.Certificate, authority.key = certificate.Leaf, certificate.PrivateKey.(*ecdsa.PrivateKey)
+		return authority, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("local CA in %s: %v", directory, err)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: strings.TrimSpace("mi-casa local CA " + hostname), Organization: []string{"mi-casa"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(authorityValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := sign(template, nil, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePair(filepath.Join(directory, AuthorityFile), filepath.Join(directory, authorityKey), der, key); err != nil {
+		return nil, err
+	}
+	authority.Certificate, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	authority.key = key
+	return authority, nil
+}
+
+//Pool is a pool holding only the local CA
+func (authority *Authority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(authority.Certificate)
+	return pool
+}
+
+//Issue signs a certificate for name, a server certificate valid for
+// hosts or, without any hosts, a client certificate
+func (authority *Authority) Issue(name string, hosts []string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"mi-casa"}},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) > 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	der, err := sign(template, authority.Certificate, &key.PublicKey, authority.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+//serverCertificate is the server certificate kept beside the CA,
+// issued again when it is missing, not signed by the CA, does not
+// name every host or is about to expire
+func (authority *Authority) serverCertificate(hosts []string, now time.Time) (tls.Certificate, error) {
+	certFile := filepath.Join(authority.Directory, "server.crt")
+	keyFile := filepath.Join(authority.Directory, "server.key")
+	certificate, err := readPair(certFile, keyFile)
+	if err == nil && authority.current(certificate.Leaf, hosts, now) {
+		return certificate, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return tls.Certificate{}, fmt.Errorf("server certificate in %s: %v", authority.Directory, err)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "mi-casa"
+	}
+	certificate, err = authority.Issue(hostname, hosts, now)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePair(certFile, keyFile, certificate.Certificate[0], certificate.PrivateKey.(*ecdsa.PrivateKey)); err != nil {
+		return tls.Certificate{}, err
+	}
+	return certificate, nil
+}
+
+//current is whether the server certificate leaf may still be used
+func (authority *Authority) current(leaf *x509.Certificate, hosts []string, now time.Time) bool {
+	if leaf.NotAfter.Sub(now) < renewBefore {
+		return false
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: authority.Pool(), CurrentTime: now}); err != nil {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+//Fingerprint is the SHA-256 of certificate, which a person can
+// compare before trusting it on a device
+func Fingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+//EncodePair is certificate and its key as PEM
+func EncodePair(certificate tls.Certificate) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	return certPEM, keyPEM, nil
+}
+
+func sign(template *x509.Certificate, parent *x509.Certificate, public *ecdsa.PublicKey, signer *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent = template
+	}
+	return x509.CreateCertificate(rand.Reader, template, parent, public, signer)
+}
+
+//readPair loads a certificate and key, a missing file
+// is reported so os.IsNotExist holds
+func readPair(certFile string, keyFile string) (tls.Certificate, error) {
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if _, ok := certificate.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		return tls.Certificate{}, fmt.Errorf("%s is not an ECDSA key", keyFile)
+	}
+	return certificate, nil
+}
+
+//writePair writes the certificate der and key as PEM, the key
+// readable only by its owner
+func writePair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	certPEM, keyPEM, err := EncodePair(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
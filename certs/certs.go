@@ -0,0 +1,166 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDirectory = "tls"
+
+//Clients is whether the API asks clients for a certificate
+type Clients string
+
+const (
+	//ClientsOptional verifies a certificate when a client sends one, so
+	// devices log in with theirs and browsers with a password or token
+	ClientsOptional Clients = "optional"
+	//ClientsRequired refuses any client without a certificate
+	ClientsRequired Clients = "required"
+)
+
+//Config is the tls section of the API config. Without Cert and Key a
+// local CA and a server certificate signed by it are generated in
+// Directory on first run, valid for localhost, this host and Hosts.
+// Clients turns on mutual TLS, client certificates are verified against
+// ClientCA or, when it is not set, the local CA.
+type Config struct {
+	Cert      string   `yaml:"cert,omitempty"`
+	Key       string   `yaml:"key,omitempty"`
+	Directory string   `yaml:"directory,omitempty"`
+	Hosts     []string `yaml:"hosts,omitempty"`
+	Clients   Clients  `yaml:"clients,omitempty"`
+	ClientCA  string   `yaml:"clientCA,omitempty"`
+}
+
+//Manager provides the certificates the API serves and verifies
+type Manager struct {
+	Config      Config
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	lock        sync.Mutex
+}
+
+//New checks conf and loads the certificates it names, nothing
+// is generated until TLSConfig
+func New(conf Config) (*Manager, error) {
+	if (conf.Cert == "") != (conf.Key == "") {
+		return nil, fmt.Errorf("tls cert and key must be set together")
+	}
+	switch conf.Clients {
+	case "", ClientsOptional, ClientsRequired:
+	default:
+		return nil, fmt.Errorf("tls clients %q is not %s or %s", conf.Clients, ClientsOptional, ClientsRequired)
+	}
+	if conf.Directory == "" {
+		conf.Directory = defaultDirectory
+	}
+	manager := &Manager{Config: conf}
+	if conf.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls cert: %v", err)
+		}
+		manager.certificate = &certificate
+	}
+	if conf.ClientCA != "" {
+		content, err := ioutil.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls clientCA: %v", err)
+		}
+		manager.clientCAs = x509.NewCertPool()
+		if !manager.clientCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("tls clientCA %s holds no PEM certificates", conf.ClientCA)
+		}
+	}
+	return manager, nil
+}
+
+//Generated is whether the server certificate comes from the local CA
+func (manager *Manager) Generated() bool {
+	return manager.Config.Cert == ""
+}
+
+//TLSConfig is the server side TLS for the API, creating the local
+// CA and server certificate when they are needed and missing. The
+// generated certificate is issued again as it nears expiry.
+func (manager *Manager) TLSConfig(now time.Time) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	var authority *Authority
+	if manager.Generated() || (manager.Config.Clients != "" && manager.clientCAs == nil) {
+		var err error
+		authority, err = OpenAuthority(manager.Config.Directory, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manager.Generated() {
+		hosts := manager.Hosts()
+		certificate, err := authority.serverCertificate(hosts, now)
+		if err != nil {
+			return nil, err
+		}
+		manager.certificate = &certificate
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return manager.current(authority, hosts, time.Now())
+		}
+	} else {
+		tlsConfig.Certificates = []tls.Certificate{*manager.certificate}
+	}
+	switch manager.Config.Clients {
+	case ClientsOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientsRequired:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if manager.Config.Clients != "" {
+		tlsConfig.ClientCAs = manager.clientCAs
+		if tlsConfig.ClientCAs == nil {
+			tlsConfig.ClientCAs = authority.Pool()
+		}
+	}
+	return tlsConfig, nil
+}
+
+//current is the generated server certificate, issued
+// again once it is within renewBefore of expiring
+func (manager *Manager) current(authority *Authority, hosts []string, now time.Time) (*tls.Certificate, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.certificate.Leaf.NotAfter.Sub(now) >= renewBefore {
+		return manager.certificate, nil
+	}
+	certificate, err := authority.serverCertificate(hosts, now)
+	if err != nil {
+		return nil, err
+	}
+	manager.certificate = &certificate
+	return manager.certificate, nil
+}
+
+//Hosts are the names the generated server certificate is valid
+// for, the loopback addresses, this host on the LAN and Config.Hosts
+func (manager *Manager) Hosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+		if net.ParseIP(hostname) == nil && !strings.Contains(hostname, ".") {
+			hosts = append(hosts, hostname+".local")
+		}
+	}
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, host := range append(hosts, manager.Config.Hosts...) {
+		if !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,140 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/certs"
+)
+
+var _ = Describe("Certs", func() {
+	var (
+		directory string
+		now       time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "certs")
+		Expect(err).ShouldNot(HaveOccurred())
+		now = time.Now()
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	Describe("the local CA", func() {
+		It("should be created once and kept", func() {
+			authority, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(authority.Certificate.IsCA).To(BeTrue())
+			info, err := os.Stat(filepath.Join(directory, "ca.key"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+			again, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(Fingerprint(again.Certificate)).To(Equal(Fingerprint(authority.Certificate)))
+		})
+		It("should issue client certificates it verifies", func() {
+			authority, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			certificate, err := authority.Issue("tablet", nil, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(certificate.Leaf.Subject.CommonName).To(Equal("tablet"))
+			_, err = certificate.Leaf.Verify(x509.VerifyOptions{
+				Roots:     authority.Pool(),
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+	Describe("the server certificate", func() {
+		served := func(manager *Manager, at time.Time) *x509.Certificate {
+			tlsConfig, err := manager.TLSConfig(at)
+			Expect(err).ShouldNot(HaveOccurred())
+			certificate, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+			Expect(err).ShouldNot(HaveOccurred())
+			return certificate.Leaf
+		}
+		It("should be generated for this host and the hosts configured", func() {
+			manager, err := New(Config{Directory: directory, Hosts: []string{"micasa.example.com", "192.168.1.5"}})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(manager.Generated()).To(BeTrue())
+			leaf := served(manager, now)
+			for _, host := range []string{"localhost", "127.0.0.1", "micasa.example.com", "192.168.1.5"} {
+				Expect(leaf.VerifyHostname(host)).To(Succeed())
+			}
+			authority, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = leaf.Verify(x509.VerifyOptions{Roots: authority.Pool(), DNSName: "micasa.example.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should be kept across restarts", func() {
+			manager, err := New(Config{Directory: directory})
+			Expect(err).ShouldNot(HaveOccurred())
+			first := served(manager, now)
+			restarted, err := New(Config{Directory: directory})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(served(restarted, now.Add(time.Hour)).SerialNumber).To(Equal(first.SerialNumber))
+		})
+		It("should be issued again for a new host or near expiry", func() {
+			manager, err := New(Config{Directory: directory})
+			Expect(err).ShouldNot(HaveOccurred())
+			first := served(manager, now)
+			moved, err := New(Config{Directory: directory, Hosts: []string{"micasa.example.com"}})
+			Expect(err).ShouldNot(HaveOccurred())
+			second := served(moved, now)
+			Expect(second.SerialNumber).NotTo(Equal(first.SerialNumber))
+			later, err := New(Config{Directory: directory, Hosts: []string{"micasa.example.com"}})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(served(later, second.NotAfter.Add(-24*time.Hour)).SerialNumber).NotTo(Equal(second.SerialNumber))
+		})
+	})
+	Describe("mutual TLS", func() {
+		It("should verify clients against the local CA", func() {
+			manager, err := New(Config{Directory: directory, Clients: ClientsRequired})
+			Expect(err).ShouldNot(HaveOccurred())
+			tlsConfig, err := manager.TLSConfig(now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(tlsConfig.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+			authority, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(tlsConfig.ClientCAs.Subjects()).To(Equal(authority.Pool().Subjects()))
+		})
+	})
+	Describe("checking the config", func() {
+		It("should refuse a cert without its key", func() {
+			_, err := New(Config{Cert: "server.crt"})
+			Expect(err).To(MatchError(ContainSubstring("set together")))
+		})
+		It("should refuse an unknown client mode", func() {
+			_, err := New(Config{Clients: "sometimes"})
+			Expect(err).To(MatchError(ContainSubstring(`clients "sometimes"`)))
+		})
+		It("should serve a certificate it is given", func() {
+			authority, err := OpenAuthority(directory, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			certificate, err := authority.Issue("micasa", []string{"micasa.example.com"}, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			certPEM, keyPEM, err := EncodePair(certificate)
+			Expect(err).ShouldNot(HaveOccurred())
+			certFile, keyFile := filepath.Join(directory, "given.crt"), filepath.Join(directory, "given.key")
+			Expect(ioutil.WriteFile(certFile, certPEM, 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+			manager, err := New(Config{Cert: certFile, Key: keyFile, Directory: filepath.Join(directory, "unused")})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(manager.Generated()).To(BeFalse())
+			tlsConfig, err := manager.TLSConfig(now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(tlsConfig.Certificates).To(HaveLen(1))
+			_, err = os.Stat(filepath.Join(directory, "unused"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/home"
+	log "github.com/sirupsen/logrus"
+)
+
+//Exit codes, scripts can tell a typo from a device which is down
+const (
+	exitOK = 0
+	//exitFailure is a device or command which failed
+	exitFailure = 1
+	//exitUsage is a command line which could not be understood
+	exitUsage = 2
+	//exitConfig is a config which could not be read or is invalid
+	exitConfig = 3
+	//exitNotFound is a device or scene which is not configured
+	exitNotFound = 4
+)
+
+const usage = `usage: micasa [--config file|url] [--set path=value]... [--json] <command>
+
+commands:
+  serve                                  run the controllers, bridges and API
+  devices list                           list the configured devices
+  switch <name> on|off|status            drive or read a switch
+  thermostat <name> read [--watch]       read a thermostat
+  config validate                        check the config without starting anything
+  config show --effective                show every setting and where it came from
+  discover [--subnet cidr]               find devices on the network
+  scene list|capture|apply|delete        manage scenes
+  secret list|set|delete                 manage the keystore of secrets
+  cert ca|issue                          manage the local CA of the API
+  audit [--since 24h] [--target name]    show who changed what and why
+  notify test [--sink name]              send a test notification
+
+flags:
+  --config file|url
+                  config to read (default config.yaml), in YAML, JSON or
+                  TOML by its extension, or fetched over HTTP. Fragments in
+                  conf.d beside a file are laid over it in name order
+  --set path=value
+                  override a setting, e.g. --set hvac.setpoint=70 or
+                  --set tasmotaT1Devices[blower].uri=http://closet.local
+  --json          write results as JSON
+  --verbose       log what the devices are doing
+
+environment:
+  MICASA_<KEY>__<KEY>...   override a setting, after conf.d and before --set.
+                           Keys match regardless of case, a list entry is
+                           picked by index or by name, e.g. MICASA_HVAC__SETPOINT=70
+                           or MICASA_TASMOTAT1DEVICES__BLOWER__URI=http://closet.local
+  MICASA_KEYSTORE_PASSPHRASE
+                           unlocks the keystore when the config sets no passphrase`
+
+//options are the flags every command takes
+type options struct {
+	config  string
+	sets    overrides
+	json    bool
+	verbose bool
+}
+
+//overrides are every --set given, in order
+type overrides []string
+
+func (sets *overrides) String() string {
+	return strings.Join(*sets, ",")
+}
+
+func (sets *overrides) Set(value string) error {
+	*sets = append(*sets, value)
+	return nil
+}
+
+//newFlagSet registers the common flags onto a new flag set,
+// defaulting to whatever was given before the command
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&opts.config, "config", opts.config, "config file or URL to read")
+	flags.Var(&opts.sets, "set", "override a setting, as path=value")
+	flags.BoolVar(&opts.json, "json", opts.json, "write results as JSON")
+	flags.BoolVar(&opts.verbose, "verbose", opts.verbose, "log what the devices are doing")
+	return flags
+}
+
+//parseArgs parses flags wherever they are among args,
+// returning the arguments which are not flags
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func run(args []string) int {
+	opts := &options{config: "config.yaml"}
+	flags := newFlagSet("micasa", opts)
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exitUsage
+	}
+	command, args := flags.Arg(0), flags.Args()[1:]
+	commands := map[string]func(*options, []string) int{
+		"serve":      serveCommand,
+		"devices":    devicesCommand,
+		"switch":     switchCommand,
+		"thermostat": thermostatCommand,
+		"config":     configCommand,
+		"discover":   discoverCommand,
+		"scene":      sceneCommand,
+		"secret":     secretCommand,
+		"cert":       certCommand,
+		"audit":      auditCommand,
+		"notify":     notifyCommand,
+	}
+	if command == "help" {
+		fmt.Println(usage)
+		return exitOK
+	}
+	handler, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "micasa: unknown command %s\n%s\n", command, usage)
+		return exitUsage
+	}
+	return handler(opts, args)
+}
+
+//commandArgs parses the flags of a command, reporting a bad flag
+// with the command usage
+func commandArgs(flags *flag.FlagSet, args []string, commandUsage string) ([]string, bool) {
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "micasa: %v\n%s\n", err, commandUsage)
+		return nil, false
+	}
+	return positional, true
+}
+
+//flagsOnly is for commands taking nothing but flags
+func flagsOnly(flags *flag.FlagSet, args []string, commandUsage string) bool {
+	positional, ok := commandArgs(flags, args, commandUsage)
+	if ok && len(positional) > 0 {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return false
+	}
+	return ok
+}
+
+//setLogLevel logs at level, or everything with --verbose
+func setLogLevel(opts *options, level log.Level) {
+	if opts.verbose {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+}
+
+//layers is the config named by --config, with its conf.d fragments,
+// the MICASA_ environment and every --set laid over it
+func layers(opts *options) *config.Layered {
+	return &config.Layered{
+		FileLocation: opts.config,
+		Environment:  os.Environ(),
+		Overrides:    opts.sets,
+	}
+}
+
+//loadConfig reads the config named by --config
+func loadConfig(opts *options) (*config.CasaConfig, error) {
+	configFile := layers(opts)
+	micasaConfig, err := configFile.GetAllFields()
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %v", config.RedactURL(opts.config), err)
+	}
+	return micasaConfig, nil
+}
+
+//loadHome reads the config and builds its devices without connecting
+func loadHome(opts *options) (*config.CasaConfig, *home.Home, int) {
+	micasaConfig, err := loadConfig(opts)
+	if err != nil {
+		return nil, nil, failed(opts, exitConfig, err)
+	}
+	myHome, err := home.New(micasaConfig)
+	if err != nil {
+		return nil, nil, failed(opts, exitConfig, err)
+	}
+	return micasaConfig, myHome, exitOK
+}
+
+//audited records a change a command made, as the user running it,
+// to the audit log of the config. err is why it failed, otherwise
+// read is what the change came to.
+func audited(micasaConfig *config.CasaConfig, action string, target string, requested string, err error, read func() (string, error)) {
+	actor := os.Getenv("USER")
+	if current, lookupErr := user.Current(); lookupErr == nil {
+		actor = current.Username
+	}
+	entry := audit.Command(audit.SourceCLI, actor, action, target, requested, err, read)
+	trail := audit.Open(micasaConfig.Audit)
+	trail.Record(entry)
+	trail.Close()
+}
+
+//known is the read back of a change whose result is known already
+func known(result string) func() (string, error) {
+	return func() (string, error) {
+		return result, nil
+	}
+}
+
+//output writes result as JSON with --json, otherwise text writes it
+func output(opts *options, result interface{}, text func()) {
+	if !opts.json {
+		text()
+		return
+	}
+	// one document per line, so watching can be piped line by line
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "micasa: %v\n", err)
+	}
+}
+
+//failed reports err on stderr, as JSON too with --json so
+// scripts reading stdout see why, and returns code
+func failed(opts *options, code int, err error) int {
+	fmt.Fprintf(os.Stderr, "micasa: %v\n", err)
+	if opts.json {
+		output(opts, map[string]string{"error": err.Error()}, func() {})
+	}
+	return code
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/certs"
+)
+
+//validate checks the settings of a decoded config make sense, the
+// schema has already checked their keys and types
+func (doc *Document) validate(casaConfig *CasaConfig) {
+	names := map[string]string{}
+	name := func(path string, value string) {
+		if value == "" {
+			doc.required(path, "name")
+			return
+		}
+		if first, ok := names[value]; ok {
+			doc.problem(path+".name", "device name %s is already used by %s", value, first)
+			return
+		}
+		names[value] = path
+	}
+	for i := range casaConfig.DysonHotCoolLink {
+		device := &casaConfig.DysonHotCoolLink[i]
+		path := fmt.Sprintf("dysonHotCoolLinkDevices[%d]", i)
+		name(path, device.Name)
+		if device.IP == "" {
+			doc.required(path, "ip")
+		} else if net.ParseIP(device.IP) == nil {
+			doc.problem(path+".ip", "%q is not an IP address", device.IP)
+		}
+		if device.Port != "" {
+			if port, err := strconv.Atoi(device.Port); err != nil || port < 1 || port > 65535 {
+				doc.problem(path+".port", "%q is not a port between 1 and 65535", device.Port)
+			}
+		}
+		for _, field := range []struct{ key, value string }{
+			{"serialNumber", device.Serial},
+			{"dysonAPIEmail", device.DysonAPIEmail},
+			{"dysonAPIPassword", device.DysonAPIPassword.Reveal()},
+		} {
+			if field.value == "" {
+				doc.required(path, field.key)
+			}
+		}
+	}
+	for i := range casaConfig.TasmotaT1 {
+		device := &casaConfig.TasmotaT1[i]
+		path := fmt.Sprintf("tasmotaT1Devices[%d]", i)
+		name(path, device.Name)
+		if device.URI == "" {
+			doc.required(path, "uri")
+		} else if uri, err := url.Parse(device.URI); err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+			doc.problem(path+".uri", "%q is not an http or https URI", device.URI)
+		}
+		if device.SwitchNumber < 1 || device.SwitchNumber > 3 {
+			if doc.at(path+".switchNumber") == nil {
+				doc.required(path, "switchNumber")
+			} else {
+				doc.problem(path+".switchNumber", "%d is not a switch, a T1 has switches 1 to 3", device.SwitchNumber)
+			}
+		}
+		if device.UpdateWindow < 0 {
+			doc.problem(path+".updateWindow", "must not be negative")
+		}
+	}
+	if casaConfig.API.Address != "" {
+		if _, port, err := net.SplitHostPort(casaConfig.API.Address); err != nil || port == "" {
+			doc.problem("api.address", "%q must be host:port, e.g. :8080", casaConfig.API.Address)
+		}
+	}
+	if casaConfig.HVAC != nil && len(casaConfig.Zones) > 0 {
+		doc.problem("zones", "configure either hvac or zones, not both")
+	}
+	doc.validateTLS(casaConfig.API.TLS)
+	doc.validateAuth(casaConfig, names)
+	doc.validateNotify(casaConfig, names)
+}
+
+//validateTLS checks the API is given both a certificate and its key or
+// neither, and asks clients for certificates in a way it knows
+func (doc *Document) validateTLS(conf *certs.Config) {
+	if conf == nil {
+		return
+	}
+	if conf.Cert != "" && conf.Key == "" {
+		doc.required("api.tls", "key")
+	}
+	if conf.Key != "" && conf.Cert == "" {
+		doc.required("api.tls", "cert")
+	}
+	switch conf.Clients {
+	case "", certs.ClientsOptional, certs.ClientsRequired:
+	default:
+		doc.problem("api.tls.clients", "%q is not %s or %s", conf.Clients, certs.ClientsOptional, certs.ClientsRequired)
+	}
+}
+
+//validateAuth checks every API token and user has a name, a secret and
+// a known role, and is scoped to devices and zones which exist
+func (doc *Document) validateAuth(casaConfig *CasaConfig, devices map[string]string) {
+	zones := zoneNames(casaConfig)
+	names := map[string]string{}
+	check := func(path string, key string, name string, role auth.Role, scope auth.Scope) {
+		if name == "" {
+			doc.required(path, key)
+		} else if first, ok := names[name]; ok {
+			doc.problem(path+"."+key, "%s is already used by %s", name, first)
+		} else {
+			names[name] = path
+		}
+		if role == "" {
+			doc.required(path, "role")
+		} else if !role.Valid() {
+			doc.problem(path+".role", "%q is not a role, use one of %v", role, auth.Roles)
+		}
+		for i, device := range scope.Devices {
+			if _, ok := devices[device]; !ok {
+				doc.problem(fmt.Sprintf("%s.devices[%d]", path, i), "no device is named %s", device)
+			}
+		}
+		for i, zone := range scope.Zones {
+			if !zones[zone] {
+				doc.problem(fmt.Sprintf("%s.zones[%d]", path, i), "no zone is named %s", zone)
+			}
+		}
+	}
+	conf := casaConfig.API.Auth
+	for i, token := range conf.Tokens {
+		path := fmt.Sprintf("api.auth.tokens[%d]", i)
+		check(path, "name", token.Name, token.Role, token.Scope)
+		// with mutual TLS a token may be for a client certificate alone
+		if token.Token == "" && (casaConfig.API.TLS == nil || casaConfig.API.TLS.Clients == "") {
+			doc.required(path, "token")
+		}
+	}
+	for i, user := range conf.Users {
+		path := fmt.Sprintf("api.auth.users[%d]", i)
+		check(path, "username", user.Username, user.Role, user.Scope)
+		if user.Password == "" {
+			doc.required(path, "password")
+		}
+	}
+	if conf.WritesPerMinute < 0 {
+		doc.problem("api.auth.writesPerMinute", "must not be negative")
+	}
+}
+
+//zoneNames are the names the HVAC controller or zones go by
+func zoneNames(casaConfig *CasaConfig) map[string]bool {
+	zones := map[string]bool{}
+	if casaConfig.HVAC != nil {
+		name := casaConfig.HVAC.Name
+		if name == "" {
+			name = "hvac"
+		}
+		zones[name] = true
+	}
+	for _, zone := range casaConfig.Zones {
+		zones[zone.Name] = true
+	}
+	return zones
+}
+
+//validateNotify checks every alert has a name and is
+// limited to devices, or zones, which exist
+func (doc *Document) validateNotify(casaConfig *CasaConfig, devices map[string]string) {
+	if casaConfig.Notify == nil {
+		return
+	}
+	zones := zoneNames(casaConfig)
+	for i, sink := range casaConfig.Notify.Sinks {
+		if sink.Name == "" {
+			doc.required(fmt.Sprintf("notify.sinks[%d]", i), "name")
+		}
+	}
+	for i, alert := range casaConfig.Notify.Alerts {
+		path := fmt.Sprintf("notify.alerts[%d]", i)
+		if alert.Name == "" {
+			doc.required(path, "name")
+		}
+		for j, device := range alert.Devices {
+			if alert.HVACRunning != 0 {
+				if !zones[device] {
+					doc.problem(fmt.Sprintf("%s.devices[%d]", path, j), "no zone is named %s", device)
+				}
+			} else if _, ok := devices[device]; !ok {
+				doc.problem(fmt.Sprintf("%s.devices[%d]", path, j), "no device is named %s", device)
+			}
+		}
+	}
+}
+
+//problem reports a setting found in the file
+func (doc *Document) problem(path string, format string, args ...interface{}) {
+	if _, ok := doc.invalid[path]; ok {
+		// already reported as the wrong type
+		return
+	}
+	node := doc.at(path)
+	if key, ok := doc.keys[path]; ok {
+		node = key
+	}
+	if node == nil {
+		doc.Report(path, fmt.Errorf(format, args...))
+		return
+	}
+	doc.add(node, path, format, args...)
+}
+
+//required reports key missing from the mapping at path
+func (doc *Document) required(path string, key string) {
+	if _, ok := doc.invalid[path+"."+key]; ok {
+		return
+	}
+	if node := doc.at(path); node != nil {
+		doc.add(node, path, "%s is required", key)
+		return
+	}
+	doc.Report(path, fmt.Errorf("%s is required", key))
+}
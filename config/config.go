@@ -1,12 +1,63 @@
 package config
 
-import "github.com/oskoss/mi-casa/thermostat"
+import (
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/broker"
+	"github.com/oskoss/mi-casa/certs"
+	"github.com/oskoss/mi-casa/history"
+	"github.com/oskoss/mi-casa/homeassistant"
+	"github.com/oskoss/mi-casa/homekit"
+	"github.com/oskoss/mi-casa/hue"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/notify"
+	"github.com/oskoss/mi-casa/rules"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/secret"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
 
+//Configurator is somewhere a config is read from
 type Configurator interface {
-	GetAllFields() (config CasaConfig, err error)
+	//GetAllFields fails with every Problem found unless
+	// the config is entirely valid
+	GetAllFields() (*CasaConfig, error)
+	//Read checks the config, err is only set when it cannot be read
+	Read() (*Document, error)
 }
 
+var (
+	_ Configurator = &YamlConfig{}
+	_ Configurator = &JSONConfig{}
+	_ Configurator = &TOMLConfig{}
+	_ Configurator = &HTTPConfig{}
+	_ Configurator = &Layered{}
+)
+
 type CasaConfig struct {
 	Name             string                        `yaml:"name"`
 	DysonHotCoolLink []thermostat.DysonHotCoolLink `yaml:"dysonHotCoolLinkDevices"`
+	TasmotaT1        []switcher.TasmotaT1          `yaml:"tasmotaT1Devices"`
+	HVAC             *hvac.Config                  `yaml:"hvac,omitempty"`
+	Zones            []hvac.Config                 `yaml:"zones,omitempty"`
+	Automation       rules.Config                  `yaml:"automation"`
+	Scenes           []scene.Scene                 `yaml:"scenes"`
+	ScenesFile       string                        `yaml:"scenesFile"`
+	API              APIConfig                     `yaml:"api"`
+	History          history.Config                `yaml:"history"`
+	StateFile        string                        `yaml:"stateFile"`
+	HomeAssistant    homeassistant.Config          `yaml:"homeAssistant"`
+	Broker           *broker.Config                `yaml:"broker,omitempty"`
+	HomeKit          *homekit.Config               `yaml:"homeKit,omitempty"`
+	Hue              *hue.Config                   `yaml:"hue,omitempty"`
+	Keystore         secret.Config                 `yaml:"keystore"`
+	Audit            audit.Config                  `yaml:"audit"`
+	Notify           *notify.Config                `yaml:"notify,omitempty"`
+}
+
+type APIConfig struct {
+	Address string        `yaml:"address"`
+	TLS     *certs.Config `yaml:"tls,omitempty"`
+	Auth    auth.Config   `yaml:"auth,omitempty"`
 }
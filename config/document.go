@@ -0,0 +1,470 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/secret"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+//Problem is something wrong with the config, Line and Column are
+// where in the file it is and Path the setting, e.g. hvac.setpoint.
+// Source is the file, environment variable or flag of a layered config.
+type Problem struct {
+	Source  string `json:"source,omitempty"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (problem Problem) Error() string {
+	message := problem.Message
+	if problem.Path != "" {
+		message = problem.Path + ": " + message
+	}
+	if problem.Line > 0 {
+		message = fmt.Sprintf("line %d, column %d: %s", problem.Line, problem.Column, message)
+	}
+	if problem.Source != "" {
+		message = problem.Source + ": " + message
+	}
+	return message
+}
+
+//Problems are every problem found within a config, in file order
+type Problems []Problem
+
+func (problems Problems) Error() string {
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+//Setting is a value set within the config and where it was set,
+// secrets show as their reference or redacted
+type Setting struct {
+	Path   string `json:"path"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+//Document is a config file read strictly, Config is nil
+// when the file could not be decoded at all
+type Document struct {
+	Config   *CasaConfig
+	Problems Problems
+	keys     map[string]*yaml.Node
+	values   map[string]*yaml.Node
+	// settings with the wrong type, decoded as if unset
+	invalid  map[string]*yaml.Node
+	settings []Setting
+	// where each node of a layered config came from, by source order
+	sources map[*yaml.Node]string
+	order   map[string]int
+}
+
+var (
+	durationType    = reflect.TypeOf(time.Duration(0))
+	unmarshalerType = reflect.TypeOf((*yamlv2.Unmarshaler)(nil)).Elem()
+	// yaml.v3 errors only give the line
+	errorLine = regexp.MustCompile(`line (\d+): `)
+)
+
+func newDocument() *Document {
+	return &Document{
+		keys:    map[string]*yaml.Node{},
+		values:  map[string]*yaml.Node{},
+		invalid: map[string]*yaml.Node{},
+		sources: map[*yaml.Node]string{},
+		order:   map[string]int{},
+	}
+}
+
+//Parse decodes content into a CasaConfig, checking every key is known,
+// every value has the right type and the settings make sense
+func Parse(content []byte) *Document {
+	doc := newDocument()
+	root, ok := doc.parseSource("", content)
+	if !ok {
+		return doc
+	}
+	doc.decode(root)
+	return doc
+}
+
+//parseSource parses the content of source, recording where each of its
+// nodes came from, root is nil for an empty source
+func (doc *Document) parseSource(source string, content []byte) (*yaml.Node, bool) {
+	doc.order[source] = len(doc.order)
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		problem := problemFromError(err)
+		problem.Source = source
+		doc.Problems = append(doc.Problems, problem)
+		return nil, false
+	}
+	if len(root.Content) == 0 {
+		return nil, true
+	}
+	doc.from(source, root.Content[0])
+	return root.Content[0], true
+}
+
+//from records every node under node as coming from source
+func (doc *Document) from(source string, node *yaml.Node) {
+	if source == "" {
+		return
+	}
+	doc.sources[node] = source
+	for _, child := range node.Content {
+		doc.from(source, child)
+	}
+}
+
+//decode checks root against the schema and decodes it
+func (doc *Document) decode(root *yaml.Node) {
+	defer doc.sort()
+	if root == nil {
+		doc.Config = &CasaConfig{}
+		doc.validate(doc.Config)
+		return
+	}
+	doc.check(root, reflect.TypeOf(CasaConfig{}), "")
+	// so one mistyped setting does not hide every other problem
+	for _, node := range doc.invalid {
+		*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: node.Line, Column: node.Column}
+	}
+	content, err := yaml.Marshal(root)
+	if err != nil {
+		doc.Problems = append(doc.Problems, problemFromError(err))
+		return
+	}
+	var casaConfig CasaConfig
+	if err := yamlv2.Unmarshal(content, &casaConfig); err != nil {
+		// anything the schema missed, type errors are already reported
+		if len(doc.Problems) == 0 {
+			doc.Problems = append(doc.Problems, problemFromError(err))
+		}
+		return
+	}
+	doc.Config = &casaConfig
+	doc.validate(&casaConfig)
+	doc.resolveSecrets(&casaConfig)
+}
+
+//Settings are every value set within the config, in the order read
+func (doc *Document) Settings() []Setting {
+	return doc.settings
+}
+
+func problemFromError(err error) Problem {
+	problem := Problem{Line: 1, Column: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+	if match := errorLine.FindStringSubmatch(err.Error()); match != nil {
+		problem.Line, _ = strconv.Atoi(match[1])
+		problem.Message = strings.Replace(problem.Message, match[0], "", 1)
+	}
+	return problem
+}
+
+func (doc *Document) sort() {
+	sort.SliceStable(doc.Problems, func(i, j int) bool {
+		a, b := doc.Problems[i], doc.Problems[j]
+		if a.Source != b.Source {
+			return doc.order[a.Source] < doc.order[b.Source]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+//mistyped reports the value at path, which cannot be decoded
+func (doc *Document) mistyped(node *yaml.Node, path string, format string, args ...interface{}) {
+	doc.invalid[path] = node
+	doc.add(node, path, format, args...)
+}
+
+func (doc *Document) add(node *yaml.Node, path string, format string, args ...interface{}) {
+	doc.Problems = append(doc.Problems, Problem{
+		Source:  doc.sources[node],
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+//Report adds err as a problem with the setting at path, placed at the
+// closest setting to it found in the file
+func (doc *Document) Report(path string, err error) {
+	for search := path; ; {
+		if node, ok := doc.values[search]; ok {
+			if key, ok := doc.keys[search]; ok {
+				node = key
+			}
+			doc.add(node, path, "%v", err)
+			doc.sort()
+			return
+		}
+		i := strings.LastIndexAny(search, ".[")
+		if i < 0 {
+			break
+		}
+		search = search[:i]
+	}
+	doc.Problems = append(doc.Problems, Problem{Line: 1, Column: 1, Path: path, Message: err.Error()})
+	doc.sort()
+}
+
+//at is the value node of the setting at path, nil when not in the file
+func (doc *Document) at(path string) *yaml.Node {
+	return doc.values[path]
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+//check walks node alongside the Go type it decodes into,
+// reporting unknown or repeated keys and mistyped values
+func (doc *Document) check(node *yaml.Node, t reflect.Type, path string) {
+	doc.values[path] = node
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	if t.Implements(unmarshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.ScalarNode {
+		doc.setting(node, t, path)
+	}
+	if t == durationType {
+		if node.Kind != yaml.ScalarNode {
+			doc.mistyped(node, path, "must be a duration such as 30s")
+		} else if _, err := time.ParseDuration(node.Value); err != nil {
+			if _, err := strconv.ParseInt(node.Value, 10, 64); err != nil {
+				doc.mistyped(node, path, "%q is not a duration such as 30s", node.Value)
+			}
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			doc.mistyped(node, path, "must be a mapping of settings")
+			return
+		}
+		fields := yamlFields(t)
+		doc.checkMapping(node, path, func(key *yaml.Node, value *yaml.Node, keyPath string) {
+			field, ok := fields[key.Value]
+			if !ok {
+				doc.add(key, path, "unknown field %s%s", key.Value, suggest(key.Value, fields))
+				return
+			}
+			doc.check(value, field, keyPath)
+		})
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			doc.mistyped(node, path, "must be a mapping")
+			return
+		}
+		doc.checkMapping(node, path, func(key *yaml.Node, value *yaml.Node, keyPath string) {
+			doc.check(value, t.Elem(), keyPath)
+		})
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			doc.mistyped(node, path, "must be a list")
+			return
+		}
+		for i, item := range node.Content {
+			doc.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Interface:
+	default:
+		if node.Kind != yaml.ScalarNode {
+			doc.mistyped(node, path, "must be a single value")
+			return
+		}
+		doc.checkScalar(node, t, path)
+	}
+}
+
+//setting records the value of node as set at path
+func (doc *Document) setting(node *yaml.Node, t reflect.Type, path string) {
+	value := node.Value
+	if _, _, ok := secret.Reference(secret.String(value)); t == secretType && !ok {
+		value = secret.String(value).String()
+	}
+	doc.settings = append(doc.settings, Setting{
+		Path:   path,
+		Value:  value,
+		Source: doc.sources[node],
+		Line:   node.Line,
+		Column: node.Column,
+	})
+}
+
+func (doc *Document) checkMapping(node *yaml.Node, path string, each func(key *yaml.Node, value *yaml.Node, keyPath string)) {
+	seen := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if first, ok := seen[key.Value]; ok {
+			doc.add(key, join(path, key.Value), "set more than once, first at line %d", first.Line)
+			continue
+		}
+		seen[key.Value] = key
+		keyPath := join(path, key.Value)
+		doc.keys[keyPath] = key
+		each(key, value, keyPath)
+	}
+}
+
+func (doc *Document) checkScalar(node *yaml.Node, t reflect.Type, path string) {
+	var err error
+	switch t.Kind() {
+	case reflect.Bool:
+		var value bool
+		err = yamlv2.Unmarshal([]byte(node.Value), &value)
+		if err != nil || node.Tag != "!!bool" {
+			doc.mistyped(node, path, "%q must be true or false", node.Value)
+		}
+		return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, err = strconv.ParseInt(node.Value, 0, t.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, err = strconv.ParseUint(node.Value, 0, t.Bits())
+	case reflect.Float32, reflect.Float64:
+		_, err = strconv.ParseFloat(node.Value, t.Bits())
+	default:
+		// yaml decodes any single value into a string
+		return
+	}
+	if err != nil {
+		doc.mistyped(node, path, "%q must be a %s number", node.Value, numberKind(t))
+	}
+}
+
+func numberKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "decimal"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "positive whole"
+	}
+	return "whole"
+}
+
+//yamlFields maps the keys of t to the types of its fields, by the
+// same rules the yaml package decodes with
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, ok := yamlName(field)
+		switch {
+		case !ok:
+		case inline:
+			for key, inlined := range yamlFields(field.Type) {
+				fields[key] = inlined
+			}
+		default:
+			fields[name] = field.Type
+		}
+	}
+	return fields
+}
+
+//yamlName is the key of field, ok is false for fields
+// which are never decoded
+func yamlName(field reflect.StructField) (name string, inline bool, ok bool) {
+	if field.PkgPath != "" {
+		return "", false, false
+	}
+	tag := field.Tag.Get("yaml")
+	name = strings.Split(tag, ",")[0]
+	if name == "-" {
+		return "", false, false
+	}
+	if strings.Contains(tag, ",inline") {
+		return "", true, true
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, false, true
+}
+
+//suggest names the known key closest to an unknown one, catching
+// the likes of dysonApiEmail for dysonAPIEmail or switch for switchNumber
+func suggest(key string, fields map[string]reflect.Type) string {
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if strings.EqualFold(name, key) || strings.HasPrefix(strings.ToLower(name), strings.ToLower(key)) {
+			return fmt.Sprintf(", did you mean %s?", name)
+		}
+		if distance := editDistance(strings.ToLower(name), strings.ToLower(key)); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
@@ -0,0 +1,235 @@
+package config_test
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/certs"
+	. "github.com/oskoss/mi-casa/config"
+)
+
+var _ = Describe("Document", func() {
+	Describe("Parsing", func() {
+		Context("with a valid config", func() {
+			It("should decode it without problems", func() {
+				doc := Parse([]byte(`name: myCasa
+tasmotaT1Devices:
+  - name: blower
+    uri: http://office-closet.local
+    switchNumber: 3
+    updateWindow: 30s
+api:
+  address: :8080
+`))
+				Expect(doc.Problems).To(BeEmpty())
+				Expect(doc.Config.TasmotaT1[0].UpdateWindow).To(Equal(30 * time.Second))
+				Expect(doc.Config.API.Address).To(Equal(":8080"))
+			})
+		})
+		Context("with a mistyped key", func() {
+			It("should report it where it is and suggest the right one", func() {
+				doc := Parse([]byte(`name: myCasa
+dysonHotCoolLinkDevices:
+  - name: living
+    ip: 10.0.0.5
+    serialNumber: ABC-123
+    dysonApiEmail: me@example.com
+    dysonAPIPassword: secret
+`))
+				Expect(doc.Problems).To(HaveLen(2))
+				Expect(doc.Problems[0]).To(Equal(Problem{Line: 3, Column: 5, Path: "dysonHotCoolLinkDevices[0]", Message: "dysonAPIEmail is required"}))
+				Expect(doc.Problems[1]).To(Equal(Problem{Line: 6, Column: 5, Path: "dysonHotCoolLinkDevices[0]", Message: "unknown field dysonApiEmail, did you mean dysonAPIEmail?"}))
+			})
+		})
+		Context("with many problems", func() {
+			It("should report every one of them in file order", func() {
+				doc := Parse([]byte(`name: myCasa
+name: again
+tasmotaT1Devices:
+  - name: blower
+    uri: office-closet.local
+    switchNumber: 4
+    updateWindow: soon
+  - name: blower
+    uri: http://garage.local
+    switchNumber: two
+api:
+  address: nowhere
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 2, Column: 1, Path: "name", Message: "set more than once, first at line 1"},
+					{Line: 5, Column: 5, Path: "tasmotaT1Devices[0].uri", Message: `"office-closet.local" is not an http or https URI`},
+					{Line: 6, Column: 5, Path: "tasmotaT1Devices[0].switchNumber", Message: "4 is not a switch, a T1 has switches 1 to 3"},
+					{Line: 7, Column: 19, Path: "tasmotaT1Devices[0].updateWindow", Message: `"soon" is not a duration such as 30s`},
+					{Line: 8, Column: 5, Path: "tasmotaT1Devices[1].name", Message: "device name blower is already used by tasmotaT1Devices[0]"},
+					{Line: 10, Column: 19, Path: "tasmotaT1Devices[1].switchNumber", Message: `"two" must be a whole number`},
+					{Line: 12, Column: 3, Path: "api.address", Message: `"nowhere" must be host:port, e.g. :8080`},
+				}))
+			})
+		})
+		Context("with a missing switch number", func() {
+			It("should report it as required", func() {
+				doc := Parse([]byte(`tasmotaT1Devices:
+  - name: blower
+    uri: http://office-closet.local
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 2, Column: 5, Path: "tasmotaT1Devices[0]", Message: "switchNumber is required"},
+				}))
+			})
+		})
+		Context("with a section of the wrong shape", func() {
+			It("should report it", func() {
+				doc := Parse([]byte(`name: myCasa
+tasmotaT1Devices: blower
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 2, Column: 19, Path: "tasmotaT1Devices", Message: "must be a list"},
+				}))
+				Expect(doc.Config.Name).To(Equal("myCasa"))
+			})
+		})
+		Context("with API auth for things which do not exist", func() {
+			It("should report the role and scope", func() {
+				doc := Parse([]byte(`tasmotaT1Devices:
+  - name: blower
+    uri: http://office-closet.local
+    switchNumber: 3
+api:
+  auth:
+    tokens:
+      - name: tablet
+        token: tablet-0123456789abcdef
+        role: owner
+        devices: [blower, lamp]
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 10, Column: 9, Path: "api.auth.tokens[0].role", Message: `"owner" is not a role, use one of [viewer operator admin]`},
+					{Line: 11, Column: 27, Path: "api.auth.tokens[0].devices[1]", Message: "no device is named lamp"},
+				}))
+			})
+		})
+		Context("with API TLS", func() {
+			It("should take tokens for client certificates alone with mutual TLS", func() {
+				doc := Parse([]byte(`api:
+  address: :8443
+  tls:
+    clients: optional
+  auth:
+    tokens:
+      - name: tablet
+        role: operator
+`))
+				Expect(doc.Problems).To(BeEmpty())
+				Expect(doc.Config.API.TLS.Clients).To(Equal(certs.ClientsOptional))
+			})
+			It("should report a cert without its key and an unknown client mode", func() {
+				doc := Parse([]byte(`api:
+  tls:
+    cert: server.crt
+    clients: sometimes
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 3, Column: 5, Path: "api.tls", Message: "key is required"},
+					{Line: 4, Column: 5, Path: "api.tls.clients", Message: `"sometimes" is not optional or required`},
+				}))
+			})
+		})
+		Context("with alerts for things which do not exist", func() {
+			It("should report the device and zone", func() {
+				doc := Parse([]byte(`tasmotaT1Devices:
+  - name: blower
+    uri: http://office-closet.local
+    switchNumber: 3
+notify:
+  sinks:
+    - name: phone
+      ntfy:
+        url: https://ntfy.sh/casa
+  alerts:
+    - name: brownout
+      vcc:
+        below: 3.1
+      devices: [blower, lamp]
+    - name: stuck
+      hvacRunning: 4h
+      devices: [upstairs]
+`))
+				Expect(doc.Problems).To(Equal(Problems{
+					{Line: 14, Column: 25, Path: "notify.alerts[0].devices[1]", Message: "no device is named lamp"},
+					{Line: 17, Column: 17, Path: "notify.alerts[1].devices[0]", Message: "no zone is named upstairs"},
+				}))
+				Expect(doc.Config.Notify.Alerts[1].HVACRunning).To(Equal(4 * time.Hour))
+			})
+		})
+		Context("with invalid yaml", func() {
+			It("should report the line", func() {
+				doc := Parse([]byte("name: myCasa\napi: [\n"))
+				Expect(doc.Config).To(BeNil())
+				Expect(doc.Problems).To(HaveLen(1))
+				Expect(doc.Problems[0].Line).To(Equal(2))
+			})
+		})
+	})
+	Describe("Resolving secrets", func() {
+		BeforeEach(func() {
+			os.Setenv("MICASA_TEST_HA_PASSWORD", "hunter2")
+		})
+		AfterEach(func() {
+			os.Unsetenv("MICASA_TEST_HA_PASSWORD")
+		})
+		It("should replace references with the secret", func() {
+			doc := Parse([]byte(`homeAssistant:
+  broker: tcp://localhost:1883
+  password: ${env:MICASA_TEST_HA_PASSWORD}
+`))
+			Expect(doc.Problems).To(BeEmpty())
+			Expect(doc.Config.HomeAssistant.Password.Reveal()).To(Equal("hunter2"))
+		})
+		It("should report references which cannot be resolved where they are", func() {
+			doc := Parse([]byte(`dysonHotCoolLinkDevices:
+  - name: living
+    ip: 10.0.0.5
+    serialNumber: ABC-123
+    dysonAPIEmail: me@example.com
+    dysonAPIPassword: keystore:dyson
+`))
+			Expect(doc.Problems).To(Equal(Problems{
+				{Line: 6, Column: 5, Path: "dysonHotCoolLinkDevices[0].dysonAPIPassword", Message: "no keystore is configured"},
+			}))
+			Expect(doc.Config.DysonHotCoolLink[0].DysonAPIPassword).To(BeEmpty())
+		})
+	})
+	Describe("Reporting", func() {
+		It("should place the problem at the closest setting", func() {
+			doc := Parse([]byte(`name: myCasa
+hvac:
+  sensor: office
+`))
+			doc.Report("hvac.heat", errTest("heat switch furnace not found"))
+			Expect(doc.Problems).To(Equal(Problems{
+				{Line: 2, Column: 1, Path: "hvac.heat", Message: "heat switch furnace not found"},
+			}))
+		})
+	})
+	Describe("Getting all fields", func() {
+		It("should fail with every problem", func() {
+			invalidConfig := YamlConfig{
+				FileLocation: "../assets/testInvalidConfig.yaml",
+			}
+			_, err := invalidConfig.GetAllFields()
+			Expect(err).To(BeAssignableToTypeOf(Problems{}))
+			Expect(err.(Problems)).To(HaveLen(2))
+			Expect(err.Error()).To(ContainSubstring("line 3, column 5: tasmotaT1Devices[0]: unknown field switch, did you mean switchNumber?"))
+		})
+	})
+})
+
+type errTest string
+
+func (err errTest) Error() string {
+	return string(err)
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//Format is the language a config is written in
+type Format string
+
+const (
+	YAML Format = "yaml"
+	JSON Format = "json"
+	TOML Format = "toml"
+)
+
+//FormatOf tells the format of location from its extension, YAML when
+// it has none which is known. location may be a path or a URL.
+func FormatOf(location string) Format {
+	if i := strings.IndexAny(location, "?#"); i >= 0 {
+		location = location[:i]
+	}
+	switch strings.ToLower(path.Ext(location)) {
+	case ".json":
+		return JSON
+	case ".toml":
+		return TOML
+	}
+	return YAML
+}
+
+//formatOfType is the format of a Content-Type, ok is false
+// when it names none of them
+func formatOfType(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return JSON, true
+	case mediaType == "application/toml":
+		return TOML, true
+	case strings.HasSuffix(mediaType, "yaml"):
+		return YAML, true
+	}
+	return "", false
+}
+
+//ParseFormat is Parse for a config written in format
+func ParseFormat(format Format, content []byte) *Document {
+	doc := newDocument()
+	root, ok := doc.parseFormat("", format, content)
+	if !ok {
+		return doc
+	}
+	doc.decode(root)
+	return doc
+}
+
+//parseFormat parses content of source as format into the
+// nodes every format is checked as
+func (doc *Document) parseFormat(source string, format Format, content []byte) (*yaml.Node, bool) {
+	switch format {
+	case JSON:
+		// YAML is a superset of JSON, which keeps the lines and columns,
+		// but a JSON config should not get away with being YAML
+		var value interface{}
+		if err := json.Unmarshal(content, &value); err != nil {
+			doc.order[source] = len(doc.order)
+			problem := Problem{Source: source, Line: 1, Column: 1, Message: err.Error()}
+			if syntax, ok := err.(*json.SyntaxError); ok {
+				problem.Line, problem.Column = position(content, syntax.Offset-1)
+			}
+			doc.Problems = append(doc.Problems, problem)
+			return nil, false
+		}
+		return doc.parseSource(source, content)
+	case TOML:
+		doc.order[source] = len(doc.order)
+		var value map[string]interface{}
+		meta, err := toml.Decode(string(content), &value)
+		if err != nil {
+			problem := Problem{Source: source, Line: 1, Column: 1, Message: err.Error()}
+			if parse, ok := err.(toml.ParseError); ok {
+				problem.Line, problem.Message = parse.Line, parse.Message
+			}
+			doc.Problems = append(doc.Problems, problem)
+			return nil, false
+		}
+		if len(value) == 0 {
+			return nil, true
+		}
+		// the order keys were written in, TOML tables are unordered
+		order := map[string]int{}
+		for i, key := range meta.Keys() {
+			order[key.String()] = i
+		}
+		root := tomlNode(value, "", order)
+		doc.from(source, root)
+		return root, true
+	}
+	return doc.parseSource(source, content)
+}
+
+//position is the line and column of offset within content
+func position(content []byte, offset int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+//tomlNode is value decoded from TOML as a node, TOML keeps no
+// line or column of values so neither does the node
+func tomlNode(value interface{}, key string, order map[string]int) *yaml.Node {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for name := range value {
+			keys = append(keys, name)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, aOK := order[join(key, keys[i])]
+			b, bOK := order[join(key, keys[j])]
+			if aOK && bOK {
+				return a < b
+			}
+			if aOK != bOK {
+				return aOK
+			}
+			return keys[i] < keys[j]
+		})
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, name := range keys {
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name},
+				tomlNode(value[name], join(key, name), order))
+		}
+		return node
+	case []map[string]interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range value {
+			node.Content = append(node.Content, tomlNode(item, key, order))
+		}
+		return node
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range value {
+			node.Content = append(node.Content, tomlNode(item, key, order))
+		}
+		return node
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(value, 10)}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(value, 'g', -1, 64)}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(value)}
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value.Format(time.RFC3339Nano)}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(value)}
+}
@@ -0,0 +1,83 @@
+package config_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/config"
+)
+
+var _ = Describe("Formats", func() {
+	Describe("telling the format from a location", func() {
+		It("should go by the extension", func() {
+			Expect(FormatOf("/etc/micasa/config.json")).To(Equal(JSON))
+			Expect(FormatOf("https://config.local/casa.TOML?v=2")).To(Equal(TOML))
+			Expect(FormatOf("config.yaml")).To(Equal(YAML))
+			Expect(FormatOf("https://config.local/casa")).To(Equal(YAML))
+		})
+	})
+	Describe("JSON", func() {
+		It("should parse the same config as YAML", func() {
+			jsonConfig := JSONConfig{FileLocation: "../assets/testAutomationConfig.json"}
+			yamlConfig := YamlConfig{FileLocation: "../assets/testAutomationConfig.yaml"}
+			expected, err := yamlConfig.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			miCasaConfig, err := jsonConfig.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(miCasaConfig).To(Equal(expected))
+		})
+		It("should place a problem on its line and column", func() {
+			doc := ParseFormat(JSON, []byte("{\n  \"name\": \"myCasa\",\n  \"hvac\": {\"setpiont\": 70}\n}\n"))
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Line).To(Equal(3))
+			Expect(doc.Problems[0].Column).To(Equal(12))
+			Expect(doc.Problems[0].Message).To(ContainSubstring("did you mean setpoint?"))
+		})
+		It("should place a syntax error on its line and column", func() {
+			doc := ParseFormat(JSON, []byte("{\n  \"name\": \"myCasa\"\n  \"hvac\": {}\n}\n"))
+			Expect(doc.Config).To(BeNil())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Line).To(Equal(3))
+			Expect(doc.Problems[0].Column).To(Equal(3))
+		})
+		It("should not take YAML as JSON", func() {
+			doc := ParseFormat(JSON, []byte("name: myCasa\n"))
+			Expect(doc.Config).To(BeNil())
+			Expect(doc.Problems).To(HaveLen(1))
+		})
+	})
+	Describe("TOML", func() {
+		It("should parse the same config as YAML", func() {
+			tomlConfig := TOMLConfig{FileLocation: "../assets/testAutomationConfig.toml"}
+			yamlConfig := YamlConfig{FileLocation: "../assets/testAutomationConfig.yaml"}
+			expected, err := yamlConfig.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			miCasaConfig, err := tomlConfig.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(miCasaConfig).To(Equal(expected))
+			Expect(miCasaConfig.TasmotaT1[0].UpdateWindow).To(Equal(30 * time.Second))
+		})
+		It("should list the settings in the order they were written", func() {
+			doc := ParseFormat(TOML, []byte("name = \"myCasa\"\n\n[hvac]\nsetpoint = 70\nmode = \"heat\"\n"))
+			paths := []string{}
+			for _, setting := range doc.Settings() {
+				paths = append(paths, setting.Path)
+			}
+			Expect(paths).To(Equal([]string{"name", "hvac.setpoint", "hvac.mode"}))
+		})
+		It("should report an unknown setting", func() {
+			doc := ParseFormat(TOML, []byte("[hvac]\nsetpiont = 70\n"))
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Path).To(Equal("hvac"))
+			Expect(doc.Problems[0].Message).To(ContainSubstring("did you mean setpoint?"))
+		})
+		It("should place a syntax error on its line", func() {
+			doc := ParseFormat(TOML, []byte("name = \"myCasa\"\n[hvac\n"))
+			Expect(doc.Config).To(BeNil())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Line).To(Equal(2))
+		})
+	})
+})
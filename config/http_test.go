@@ -0,0 +1,102 @@
+package config_test
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/config"
+)
+
+var _ = Describe("HTTPConfig", func() {
+	var server *httptest.Server
+	var content, contentType string
+	var served, notModified int32
+	BeforeEach(func() {
+		content, contentType = "name: myCasa\n", "application/yaml"
+		atomic.StoreInt32(&served, 0)
+		atomic.StoreInt32(&notModified, 0)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			etag := fmt.Sprintf(`"%08x"`, crc32.ChecksumIEEE([]byte(content)))
+			if r.Header.Get("If-None-Match") == etag {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&served, 1)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(content))
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	It("should fetch and parse the config", func() {
+		remote := HTTPConfig{URL: server.URL + "/casa"}
+		miCasaConfig, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(miCasaConfig.Name).To(Equal("myCasa"))
+	})
+	It("should not fetch an unchanged config twice", func() {
+		remote := HTTPConfig{URL: server.URL + "/casa"}
+		_, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		miCasaConfig, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(miCasaConfig.Name).To(Equal("myCasa"))
+		Expect(atomic.LoadInt32(&served)).To(Equal(int32(1)))
+		Expect(atomic.LoadInt32(&notModified)).To(Equal(int32(1)))
+	})
+	It("should fetch a changed config again", func() {
+		remote := HTTPConfig{URL: server.URL + "/casa"}
+		_, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		content = "name: ourCasa\n"
+		miCasaConfig, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(miCasaConfig.Name).To(Equal("ourCasa"))
+		Expect(atomic.LoadInt32(&served)).To(Equal(int32(2)))
+	})
+	It("should tell the format from the Content-Type", func() {
+		content, contentType = `{"name": "myCasa"}`, "application/json; charset=utf-8"
+		remote := HTTPConfig{URL: server.URL + "/casa"}
+		doc, err := remote.Read()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(doc.Problems).To(BeEmpty())
+		Expect(doc.Settings()[0].Source).To(Equal(server.URL + "/casa"))
+	})
+	It("should tell the format from the URL otherwise", func() {
+		content, contentType = "name = \"myCasa\"\n", "text/plain"
+		remote := HTTPConfig{URL: server.URL + "/casa.toml"}
+		miCasaConfig, err := remote.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(miCasaConfig.Name).To(Equal("myCasa"))
+	})
+	It("should fail when the server does", func() {
+		remote := HTTPConfig{URL: server.URL + "/casa"}
+		server.Config.Handler = http.NotFoundHandler()
+		_, err := remote.Read()
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("404"))
+	})
+	It("should never show a password given in the URL", func() {
+		remote := HTTPConfig{URL: "http://micasa:hunter2@" + server.Listener.Addr().String() + "/casa"}
+		content = "hvac:\n  setpiont: 70\n"
+		doc, err := remote.Read()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(doc.Problems).To(HaveLen(1))
+		Expect(doc.Problems[0].Source).NotTo(ContainSubstring("hunter2"))
+	})
+	It("should be laid under conf.d, the environment and flags", func() {
+		layered := Layered{FileLocation: server.URL + "/casa", Environment: []string{"MICASA_NAME=ourCasa"}}
+		miCasaConfig, err := layered.GetAllFields()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(miCasaConfig.Name).To(Equal("ourCasa"))
+	})
+})
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"io/ioutil"
+)
+
+//JSONConfig is a config file written in JSON, checked
+// just as strictly as YAML
+type JSONConfig struct {
+	FileLocation string
+}
+
+//GetAllFields reads the config file, failing with every Problem
+// found when it is not entirely valid
+func (conf *JSONConfig) GetAllFields() (*CasaConfig, error) {
+	return allFields(conf.Read())
+}
+
+//Read parses the config file, err is only set when it cannot be read
+func (conf *JSONConfig) Read() (*Document, error) {
+	content, err := ioutil.ReadFile(conf.FileLocation)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFormat(JSON, content), nil
+}
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oskoss/mi-casa/secret"
+	"gopkg.in/yaml.v3"
+)
+
+//EnvPrefix starts the name of every environment variable overriding
+// a setting. The rest of the name is the path to the setting with each
+// key separated by a double underscore, matched regardless of case.
+// A list entry is picked by its index or, for devices and zones, by its
+// name, which adds the entry when there is none by that name:
+//
+//	MICASA_API__ADDRESS=:9090
+//	MICASA_HVAC__SETPOINT=70
+//	MICASA_TASMOTAT1DEVICES__BLOWER__URI=http://office-closet.local
+//	MICASA_DYSONHOTCOOLLINKDEVICES__0__DYSONAPIPASSWORD=file:/run/secrets/dyson
+//
+// Values are read as YAML, so 30s, true and [bedroom, office] all work.
+const EnvPrefix = "MICASA_"
+
+//FragmentDirectory is where fragments are read from, beside the base file
+const FragmentDirectory = "conf.d"
+
+//Layered is a config built up in layers, each overriding the last:
+// the base file, every fragment of the conf.d directory beside it in
+// name order, MICASA_ environment variables and finally overrides given
+// as path=value, e.g. tasmotaT1Devices[blower].uri=...
+//
+// Files may be YAML, JSON or TOML, told apart by their extension. The
+// base may be a URL instead, which is fetched as an HTTPConfig and has
+// no fragments unless Fragments is set.
+//
+// Mappings are merged key by key and lists of named entries, such as
+// the devices, entry by entry so a fragment can add a device. Any other
+// value replaces what came before.
+type Layered struct {
+	FileLocation string
+	//Fragments is the fragment directory, conf.d beside the base file when empty
+	Fragments string
+	//Environment is in the form of os.Environ
+	Environment []string
+	Overrides   []string
+
+	mutex  sync.Mutex
+	remote *HTTPConfig
+}
+
+//GetAllFields reads every layer, failing with every Problem
+// found when the result is not entirely valid
+func (conf *Layered) GetAllFields() (*CasaConfig, error) {
+	return allFields(conf.Read())
+}
+
+//files are the base and every fragment, in the order they are laid
+func (conf *Layered) files() ([]string, error) {
+	directory := conf.Fragments
+	if directory == "" {
+		if IsURL(conf.FileLocation) {
+			return []string{conf.FileLocation}, nil
+		}
+		directory = filepath.Join(filepath.Dir(conf.FileLocation), FragmentDirectory)
+	}
+	fragments := []string{}
+	for _, pattern := range []string{"*.yaml", "*.yml", "*.json", "*.toml"} {
+		matches, err := filepath.Glob(filepath.Join(directory, pattern))
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, matches...)
+	}
+	sort.Strings(fragments)
+	return append([]string{conf.FileLocation}, fragments...), nil
+}
+
+//load reads location, fetching it when it is a URL
+func (conf *Layered) load(location string) ([]byte, Format, error) {
+	if !IsURL(location) {
+		content, err := ioutil.ReadFile(location)
+		return content, FormatOf(location), err
+	}
+	// kept between reads so the ETag is too, the watcher reads as well
+	conf.mutex.Lock()
+	if conf.remote == nil || conf.remote.URL != location {
+		conf.remote = &HTTPConfig{URL: location}
+	}
+	remote := conf.remote
+	conf.mutex.Unlock()
+	return remote.Fetch()
+}
+
+//Read merges every layer and checks the result, err is only set
+// when the base file or a fragment cannot be read
+func (conf *Layered) Read() (*Document, error) {
+	doc := newDocument()
+	files, err := conf.files()
+	if err != nil {
+		return nil, err
+	}
+	var root *yaml.Node
+	parsed := true
+	for _, file := range files {
+		content, format, err := conf.load(file)
+		if err != nil {
+			return nil, err
+		}
+		layer, ok := doc.parseFormat(RedactURL(file), format, content)
+		if !ok {
+			parsed = false
+			continue
+		}
+		if layer == nil {
+			continue
+		}
+		if layer.Kind != yaml.MappingNode {
+			doc.add(layer, "", "must be a mapping of settings")
+			parsed = false
+			continue
+		}
+		if root == nil {
+			root = layer
+			continue
+		}
+		doc.duplicates(layer, "")
+		root = merge(root, layer)
+	}
+	if !parsed {
+		doc.sort()
+		return doc, nil
+	}
+	if root == nil {
+		root = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	for _, variable := range conf.Environment {
+		i := strings.Index(variable, "=")
+		if i < 0 || !strings.HasPrefix(variable[:i], EnvPrefix) || variable[:i] == secret.PassphraseEnv {
+			continue
+		}
+		name := variable[:i]
+		doc.override(root, "env "+name, strings.Split(name[len(EnvPrefix):], "__"), variable[i+1:])
+	}
+	for _, override := range conf.Overrides {
+		source := "--set " + override
+		i := strings.Index(override, "=")
+		if i <= 0 {
+			doc.Problems = append(doc.Problems, Problem{Source: source, Message: "must be path=value"})
+			continue
+		}
+		path, err := splitPath(override[:i])
+		if err != nil {
+			doc.Problems = append(doc.Problems, Problem{Source: source, Message: err.Error()})
+			continue
+		}
+		doc.override(root, "--set "+override[:i], path, override[i+1:])
+	}
+	doc.decode(root)
+	return doc, nil
+}
+
+//Content is everything the config is read from, which changes
+// whenever any layer read from a file does
+func (conf *Layered) Content() ([]byte, error) {
+	var content bytes.Buffer
+	files, err := conf.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		layer, _, err := conf.load(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&content, "# %s\n", file)
+		content.Write(layer)
+	}
+	return content.Bytes(), nil
+}
+
+//splitPath splits a path such as zones[0].setpoint into its keys
+func splitPath(path string) ([]string, error) {
+	keys := []string{}
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			i := strings.Index(part, "[")
+			if i < 0 {
+				keys = append(keys, part)
+				break
+			}
+			if i > 0 {
+				keys = append(keys, part[:i])
+			}
+			end := strings.Index(part, "]")
+			if end < i {
+				return nil, fmt.Errorf("%s has an unclosed [", path)
+			}
+			keys = append(keys, part[i+1:end])
+			part = part[end+1:]
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("%s has an empty key", path)
+		}
+	}
+	return keys, nil
+}
+
+//override sets the setting at keys within root to value, creating
+// whatever mappings and named list entries lead to it
+func (doc *Document) override(root *yaml.Node, source string, keys []string, value string) {
+	doc.order[source] = len(doc.order)
+	node := root
+	t := reflect.TypeOf(CasaConfig{})
+	path := ""
+	for n, key := range keys {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		last := n == len(keys)-1
+		switch {
+		case t.Kind() == reflect.Slice:
+			if node.Kind != yaml.SequenceNode {
+				*node = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			}
+			item := listEntry(node, key)
+			if item == nil {
+				doc.Problems = append(doc.Problems, Problem{Source: source, Path: path, Message: fmt.Sprintf("has no entry %s", key)})
+				return
+			}
+			doc.claim(source, item)
+			path = fmt.Sprintf("%s[%s]", path, key)
+			t = t.Elem()
+			if last {
+				*item = *scalar(value)
+				doc.from(source, item)
+				return
+			}
+			node = item
+		default:
+			if node.Kind != yaml.MappingNode {
+				*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			if t.Kind() == reflect.Struct {
+				fields := yamlFields(t)
+				for name := range fields {
+					if strings.EqualFold(name, key) {
+						key = name
+					}
+				}
+				t = fields[key]
+			} else if t.Kind() == reflect.Map {
+				t = t.Elem()
+			}
+			if t == nil {
+				// unknown, the schema check reports it
+				t = reflect.TypeOf((*interface{})(nil)).Elem()
+			}
+			path = join(path, key)
+			child := mappingValue(node, key)
+			if child == nil {
+				keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				node.Content = append(node.Content, keyNode, child)
+				doc.from(source, keyNode)
+			}
+			doc.claim(source, child)
+			if last {
+				*child = *scalar(value)
+				doc.from(source, child)
+				return
+			}
+			node = child
+		}
+	}
+}
+
+//claim gives node and whatever within it was just created the source
+// which created it, leaving what came from a file alone
+func (doc *Document) claim(source string, node *yaml.Node) {
+	if _, ok := doc.sources[node]; ok {
+		return
+	}
+	doc.sources[node] = source
+	for _, child := range node.Content {
+		doc.claim(source, child)
+	}
+}
+
+//scalar reads value as YAML, or as a string when it is not YAML.
+// It has no line or column, as it is not from a file.
+func scalar(value string) *yaml.Node {
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &document); err != nil || len(document.Content) != 1 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	}
+	unplace(document.Content[0])
+	return document.Content[0]
+}
+
+func unplace(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, child := range node.Content {
+		unplace(child)
+	}
+}
+
+//listEntry finds the entry of list at index key or named key,
+// adding a named entry when there is none
+func listEntry(list *yaml.Node, key string) *yaml.Node {
+	if index, err := strconv.Atoi(key); err == nil {
+		if index < 0 || index >= len(list.Content) {
+			return nil
+		}
+		return list.Content[index]
+	}
+	for _, item := range list.Content {
+		if name := mappingValue(item, "name"); name != nil && strings.EqualFold(name.Value, key) {
+			return item
+		}
+	}
+	item := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "name"},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: strings.ToLower(key)},
+	}}
+	list.Content = append(list.Content, item)
+	return item
+}
+
+//mappingValue is the value of key within mapping, nil when not set
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+//merge lays over on top of base
+func merge(base *yaml.Node, over *yaml.Node) *yaml.Node {
+	switch {
+	case base.Kind == yaml.MappingNode && over.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(over.Content); i += 2 {
+			key, value := over.Content[i], over.Content[i+1]
+			merged := false
+			for j := 0; j+1 < len(base.Content); j += 2 {
+				if base.Content[j].Value == key.Value {
+					base.Content[j+1] = merge(base.Content[j+1], value)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				base.Content = append(base.Content, key, value)
+			}
+		}
+		return base
+	case base.Kind == yaml.SequenceNode && over.Kind == yaml.SequenceNode && named(base) && named(over):
+		for _, item := range over.Content {
+			merged := false
+			for i, existing := range base.Content {
+				if mappingValue(existing, "name").Value == mappingValue(item, "name").Value {
+					base.Content[i] = merge(existing, item)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				base.Content = append(base.Content, item)
+			}
+		}
+		return base
+	}
+	return over
+}
+
+//named is whether every entry of list is a mapping with a name
+func named(list *yaml.Node) bool {
+	for _, item := range list.Content {
+		if mappingValue(item, "name") == nil {
+			return false
+		}
+	}
+	return true
+}
+
+//duplicates reports keys set twice within node, which merging
+// would otherwise hide
+func (doc *Document) duplicates(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		seen := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if first, ok := seen[key.Value]; ok {
+				doc.add(key, join(path, key.Value), "set more than once, first at line %d", first.Line)
+				continue
+			}
+			seen[key.Value] = key
+			doc.duplicates(node.Content[i+1], join(path, key.Value))
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			doc.duplicates(item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/config"
+)
+
+var _ = Describe("Layered", func() {
+	var directory, location string
+	var layered *Layered
+	write := func(name string, content string) {
+		path := filepath.Join(directory, name)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).Should(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).Should(Succeed())
+	}
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "config")
+		Expect(err).ShouldNot(HaveOccurred())
+		location = filepath.Join(directory, "config.yaml")
+		write("config.yaml", `name: myCasa
+tasmotaT1Devices:
+  - name: blower
+    uri: http://office-closet.local
+    switchNumber: 3
+`)
+		layered = &Layered{FileLocation: location}
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	Context("when there is nothing but the base file", func() {
+		It("should read it as it is", func() {
+			casaConfig, err := layered.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(casaConfig.Name).To(Equal("myCasa"))
+			Expect(casaConfig.TasmotaT1).To(HaveLen(1))
+		})
+	})
+	Context("when there are fragments", func() {
+		BeforeEach(func() {
+			write("conf.d/20-attic.yaml", `tasmotaT1Devices:
+  - name: fan
+    uri: http://attic.local
+    switchNumber: 1
+`)
+			write("conf.d/10-closet.yaml", `name: ourCasa
+tasmotaT1Devices:
+  - name: blower
+    switchNumber: 2
+`)
+		})
+		It("should merge devices by name, in name order", func() {
+			casaConfig, err := layered.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(casaConfig.Name).To(Equal("ourCasa"))
+			Expect(casaConfig.TasmotaT1).To(HaveLen(2))
+			Expect(casaConfig.TasmotaT1[0].Name).To(Equal("blower"))
+			Expect(casaConfig.TasmotaT1[0].URI).To(Equal("http://office-closet.local"))
+			Expect(casaConfig.TasmotaT1[0].SwitchNumber).To(Equal(2))
+			Expect(casaConfig.TasmotaT1[1].Name).To(Equal("fan"))
+		})
+		It("should tell which file each setting came from", func() {
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "tasmotaT1Devices[0].switchNumber",
+				Value:  "2",
+				Source: filepath.Join(directory, "conf.d", "10-closet.yaml"),
+				Line:   4,
+				Column: 19,
+			}))
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "tasmotaT1Devices[0].uri",
+				Value:  "http://office-closet.local",
+				Source: location,
+				Line:   4,
+				Column: 10,
+			}))
+		})
+		It("should report a problem in the fragment it is in", func() {
+			write("conf.d/30-typo.yaml", "hvac:\n  setpiont: 70\n")
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Source).To(Equal(filepath.Join(directory, "conf.d", "30-typo.yaml")))
+			Expect(doc.Problems[0].Line).To(Equal(2))
+		})
+		It("should reject a fragment which is not a mapping", func() {
+			write("conf.d/30-list.yaml", "- name: lamp\n")
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Config).To(BeNil())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Message).To(Equal("must be a mapping of settings"))
+		})
+	})
+	Context("when the environment overrides settings", func() {
+		BeforeEach(func() {
+			layered.Environment = []string{
+				"PATH=/usr/bin",
+				"MICASA_NAME=ourCasa",
+				"MICASA_TASMOTAT1DEVICES__BLOWER__SWITCHNUMBER=1",
+				"MICASA_API__ADDRESS=:9090",
+				"MICASA_KEYSTORE_PASSPHRASE=hunter2",
+			}
+		})
+		It("should match keys and device names regardless of case", func() {
+			casaConfig, err := layered.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(casaConfig.Name).To(Equal("ourCasa"))
+			Expect(casaConfig.TasmotaT1[0].SwitchNumber).To(Equal(1))
+			Expect(casaConfig.API.Address).To(Equal(":9090"))
+		})
+		It("should tell which variable each setting came from", func() {
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "tasmotaT1Devices[0].switchNumber",
+				Value:  "1",
+				Source: "env MICASA_TASMOTAT1DEVICES__BLOWER__SWITCHNUMBER",
+			}))
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "tasmotaT1Devices[0].name",
+				Value:  "blower",
+				Source: location,
+				Line:   3,
+				Column: 11,
+			}))
+		})
+		It("should add a device named by a variable", func() {
+			layered.Environment = append(layered.Environment,
+				"MICASA_TASMOTAT1DEVICES__FAN__URI=http://attic.local",
+				"MICASA_TASMOTAT1DEVICES__FAN__SWITCHNUMBER=1",
+			)
+			casaConfig, err := layered.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(casaConfig.TasmotaT1).To(HaveLen(2))
+			Expect(casaConfig.TasmotaT1[1].Name).To(Equal("fan"))
+		})
+		It("should report a setting which does not exist against the variable", func() {
+			layered.Environment = append(layered.Environment, "MICASA_HVAC__SETPIONT=70")
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Source).To(Equal("env MICASA_HVAC__SETPIONT"))
+			Expect(doc.Problems[0].Error()).To(ContainSubstring("did you mean setpoint?"))
+		})
+	})
+	Context("when flags override settings", func() {
+		It("should override the environment", func() {
+			layered.Environment = []string{"MICASA_NAME=ourCasa"}
+			layered.Overrides = []string{"name=theirCasa", "tasmotaT1Devices[blower].updateWindow=30s"}
+			casaConfig, err := layered.GetAllFields()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(casaConfig.Name).To(Equal("theirCasa"))
+			Expect(casaConfig.TasmotaT1[0].UpdateWindow).To(Equal(30 * time.Second))
+		})
+		It("should report an override which is not path=value", func() {
+			layered.Overrides = []string{"theirCasa"}
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Source).To(Equal("--set theirCasa"))
+		})
+		It("should report an index past the end of a list", func() {
+			layered.Overrides = []string{"tasmotaT1Devices[3].switchNumber=1"}
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Problems).To(HaveLen(1))
+			Expect(doc.Problems[0].Path).To(Equal("tasmotaT1Devices"))
+		})
+	})
+	Context("when a setting is a secret", func() {
+		It("should never show the secret", func() {
+			layered.Overrides = []string{"homeAssistant.password=hunter2"}
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "homeAssistant.password",
+				Value:  "*****",
+				Source: "--set homeAssistant.password",
+			}))
+		})
+		It("should show a reference to where the secret is kept", func() {
+			layered.Overrides = []string{"homeAssistant.password=file:/run/secrets/homeassistant"}
+			doc, err := layered.Read()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(doc.Settings()).To(ContainElement(Setting{
+				Path:   "homeAssistant.password",
+				Value:  "file:/run/secrets/homeassistant",
+				Source: "--set homeAssistant.password",
+			}))
+		})
+	})
+	Describe("watching", func() {
+		It("should report a fragment which was added", func() {
+			changed := make(chan struct{}, 1)
+			stop := make(chan struct{})
+			defer close(stop)
+			go layered.Watcher().Run(10*time.Millisecond, changed, stop)
+			Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+			write("conf.d/10-closet.yaml", "name: ourCasa\n")
+			Eventually(changed).Should(Receive())
+		})
+	})
+})
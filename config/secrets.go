@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/oskoss/mi-casa/secret"
+)
+
+var secretType = reflect.TypeOf(secret.String(""))
+
+//resolveSecrets replaces every secret reference within casaConfig with
+// the secret, the keystore passphrase first as the keystore needs it
+func (doc *Document) resolveSecrets(casaConfig *CasaConfig) {
+	resolver := &secret.Resolver{}
+	if kind, _, _ := secret.Reference(casaConfig.Keystore.Passphrase); kind == "keystore" {
+		doc.problem("keystore.passphrase", "the keystore passphrase cannot be kept in the keystore")
+		casaConfig.Keystore.Passphrase = ""
+	}
+	doc.resolve(resolver, reflect.ValueOf(&casaConfig.Keystore).Elem(), "keystore")
+	resolver.Keystore = casaConfig.Keystore
+	value := reflect.ValueOf(casaConfig).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if name, _, ok := yamlName(value.Type().Field(i)); ok && name != "keystore" {
+			doc.resolve(resolver, value.Field(i), name)
+		}
+	}
+}
+
+func (doc *Document) resolve(resolver *secret.Resolver, value reflect.Value, path string) {
+	if value.Type() == secretType {
+		resolved, err := resolver.Resolve(value.Interface().(secret.String))
+		if err != nil {
+			doc.problem(path, "%v", err)
+		}
+		// an unresolved reference must never be taken for the secret
+		value.Set(reflect.ValueOf(resolved))
+		return
+	}
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			doc.resolve(resolver, value.Elem(), path)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			name, inline, ok := yamlName(value.Type().Field(i))
+			switch {
+			case !ok:
+			case inline:
+				doc.resolve(resolver, value.Field(i), path)
+			default:
+				doc.resolve(resolver, value.Field(i), join(path, name))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			doc.resolve(resolver, value.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String || !containsSecrets(value.Type().Elem()) {
+			return
+		}
+		for _, key := range value.MapKeys() {
+			// map values cannot be set in place
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(value.MapIndex(key))
+			doc.resolve(resolver, element, join(path, key.String()))
+			value.SetMapIndex(key, element)
+		}
+	}
+}
+
+//containsSecrets is whether a value of t can hold a secret.String
+func containsSecrets(t reflect.Type) bool {
+	return containsType(t, secretType, map[reflect.Type]bool{})
+}
+
+func containsType(t reflect.Type, wanted reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == wanted {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return containsType(t.Elem(), wanted, seen)
+	case reflect.Map:
+		return containsType(t.Elem(), wanted, seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if _, _, ok := yamlName(t.Field(i)); ok && containsType(t.Field(i).Type, wanted, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
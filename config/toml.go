@@ -0,0 +1,27 @@
+package config
+
+import (
+	"io/ioutil"
+)
+
+//TOMLConfig is a config file written in TOML, devices are arrays
+// of tables such as [[tasmotaT1Devices]]. Problems are only placed
+// on a line when the file cannot be parsed, TOML keeps no positions.
+type TOMLConfig struct {
+	FileLocation string
+}
+
+//GetAllFields reads the config file, failing with every Problem
+// found when it is not entirely valid
+func (conf *TOMLConfig) GetAllFields() (*CasaConfig, error) {
+	return allFields(conf.Read())
+}
+
+//Read parses the config file, err is only set when it cannot be read
+func (conf *TOMLConfig) Read() (*Document, error) {
+	content, err := ioutil.ReadFile(conf.FileLocation)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFormat(TOML, content), nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+)
+
+//Watcher tells when the content of the config file at Location changes
+type Watcher struct {
+	Location string
+	read     func() ([]byte, error)
+	last     []byte
+}
+
+//NewWatcher watches location for changes from what it holds now
+func NewWatcher(location string) *Watcher {
+	return newWatcher(location, func() ([]byte, error) {
+		return ioutil.ReadFile(location)
+	})
+}
+
+//Watcher watches the base file and every fragment, including
+// fragments added or removed later
+func (conf *Layered) Watcher() *Watcher {
+	return newWatcher(conf.FileLocation, conf.Content)
+}
+
+func newWatcher(location string, read func() ([]byte, error)) *Watcher {
+	last, _ := read()
+	return &Watcher{Location: location, read: read, last: last}
+}
+
+//Run sends on changed whenever the content of the file differs from
+// when it was last looked at, every interval until stop is closed.
+// Editors which replace the file rather than write it are seen too,
+// while a file which is missing or empty is tried again.
+func (watcher *Watcher) Run(interval time.Duration, changed chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		content, err := watcher.read()
+		if err != nil || len(content) == 0 || bytes.Equal(content, watcher.last) {
+			continue
+		}
+		watcher.last = content
+		select {
+		case changed <- struct{}{}:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/config"
+)
+
+var _ = Describe("Watcher", func() {
+	var directory, location string
+	var changed chan struct{}
+	var stop chan struct{}
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "config")
+		Expect(err).ShouldNot(HaveOccurred())
+		location = filepath.Join(directory, "config.yaml")
+		Expect(ioutil.WriteFile(location, []byte("name: myCasa\n"), 0644)).Should(Succeed())
+		changed = make(chan struct{}, 1)
+		stop = make(chan struct{})
+		go NewWatcher(location).Run(10*time.Millisecond, changed, stop)
+	})
+	AfterEach(func() {
+		close(stop)
+		os.RemoveAll(directory)
+	})
+	It("should not report a file which has not changed", func() {
+		Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+	})
+	It("should report a file which was written", func() {
+		Expect(ioutil.WriteFile(location, []byte("name: ourCasa\n"), 0644)).Should(Succeed())
+		Eventually(changed).Should(Receive())
+		Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+	})
+	It("should report a file which was replaced", func() {
+		replacement := filepath.Join(directory, "config.yaml.new")
+		Expect(ioutil.WriteFile(replacement, []byte("name: ourCasa\n"), 0644)).Should(Succeed())
+		Expect(os.Rename(replacement, location)).Should(Succeed())
+		Eventually(changed).Should(Receive())
+	})
+	It("should not report a file which was written back as it was", func() {
+		Expect(ioutil.WriteFile(location, []byte("name: myCasa\n"), 0644)).Should(Succeed())
+		Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+	})
+})
@@ -2,23 +2,35 @@ package config
 
 import (
 	"io/ioutil"
-
-	"gopkg.in/yaml.v2"
 )
 
 type YamlConfig struct {
 	FileLocation string
 }
 
+//GetAllFields reads the config file, failing with every Problem
+// found when it is not entirely valid
 func (conf *YamlConfig) GetAllFields() (*CasaConfig, error) {
+	return allFields(conf.Read())
+}
+
+//Read parses the config file, err is only set when it cannot be read
+func (conf *YamlConfig) Read() (*Document, error) {
 	content, err := ioutil.ReadFile(conf.FileLocation)
 	if err != nil {
 		return nil, err
 	}
-	var MiCasaConfig CasaConfig
-	err = yaml.Unmarshal(content, &MiCasaConfig)
+	return Parse(content), nil
+}
+
+//allFields is the config of doc, failing with every
+// Problem found when it is not entirely valid
+func allFields(doc *Document, err error) (*CasaConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MiCasaConfig, nil
+	if len(doc.Problems) > 0 {
+		return nil, doc.Problems
+	}
+	return doc.Config, nil
 }
@@ -1,6 +1,8 @@
 package config_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -25,6 +27,37 @@ var _ = Describe("Yaml", func() {
 				Expect(miCasaConfig).To(BeEquivalentTo(&expected))
 			})
 		})
+		Context("with devices and automation rules", func() {
+			It("should parse the switches and rules", func() {
+				automationConfig := YamlConfig{
+					FileLocation: "../assets/testAutomationConfig.yaml",
+				}
+				miCasaConfig, err := automationConfig.GetAllFields()
+				Expect(err).To(BeNil())
+				Expect(miCasaConfig.TasmotaT1).To(HaveLen(1))
+				Expect(miCasaConfig.TasmotaT1[0].SwitchNumber).To(Equal(3))
+				Expect(miCasaConfig.TasmotaT1[0].UpdateWindow).To(Equal(30 * time.Second))
+				Expect(miCasaConfig.Automation.DryRun).To(BeTrue())
+				Expect(miCasaConfig.Automation.Rules).To(HaveLen(1))
+				Expect(miCasaConfig.Automation.Rules[0].Debounce).To(Equal(2 * time.Minute))
+				Expect(miCasaConfig.Automation.Rules[0].Actions[0].Switch.State).To(Equal("on"))
+			})
+		})
+		Context("with zones", func() {
+			It("should parse each zone", func() {
+				zonesConfig := YamlConfig{
+					FileLocation: "../assets/testZonesConfig.yaml",
+				}
+				miCasaConfig, err := zonesConfig.GetAllFields()
+				Expect(err).To(BeNil())
+				Expect(miCasaConfig.Zones).To(HaveLen(2))
+				Expect(miCasaConfig.Zones[0].Sensors).To(Equal([]string{"bedroom", "office"}))
+				Expect(miCasaConfig.Zones[0].Schedule).To(HaveLen(3))
+				Expect(miCasaConfig.Zones[0].Schedule[2].Days).To(Equal([]string{"sat", "sun"}))
+				Expect(miCasaConfig.Zones[1].Strategy.Type).To(Equal("pid"))
+				Expect(miCasaConfig.Zones[1].Fan).To(Equal("blower"))
+			})
+		})
 		Context("with a invalid yaml file", func() {
 			It("should fail", func() {
 				_, err := invalidConfig.GetAllFields()
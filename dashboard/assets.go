@@ -0,0 +1,521 @@
+package dashboard
+
+//indexHTML is the single page, everything on it is filled in by appJS
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>mi-casa</title>
+<link rel="stylesheet" href="/dashboard/app.css">
+</head>
+<body>
+<header>
+<h1>mi-casa</h1>
+<span id="connection" class="badge">connecting</span>
+</header>
+<div id="error" class="error" hidden></div>
+<main>
+<section>
+<h2>Zones</h2>
+<div id="zones" class="cards"><p class="empty">No HVAC configured</p></div>
+</section>
+<section>
+<h2>Switches</h2>
+<div id="switches" class="cards"><p class="empty">No switches configured</p></div>
+</section>
+<section>
+<h2>Thermostats</h2>
+<div id="thermostats" class="cards"><p class="empty">No thermostats configured</p></div>
+</section>
+<section id="history">
+<h2>Last 24 hours</h2>
+<div class="controls">
+<select id="history-device"></select>
+<select id="history-metric">
+<option value="temperature">Temperature</option>
+<option value="humidity">Humidity</option>
+</select>
+</div>
+<div id="chart" class="chart"><p class="empty">History is not enabled</p></div>
+</section>
+</main>
+<script src="/dashboard/app.js"></script>
+</body>
+</html>
+`
+
+//appCSS styles the page, no web fonts so nothing is fetched
+const appCSS = `:root {
+  --background: #f4f5f7;
+  --card: #ffffff;
+  --text: #1d2330;
+  --muted: #6b7280;
+  --heat: #e4572e;
+  --cool: #2e86de;
+  --fan: #17a589;
+  --idle: #9ca3af;
+  --border: #e1e4e8;
+}
+* { box-sizing: border-box; }
+body {
+  margin: 0;
+  font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif;
+  background: var(--background);
+  color: var(--text);
+}
+header {
+  display: flex;
+  align-items: center;
+  justify-content: space-between;
+  padding: 0.75rem 1.25rem;
+  background: var(--text);
+  color: #fff;
+}
+header h1 { margin: 0; font-size: 1.25rem; }
+main { padding: 1rem 1.25rem; max-width: 80rem; margin: 0 auto; }
+h2 { font-size: 1rem; color: var(--muted); text-transform: uppercase; letter-spacing: 0.05em; }
+.cards { display: grid; grid-template-columns: repeat(auto-fill, minmax(15rem, 1fr)); gap: 1rem; }
+.card {
+  background: var(--card);
+  border: 1px solid var(--border);
+  border-radius: 0.5rem;
+  padding: 1rem;
+}
+.card h3 { margin: 0 0 0.5rem; font-size: 1.05rem; display: flex; justify-content: space-between; }
+.temperature { font-size: 2.5rem; font-weight: 300; }
+.row { display: flex; align-items: center; justify-content: space-between; margin: 0.4rem 0; }
+.muted, .empty { color: var(--muted); font-size: 0.85rem; }
+.badge {
+  display: inline-block;
+  padding: 0.1rem 0.5rem;
+  border-radius: 1rem;
+  font-size: 0.75rem;
+  background: var(--idle);
+  color: #fff;
+}
+.badge.live, .badge.on { background: var(--fan); }
+.badge.down { background: var(--heat); }
+.call { font-weight: 600; }
+.call.heating { color: var(--heat); }
+.call.cooling { color: var(--cool); }
+.call.fan { color: var(--fan); }
+.call.idle { color: var(--idle); }
+button, select, input {
+  font: inherit;
+  padding: 0.3rem 0.6rem;
+  border: 1px solid var(--border);
+  border-radius: 0.3rem;
+  background: #fff;
+}
+button { cursor: pointer; }
+button.toggle.on { background: var(--fan); color: #fff; border-color: var(--fan); }
+input[type=number] { width: 5rem; }
+.error {
+  background: var(--heat);
+  color: #fff;
+  padding: 0.5rem 1.25rem;
+}
+.controls { display: flex; gap: 0.5rem; margin-bottom: 0.5rem; }
+.chart { background: var(--card); border: 1px solid var(--border); border-radius: 0.5rem; padding: 0.5rem; }
+.chart svg { width: 100%; height: 16rem; display: block; }
+.chart .line { fill: none; stroke: var(--cool); stroke-width: 2; }
+.chart .axis { stroke: var(--border); }
+.chart text { fill: var(--muted); font-size: 11px; }
+`
+
+//appJS loads zones and devices from the API, keeps them current
+// from the event stream and draws the history chart as SVG
+const appJS = `(function () {
+  "use strict";
+
+  var state = {
+    zones: [],
+    single: false,
+    thermostats: [],
+    switches: [],
+    history: true,
+    points: []
+  };
+
+  function byId(id) {
+    return document.getElementById(id);
+  }
+
+  function esc(value) {
+    return String(value).replace(/[&<>"']/g, function (c) {
+      return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+    });
+  }
+
+  function api(method, path, body) {
+    var options = {method: method, headers: {}};
+    if (body !== undefined) {
+      options.headers["Content-Type"] = "application/json";
+      options.body = JSON.stringify(body);
+    }
+    return fetch(path, options).then(function (resp) {
+      return resp.json().catch(function () {
+        return {};
+      }).then(function (data) {
+        if (!resp.ok) {
+          var err = new Error(data.error || resp.statusText);
+          err.status = resp.status;
+          throw err;
+        }
+        return data;
+      });
+    });
+  }
+
+  function showError(err) {
+    var banner = byId("error");
+    banner.textContent = err.message;
+    banner.hidden = false;
+    clearTimeout(showError.timer);
+    showError.timer = setTimeout(function () {
+      banner.hidden = true;
+    }, 5000);
+  }
+
+  function degrees(value) {
+    return value === undefined || value === null ? "--" : value.toFixed(1) + "°F";
+  }
+
+  function describeCall(call) {
+    if (call.heatStages > 0) {
+      var text = "Heating";
+      if (call.heatStages > 1) {
+        text += " (stage " + call.heatStages + ")";
+      }
+      return {text: call.aux ? text + " + aux" : text, className: "heating"};
+    }
+    if (call.aux) {
+      return {text: "Aux heat", className: "heating"};
+    }
+    if (call.cool) {
+      return {text: "Cooling", className: "cooling"};
+    }
+    if (call.fan) {
+      return {text: "Fan", className: "fan"};
+    }
+    return {text: "Idle", className: "idle"};
+  }
+
+  function zonePath(zone) {
+    return state.single ? "/v1/hvac" : "/v1/zones/" + encodeURIComponent(zone.name);
+  }
+
+  function loadZones() {
+    return api("GET", "/v1/zones").then(function (zones) {
+      state.single = false;
+      state.zones = zones;
+    }).catch(function () {
+      return api("GET", "/v1/hvac/status").then(function (status) {
+        state.single = true;
+        status.name = status.name || "hvac";
+        state.zones = [status];
+      });
+    }).catch(function () {
+      state.zones = [];
+    }).then(renderZones);
+  }
+
+  function renderZones() {
+    var container = byId("zones");
+    if (state.zones.length === 0) {
+      container.innerHTML = '<p class="empty">No HVAC configured</p>';
+      return;
+    }
+    container.innerHTML = state.zones.map(function (zone, i) {
+      var last = zone.lastDecision;
+      var decided = last.time && last.time.indexOf("0001-") !== 0;
+      var call = describeCall(last.call);
+      var modes = zone.modes.map(function (mode) {
+        return '<option' + (mode === zone.mode ? " selected" : "") + ">" + esc(mode) + "</option>";
+      }).join("");
+      return '<div class="card">' +
+        "<h3>" + esc(zone.name) + "</h3>" +
+        '<div class="temperature">' + (decided && !last.error ? degrees(last.temperature) : "--") + "</div>" +
+        '<div class="row"><span>Setpoint</span><span>' +
+        '<button data-zone="' + i + '" data-step="-0.5">&minus;</button> ' +
+        "<strong>" + degrees(zone.setpoint) + "</strong> " +
+        '<button data-zone="' + i + '" data-step="0.5">+</button></span></div>' +
+        '<div class="row"><span>Mode</span><select data-zone="' + i + '" data-mode>' + modes + "</select></div>" +
+        '<div class="row"><span class="call ' + call.className + '">' + call.text + "</span></div>" +
+        '<div class="muted">' + esc(last.error || last.reason || "") + "</div>" +
+        "</div>";
+    }).join("");
+  }
+
+  function loadDevices() {
+    return api("GET", "/v1/devices").then(function (devices) {
+      state.thermostats = devices.thermostats;
+      state.switches = devices.switches;
+      renderDevices();
+      renderHistoryDevices();
+    }).catch(showError);
+  }
+
+  function renderDevices() {
+    var switches = byId("switches");
+    if (state.switches.length === 0) {
+      switches.innerHTML = '<p class="empty">No switches configured</p>';
+    } else {
+      switches.innerHTML = state.switches.map(function (device, i) {
+        var on = device.status === "ON";
+        return '<div class="card"><h3>' + esc(device.name) + health(device) + "</h3>" +
+          '<button class="toggle' + (on ? " on" : "") + '" data-switch="' + i + '">' +
+          (device.error ? "unknown" : on ? "ON" : "OFF") + "</button></div>";
+      }).join("");
+    }
+    var thermostats = byId("thermostats");
+    if (state.thermostats.length === 0) {
+      thermostats.innerHTML = '<p class="empty">No thermostats configured</p>';
+      return;
+    }
+    thermostats.innerHTML = state.thermostats.map(function (device, i) {
+      var html = '<div class="card"><h3>' + esc(device.name) + health(device) + "</h3>" +
+        '<div class="temperature">' + degrees(device.temperature) + "</div>";
+      if (device.humidity !== undefined) {
+        html += '<div class="row"><span>Humidity</span><span>' + device.humidity.toFixed(0) + "%</span></div>";
+      }
+      Object.keys(device.airQuality || {}).sort().forEach(function (metric) {
+        html += '<div class="row"><span>' + esc(metric) + "</span><span>" + device.airQuality[metric] + "</span></div>";
+      });
+      if (device.commands && device.state) {
+        html += dysonControls(device, i);
+      }
+      return html + "</div>";
+    }).join("");
+  }
+
+  function health(device) {
+    return device.error ? ' <span class="badge down" title="' + esc(device.error) + '">down</span>' : "";
+  }
+
+  function choice(device, i, key, label, values) {
+    if (device.state[key] === undefined) {
+      return "";
+    }
+    return '<div class="row"><span>' + label + '</span><select data-thermostat="' + i + '" data-key="' + key + '">' +
+      values.map(function (value) {
+        return "<option" + (value === device.state[key] ? " selected" : "") + ">" + value + "</option>";
+      }).join("") + "</select></div>";
+  }
+
+  //dysonControls are the raw Dyson states worth changing by hand,
+  // hmax is the heat target in tenths of a Kelvin
+  function dysonControls(device, i) {
+    var speeds = ["AUTO"];
+    for (var speed = 1; speed <= 10; speed++) {
+      speeds.push(("000" + speed).slice(-4));
+    }
+    var html = choice(device, i, "fmod", "Power", ["OFF", "FAN", "HEAT", "AUTO"]) +
+      choice(device, i, "fnsp", "Fan speed", speeds) +
+      choice(device, i, "oson", "Oscillate", ["OFF", "ON"]) +
+      choice(device, i, "hmod", "Heat", ["OFF", "HEAT"]);
+    if (device.state.hmax !== undefined) {
+      var target = (parseInt(device.state.hmax, 10) / 10 - 273.15) * 9 / 5 + 32;
+      html += '<div class="row"><span>Heat to</span><input type="number" step="1" min="34" max="98" value="' +
+        Math.round(target) + '" data-thermostat="' + i + '" data-key="hmax"></div>';
+    }
+    return html;
+  }
+
+  function renderHistoryDevices() {
+    var select = byId("history-device");
+    var current = select.value;
+    select.innerHTML = state.thermostats.map(function (device) {
+      return "<option" + (device.name === current ? " selected" : "") + ">" + esc(device.name) + "</option>";
+    }).join("");
+  }
+
+  function loadHistory() {
+    var device = byId("history-device").value;
+    if (!state.history || !device) {
+      return;
+    }
+    var from = new Date(Date.now() - 24 * 3600 * 1000).toISOString().replace(/\.\d+Z$/, "Z");
+    var query = "?kind=reading&device=" + encodeURIComponent(device) +
+      "&metric=" + encodeURIComponent(byId("history-metric").value) +
+      "&from=" + encodeURIComponent(from);
+    api("GET", "/v1/history" + query).then(function (found) {
+      state.points = found.map(function (event) {
+        return {time: new Date(event.time).getTime(), value: event.value};
+      });
+      drawChart();
+    }).catch(function (err) {
+      if (err.status === 404) {
+        state.history = false;
+        byId("history").hidden = true;
+        return;
+      }
+      showError(err);
+    });
+  }
+
+  function drawChart() {
+    var chart = byId("chart");
+    var now = Date.now();
+    var start = now - 24 * 3600 * 1000;
+    var points = state.points.filter(function (point) {
+      return point.time >= start;
+    });
+    if (points.length === 0) {
+      chart.innerHTML = '<p class="empty">Nothing recorded yet</p>';
+      return;
+    }
+    var width = 800, height = 240, left = 40, bottom = 20;
+    var values = points.map(function (point) {
+      return point.value;
+    });
+    var min = Math.floor(Math.min.apply(null, values) - 1);
+    var max = Math.ceil(Math.max.apply(null, values) + 1);
+    function x(time) {
+      return left + (time - start) / (now - start) * (width - left);
+    }
+    function y(value) {
+      return (height - bottom) - (value - min) / (max - min) * (height - bottom - 10);
+    }
+    var svg = '<svg viewBox="0 0 ' + width + " " + height + '" preserveAspectRatio="none">';
+    svg += '<line class="axis" x1="' + left + '" y1="' + (height - bottom) + '" x2="' + width + '" y2="' + (height - bottom) + '"/>';
+    svg += '<text x="0" y="' + y(max) + '">' + max + "</text>";
+    svg += '<text x="0" y="' + y(min) + '">' + min + "</text>";
+    for (var hours = 24; hours > 0; hours -= 6) {
+      var tick = now - hours * 3600 * 1000;
+      var label = new Date(tick).toLocaleTimeString([], {hour: "2-digit", minute: "2-digit"});
+      svg += '<text x="' + x(tick) + '" y="' + height + '">' + label + "</text>";
+    }
+    svg += '<polyline class="line" points="' + points.map(function (point) {
+      return x(point.time).toFixed(1) + "," + y(point.value).toFixed(1);
+    }).join(" ") + '"/></svg>';
+    chart.innerHTML = svg;
+  }
+
+  function find(list, name) {
+    for (var i = 0; i < list.length; i++) {
+      if (list[i].name === name) {
+        return list[i];
+      }
+    }
+    return null;
+  }
+
+  function handle(event) {
+    switch (event.kind) {
+    case "reading":
+      var thermostat = find(state.thermostats, event.device);
+      if (thermostat) {
+        if (event.metric === "temperature" || event.metric === "humidity") {
+          thermostat[event.metric] = event.value;
+        } else {
+          thermostat.airQuality = thermostat.airQuality || {};
+          thermostat.airQuality[event.metric] = event.value;
+        }
+        renderDevices();
+      }
+      if (event.device === byId("history-device").value && event.metric === byId("history-metric").value) {
+        state.points.push({time: new Date(event.time).getTime(), value: event.value});
+        drawChart();
+      }
+      break;
+    case "switch":
+      var relay = find(state.switches, event.device);
+      if (relay) {
+        relay.status = event.state;
+        relay.error = "";
+        renderDevices();
+      }
+      break;
+    case "decision":
+      loadZones();
+      break;
+    case "health":
+      var device = find(state.switches, event.device) || find(state.thermostats, event.device);
+      if (device) {
+        device.error = event.state === "down" ? event.reason || "unreachable" : "";
+        renderDevices();
+      }
+      break;
+    }
+  }
+
+  function refresh() {
+    loadZones();
+    loadDevices().then(loadHistory);
+  }
+
+  //connect follows the event stream, the browser resumes it with
+  // Last-Event-ID after a drop and a gap means starting over
+  function connect() {
+    var badge = byId("connection");
+    if (!window.EventSource) {
+      badge.textContent = "polling";
+      return;
+    }
+    var stream = new EventSource("/v1/stream");
+    ["reading", "switch", "decision", "health"].forEach(function (kind) {
+      stream.addEventListener(kind, function (message) {
+        handle(JSON.parse(message.data));
+      });
+    });
+    stream.addEventListener("gap", refresh);
+    stream.onopen = function () {
+      badge.textContent = "live";
+      badge.className = "badge live";
+    };
+    stream.onerror = function () {
+      badge.textContent = stream.readyState === EventSource.CLOSED ? "polling" : "reconnecting";
+      badge.className = "badge";
+    };
+  }
+
+  document.addEventListener("click", function (e) {
+    var target = e.target;
+    if (target.dataset.step !== undefined) {
+      var zone = state.zones[target.dataset.zone];
+      api("POST", zonePath(zone) + "/temperature", {set_temperature: zone.setpoint + parseFloat(target.dataset.step)})
+        .then(loadZones).catch(showError);
+    } else if (target.dataset.switch !== undefined) {
+      var relay = state.switches[target.dataset.switch];
+      api("PUT", "/v1/switches/" + encodeURIComponent(relay.name), {status: relay.status === "ON" ? "OFF" : "ON"})
+        .then(function (status) {
+          relay.status = status.status;
+          relay.error = status.error;
+          renderDevices();
+        }).catch(showError);
+    }
+  });
+
+  document.addEventListener("change", function (e) {
+    var target = e.target;
+    if (target.dataset.mode !== undefined) {
+      var zone = state.zones[target.dataset.zone];
+      api("POST", zonePath(zone) + "/mode", {mode: target.value}).then(loadZones).catch(function (err) {
+        showError(err);
+        loadZones();
+      });
+    } else if (target.dataset.key !== undefined) {
+      var device = state.thermostats[target.dataset.thermostat];
+      var command = {};
+      command[target.dataset.key] = target.value;
+      if (target.dataset.key === "hmax") {
+        var kelvin = Math.round(((parseFloat(target.value) - 32) * 5 / 9 + 273.15) * 10);
+        command.hmax = ("000" + kelvin).slice(-4);
+      }
+      api("PUT", "/v1/thermostats/" + encodeURIComponent(device.name) + "/state", command).then(function (status) {
+        state.thermostats[target.dataset.thermostat] = status;
+        renderDevices();
+      }).catch(showError);
+    } else if (target.id === "history-device" || target.id === "history-metric") {
+      loadHistory();
+    }
+  });
+
+  refresh();
+  connect();
+  // settings changed elsewhere, like a setpoint from HomeKit, are not events
+  setInterval(refresh, 60 * 1000);
+})();
+`
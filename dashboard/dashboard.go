@@ -0,0 +1,39 @@
+package dashboard
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+//asset is one file of the dashboard, kept within the binary so
+// the dashboard works without network access beyond the API
+type asset struct {
+	contentType string
+	body        string
+}
+
+var assets = map[string]asset{
+	"/":                  {contentType: "text/html; charset=utf-8", body: indexHTML},
+	"/dashboard/app.js":  {contentType: "application/javascript; charset=utf-8", body: appJS},
+	"/dashboard/app.css": {contentType: "text/css; charset=utf-8", body: appCSS},
+}
+
+//started is when the assets were last changed as far as browsers
+// are concerned, they can only change with a new binary
+var started = time.Now()
+
+//Handler serves the dashboard page at / and its script and
+// styles under /dashboard/, everything else is not found
+func Handler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		found, ok := assets[req.URL.Path]
+		if !ok {
+			http.NotFound(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Type", found.contentType)
+		resp.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(resp, req, req.URL.Path, started, strings.NewReader(found.body))
+	})
+}
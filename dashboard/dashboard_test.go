@@ -0,0 +1,53 @@
+package dashboard_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/dashboard"
+)
+
+var _ = Describe("Dashboard", func() {
+	var server *httptest.Server
+	BeforeEach(func() {
+		server = httptest.NewServer(Handler())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		return resp, string(body)
+	}
+	It("should serve the page with its script and styles", func() {
+		resp, body := get("/")
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(HavePrefix("text/html"))
+		Expect(body).Should(ContainSubstring(`src="/dashboard/app.js"`))
+		Expect(body).Should(ContainSubstring(`href="/dashboard/app.css"`))
+		resp, body = get("/dashboard/app.js")
+		Expect(resp.Header.Get("Content-Type")).Should(HavePrefix("application/javascript"))
+		Expect(body).Should(ContainSubstring("/v1/stream"))
+		resp, _ = get("/dashboard/app.css")
+		Expect(resp.Header.Get("Content-Type")).Should(HavePrefix("text/css"))
+	})
+	It("should not fetch anything from elsewhere", func() {
+		for _, path := range []string{"/", "/dashboard/app.js", "/dashboard/app.css"} {
+			_, body := get(path)
+			Expect(body).ShouldNot(ContainSubstring("http://"))
+			Expect(body).ShouldNot(ContainSubstring("https://"))
+		}
+	})
+	It("should not serve anything else", func() {
+		resp, _ := get("/dashboard/missing.js")
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/discover"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	devicesUsage    = `usage: micasa devices list`
+	switchUsage     = `usage: micasa switch <name> on|off|status`
+	thermostatUsage = `usage: micasa thermostat <name> read [--watch] [--interval 10s] [--timeout 30s]`
+)
+
+//configuredDevice is a device entry of the config
+type configuredDevice struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Serial  string `json:"serial,omitempty"`
+	Switch  int    `json:"switch,omitempty"`
+}
+
+//switchResult is the status a switch reported
+type switchResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+//thermostatReading is everything a thermostat reported at Time
+type thermostatReading struct {
+	Time        time.Time          `json:"time"`
+	Name        string             `json:"name"`
+	Temperature float64            `json:"temperature"`
+	Humidity    *float64           `json:"humidity,omitempty"`
+	AirQuality  map[string]float64 `json:"airQuality,omitempty"`
+	State       map[string]string  `json:"state,omitempty"`
+}
+
+func devicesCommand(opts *options, args []string) int {
+	flags := newFlagSet("devices", opts)
+	args, ok := commandArgs(flags, args, devicesUsage)
+	if !ok || len(args) != 1 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, devicesUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, _, code := loadHome(opts)
+	if code != exitOK {
+		return code
+	}
+	devices := []configuredDevice{}
+	for i := range micasaConfig.DysonHotCoolLink {
+		device := &micasaConfig.DysonHotCoolLink[i]
+		address := device.IP
+		if device.Port != "" {
+			address += ":" + device.Port
+		}
+		devices = append(devices, configuredDevice{Kind: discover.KindDyson, Name: device.Name, Address: address, Serial: device.Serial})
+	}
+	for i := range micasaConfig.TasmotaT1 {
+		device := &micasaConfig.TasmotaT1[i]
+		devices = append(devices, configuredDevice{Kind: discover.KindTasmota, Name: device.Name, Address: device.URI, Switch: device.SwitchNumber})
+	}
+	output(opts, devices, func() {
+		for _, device := range devices {
+			fmt.Printf("%s\t%s\t%s\n", device.Name, device.Kind, device.Address)
+		}
+	})
+	return exitOK
+}
+
+func switchCommand(opts *options, args []string) int {
+	flags := newFlagSet("switch", opts)
+	args, ok := commandArgs(flags, args, switchUsage)
+	if !ok || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, switchUsage)
+		return exitUsage
+	}
+	name, action := args[0], args[1]
+	if action != "on" && action != "off" && action != "status" {
+		fmt.Fprintln(os.Stderr, switchUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, myHome, code := loadHome(opts)
+	if code != exitOK {
+		return code
+	}
+	device, ok := myHome.Switches[name]
+	if !ok {
+		return failed(opts, exitNotFound, fmt.Errorf("switch %s not found", name))
+	}
+	var err error
+	switch action {
+	case "on":
+		err = device.TurnOn()
+	case "off":
+		err = device.TurnOff()
+	}
+	if err != nil {
+		audited(micasaConfig, "switch", name, strings.ToUpper(action), err, nil)
+		return failed(opts, exitFailure, fmt.Errorf("switch %s: %v", name, err))
+	}
+	status, err := device.UpdateStatus()
+	if action != "status" {
+		audited(micasaConfig, "switch", name, strings.ToUpper(action), nil, func() (string, error) {
+			if err != nil {
+				return "", err
+			}
+			return strings.ToUpper(*status), nil
+		})
+	}
+	if err != nil {
+		return failed(opts, exitFailure, fmt.Errorf("switch %s: %v", name, err))
+	}
+	result := switchResult{Name: name, Status: *status}
+	output(opts, result, func() {
+		fmt.Printf("%s\t%s\n", result.Name, result.Status)
+	})
+	return exitOK
+}
+
+func thermostatCommand(opts *options, args []string) int {
+	flags := newFlagSet("thermostat", opts)
+	watch := flags.Bool("watch", false, "keep reading until interrupted")
+	interval := flags.Duration("interval", 10*time.Second, "how often to read when watching")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for the first reading")
+	args, ok := commandArgs(flags, args, thermostatUsage)
+	if !ok || len(args) != 2 || args[1] != "read" || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, thermostatUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	_, myHome, code := loadHome(opts)
+	if code != exitOK {
+		return code
+	}
+	name := args[0]
+	device, ok := myHome.Thermostats[name]
+	if !ok {
+		return failed(opts, exitNotFound, fmt.Errorf("thermostat %s not found", name))
+	}
+	if err := device.Connect(); err != nil {
+		return failed(opts, exitFailure, fmt.Errorf("connecting %s: %v", name, err))
+	}
+	// devices such as the Dyson only have a temperature once they report
+	reading, err := waitForReading(name, device, *timeout)
+	if err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	show := func(reading thermostatReading) {
+		output(opts, reading, func() {
+			fmt.Printf("%s\t%s\ttemperature=%.1f", reading.Time.Format(time.RFC3339), reading.Name, reading.Temperature)
+			if reading.Humidity != nil {
+				fmt.Printf("\thumidity=%.0f", *reading.Humidity)
+			}
+			for _, metric := range []string{"particulates", "voc"} {
+				if value, ok := reading.AirQuality[metric]; ok {
+					fmt.Printf("\t%s=%v", metric, value)
+				}
+			}
+			fmt.Println()
+		})
+	}
+	show(reading)
+	if !*watch {
+		return exitOK
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupted:
+			return exitOK
+		case <-ticker.C:
+			reading, err := readThermostat(name, device)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "micasa: %v\n", err)
+				continue
+			}
+			show(reading)
+		}
+	}
+}
+
+//waitForReading reads device until it has a temperature or timeout passes
+func waitForReading(name string, device thermostat.ThermostatDevice, timeout time.Duration) (thermostatReading, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		reading, err := readThermostat(name, device)
+		if err == nil {
+			return reading, nil
+		}
+		if time.Now().After(deadline) {
+			return reading, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func readThermostat(name string, device thermostat.ThermostatDevice) (thermostatReading, error) {
+	reading := thermostatReading{Time: time.Now(), Name: name}
+	temp, err := device.CurrentTemp()
+	if err != nil {
+		return reading, fmt.Errorf("thermostat %s: %v", name, err)
+	}
+	reading.Temperature = *temp
+	if sensor, ok := device.(thermostat.HumiditySensor); ok {
+		reading.Humidity, _ = sensor.CurrentHumidity()
+	}
+	if sensor, ok := device.(thermostat.AirQualitySensor); ok {
+		reading.AirQuality, _ = sensor.AirQuality()
+	}
+	if reporter, ok := device.(thermostat.StateReporter); ok {
+		reading.State, _ = reporter.CurrentState()
+	}
+	return reading, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/discover"
+	log "github.com/sirupsen/logrus"
+)
+
+const discoverUsage = `usage: micasa discover [--subnet 192.168.1.0/24] [--port 80] [--wait 5s]`
+
+//discovered is a device found on the network, Configured
+// names the config entry already driving it
+type discovered struct {
+	discover.Device
+	Configured string `json:"configured,omitempty"`
+}
+
+//discoverCommand looks for Dyson devices over mDNS and, given a
+// subnet, Tasmota relays, marking those already in the config
+func discoverCommand(opts *options, args []string) int {
+	flags := newFlagSet("discover", opts)
+	subnet := flags.String("subnet", "", "IPv4 subnet to probe for Tasmota relays")
+	port := flags.String("port", "", "port Tasmota relays answer HTTP on")
+	wait := flags.Duration("wait", 5*time.Second, "how long to listen for mDNS answers")
+	if !flagsOnly(flags, args, discoverUsage) {
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	// the config is only used to mark what is already set up
+	micasaConfig, err := loadConfig(opts)
+	if err != nil {
+		micasaConfig = &config.CasaConfig{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	devices, err := discover.Dyson(ctx)
+	if err != nil {
+		return failed(opts, exitFailure, fmt.Errorf("browsing mDNS: %v", err))
+	}
+	if *subnet != "" {
+		relays, err := discover.Tasmota(context.Background(), *subnet, *port, time.Second)
+		if err != nil {
+			return failed(opts, exitUsage, err)
+		}
+		devices = append(devices, relays...)
+	}
+	found := []discovered{}
+	for _, device := range devices {
+		found = append(found, discovered{Device: device, Configured: configuredAs(micasaConfig, device)})
+	}
+	output(opts, found, func() {
+		for _, device := range found {
+			configured := "new"
+			if device.Configured != "" {
+				configured = "configured as " + device.Configured
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", device.Kind, device.Name, device.Address, configured)
+		}
+		if len(found) == 0 {
+			fmt.Fprintln(os.Stderr, "no devices found")
+		}
+	})
+	return exitOK
+}
+
+//configuredAs is the name of the config entry for device, if any
+func configuredAs(micasaConfig *config.CasaConfig, device discover.Device) string {
+	switch device.Kind {
+	case discover.KindDyson:
+		for i := range micasaConfig.DysonHotCoolLink {
+			if micasaConfig.DysonHotCoolLink[i].Serial == device.Serial || micasaConfig.DysonHotCoolLink[i].IP == device.Address {
+				return micasaConfig.DysonHotCoolLink[i].Name
+			}
+		}
+	case discover.KindTasmota:
+		for i := range micasaConfig.TasmotaT1 {
+			if strings.TrimSuffix(micasaConfig.TasmotaT1[i].URI, "/") == device.Address {
+				return micasaConfig.TasmotaT1[i].Name
+			}
+		}
+	}
+	return ""
+}
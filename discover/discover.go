@@ -0,0 +1,195 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/dnssd"
+)
+
+const (
+	//KindDyson is a Dyson Hot+Cool Link, found by its mDNS service
+	KindDyson = "dysonHotCoolLink"
+	//KindTasmota is a Tasmota relay, found by asking every host of a
+	// subnet for its status over HTTP
+	KindTasmota = "tasmotaT1"
+
+	dysonService = "_dyson_mqtt._tcp.local."
+	// a /22 is already over a thousand requests
+	maxSubnetHosts = 1024
+	probeWorkers   = 64
+	defaultTimeout = time.Second
+)
+
+//Device is something found on the network which mi-casa can drive,
+// Address is what its config entry needs, an IP or a URI
+type Device struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    string `json:"port,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+}
+
+//Dyson browses mDNS for Dyson devices until ctx is done. The service
+// instance name is the product type and serial joined by an underscore.
+func Dyson(ctx context.Context) ([]Device, error) {
+	var lock sync.Mutex
+	found := map[string]Device{}
+	add := func(entry dnssd.BrowseEntry) {
+		if len(entry.IPs) == 0 {
+			return
+		}
+		serial := entry.Name
+		if i := strings.Index(serial, "_"); i >= 0 {
+			serial = serial[i+1:]
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		found[serial] = Device{
+			Kind:    KindDyson,
+			Name:    entry.Name,
+			Address: entry.IPs[0].String(),
+			Port:    strconv.Itoa(entry.Port),
+			Serial:  serial,
+		}
+	}
+	err := dnssd.LookupType(ctx, dysonService, add, func(dnssd.BrowseEntry) {})
+	if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+		return nil, err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	devices := []Device{}
+	for _, device := range found {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Serial < devices[j].Serial
+	})
+	return devices, nil
+}
+
+//tasmotaStatus is the part of the Tasmota "Status" command response
+// which names the device
+type tasmotaStatus struct {
+	Status *struct {
+		DeviceName   string   `json:"DeviceName"`
+		FriendlyName []string `json:"FriendlyName"`
+		Topic        string   `json:"Topic"`
+	} `json:"Status"`
+}
+
+//Tasmota asks every host of subnet, in CIDR form, for its Tasmota status
+// on port, giving each timeout to answer. Hosts which do not answer or
+// answer with anything else are skipped.
+func Tasmota(ctx context.Context, subnet string, port string, timeout time.Duration) ([]Device, error) {
+	hosts, err := subnetHosts(subnet)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	addresses := make(chan string)
+	var lock sync.Mutex
+	devices := []Device{}
+	var probing sync.WaitGroup
+	for i := 0; i < probeWorkers; i++ {
+		probing.Add(1)
+		go func() {
+			defer probing.Done()
+			for address := range addresses {
+				if device, ok := probeTasmota(ctx, client, address); ok {
+					lock.Lock()
+					devices = append(devices, device)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, host := range hosts {
+		address := host
+		if port != "" {
+			address = net.JoinHostPort(host, port)
+		}
+		select {
+		case addresses <- address:
+		case <-ctx.Done():
+		}
+	}
+	close(addresses)
+	probing.Wait()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+	return devices, nil
+}
+
+func probeTasmota(ctx context.Context, client *http.Client, address string) (Device, bool) {
+	uri := "http://" + address
+	req, err := http.NewRequest(http.MethodGet, uri+"/cm?cmnd=Status", nil)
+	if err != nil {
+		return Device{}, false
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Device{}, false
+	}
+	defer resp.Body.Close()
+	var status tasmotaStatus
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&status) != nil || status.Status == nil {
+		return Device{}, false
+	}
+	name := status.Status.DeviceName
+	if name == "" && len(status.Status.FriendlyName) > 0 {
+		name = status.Status.FriendlyName[0]
+	}
+	if name == "" {
+		name = status.Status.Topic
+	}
+	return Device{Kind: KindTasmota, Name: name, Address: uri}, true
+}
+
+//subnetHosts lists the host addresses of an IPv4 subnet, leaving out
+// the network and broadcast addresses unless it is a /31 or /32
+func subnetHosts(subnet string) ([]string, error) {
+	ip, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not IPv4", subnet)
+	}
+	ones, bits := network.Mask.Size()
+	size := 1 << uint(bits-ones)
+	if size > maxSubnetHosts {
+		return nil, fmt.Errorf("subnet %s has more than %d addresses", subnet, maxSubnetHosts)
+	}
+	first := ipToInt(network.IP.To4())
+	hosts := []string{}
+	for i := 0; i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		hosts = append(hosts, intToIP(first+uint32(i)).String())
+	}
+	return hosts, nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func intToIP(value uint32) net.IP {
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
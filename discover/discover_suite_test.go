@@ -0,0 +1,13 @@
+package discover_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDiscover(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Discover Suite")
+}
@@ -0,0 +1,62 @@
+package discover_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/discover"
+)
+
+var _ = Describe("Tasmota", func() {
+	var (
+		server *httptest.Server
+		port   string
+	)
+	serve := func(handler http.HandlerFunc) {
+		server = httptest.NewServer(handler)
+		_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+	}
+	AfterEach(func() {
+		server.Close()
+	})
+	It("should find a device answering with its status", func() {
+		serve(func(resp http.ResponseWriter, req *http.Request) {
+			Expect(req.URL.Query().Get("cmnd")).Should(Equal("Status"))
+			fmt.Fprint(resp, `{"Status": {"Module": 29, "DeviceName": "porch", "FriendlyName": ["Porch"], "Topic": "tasmota_1A2B3C"}}`)
+		})
+		devices, err := Tasmota(context.Background(), "127.0.0.1/32", port, time.Second)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(devices).Should(Equal([]Device{{Kind: KindTasmota, Name: "porch", Address: "http://127.0.0.1:" + port}}))
+	})
+	It("should fall back to the friendly name", func() {
+		serve(func(resp http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(resp, `{"Status": {"FriendlyName": ["Porch"]}}`)
+		})
+		devices, err := Tasmota(context.Background(), "127.0.0.1/32", port, time.Second)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(devices).Should(HaveLen(1))
+		Expect(devices[0].Name).Should(Equal("Porch"))
+	})
+	It("should skip hosts which are not Tasmota", func() {
+		serve(func(resp http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(resp, `<html>router login</html>`)
+		})
+		devices, err := Tasmota(context.Background(), "127.0.0.1/32", port, time.Second)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(devices).Should(BeEmpty())
+	})
+	It("should refuse a subnet too large to scan", func() {
+		serve(func(resp http.ResponseWriter, req *http.Request) {})
+		_, err := Tasmota(context.Background(), "10.0.0.0/8", port, time.Second)
+		Expect(err).Should(HaveOccurred())
+		_, err = Tasmota(context.Background(), "10.0.0.1", port, time.Second)
+		Expect(err).Should(HaveOccurred())
+	})
+})
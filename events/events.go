@@ -0,0 +1,126 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Kind is what an Event describes
+type Kind string
+
+const (
+	//KindReading is a sensor reading, Metric and Value are set
+	KindReading Kind = "reading"
+	//KindSwitch is a relay transition, State is "ON" or "OFF"
+	KindSwitch Kind = "switch"
+	//KindDecision is an HVAC call change, State is the call,
+	// Value the temperature and Reason why
+	KindDecision Kind = "decision"
+	//KindHealth is a device becoming reachable or unreachable,
+	// State is "up" or "down" and Reason the error when down
+	KindHealth Kind = "health"
+)
+
+//Backlog is how many of the latest events the bus keeps for Since
+const Backlog = 1024
+
+//Event is something that happened to a device
+type Event struct {
+	ID     uint64    `json:"id,omitempty"`
+	Time   time.Time `json:"time"`
+	Kind   Kind      `json:"kind"`
+	Device string    `json:"device"`
+	Metric string    `json:"metric,omitempty"`
+	Value  float64   `json:"value"`
+	State  string    `json:"state,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+//Bus fans events out to every subscriber. Publishing never blocks,
+// a subscriber which falls behind misses events rather than stalling
+// the device or controller publishing them. Every event is numbered as
+// it is published so a subscriber can catch up on the latest Backlog
+// events with Since. A nil Bus drops everything.
+type Bus struct {
+	subscribers map[int]chan Event
+	next        int
+	sequence    uint64
+	recent      []Event
+	lock        sync.Mutex
+}
+
+//NewBus returns a Bus without any subscribers
+func NewBus() *Bus {
+	return &Bus{subscribers: map[int]chan Event{}}
+}
+
+//Publish numbers event and sends it to every subscriber
+func (bus *Bus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.sequence++
+	event.ID = bus.sequence
+	if len(bus.recent) >= Backlog {
+		bus.recent = bus.recent[1:]
+	}
+	bus.recent = append(bus.recent, event)
+	for id, subscriber := range bus.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			log.WithFields(log.Fields{
+				"subscriber": id,
+				"kind":       event.Kind,
+				"device":     event.Device,
+			}).Warn("event subscriber is full, dropping event")
+		}
+	}
+}
+
+//Subscribe returns a channel receiving every event published from now
+// on, buffering up to buffer events, and a function to unsubscribe
+// which closes the channel
+func (bus *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	id := bus.next
+	bus.next++
+	subscriber := make(chan Event, buffer)
+	bus.subscribers[id] = subscriber
+	var once sync.Once
+	return subscriber, func() {
+		once.Do(func() {
+			bus.lock.Lock()
+			defer bus.lock.Unlock()
+			delete(bus.subscribers, id)
+			close(subscriber)
+		})
+	}
+}
+
+//Since returns the kept events published after the event numbered id,
+// false when some of them are no longer kept. An id beyond any published
+// was numbered before a restart, every kept event is returned and false.
+func (bus *Bus) Since(id uint64) ([]Event, bool) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	missed := []Event{}
+	if id > bus.sequence {
+		return append(missed, bus.recent...), false
+	}
+	for _, event := range bus.recent {
+		if event.ID > id {
+			missed = append(missed, event)
+		}
+	}
+	complete := id >= bus.sequence || (len(bus.recent) > 0 && bus.recent[0].ID <= id+1)
+	return missed, complete
+}
@@ -0,0 +1,75 @@
+package events_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/events"
+)
+
+var _ = Describe("Bus", func() {
+	var bus *Bus
+	BeforeEach(func() {
+		bus = NewBus()
+	})
+	It("should deliver events to every subscriber", func() {
+		first, unsubscribeFirst := bus.Subscribe(1)
+		defer unsubscribeFirst()
+		second, unsubscribeSecond := bus.Subscribe(1)
+		defer unsubscribeSecond()
+		bus.Publish(Event{Kind: KindSwitch, Device: "blower", State: "ON"})
+		Expect((<-first).Device).Should(Equal("blower"))
+		event := <-second
+		Expect(event.State).Should(Equal("ON"))
+		Expect(event.Time.IsZero()).Should(BeFalse())
+	})
+	It("should drop events for a full subscriber rather than block", func() {
+		subscriber, unsubscribe := bus.Subscribe(1)
+		defer unsubscribe()
+		bus.Publish(Event{Device: "first"})
+		bus.Publish(Event{Device: "second"})
+		Expect((<-subscriber).Device).Should(Equal("first"))
+		Consistently(subscriber).ShouldNot(Receive())
+	})
+	It("should close the channel when unsubscribing", func() {
+		subscriber, unsubscribe := bus.Subscribe(1)
+		unsubscribe()
+		unsubscribe()
+		Eventually(subscriber).Should(BeClosed())
+		bus.Publish(Event{Device: "blower"})
+	})
+	It("should ignore events published to a nil bus", func() {
+		var nilBus *Bus
+		nilBus.Publish(Event{Device: "blower"})
+	})
+	It("should number events and replay those since an event", func() {
+		for _, device := range []string{"first", "second", "third"} {
+			bus.Publish(Event{Device: device})
+		}
+		missed, complete := bus.Since(1)
+		Expect(complete).Should(BeTrue())
+		Expect(missed).Should(HaveLen(2))
+		Expect(missed[0].ID).Should(Equal(uint64(2)))
+		Expect(missed[1].Device).Should(Equal("third"))
+		missed, complete = bus.Since(3)
+		Expect(complete).Should(BeTrue())
+		Expect(missed).Should(BeEmpty())
+	})
+	It("should say when events since an event are no longer kept", func() {
+		for i := 0; i < Backlog+2; i++ {
+			bus.Publish(Event{Device: "blower"})
+		}
+		missed, complete := bus.Since(1)
+		Expect(complete).Should(BeFalse())
+		Expect(missed).Should(HaveLen(Backlog))
+		_, complete = bus.Since(2)
+		Expect(complete).Should(BeTrue())
+	})
+	It("should replay everything kept for an event numbered before a restart", func() {
+		bus.Publish(Event{Device: "blower"})
+		missed, complete := bus.Since(500)
+		Expect(complete).Should(BeFalse())
+		Expect(missed).Should(HaveLen(1))
+		Expect(missed[0].ID).Should(Equal(uint64(1)))
+	})
+})
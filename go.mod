@@ -3,12 +3,19 @@ module github.com/oskoss/mi-casa
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/brutella/dnssd v1.2.1
+	github.com/brutella/hc v1.2.5
 	github.com/eclipse/paho.mqtt.golang v1.3.2
+	github.com/go-chi/chi v4.1.2+incompatible
+	github.com/gorilla/websocket v1.4.2
 	github.com/magefile/mage v1.11.0 // indirect
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.8.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.8.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20210224082022-3d97a244fca7 // indirect
-	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073 // indirect
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,355 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInterval        = time.Minute
+	defaultRetention       = 90 * 24 * time.Hour
+	defaultDownsampleAfter = 7 * 24 * time.Hour
+	defaultResolution      = 15 * time.Minute
+	dayFormat              = "2006-01-02"
+	fileSuffix             = ".jsonl"
+)
+
+//Config is the history section of the mi-casa YAML config. Readings
+// are sampled every Interval, kept at full resolution for DownsampleAfter
+// and then averaged into Resolution buckets until Retention has passed.
+type Config struct {
+	Directory       string        `yaml:"directory"`
+	Interval        time.Duration `yaml:"interval,omitempty"`
+	Retention       time.Duration `yaml:"retention,omitempty"`
+	DownsampleAfter time.Duration `yaml:"downsampleAfter,omitempty"`
+	Resolution      time.Duration `yaml:"resolution,omitempty"`
+}
+
+//Query selects events, empty fields match everything
+type Query struct {
+	Device string
+	Metric string
+	Kind   events.Kind
+	From   time.Time
+	To     time.Time
+}
+
+func (query Query) matches(event events.Event) bool {
+	switch {
+	case query.Device != "" && event.Device != query.Device:
+		return false
+	case query.Metric != "" && event.Metric != query.Metric:
+		return false
+	case query.Kind != "" && event.Kind != query.Kind:
+		return false
+	case !query.From.IsZero() && event.Time.Before(query.From):
+		return false
+	case !query.To.IsZero() && event.Time.After(query.To):
+		return false
+	}
+	return true
+}
+
+//Store keeps events in one JSON lines file per UTC day within
+// Directory, so old days are removed or downsampled a file at a time
+type Store struct {
+	Config      Config
+	downsampled map[string]bool
+	file        *os.File
+	day         string
+	lock        sync.Mutex
+}
+
+//Open creates the history directory when needed and fills in defaults
+func Open(conf Config) (*Store, error) {
+	if conf.Directory == "" {
+		return nil, fmt.Errorf("history directory not set")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = defaultInterval
+	}
+	if conf.Retention <= 0 {
+		conf.Retention = defaultRetention
+	}
+	if conf.DownsampleAfter <= 0 {
+		conf.DownsampleAfter = defaultDownsampleAfter
+	}
+	if conf.Resolution <= 0 {
+		conf.Resolution = defaultResolution
+	}
+	if err := os.MkdirAll(conf.Directory, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Config: conf, downsampled: map[string]bool{}}, nil
+}
+
+//Record appends event to the file for its day
+func (store *Store) Record(event events.Event) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	day := event.Time.UTC().Format(dayFormat)
+	if store.file == nil || store.day != day {
+		if err := store.closeFile(); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(store.path(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		store.file = file
+		store.day = day
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = store.file.Write(append(line, '\n'))
+	return err
+}
+
+//Query returns the matching events in time order
+func (store *Store) Query(query Query) ([]events.Event, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	days, err := store.days()
+	if err != nil {
+		return nil, err
+	}
+	found := []events.Event{}
+	for _, day := range days {
+		if !query.From.IsZero() && day < query.From.UTC().Format(dayFormat) {
+			continue
+		}
+		if !query.To.IsZero() && day > query.To.UTC().Format(dayFormat) {
+			continue
+		}
+		dayEvents, err := store.read(day)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range dayEvents {
+			if query.matches(event) {
+				found = append(found, event)
+			}
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Time.Before(found[j].Time)
+	})
+	return found, nil
+}
+
+//Maintain removes days past Retention and downsamples
+// the readings of days past DownsampleAfter
+func (store *Store) Maintain(now time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	days, err := store.days()
+	if err != nil {
+		return err
+	}
+	expired := now.Add(-store.Config.Retention).UTC().Format(dayFormat)
+	settled := now.Add(-store.Config.DownsampleAfter).UTC().Format(dayFormat)
+	for _, day := range days {
+		switch {
+		case day < expired:
+			if day == store.day {
+				store.closeFile()
+			}
+			if err := os.Remove(store.path(day)); err != nil {
+				return err
+			}
+			delete(store.downsampled, day)
+			log.WithFields(log.Fields{
+				"day": day,
+			}).Printf("history expired")
+		case day < settled && !store.downsampled[day]:
+			if err := store.downsample(day); err != nil {
+				return err
+			}
+			store.downsampled[day] = true
+		}
+	}
+	return nil
+}
+
+//Run records every event published to bus and maintains the
+// store hourly until stop is closed
+func (store *Store) Run(bus *events.Bus, stop <-chan struct{}) {
+	received, unsubscribe := bus.Subscribe(1024)
+	defer unsubscribe()
+	maintenance := time.NewTicker(time.Hour)
+	defer maintenance.Stop()
+	if err := store.Maintain(time.Now()); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("history maintenance failed")
+	}
+	for {
+		select {
+		case <-stop:
+			store.Close()
+			return
+		case event := <-received:
+			if err := store.Record(event); err != nil {
+				log.WithFields(log.Fields{
+					"err":    err,
+					"device": event.Device,
+				}).Error("could not record history")
+			}
+		case now := <-maintenance.C:
+			if err := store.Maintain(now); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("history maintenance failed")
+			}
+		}
+	}
+}
+
+//Close closes the file being appended to
+func (store *Store) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.closeFile()
+}
+
+func (store *Store) closeFile() error {
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	store.day = ""
+	return err
+}
+
+func (store *Store) path(day string) string {
+	return filepath.Join(store.Config.Directory, day+fileSuffix)
+}
+
+//days lists the days with a history file, oldest first
+func (store *Store) days() ([]string, error) {
+	files, err := ioutil.ReadDir(store.Config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	days := []string{}
+	for _, file := range files {
+		day := strings.TrimSuffix(file.Name(), fileSuffix)
+		if file.IsDir() || day == file.Name() {
+			continue
+		}
+		if _, err := time.Parse(dayFormat, day); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (store *Store) read(day string) ([]events.Event, error) {
+	file, err := os.Open(store.path(day))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dayEvents := []events.Event{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a line cut short by a crash loses that event only
+			log.WithFields(log.Fields{
+				"day": day,
+				"err": err,
+			}).Warn("skipping unreadable history line")
+			continue
+		}
+		dayEvents = append(dayEvents, event)
+	}
+	return dayEvents, scanner.Err()
+}
+
+//downsample averages the readings of day into Resolution buckets,
+// switch and decision events are few enough to keep as they are
+func (store *Store) downsample(day string) error {
+	dayEvents, err := store.read(day)
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		device string
+		metric string
+		start  time.Time
+	}
+	sums := map[bucket]float64{}
+	counts := map[bucket]int{}
+	kept := []events.Event{}
+	for _, event := range dayEvents {
+		if event.Kind != events.KindReading {
+			kept = append(kept, event)
+			continue
+		}
+		key := bucket{event.Device, event.Metric, event.Time.UTC().Truncate(store.Config.Resolution)}
+		sums[key] += event.Value
+		counts[key]++
+	}
+	for key, sum := range sums {
+		kept = append(kept, events.Event{
+			Time:   key.start,
+			Kind:   events.KindReading,
+			Device: key.device,
+			Metric: key.metric,
+			Value:  sum / float64(counts[key]),
+		})
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].Time.Equal(kept[j].Time) {
+			return kept[i].Device+kept[i].Metric < kept[j].Device+kept[j].Metric
+		}
+		return kept[i].Time.Before(kept[j].Time)
+	})
+
+	if day == store.day {
+		store.closeFile()
+	}
+	tmp := store.path(day) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range kept {
+		if err := encoder.Encode(event); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"day":    day,
+		"before": len(dayEvents),
+		"after":  len(kept),
+	}).Printf("history downsampled")
+	return os.Rename(tmp, store.path(day))
+}
@@ -0,0 +1,138 @@
+package history_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/history"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		directory string
+		store     *Store
+		start     time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "history")
+		Expect(err).ShouldNot(HaveOccurred())
+		store, err = Open(Config{
+			Directory:       directory,
+			Retention:       30 * 24 * time.Hour,
+			DownsampleAfter: 2 * 24 * time.Hour,
+			Resolution:      time.Hour,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		start = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	})
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll(directory)
+	})
+	reading := func(at time.Time, device string, value float64) events.Event {
+		return events.Event{Time: at, Kind: events.KindReading, Device: device, Metric: "temperature", Value: value}
+	}
+	Describe("recording and querying", func() {
+		BeforeEach(func() {
+			Expect(store.Record(reading(start, "office", 70))).Should(Succeed())
+			Expect(store.Record(reading(start.Add(time.Minute), "bedroom", 66))).Should(Succeed())
+			Expect(store.Record(events.Event{Time: start.Add(2 * time.Minute), Kind: events.KindSwitch, Device: "blower", State: "ON"})).Should(Succeed())
+			Expect(store.Record(reading(start.Add(24*time.Hour), "office", 71))).Should(Succeed())
+		})
+		It("should write one file per day", func() {
+			Expect(filepath.Join(directory, "2021-03-01.jsonl")).Should(BeAnExistingFile())
+			Expect(filepath.Join(directory, "2021-03-02.jsonl")).Should(BeAnExistingFile())
+		})
+		It("should return everything in time order", func() {
+			found, err := store.Query(Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(4))
+			Expect(found[3].Value).Should(Equal(71.0))
+		})
+		It("should filter by device and time", func() {
+			found, err := store.Query(Query{Device: "office", From: start.Add(time.Hour), To: start.Add(48 * time.Hour)})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(1))
+			Expect(found[0].Time).Should(BeTemporally("==", start.Add(24*time.Hour)))
+		})
+		It("should filter by kind", func() {
+			found, err := store.Query(Query{Kind: events.KindSwitch})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(1))
+			Expect(found[0].State).Should(Equal("ON"))
+		})
+		It("should survive a line cut short", func() {
+			file, err := os.OpenFile(filepath.Join(directory, "2021-03-01.jsonl"), os.O_APPEND|os.O_WRONLY, 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+			file.WriteString(`{"time":"2021-03-01T`)
+			file.Close()
+			found, err := store.Query(Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(4))
+		})
+	})
+	Describe("maintaining", func() {
+		BeforeEach(func() {
+			for minute := 0; minute < 120; minute++ {
+				Expect(store.Record(reading(start.Add(time.Duration(minute)*time.Minute), "office", float64(minute)))).Should(Succeed())
+			}
+			Expect(store.Record(events.Event{Time: start.Add(time.Minute), Kind: events.KindSwitch, Device: "blower", State: "ON"})).Should(Succeed())
+		})
+		It("should leave recent days alone", func() {
+			Expect(store.Maintain(start.Add(24 * time.Hour))).Should(Succeed())
+			found, err := store.Query(Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(121))
+		})
+		It("should average old readings and keep switch events", func() {
+			Expect(store.Maintain(start.Add(3 * 24 * time.Hour))).Should(Succeed())
+			found, err := store.Query(Query{Kind: events.KindReading})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(2))
+			Expect(found[0].Time).Should(BeTemporally("==", start))
+			Expect(found[0].Value).Should(Equal(29.5))
+			Expect(found[1].Value).Should(Equal(89.5))
+			switches, err := store.Query(Query{Kind: events.KindSwitch})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(switches).Should(HaveLen(1))
+		})
+		It("should keep recording after downsampling the current day", func() {
+			Expect(store.Maintain(start.Add(3 * 24 * time.Hour))).Should(Succeed())
+			Expect(store.Record(reading(start.Add(3*time.Hour), "office", 50))).Should(Succeed())
+			found, err := store.Query(Query{Kind: events.KindReading})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(HaveLen(3))
+		})
+		It("should remove days past retention", func() {
+			Expect(store.Maintain(start.Add(31 * 24 * time.Hour))).Should(Succeed())
+			found, err := store.Query(Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(found).Should(BeEmpty())
+		})
+	})
+	Describe("running", func() {
+		It("should record events published to the bus", func() {
+			bus := events.NewBus()
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				store.Run(bus, stop)
+				close(done)
+			}()
+			Eventually(func() []events.Event {
+				bus.Publish(reading(time.Now(), "office", 70))
+				found, _ := store.Query(Query{Device: "office"})
+				return found
+			}).ShouldNot(BeEmpty())
+			close(stop)
+			Eventually(done).Should(BeClosed())
+		})
+	})
+})
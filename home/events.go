@@ -0,0 +1,242 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//manualReason is the reason of a switch event for a change
+// made outside mi-casa
+const manualReason = "changed outside mi-casa"
+
+//Instrument publishes every switch transition and every change in
+// whether a switch can be reached to bus by wrapping each switch,
+// so it must be called before Switches is handed out
+func (myHome *Home) Instrument(bus *events.Bus) {
+	myHome.Events = bus
+	switches := myHome.interlocked(myHome.Switches, nil)
+	for name, device := range switches {
+		switches[name] = &instrumentedSwitch{name: name, device: device, home: myHome}
+	}
+	switches = myHome.interlocked(switches, myHome.opposing)
+	myHome.lock.Lock()
+	myHome.Switches = switches
+	myHome.lock.Unlock()
+}
+
+//reportHealth publishes a health event when a device becomes unreachable
+// or reachable again, devices are taken to be up until an error says not
+func (myHome *Home) reportHealth(name string, err error) {
+	myHome.healthLock.Lock()
+	defer myHome.healthLock.Unlock()
+	if myHome.down == nil {
+		myHome.down = map[string]bool{}
+	}
+	wasDown := myHome.down[name]
+	event := events.Event{Kind: events.KindHealth, Device: name}
+	switch {
+	case err != nil && !wasDown:
+		myHome.down[name] = true
+		event.State = "down"
+		event.Reason = err.Error()
+	case err == nil && wasDown:
+		delete(myHome.down, name)
+		event.State = "up"
+	default:
+		return
+	}
+	myHome.Events.Publish(event)
+}
+
+//Sample publishes a reading for every metric of every thermostat and
+// reads every switch, so one changed outside mi-casa is noticed, with the
+// supply voltage of Tasmota switches. Devices which cannot be read are
+// skipped and reported down.
+func (myHome *Home) Sample(now time.Time) {
+	thermostats, allSwitches := myHome.Devices()
+	names := []string{}
+	for name := range thermostats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, err := readings(name, thermostats[name])
+		myHome.reportHealth(name, err)
+		for metric, value := range values {
+			myHome.Events.Publish(events.Event{
+				Time:   now,
+				Kind:   events.KindReading,
+				Device: name,
+				Metric: metric,
+				Value:  value,
+			})
+		}
+	}
+	switches := []string{}
+	for name := range allSwitches {
+		switches = append(switches, name)
+	}
+	sort.Strings(switches)
+	for _, name := range switches {
+		device := allSwitches[name]
+		if _, err := device.UpdateStatus(); err != nil {
+			continue
+		}
+		tasmota, ok := switcher.Unwrap(device).(*switcher.TasmotaT1)
+		if !ok {
+			continue
+		}
+		// a sagging supply is the first sign of a failing Tasmota
+		if vcc := tasmota.LastStatus().Vcc; vcc > 0 {
+			myHome.Events.Publish(events.Event{
+				Time:   now,
+				Kind:   events.KindReading,
+				Device: name,
+				Metric: "vcc",
+				Value:  vcc,
+			})
+		}
+	}
+}
+
+//Watch samples the devices every interval until stop is closed
+func (myHome *Home) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			myHome.Sample(now)
+		}
+	}
+}
+
+//readings returns every metric device can report, with the error
+// reading the temperature which every thermostat provides
+func readings(name string, device thermostat.ThermostatDevice) (map[string]float64, error) {
+	values := map[string]float64{}
+	logFailure := func(metric string, err error) {
+		log.WithFields(log.Fields{
+			"device": name,
+			"metric": metric,
+			"err":    err,
+		}).Debugf("could not sample reading")
+	}
+	temp, err := device.CurrentTemp()
+	if err == nil {
+		values["temperature"] = *temp
+	} else {
+		logFailure("temperature", err)
+	}
+	if sensor, ok := device.(thermostat.HumiditySensor); ok {
+		if humidity, err := sensor.CurrentHumidity(); err == nil {
+			values["humidity"] = *humidity
+		} else {
+			logFailure("humidity", err)
+		}
+	}
+	if sensor, ok := device.(thermostat.AirQualitySensor); ok {
+		if quality, err := sensor.AirQuality(); err == nil {
+			for metric, value := range quality {
+				values[metric] = value
+			}
+		} else {
+			logFailure("air quality", err)
+		}
+	}
+	return values, err
+}
+
+//instrumentedSwitch publishes a switch event after every successful
+// TurnOn or TurnOff of the switch it wraps, and a health event whenever
+// the switch stops or starts answering. A status read which differs from
+// the last one known is a change made outside mi-casa, which is published
+// and audited as a manual override. Calls are made one at a time so a
+// read racing a command is not mistaken for one.
+type instrumentedSwitch struct {
+	name   string
+	device switcher.SwitchDevice
+	home   *Home
+	known  string
+	lock   sync.Mutex
+}
+
+func (instrumented *instrumentedSwitch) Unwrap() switcher.SwitchDevice {
+	return instrumented.device
+}
+
+func (instrumented *instrumentedSwitch) UpdateStatus() (status *string, err error) {
+	instrumented.lock.Lock()
+	defer instrumented.lock.Unlock()
+	status, err = instrumented.device.UpdateStatus()
+	instrumented.home.reportHealth(instrumented.name, err)
+	if err != nil {
+		// it may lose power meanwhile, which is not a manual change
+		instrumented.known = ""
+		return status, err
+	}
+	found := strings.ToUpper(*status)
+	if instrumented.known != "" && found != instrumented.known {
+		now := time.Now()
+		instrumented.publish(found, manualReason, now)
+		instrumented.home.Audit.Record(audit.Entry{
+			Time:   now,
+			Source: audit.SourceManual,
+			Actor:  "unknown",
+			Action: "switch",
+			Target: instrumented.name,
+			Result: found,
+			Reason: fmt.Sprintf("found %s, mi-casa last knew it %s", found, instrumented.known),
+		})
+		log.WithFields(log.Fields{
+			"switch": instrumented.name,
+			"was":    instrumented.known,
+			"now":    found,
+		}).Printf("switch changed outside mi-casa")
+	}
+	instrumented.known = found
+	return status, err
+}
+
+func (instrumented *instrumentedSwitch) TurnOn() (err error) {
+	return instrumented.turn("ON", instrumented.device.TurnOn)
+}
+
+func (instrumented *instrumentedSwitch) TurnOff() (err error) {
+	return instrumented.turn("OFF", instrumented.device.TurnOff)
+}
+
+func (instrumented *instrumentedSwitch) turn(state string, turn func() error) error {
+	instrumented.lock.Lock()
+	defer instrumented.lock.Unlock()
+	err := turn()
+	instrumented.home.reportHealth(instrumented.name, err)
+	if err != nil {
+		instrumented.known = ""
+		return err
+	}
+	instrumented.known = state
+	instrumented.publish(state, "", time.Now())
+	return nil
+}
+
+func (instrumented *instrumentedSwitch) publish(state string, reason string, now time.Time) {
+	instrumented.home.Events.Publish(events.Event{
+		Time:   now,
+		Kind:   events.KindSwitch,
+		Device: instrumented.name,
+		State:  state,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,163 @@
+package home_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Events", func() {
+	var (
+		office      *thermostat.MockThermostat
+		blower      *switcher.MockSwitch
+		myHome      *Home
+		bus         *events.Bus
+		received    <-chan events.Event
+		unsubscribe func()
+	)
+	BeforeEach(func() {
+		office = &thermostat.MockThermostat{Temperature: 70, Humidity: 40, Quality: map[string]float64{"voc": 2}}
+		blower = &switcher.MockSwitch{Status: "OFF"}
+		myHome = &Home{
+			Thermostats: map[string]thermostat.ThermostatDevice{"office": office},
+			Switches:    map[string]switcher.SwitchDevice{"blower": blower},
+		}
+		bus = events.NewBus()
+		received, unsubscribe = bus.Subscribe(10)
+		myHome.Instrument(bus)
+	})
+	AfterEach(func() {
+		unsubscribe()
+	})
+	Describe("switching", func() {
+		It("should publish each transition", func() {
+			Expect(myHome.Switches["blower"].TurnOn()).Should(Succeed())
+			Expect(blower.Status).Should(Equal("ON"))
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindSwitch))
+			Expect(event.Device).Should(Equal("blower"))
+			Expect(event.State).Should(Equal("ON"))
+		})
+		It("should not publish a failed transition", func() {
+			blower.Err = errors.New("unreachable")
+			Expect(myHome.Switches["blower"].TurnOff()).ShouldNot(Succeed())
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindHealth))
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+	Describe("sampling", func() {
+		It("should publish every metric", func() {
+			now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+			myHome.Sample(now)
+			metrics := map[string]float64{}
+			for i := 0; i < 3; i++ {
+				event := <-received
+				Expect(event.Time).Should(Equal(now))
+				metrics[event.Metric] = event.Value
+			}
+			Expect(metrics).Should(Equal(map[string]float64{"temperature": 70, "humidity": 40, "voc": 2}))
+		})
+		It("should publish the supply voltage of a Tasmota", func() {
+			statusJSON, err := ioutil.ReadFile("../assets/testTasmotaStatus.json")
+			Expect(err).ShouldNot(HaveOccurred())
+			server := ghttp.NewServer()
+			defer server.Close()
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, statusJSON))
+			myHome = &Home{Switches: map[string]switcher.SwitchDevice{
+				"closet": &switcher.TasmotaT1{Name: "closet", URI: server.URL(), SwitchNumber: 1},
+			}}
+			myHome.Instrument(bus)
+			myHome.Sample(time.Now())
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindReading))
+			Expect(event.Device).Should(Equal("closet"))
+			Expect(event.Metric).Should(Equal("vcc"))
+			Expect(event.Value).Should(Equal(3.252))
+		})
+		It("should skip a device which cannot be read", func() {
+			office.Err = errors.New("unreachable")
+			myHome.Sample(time.Now())
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindHealth))
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+	Describe("manual overrides", func() {
+		var directory string
+		BeforeEach(func() {
+			var err error
+			directory, err = ioutil.TempDir("", "home")
+			Expect(err).ShouldNot(HaveOccurred())
+			myHome.Audit = audit.Open(audit.Config{File: filepath.Join(directory, "audit.jsonl")})
+		})
+		AfterEach(func() {
+			os.RemoveAll(directory)
+		})
+		It("should publish and audit a switch changed outside mi-casa", func() {
+			Expect(myHome.Switches["blower"].TurnOff()).Should(Succeed())
+			Expect((<-received).State).Should(Equal("OFF"))
+			blower.Status = "ON"
+			_, err := myHome.Switches["blower"].UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindSwitch))
+			Expect(event.State).Should(Equal("ON"))
+			Expect(event.Reason).Should(Equal("changed outside mi-casa"))
+			entries, err := myHome.Audit.Query(audit.Query{Source: audit.SourceManual})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Target).Should(Equal("blower"))
+			Expect(entries[0].Result).Should(Equal("ON"))
+		})
+		It("should not take the first status read for a change", func() {
+			_, err := myHome.Switches["blower"].UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			Consistently(received).ShouldNot(Receive())
+			Expect(myHome.Audit.Query(audit.Query{})).Should(BeEmpty())
+		})
+	})
+	Describe("health", func() {
+		It("should publish when a device goes down and comes back", func() {
+			blower.Err = errors.New("unreachable")
+			_, err := myHome.Switches["blower"].UpdateStatus()
+			Expect(err).Should(HaveOccurred())
+			_, err = myHome.Switches["blower"].UpdateStatus()
+			Expect(err).Should(HaveOccurred())
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindHealth))
+			Expect(event.Device).Should(Equal("blower"))
+			Expect(event.State).Should(Equal("down"))
+			Expect(event.Reason).Should(Equal("unreachable"))
+			Consistently(received).ShouldNot(Receive())
+
+			blower.Err = nil
+			_, err = myHome.Switches["blower"].UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			event = <-received
+			Expect(event.State).Should(Equal("up"))
+		})
+		It("should take devices to be up until they fail", func() {
+			myHome.Sample(time.Now())
+			_, err := myHome.Switches["blower"].UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				Expect((<-received).Kind).Should(Equal(events.KindReading))
+			}
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+})
@@ -0,0 +1,117 @@
+package home
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//Home holds every configured device by name, Events is
+// where device activity is published once instrumented and
+// Audit where switches changed outside mi-casa are recorded.
+// Anything reading the devices while the config may be reloaded
+// goes through Devices, Thermostat and Switch.
+type Home struct {
+	Name        string
+	Thermostats map[string]thermostat.ThermostatDevice
+	Switches    map[string]switcher.SwitchDevice
+	Events      *events.Bus
+	Audit       *audit.Trail
+	down        map[string]bool
+	healthLock  sync.Mutex
+	// guards replacing Thermostats and Switches, the maps
+	// themselves are never changed once handed out
+	lock sync.RWMutex
+	// the configured settings of each device, to tell what a reload changes
+	settings map[string]interface{}
+	// the heat or cool relays each relay must not be on together with
+	opposing      map[string][]string
+	interlockLock sync.Mutex
+}
+
+//New builds a Home from the devices within the config,
+// the devices point back into casaConfig rather than being copied
+func New(casaConfig *config.CasaConfig) (*Home, error) {
+	myHome := &Home{
+		Name:        casaConfig.Name,
+		Thermostats: map[string]thermostat.ThermostatDevice{},
+		Switches:    map[string]switcher.SwitchDevice{},
+		settings:    map[string]interface{}{},
+	}
+	for i := range casaConfig.DysonHotCoolLink {
+		device := &casaConfig.DysonHotCoolLink[i]
+		if err := myHome.checkName(device.Name); err != nil {
+			return nil, err
+		}
+		myHome.Thermostats[device.Name] = device
+		myHome.settings[device.Name] = dysonSettings(device)
+	}
+	for i := range casaConfig.TasmotaT1 {
+		device := &casaConfig.TasmotaT1[i]
+		if err := myHome.checkName(device.Name); err != nil {
+			return nil, err
+		}
+		myHome.Switches[device.Name] = device
+		myHome.settings[device.Name] = tasmotaSettings(device)
+	}
+	confs := append([]hvac.Config{}, casaConfig.Zones...)
+	if casaConfig.HVAC != nil {
+		confs = append(confs, *casaConfig.HVAC)
+	}
+	myHome.Interlock(confs)
+	return myHome, nil
+}
+
+func (myHome *Home) checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("device name not set")
+	}
+	_, isThermostat := myHome.Thermostats[name]
+	_, isSwitch := myHome.Switches[name]
+	if isThermostat || isSwitch {
+		return fmt.Errorf("device name %s is used more than once", name)
+	}
+	return nil
+}
+
+//Devices returns the thermostats and switches in use, which
+// must only be read as a reload replaces them rather than changing them
+func (myHome *Home) Devices() (map[string]thermostat.ThermostatDevice, map[string]switcher.SwitchDevice) {
+	myHome.lock.RLock()
+	defer myHome.lock.RUnlock()
+	return myHome.Thermostats, myHome.Switches
+}
+
+//Thermostat returns the named thermostat in use
+func (myHome *Home) Thermostat(name string) (thermostat.ThermostatDevice, bool) {
+	thermostats, _ := myHome.Devices()
+	device, ok := thermostats[name]
+	return device, ok
+}
+
+//Switch returns the named switch in use
+func (myHome *Home) Switch(name string) (switcher.SwitchDevice, bool) {
+	_, switches := myHome.Devices()
+	device, ok := switches[name]
+	return device, ok
+}
+
+//Connect connects every thermostat, returning the first failure
+func (myHome *Home) Connect() error {
+	for name, device := range myHome.Thermostats {
+		if err := device.Connect(); err != nil {
+			return fmt.Errorf("connecting %s: %v", name, err)
+		}
+		log.WithFields(log.Fields{
+			"thermostat": name,
+		}).Printf("thermostat connected")
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package home_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHome(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Home Suite")
+}
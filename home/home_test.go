@@ -0,0 +1,57 @@
+package home_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/config"
+	. "github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Home", func() {
+	var casaConfig config.CasaConfig
+	BeforeEach(func() {
+		casaConfig = config.CasaConfig{
+			Name: "myCasa",
+			DysonHotCoolLink: []thermostat.DysonHotCoolLink{
+				{Name: "office"},
+			},
+			TasmotaT1: []switcher.TasmotaT1{
+				{Name: "blower", SwitchNumber: 3},
+			},
+		}
+	})
+	Describe("building a home from config", func() {
+		It("should index every device by name", func() {
+			myHome, err := New(&casaConfig)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(myHome.Thermostats).Should(HaveKey("office"))
+			Expect(myHome.Switches).Should(HaveKey("blower"))
+		})
+		It("should point back into the config", func() {
+			myHome, err := New(&casaConfig)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(myHome.Switches["blower"]).Should(BeIdenticalTo(&casaConfig.TasmotaT1[0]))
+		})
+		Context("when two devices share a name", func() {
+			BeforeEach(func() {
+				casaConfig.TasmotaT1[0].Name = "office"
+			})
+			It("should return an error", func() {
+				_, err := New(&casaConfig)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+		Context("when a device has no name", func() {
+			BeforeEach(func() {
+				casaConfig.TasmotaT1[0].Name = ""
+			})
+			It("should return an error", func() {
+				_, err := New(&casaConfig)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+})
@@ -0,0 +1,95 @@
+package home
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+)
+
+//Interlock keeps the heat and cool relays of each of confs from being on
+// together, however they are switched, by wrapping each so it refuses to
+// turn on while a relay of the other side is on or cannot be read
+func (myHome *Home) Interlock(confs []hvac.Config) {
+	opposing := map[string][]string{}
+	for _, conf := range confs {
+		heat := append([]string{}, conf.Heat...)
+		if conf.Aux != "" {
+			heat = append(heat, conf.Aux)
+		}
+		if conf.Cool == "" {
+			continue
+		}
+		for _, name := range heat {
+			opposing[name] = append(opposing[name], conf.Cool)
+			opposing[conf.Cool] = append(opposing[conf.Cool], name)
+		}
+	}
+	switches := myHome.interlocked(myHome.Switches, opposing)
+	myHome.lock.Lock()
+	myHome.opposing = opposing
+	myHome.Switches = switches
+	myHome.lock.Unlock()
+}
+
+//interlocked returns switches with every switch in opposing wrapped by
+// an interlock pointing at myHome, and any other left as it is
+func (myHome *Home) interlocked(switches map[string]switcher.SwitchDevice, opposing map[string][]string) map[string]switcher.SwitchDevice {
+	wrapped := map[string]switcher.SwitchDevice{}
+	for name, device := range switches {
+		if interlocked, ok := device.(*interlockedSwitch); ok {
+			device = interlocked.device
+		}
+		if len(opposing[name]) > 0 {
+			device = &interlockedSwitch{name: name, device: device, home: myHome}
+		}
+		wrapped[name] = device
+	}
+	return wrapped
+}
+
+//interlockedSwitch is a heat or cool relay which only turns on once
+// every relay opposing it is known to be off. Turning on is done one
+// relay at a time across the home, so two opposing relays both
+// turning on cannot each find the other off.
+type interlockedSwitch struct {
+	name   string
+	device switcher.SwitchDevice
+	home   *Home
+}
+
+func (interlocked *interlockedSwitch) Unwrap() switcher.SwitchDevice {
+	return interlocked.device
+}
+
+func (interlocked *interlockedSwitch) UpdateStatus() (status *string, err error) {
+	return interlocked.device.UpdateStatus()
+}
+
+func (interlocked *interlockedSwitch) TurnOn() (err error) {
+	myHome := interlocked.home
+	myHome.interlockLock.Lock()
+	defer myHome.interlockLock.Unlock()
+	myHome.lock.RLock()
+	opposing, switches := myHome.opposing[interlocked.name], myHome.Switches
+	myHome.lock.RUnlock()
+	for _, name := range opposing {
+		device, ok := switches[name]
+		if !ok {
+			continue
+		}
+		status, err := device.UpdateStatus()
+		if err != nil {
+			return fmt.Errorf("interlock: not turning %s on, %s cannot be read: %v", interlocked.name, name, err)
+		}
+		if strings.ToUpper(*status) != "OFF" {
+			return fmt.Errorf("interlock: not turning %s on while %s is %s", interlocked.name, name, *status)
+		}
+	}
+	return interlocked.device.TurnOn()
+}
+
+func (interlocked *interlockedSwitch) TurnOff() (err error) {
+	return interlocked.device.TurnOff()
+}
@@ -0,0 +1,94 @@
+package home_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+)
+
+var _ = Describe("Interlock", func() {
+	var (
+		furnace    *switcher.MockSwitch
+		strips     *switcher.MockSwitch
+		compressor *switcher.MockSwitch
+		lamp       *switcher.MockSwitch
+		myHome     *Home
+	)
+	BeforeEach(func() {
+		furnace = &switcher.MockSwitch{Status: "OFF"}
+		strips = &switcher.MockSwitch{Status: "OFF"}
+		compressor = &switcher.MockSwitch{Status: "OFF"}
+		lamp = &switcher.MockSwitch{Status: "OFF"}
+		myHome = &Home{
+			Switches: map[string]switcher.SwitchDevice{
+				"furnace":    furnace,
+				"strips":     strips,
+				"compressor": compressor,
+				"lamp":       lamp,
+			},
+		}
+		myHome.Interlock([]hvac.Config{{Heat: []string{"furnace"}, Aux: "strips", Cool: "compressor"}})
+	})
+	It("should turn a heat relay on while cooling is off", func() {
+		Expect(myHome.Switches["furnace"].TurnOn()).Should(Succeed())
+		Expect(furnace.Status).Should(Equal("ON"))
+	})
+	It("should refuse a heat relay while cooling is on", func() {
+		compressor.Status = "ON"
+		Expect(myHome.Switches["furnace"].TurnOn()).ShouldNot(Succeed())
+		Expect(myHome.Switches["strips"].TurnOn()).ShouldNot(Succeed())
+		Expect(furnace.Status).Should(Equal("OFF"))
+		Expect(strips.Status).Should(Equal("OFF"))
+	})
+	It("should refuse cooling while any heat relay is on", func() {
+		strips.Status = "ON"
+		Expect(myHome.Switches["compressor"].TurnOn()).ShouldNot(Succeed())
+		Expect(compressor.Status).Should(Equal("OFF"))
+	})
+	It("should refuse a relay while one opposing it cannot be read", func() {
+		compressor.Err = errors.New("unreachable")
+		Expect(myHome.Switches["furnace"].TurnOn()).ShouldNot(Succeed())
+		Expect(furnace.Status).Should(Equal("OFF"))
+	})
+	It("should always let a relay turn off", func() {
+		compressor.Status = "ON"
+		furnace.Status = "ON"
+		Expect(myHome.Switches["furnace"].TurnOff()).Should(Succeed())
+		Expect(furnace.Status).Should(Equal("OFF"))
+	})
+	It("should leave other switches alone", func() {
+		Expect(myHome.Switches["lamp"]).Should(BeIdenticalTo(lamp))
+	})
+	It("should keep interlocking once instrumented", func() {
+		myHome.Instrument(events.NewBus())
+		compressor.Status = "ON"
+		Expect(myHome.Switches["furnace"].TurnOn()).ShouldNot(Succeed())
+		Expect(furnace.Status).Should(Equal("OFF"))
+	})
+	Describe("building a home from config", func() {
+		It("should interlock the relays of the HVAC and of every zone", func() {
+			casaConfig := config.CasaConfig{
+				TasmotaT1: []switcher.TasmotaT1{
+					{Name: "furnace"}, {Name: "compressor"}, {Name: "boiler"}, {Name: "chiller"}, {Name: "lamp"},
+				},
+				HVAC:  &hvac.Config{Heat: []string{"furnace"}, Cool: "compressor"},
+				Zones: []hvac.Config{{Heat: []string{"boiler"}, Cool: "chiller"}},
+			}
+			built, err := New(&casaConfig)
+			Expect(err).ShouldNot(HaveOccurred())
+			for i := 0; i < 4; i++ {
+				device := &casaConfig.TasmotaT1[i]
+				Expect(built.Switches[device.Name]).ShouldNot(BeIdenticalTo(device))
+				Expect(switcher.Unwrap(built.Switches[device.Name])).Should(BeIdenticalTo(device))
+			}
+			Expect(built.Switches["lamp"]).Should(BeIdenticalTo(&casaConfig.TasmotaT1[4]))
+		})
+	})
+})
@@ -0,0 +1,166 @@
+package home
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//Changes are the names of the devices a new config adds, removes
+// or configures differently
+type Changes struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+//Empty is whether the devices are configured exactly as before
+func (changes Changes) Empty() bool {
+	return len(changes.Added) == 0 && len(changes.Removed) == 0 && len(changes.Changed) == 0
+}
+
+//Update is the devices of a new config, ready to replace those of a Home
+type Update struct {
+	Changes
+	next *Home
+}
+
+//Prepare builds the devices of casaConfig, reusing every device which is
+// configured as before so it stays connected, and connects the new
+// thermostats. Nothing in use changes until the Update is applied.
+func (myHome *Home) Prepare(casaConfig *config.CasaConfig) (*Update, error) {
+	next, err := New(casaConfig)
+	if err != nil {
+		return nil, err
+	}
+	update := &Update{next: next}
+	for name, settings := range next.settings {
+		previous, ok := myHome.settings[name]
+		switch {
+		case !ok:
+			update.Added = append(update.Added, name)
+		case !reflect.DeepEqual(previous, settings):
+			update.Changed = append(update.Changed, name)
+		default:
+			if device, ok := myHome.Thermostats[name]; ok {
+				next.Thermostats[name] = device
+			} else {
+				next.Switches[name] = myHome.Switches[name]
+			}
+		}
+	}
+	for name := range myHome.settings {
+		if _, ok := next.settings[name]; !ok {
+			update.Removed = append(update.Removed, name)
+		}
+	}
+	sort.Strings(update.Added)
+	sort.Strings(update.Removed)
+	sort.Strings(update.Changed)
+	for _, name := range append(append([]string{}, update.Added...), update.Changed...) {
+		device, ok := next.Thermostats[name]
+		if !ok {
+			continue
+		}
+		if err := device.Connect(); err != nil {
+			update.Discard()
+			return nil, fmt.Errorf("connecting %s: %v", name, err)
+		}
+		log.WithFields(log.Fields{
+			"thermostat": name,
+		}).Printf("thermostat connected")
+	}
+	return update, nil
+}
+
+//Discard closes the thermostats Prepare connected, for an
+// update which will not be applied
+func (update *Update) Discard() {
+	for _, name := range append(append([]string{}, update.Added...), update.Changed...) {
+		if device, ok := update.next.Thermostats[name]; ok {
+			closeThermostat(name, device)
+		}
+	}
+}
+
+//Apply replaces the devices of myHome with those of update, closing the
+// thermostats which were removed or replaced. Whatever holds the maps
+// of before keeps them, Devices returns the new ones.
+func (myHome *Home) Apply(update *Update) {
+	replaced := append(append([]string{}, update.Removed...), update.Changed...)
+	for _, name := range replaced {
+		if device, ok := myHome.Thermostats[name]; ok {
+			closeThermostat(name, device)
+		}
+	}
+	next := update.next
+	switches := myHome.interlocked(next.Switches, nil)
+	if myHome.Events != nil {
+		for _, name := range append(append([]string{}, update.Added...), update.Changed...) {
+			if device, ok := switches[name]; ok {
+				switches[name] = &instrumentedSwitch{name: name, device: device, home: myHome}
+			}
+		}
+	}
+	switches = myHome.interlocked(switches, next.opposing)
+	myHome.lock.Lock()
+	myHome.Name = next.Name
+	myHome.Thermostats = next.Thermostats
+	myHome.Switches = switches
+	myHome.settings = next.settings
+	myHome.opposing = next.opposing
+	myHome.lock.Unlock()
+	myHome.healthLock.Lock()
+	for _, name := range replaced {
+		delete(myHome.down, name)
+	}
+	myHome.healthLock.Unlock()
+}
+
+func closeThermostat(name string, device thermostat.ThermostatDevice) {
+	closer, ok := device.(thermostat.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"thermostat": name,
+			"err":        err,
+		}).Warn("could not close thermostat")
+		return
+	}
+	log.WithFields(log.Fields{
+		"thermostat": name,
+	}).Printf("thermostat closed")
+}
+
+//dysonSettings are what configures a Dyson, leaving out what
+// it learns once connected
+func dysonSettings(device *thermostat.DysonHotCoolLink) interface{} {
+	return thermostat.DysonHotCoolLink{
+		Name:             device.Name,
+		IP:               device.IP,
+		Port:             device.Port,
+		Serial:           device.Serial,
+		DysonAPIEmail:    device.DysonAPIEmail,
+		DysonAPIPassword: device.DysonAPIPassword,
+		DysonAPIEndpoint: device.DysonAPIEndpoint,
+	}
+}
+
+//tasmotaSettings are what configures a Tasmota, leaving out
+// the status it last reported
+func tasmotaSettings(device *switcher.TasmotaT1) interface{} {
+	return struct {
+		Name         string
+		SwitchNumber int
+		URI          string
+		UpdateWindow time.Duration
+	}{device.Name, device.SwitchNumber, device.URI, device.UpdateWindow}
+}
@@ -0,0 +1,160 @@
+package home_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Reload", func() {
+	var myHome *Home
+	var casaConfig config.CasaConfig
+	BeforeEach(func() {
+		casaConfig = config.CasaConfig{
+			Name: "myCasa",
+			TasmotaT1: []switcher.TasmotaT1{
+				{Name: "blower", SwitchNumber: 3, URI: "http://office-closet.local"},
+				{Name: "heater", SwitchNumber: 1, URI: "http://garage.local"},
+				{Name: "lamp", SwitchNumber: 1, URI: "http://hall.local"},
+			},
+		}
+		var err error
+		myHome, err = New(&casaConfig)
+		Expect(err).ShouldNot(HaveOccurred())
+		myHome.Instrument(events.NewBus())
+	})
+	Describe("preparing a new config", func() {
+		It("should tell what was added, removed and changed", func() {
+			next := config.CasaConfig{
+				Name: "myCasa",
+				TasmotaT1: []switcher.TasmotaT1{
+					{Name: "blower", SwitchNumber: 3, URI: "http://office-closet.local"},
+					{Name: "heater", SwitchNumber: 2, URI: "http://garage.local"},
+					{Name: "fan", SwitchNumber: 1, URI: "http://attic.local"},
+				},
+			}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(update.Changes).To(Equal(Changes{
+				Added:   []string{"fan"},
+				Removed: []string{"lamp"},
+				Changed: []string{"heater"},
+			}))
+		})
+		It("should see nothing changed when the devices are configured as before", func() {
+			next := casaConfig
+			next.TasmotaT1 = []switcher.TasmotaT1{
+				{Name: "lamp", SwitchNumber: 1, URI: "http://hall.local"},
+				{Name: "blower", SwitchNumber: 3, URI: "http://office-closet.local"},
+				{Name: "heater", SwitchNumber: 1, URI: "http://garage.local"},
+			}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(update.Empty()).To(BeTrue())
+		})
+		Context("when a new thermostat cannot connect", func() {
+			It("should return an error and leave the home as it was", func() {
+				next := casaConfig
+				next.DysonHotCoolLink = []thermostat.DysonHotCoolLink{{Name: "office"}}
+				_, err := myHome.Prepare(&next)
+				Expect(err).Should(HaveOccurred())
+				Expect(myHome.Thermostats).To(BeEmpty())
+				Expect(myHome.Switches).To(HaveLen(3))
+			})
+		})
+		Context("when two devices share a name", func() {
+			It("should return an error", func() {
+				next := casaConfig
+				next.TasmotaT1 = append([]switcher.TasmotaT1{}, casaConfig.TasmotaT1...)
+				next.TasmotaT1[2].Name = "blower"
+				_, err := myHome.Prepare(&next)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+	Describe("applying an update", func() {
+		It("should keep the devices configured as before and replace the rest", func() {
+			blower := myHome.Switches["blower"]
+			heater := myHome.Switches["heater"]
+			next := config.CasaConfig{
+				Name: "ourCasa",
+				TasmotaT1: []switcher.TasmotaT1{
+					{Name: "blower", SwitchNumber: 3, URI: "http://office-closet.local"},
+					{Name: "heater", SwitchNumber: 2, URI: "http://garage.local"},
+					{Name: "fan", SwitchNumber: 1, URI: "http://attic.local", UpdateWindow: time.Minute},
+				},
+			}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			myHome.Apply(update)
+			Expect(myHome.Name).To(Equal("ourCasa"))
+			Expect(myHome.Switches).To(HaveLen(3))
+			Expect(myHome.Switches).NotTo(HaveKey("lamp"))
+			Expect(myHome.Switches["blower"]).To(BeIdenticalTo(blower))
+			Expect(myHome.Switches["heater"]).NotTo(BeIdenticalTo(heater))
+		})
+		It("should interlock a switch kept as before once the HVAC switches it", func() {
+			blower := myHome.Switches["blower"]
+			next := casaConfig
+			next.HVAC = &hvac.Config{Heat: []string{"heater"}, Cool: "blower"}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(update.Empty()).To(BeTrue())
+			myHome.Apply(update)
+			Expect(myHome.Switches["blower"]).NotTo(BeIdenticalTo(blower))
+			Expect(myHome.Switches["blower"].(switcher.Wrapper).Unwrap()).To(BeIdenticalTo(blower))
+
+			update, err = myHome.Prepare(&casaConfig)
+			Expect(err).ShouldNot(HaveOccurred())
+			myHome.Apply(update)
+			Expect(myHome.Switches["blower"]).To(BeIdenticalTo(blower))
+		})
+		It("should keep publishing switch events from the new switches", func() {
+			received, unsubscribe := myHome.Events.Subscribe(4)
+			defer unsubscribe()
+			next := casaConfig
+			next.TasmotaT1 = []switcher.TasmotaT1{
+				{Name: "fan", SwitchNumber: 1, URI: "http://attic.local"},
+			}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			myHome.Apply(update)
+			_, instrumented := myHome.Switches["fan"].(interface {
+				Unwrap() switcher.SwitchDevice
+			})
+			Expect(instrumented).To(BeTrue())
+			Expect(received).NotTo(Receive())
+		})
+		It("should hand out the devices of before or after while applying", func() {
+			next := casaConfig
+			next.TasmotaT1 = []switcher.TasmotaT1{
+				{Name: "fan", SwitchNumber: 1, URI: "http://attic.local"},
+			}
+			update, err := myHome.Prepare(&next)
+			Expect(err).ShouldNot(HaveOccurred())
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					_, switches := myHome.Devices()
+					Expect(len(switches)).To(Or(Equal(3), Equal(1)))
+				}
+			}()
+			myHome.Apply(update)
+			Eventually(done).Should(BeClosed())
+			_, ok := myHome.Switch("fan")
+			Expect(ok).To(BeTrue())
+			_, ok = myHome.Switch("lamp")
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,493 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/secret"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	online                 = "online"
+	offline                = "offline"
+	defaultDiscoveryPrefix = "homeassistant"
+	defaultTopicPrefix     = "mi-casa"
+	defaultStateInterval   = 30 * time.Second
+)
+
+//Config is the homeAssistant section of the mi-casa YAML config,
+// Broker is an MQTT URI such as tcp://localhost:1883
+type Config struct {
+	Broker          string        `yaml:"broker"`
+	Username        string        `yaml:"username,omitempty"`
+	Password        secret.String `yaml:"password,omitempty"`
+	ClientID        string        `yaml:"clientID,omitempty"`
+	DiscoveryPrefix string        `yaml:"discoveryPrefix,omitempty"`
+	TopicPrefix     string        `yaml:"topicPrefix,omitempty"`
+	Interval        time.Duration `yaml:"interval,omitempty"`
+}
+
+func (conf Config) clientID() string {
+	if conf.ClientID != "" {
+		return conf.ClientID
+	}
+	return conf.topicPrefix()
+}
+
+func (conf Config) topicPrefix() string {
+	if conf.TopicPrefix != "" {
+		return conf.TopicPrefix
+	}
+	return defaultTopicPrefix
+}
+
+func (conf Config) discoveryPrefix() string {
+	if conf.DiscoveryPrefix != "" {
+		return conf.DiscoveryPrefix
+	}
+	return defaultDiscoveryPrefix
+}
+
+func (conf Config) availabilityTopic() string {
+	return conf.topicPrefix() + "/status"
+}
+
+//Bridge makes every thermostat, switch and every HVAC controller appear in
+// Home Assistant through MQTT discovery. Thermostat readings become
+// sensors, switches become switches and controllers become climate
+// entities, with their state mirrored to MQTT and commands accepted on
+// the set topics.
+type Bridge struct {
+	Config      Config
+	Client      Client
+	Thermostats map[string]thermostat.ThermostatDevice
+	Switches    map[string]switcher.SwitchDevice
+	Controllers []*hvac.Controller
+	//Audit records every command from Home Assistant when set
+	Audit *audit.Trail
+}
+
+//NewBridge returns a bridge publishing through client
+func NewBridge(conf Config, client Client, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice, controllers []*hvac.Controller) *Bridge {
+	return &Bridge{
+		Config:      conf,
+		Client:      client,
+		Thermostats: thermostats,
+		Switches:    switches,
+		Controllers: controllers,
+	}
+}
+
+//device is the Home Assistant device registry entry every entity belongs to
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+//discovery is the config payload, only the fields
+// of the component being discovered are set
+type discovery struct {
+	Name                    string   `json:"name"`
+	UniqueID                string   `json:"unique_id"`
+	Device                  device   `json:"device"`
+	AvailabilityTopic       string   `json:"availability_topic"`
+	StateTopic              string   `json:"state_topic,omitempty"`
+	CommandTopic            string   `json:"command_topic,omitempty"`
+	PayloadOn               string   `json:"payload_on,omitempty"`
+	PayloadOff              string   `json:"payload_off,omitempty"`
+	DeviceClass             string   `json:"device_class,omitempty"`
+	UnitOfMeasurement       string   `json:"unit_of_measurement,omitempty"`
+	StateClass              string   `json:"state_class,omitempty"`
+	Modes                   []string `json:"modes,omitempty"`
+	ModeStateTopic          string   `json:"mode_state_topic,omitempty"`
+	ModeCommandTopic        string   `json:"mode_command_topic,omitempty"`
+	TemperatureStateTopic   string   `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string   `json:"temperature_command_topic,omitempty"`
+	CurrentTemperatureTopic string   `json:"current_temperature_topic,omitempty"`
+	ActionTopic             string   `json:"action_topic,omitempty"`
+	TemperatureUnit         string   `json:"temperature_unit,omitempty"`
+	Precision               float64  `json:"precision,omitempty"`
+	MinTemp                 float64  `json:"min_temp,omitempty"`
+	MaxTemp                 float64  `json:"max_temp,omitempty"`
+}
+
+var unsafeID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+//objectID turns a device name into something safe within a topic
+func objectID(name string) string {
+	return strings.Trim(unsafeID.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+func (bridge *Bridge) device(name string, model string) device {
+	return device{
+		Identifiers:  []string{"mi_casa_" + objectID(name)},
+		Name:         name,
+		Manufacturer: "mi-casa",
+		Model:        model,
+	}
+}
+
+func (bridge *Bridge) topic(parts ...string) string {
+	return strings.Join(append([]string{bridge.Config.topicPrefix()}, parts...), "/")
+}
+
+func (bridge *Bridge) publishDiscovery(component string, id string, payload discovery) error {
+	payload.UniqueID = "mi_casa_" + id
+	payload.AvailabilityTopic = bridge.Config.availabilityTopic()
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return bridge.Client.Publish(fmt.Sprintf("%s/%s/%s/config", bridge.Config.discoveryPrefix(), component, id), true, content)
+}
+
+//sensorMetrics describes the Home Assistant sensor for each metric
+var sensorMetrics = map[string]discovery{
+	"temperature":  {DeviceClass: "temperature", UnitOfMeasurement: "°F", StateClass: "measurement"},
+	"humidity":     {DeviceClass: "humidity", UnitOfMeasurement: "%", StateClass: "measurement"},
+	"particulates": {StateClass: "measurement"},
+	"voc":          {StateClass: "measurement"},
+}
+
+//Start publishes discovery for everything, subscribes to the
+// set topics and announces mi-casa is online, doing it all again
+// whenever the client reconnects
+func (bridge *Bridge) Start() error {
+	if err := bridge.announce(); err != nil {
+		return err
+	}
+	bridge.Client.OnReconnect(bridge.reconnected)
+	return nil
+}
+
+//reconnected announces everything again along with the current state
+func (bridge *Bridge) reconnected() {
+	log.Info("reconnected to MQTT broker, announcing to Home Assistant again")
+	if err := bridge.announce(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not announce to Home Assistant after reconnecting")
+		return
+	}
+	bridge.PublishState()
+}
+
+func (bridge *Bridge) announce() error {
+	for _, name := range sortedNames(bridge.Thermostats) {
+		for _, metric := range metrics(bridge.Thermostats[name]) {
+			payload := sensorMetrics[metric]
+			payload.Name = fmt.Sprintf("%s %s", name, metric)
+			payload.Device = bridge.device(name, "thermostat")
+			payload.StateTopic = bridge.topic("sensor", objectID(name), metric)
+			if err := bridge.publishDiscovery("sensor", objectID(name)+"_"+metric, payload); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range bridge.Switches {
+		id := objectID(name)
+		err := bridge.publishDiscovery("switch", id, discovery{
+			Name:         name,
+			Device:       bridge.device(name, "switch"),
+			StateTopic:   bridge.topic("switch", id, "state"),
+			CommandTopic: bridge.topic("switch", id, "set"),
+			PayloadOn:    "ON",
+			PayloadOff:   "OFF",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(bridge.Switches) > 0 {
+		if err := bridge.Client.Subscribe(bridge.topic("switch", "+", "set"), bridge.handleSwitch); err != nil {
+			return err
+		}
+	}
+	for _, controller := range bridge.Controllers {
+		id := zoneID(controller)
+		modes := []string{}
+		for _, mode := range controller.Modes() {
+			modes = append(modes, haMode(mode))
+		}
+		min, max := controller.SetpointLimits()
+		err := bridge.publishDiscovery("climate", id, discovery{
+			Name:                    zoneDevice(controller),
+			Device:                  bridge.device(zoneDevice(controller), "hvac"),
+			Modes:                   modes,
+			ModeStateTopic:          bridge.topic("climate", id, "mode"),
+			ModeCommandTopic:        bridge.topic("climate", id, "mode", "set"),
+			TemperatureStateTopic:   bridge.topic("climate", id, "temperature"),
+			TemperatureCommandTopic: bridge.topic("climate", id, "temperature", "set"),
+			CurrentTemperatureTopic: bridge.topic("climate", id, "current_temperature"),
+			ActionTopic:             bridge.topic("climate", id, "action"),
+			TemperatureUnit:         "F",
+			Precision:               0.1,
+			MinTemp:                 min,
+			MaxTemp:                 max,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(bridge.Controllers) > 0 {
+		if err := bridge.Client.Subscribe(bridge.topic("climate", "+", "+", "set"), bridge.handleClimate); err != nil {
+			return err
+		}
+	}
+	return bridge.Client.Publish(bridge.Config.availabilityTopic(), true, []byte(online))
+}
+
+//PublishState mirrors the current state of everything to MQTT
+func (bridge *Bridge) PublishState() {
+	for _, name := range sortedNames(bridge.Thermostats) {
+		for metric, value := range readings(bridge.Thermostats[name]) {
+			bridge.publish(bridge.topic("sensor", objectID(name), metric), formatFloat(value))
+		}
+	}
+	for name, device := range bridge.Switches {
+		if status, err := device.UpdateStatus(); err == nil {
+			bridge.publishSwitch(name, *status)
+		}
+	}
+	for _, controller := range bridge.Controllers {
+		bridge.publishController(controller)
+	}
+}
+
+func (bridge *Bridge) publishSwitch(name string, status string) {
+	bridge.publish(bridge.topic("switch", objectID(name), "state"), strings.ToUpper(status))
+}
+
+func (bridge *Bridge) publishController(controller *hvac.Controller) {
+	id := zoneID(controller)
+	status := controller.Status()
+	bridge.publish(bridge.topic("climate", id, "mode"), haMode(status.Mode))
+	bridge.publish(bridge.topic("climate", id, "temperature"), formatFloat(status.Setpoint))
+	if !status.LastDecision.Time.IsZero() && status.LastDecision.Error == "" {
+		bridge.publish(bridge.topic("climate", id, "current_temperature"), formatFloat(status.LastDecision.Temperature))
+	}
+	bridge.publish(bridge.topic("climate", id, "action"), haAction(status))
+}
+
+func (bridge *Bridge) publish(topic string, payload string) {
+	if err := bridge.Client.Publish(topic, true, []byte(payload)); err != nil {
+		log.WithFields(log.Fields{
+			"topic": topic,
+			"err":   err,
+		}).Error("could not publish state to Home Assistant")
+	}
+}
+
+//Run publishes the state every Interval and as soon as a switch or
+// controller call changes, until stop is closed
+func (bridge *Bridge) Run(bus *events.Bus, stop <-chan struct{}) {
+	interval := bridge.Config.Interval
+	if interval <= 0 {
+		interval = defaultStateInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var received <-chan events.Event
+	if bus != nil {
+		var unsubscribe func()
+		received, unsubscribe = bus.Subscribe(64)
+		defer unsubscribe()
+	}
+	bridge.PublishState()
+	for {
+		select {
+		case <-stop:
+			bridge.publish(bridge.Config.availabilityTopic(), offline)
+			bridge.Client.Close()
+			return
+		case <-ticker.C:
+			bridge.PublishState()
+		case event := <-received:
+			switch event.Kind {
+			case events.KindSwitch:
+				bridge.publishSwitch(event.Device, event.State)
+			case events.KindDecision:
+				for _, controller := range bridge.Controllers {
+					if zoneDevice(controller) == event.Device {
+						bridge.publishController(controller)
+					}
+				}
+			}
+		}
+	}
+}
+
+//handleSwitch turns a switch on or off from its set topic
+func (bridge *Bridge) handleSwitch(topic string, payload []byte) {
+	id := strings.Split(strings.TrimPrefix(topic, bridge.topic("switch")+"/"), "/")[0]
+	for name, device := range bridge.Switches {
+		if objectID(name) != id {
+			continue
+		}
+		command := strings.ToUpper(strings.TrimSpace(string(payload)))
+		var err error
+		switch command {
+		case "ON":
+			err = device.TurnOn()
+		case "OFF":
+			err = device.TurnOff()
+		default:
+			err = fmt.Errorf("command must be ON or OFF")
+		}
+		bridge.Audit.Record(audit.Command(audit.SourceHomeAssistant, "homeAssistant", "switch", name, command, err, switcher.ReadBack(device)))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"switch":  name,
+				"command": command,
+				"err":     err,
+			}).Error("Home Assistant switch command failed")
+		}
+		if status, err := device.UpdateStatus(); err == nil {
+			bridge.publishSwitch(name, *status)
+		}
+		return
+	}
+	log.WithFields(log.Fields{
+		"topic": topic,
+	}).Warn("Home Assistant command for unknown switch")
+}
+
+//handleClimate changes a controller setpoint or mode from its set topics
+func (bridge *Bridge) handleClimate(topic string, payload []byte) {
+	parts := strings.Split(strings.TrimPrefix(topic, bridge.topic("climate")+"/"), "/")
+	if len(parts) != 3 {
+		return
+	}
+	for _, controller := range bridge.Controllers {
+		if zoneID(controller) != parts[0] {
+			continue
+		}
+		value := strings.TrimSpace(string(payload))
+		var err error
+		switch parts[1] {
+		case "temperature":
+			var setpoint float64
+			if setpoint, err = strconv.ParseFloat(value, 64); err == nil {
+				err = controller.SetSetpoint(setpoint)
+			}
+		case "mode":
+			err = controller.SetMode(fromHAMode(value))
+		default:
+			err = fmt.Errorf("unknown climate command %s", parts[1])
+		}
+		bridge.Audit.Record(audit.Command(audit.SourceHomeAssistant, "homeAssistant", parts[1], zoneDevice(controller), value, err, hvac.ReadBack(controller, parts[1])))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"zone":    zoneDevice(controller),
+				"command": parts[1],
+				"value":   value,
+				"err":     err,
+			}).Error("Home Assistant climate command failed")
+		}
+		bridge.publishController(controller)
+		return
+	}
+}
+
+//zoneDevice is the device name the controller publishes decisions as
+func zoneDevice(controller *hvac.Controller) string {
+	if controller.Name == "" {
+		return "hvac"
+	}
+	return controller.Name
+}
+
+func zoneID(controller *hvac.Controller) string {
+	return objectID(zoneDevice(controller))
+}
+
+//haMode maps a controller mode to the Home Assistant climate mode
+func haMode(mode hvac.Mode) string {
+	if mode == hvac.ModeFan {
+		return "fan_only"
+	}
+	return string(mode)
+}
+
+func fromHAMode(mode string) hvac.Mode {
+	if mode == "fan_only" {
+		return hvac.ModeFan
+	}
+	return hvac.Mode(mode)
+}
+
+//haAction is what the equipment is doing in Home Assistant terms
+func haAction(status hvac.Status) string {
+	call := status.LastDecision.Call
+	switch {
+	case status.Mode == hvac.ModeOff:
+		return "off"
+	case call.Heating():
+		return "heating"
+	case call.Cool:
+		return "cooling"
+	case call.Fan:
+		return "fan"
+	}
+	return "idle"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func sortedNames(thermostats map[string]thermostat.ThermostatDevice) []string {
+	names := []string{}
+	for name := range thermostats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//metrics lists the sensors a thermostat provides, air quality sensors
+// are assumed to report particulates and voc as the Dyson does
+func metrics(device thermostat.ThermostatDevice) []string {
+	provided := []string{"temperature"}
+	if _, ok := device.(thermostat.HumiditySensor); ok {
+		provided = append(provided, "humidity")
+	}
+	if _, ok := device.(thermostat.AirQualitySensor); ok {
+		provided = append(provided, "particulates", "voc")
+	}
+	return provided
+}
+
+//readings returns the metrics device can currently report
+func readings(device thermostat.ThermostatDevice) map[string]float64 {
+	values := map[string]float64{}
+	if temp, err := device.CurrentTemp(); err == nil {
+		values["temperature"] = *temp
+	}
+	if sensor, ok := device.(thermostat.HumiditySensor); ok {
+		if humidity, err := sensor.CurrentHumidity(); err == nil {
+			values["humidity"] = *humidity
+		}
+	}
+	if sensor, ok := device.(thermostat.AirQualitySensor); ok {
+		if quality, err := sensor.AirQuality(); err == nil {
+			for metric, value := range quality {
+				values[metric] = value
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,294 @@
+package homeassistant_test
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/broker"
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/homeassistant"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//fakeClient keeps the last payload published to each topic
+// and delivers messages to matching subscriptions
+type fakeClient struct {
+	published     map[string]string
+	subscriptions map[string]func(topic string, payload []byte)
+	reconnected   func()
+	closed        bool
+	lock          sync.Mutex
+}
+
+func (client *fakeClient) Publish(topic string, retained bool, payload []byte) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.published[topic] = string(payload)
+	return nil
+}
+
+func (client *fakeClient) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.subscriptions[topic] = handler
+	return nil
+}
+
+func (client *fakeClient) OnReconnect(handler func()) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.reconnected = handler
+}
+
+//reconnect forgets everything as a restarted broker would and reconnects
+func (client *fakeClient) reconnect() {
+	client.lock.Lock()
+	client.published = map[string]string{}
+	client.subscriptions = map[string]func(topic string, payload []byte){}
+	handler := client.reconnected
+	client.lock.Unlock()
+	handler()
+}
+
+func (client *fakeClient) Close() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.closed = true
+}
+
+func (client *fakeClient) get(topic string) string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.published[topic]
+}
+
+func (client *fakeClient) deliver(topic string, payload string) {
+	client.lock.Lock()
+	handlers := []func(string, []byte){}
+	for filter, handler := range client.subscriptions {
+		if matches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	client.lock.Unlock()
+	for _, handler := range handlers {
+		handler(topic, []byte(payload))
+	}
+}
+
+func matches(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	if len(filterParts) != len(topicParts) {
+		return false
+	}
+	for i := range filterParts {
+		if filterParts[i] != "+" && filterParts[i] != topicParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var _ = Describe("Bridge", func() {
+	var (
+		client     *fakeClient
+		office     *thermostat.MockThermostat
+		porch      *switcher.MockSwitch
+		furnace    *switcher.MockSwitch
+		controller *hvac.Controller
+		bridge     *Bridge
+	)
+	BeforeEach(func() {
+		client = &fakeClient{published: map[string]string{}, subscriptions: map[string]func(string, []byte){}}
+		office = &thermostat.MockThermostat{Temperature: 68.5, Humidity: 40}
+		porch = &switcher.MockSwitch{Status: "OFF"}
+		furnace = &switcher.MockSwitch{Status: "OFF"}
+		thermostats := map[string]thermostat.ThermostatDevice{"Office": office}
+		var err error
+		controller, err = hvac.NewController(
+			hvac.Config{Name: "upstairs", Mode: "heat", Setpoint: 70, Sensor: "Office", Heat: []string{"furnace"}, Fan: "furnace fan"},
+			thermostats,
+			map[string]switcher.SwitchDevice{"furnace": furnace, "furnace fan": &switcher.MockSwitch{Status: "OFF"}},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		bridge = NewBridge(Config{}, client, thermostats, map[string]switcher.SwitchDevice{"porch light": porch}, []*hvac.Controller{controller})
+		Expect(bridge.Start()).Should(Succeed())
+	})
+	discovered := func(topic string) map[string]interface{} {
+		payload := client.get(topic)
+		Expect(payload).ShouldNot(BeEmpty(), topic)
+		var config map[string]interface{}
+		Expect(json.Unmarshal([]byte(payload), &config)).Should(Succeed())
+		return config
+	}
+	Describe("discovery", func() {
+		It("should announce every thermostat metric as a sensor", func() {
+			config := discovered("homeassistant/sensor/office_temperature/config")
+			Expect(config["device_class"]).Should(Equal("temperature"))
+			Expect(config["state_topic"]).Should(Equal("mi-casa/sensor/office/temperature"))
+			Expect(config["availability_topic"]).Should(Equal("mi-casa/status"))
+			discovered("homeassistant/sensor/office_humidity/config")
+			discovered("homeassistant/sensor/office_voc/config")
+		})
+		It("should announce switches", func() {
+			config := discovered("homeassistant/switch/porch_light/config")
+			Expect(config["command_topic"]).Should(Equal("mi-casa/switch/porch_light/set"))
+			Expect(config["unique_id"]).Should(Equal("mi_casa_porch_light"))
+		})
+		It("should announce controllers as climate entities", func() {
+			config := discovered("homeassistant/climate/upstairs/config")
+			Expect(config["modes"]).Should(Equal([]interface{}{"off", "heat", "fan_only"}))
+			Expect(config["temperature_command_topic"]).Should(Equal("mi-casa/climate/upstairs/temperature/set"))
+			Expect(config["min_temp"]).Should(Equal(45.0))
+			Expect(config["max_temp"]).Should(Equal(90.0))
+		})
+		It("should announce mi-casa is online", func() {
+			Expect(client.get("mi-casa/status")).Should(Equal("online"))
+		})
+	})
+	Describe("mirroring state", func() {
+		It("should publish readings, switches and controllers", func() {
+			office.Temperature = 65
+			controller.Step(time.Now())
+			bridge.PublishState()
+			Expect(client.get("mi-casa/sensor/office/temperature")).Should(Equal("65"))
+			Expect(client.get("mi-casa/switch/porch_light/state")).Should(Equal("OFF"))
+			Expect(client.get("mi-casa/climate/upstairs/temperature")).Should(Equal("70"))
+			Expect(client.get("mi-casa/climate/upstairs/current_temperature")).Should(Equal("65"))
+			Expect(client.get("mi-casa/climate/upstairs/action")).Should(Equal("heating"))
+		})
+		It("should publish switch transitions as they happen and go offline when stopped", func() {
+			bus := events.NewBus()
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				bridge.Run(bus, stop)
+				close(done)
+			}()
+			Eventually(func() string { return client.get("mi-casa/switch/porch_light/state") }).Should(Equal("OFF"))
+			Eventually(func() string {
+				bus.Publish(events.Event{Kind: events.KindSwitch, Device: "porch light", State: "ON"})
+				return client.get("mi-casa/switch/porch_light/state")
+			}).Should(Equal("ON"))
+			close(stop)
+			Eventually(done).Should(BeClosed())
+			Expect(client.get("mi-casa/status")).Should(Equal("offline"))
+			Expect(client.closed).Should(BeTrue())
+		})
+	})
+	Describe("commands", func() {
+		It("should switch a switch", func() {
+			client.deliver("mi-casa/switch/porch_light/set", "ON")
+			Expect(porch.Status).Should(Equal("ON"))
+			Expect(client.get("mi-casa/switch/porch_light/state")).Should(Equal("ON"))
+		})
+		It("should change the setpoint", func() {
+			client.deliver("mi-casa/climate/upstairs/temperature/set", "72.5")
+			Expect(controller.Status().Setpoint).Should(Equal(72.5))
+			Expect(client.get("mi-casa/climate/upstairs/temperature")).Should(Equal("72.5"))
+		})
+		It("should change the mode", func() {
+			client.deliver("mi-casa/climate/upstairs/mode/set", "fan_only")
+			Expect(controller.Status().Mode).Should(Equal(hvac.ModeFan))
+			Expect(client.get("mi-casa/climate/upstairs/mode")).Should(Equal("fan_only"))
+		})
+		It("should ignore a mode the equipment cannot run", func() {
+			client.deliver("mi-casa/climate/upstairs/mode/set", "cool")
+			Expect(controller.Status().Mode).Should(Equal(hvac.ModeHeat))
+		})
+	})
+	Describe("reconnecting", func() {
+		It("should announce everything again and take commands", func() {
+			client.reconnect()
+			Expect(client.get("mi-casa/status")).Should(Equal("online"))
+			discovered("homeassistant/switch/porch_light/config")
+			discovered("homeassistant/climate/upstairs/config")
+			Expect(client.get("mi-casa/switch/porch_light/state")).Should(Equal("OFF"))
+			client.deliver("mi-casa/switch/porch_light/set", "ON")
+			Expect(porch.Status).Should(Equal("ON"))
+		})
+	})
+	Describe("through the embedded broker", func() {
+		It("should take commands from other MQTT clients", func() {
+			mqttBroker, err := broker.New(broker.Config{Address: "127.0.0.1:0"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mqttBroker.Listen()).Should(Succeed())
+			stop := make(chan struct{})
+			defer close(stop)
+			go mqttBroker.Serve(stop)
+
+			conf := Config{Broker: "tcp://" + mqttBroker.Addr().String()}
+			client, err := Dial(conf)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer client.Close()
+			light := &switcher.MockSwitch{Status: "OFF"}
+			live := NewBridge(conf, client, nil, map[string]switcher.SwitchDevice{"porch light": light}, nil)
+			Expect(live.Start()).Should(Succeed())
+
+			opts := mqtt.NewClientOptions()
+			opts.AddBroker(conf.Broker)
+			opts.SetClientID("home-assistant")
+			homeAssistant := mqtt.NewClient(opts)
+			Expect(homeAssistant.Connect().WaitTimeout(5 * time.Second)).Should(BeTrue())
+			defer homeAssistant.Disconnect(0)
+			states := make(chan string, 4)
+			homeAssistant.Subscribe("mi-casa/switch/porch_light/state", 1, func(client mqtt.Client, msg mqtt.Message) {
+				states <- string(msg.Payload())
+			}).WaitTimeout(5 * time.Second)
+			homeAssistant.Publish("mi-casa/switch/porch_light/set", 1, false, "ON").WaitTimeout(5 * time.Second)
+			Eventually(states).Should(Receive(Equal("ON")))
+		})
+		It("should announce itself again to a restarted broker", func() {
+			mqttBroker, err := broker.New(broker.Config{Address: "127.0.0.1:0"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mqttBroker.Listen()).Should(Succeed())
+			address := mqttBroker.Addr().String()
+			stop := make(chan struct{})
+			go mqttBroker.Serve(stop)
+
+			conf := Config{Broker: "tcp://" + address}
+			client, err := Dial(conf)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer client.Close()
+			light := &switcher.MockSwitch{Status: "OFF"}
+			live := NewBridge(conf, client, nil, map[string]switcher.SwitchDevice{"porch light": light}, nil)
+			Expect(live.Start()).Should(Succeed())
+
+			close(stop)
+			restarted, err := broker.New(broker.Config{Address: address})
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(restarted.Listen).Should(Succeed())
+			stop = make(chan struct{})
+			defer close(stop)
+			go restarted.Serve(stop)
+
+			opts := mqtt.NewClientOptions()
+			opts.AddBroker(conf.Broker)
+			opts.SetClientID("home-assistant")
+			homeAssistant := mqtt.NewClient(opts)
+			Expect(homeAssistant.Connect().WaitTimeout(5 * time.Second)).Should(BeTrue())
+			defer homeAssistant.Disconnect(0)
+			statuses := make(chan string, 4)
+			homeAssistant.Subscribe("mi-casa/status", 1, func(client mqtt.Client, msg mqtt.Message) {
+				statuses <- string(msg.Payload())
+			}).WaitTimeout(5 * time.Second)
+			Eventually(statuses, 10*time.Second).Should(Receive(Equal("online")))
+			states := make(chan string, 4)
+			homeAssistant.Subscribe("mi-casa/switch/porch_light/state", 1, func(client mqtt.Client, msg mqtt.Message) {
+				states <- string(msg.Payload())
+			}).WaitTimeout(5 * time.Second)
+			Eventually(states).Should(Receive(Equal("OFF")))
+			homeAssistant.Publish("mi-casa/switch/porch_light/set", 1, false, "ON").WaitTimeout(5 * time.Second)
+			Eventually(states).Should(Receive(Equal("ON")))
+		})
+	})
+})
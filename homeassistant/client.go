@@ -0,0 +1,95 @@
+package homeassistant
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//Client is the part of an MQTT client the bridge needs,
+// so it can be tested without a broker
+type Client interface {
+	Publish(topic string, retained bool, payload []byte) error
+	Subscribe(topic string, handler func(topic string, payload []byte)) error
+	//OnReconnect calls handler every time the connection comes back
+	OnReconnect(handler func())
+	Close()
+}
+
+//pahoClient is a Client backed by a paho MQTT connection
+type pahoClient struct {
+	client      mqtt.Client
+	connected   bool
+	reconnected func()
+	lock        sync.Mutex
+}
+
+//Dial connects to the broker in conf, setting the availability topic as
+// the will so Home Assistant marks everything unavailable if mi-casa dies.
+// The will is sent whenever the connection drops and a restarted broker
+// forgets everything, so a reconnect has to announce it all again.
+func Dial(conf Config) (Client, error) {
+	paho := &pahoClient{}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(conf.Broker)
+	opts.SetClientID(conf.clientID())
+	opts.SetUsername(conf.Username)
+	opts.SetPassword(conf.Password.Reveal())
+	opts.SetWill(conf.availabilityTopic(), offline, 1, true)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		paho.connect()
+	})
+	paho.client = mqtt.NewClient(opts)
+	token := paho.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", conf.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return paho, nil
+}
+
+//connect runs the reconnect handler on every connection after the first,
+// paho calls it on a goroutine of its own so the handler may block
+func (paho *pahoClient) connect() {
+	paho.lock.Lock()
+	first := !paho.connected
+	paho.connected = true
+	handler := paho.reconnected
+	paho.lock.Unlock()
+	if !first && handler != nil {
+		handler()
+	}
+}
+
+func (paho *pahoClient) OnReconnect(handler func()) {
+	paho.lock.Lock()
+	defer paho.lock.Unlock()
+	paho.reconnected = handler
+}
+
+func (paho *pahoClient) Publish(topic string, retained bool, payload []byte) error {
+	token := paho.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+func (paho *pahoClient) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	token := paho.client.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		handler(msg.Topic(), msg.Payload())
+	})
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	}
+	return token.Error()
+}
+
+func (paho *pahoClient) Close() {
+	paho.client.Disconnect(250)
+}
@@ -0,0 +1,13 @@
+package homeassistant_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHomeAssistant(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Home Assistant Suite")
+}
@@ -0,0 +1,203 @@
+package homekit
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//HomeKit always speaks Celsius, the iPhone converts back for display
+func toCelsius(fahrenheit float64) float64 {
+	return (fahrenheit - 32) * 5 / 9
+}
+
+//toFahrenheit rounds to half a degree, undoing the rounding
+// of whole Fahrenheit degrees to tenths of a degree Celsius
+func toFahrenheit(celsius float64) float64 {
+	return math.Round((celsius*9/5+32)*2) / 2
+}
+
+//sensor is a thermostat device as a temperature sensor,
+// with a humidity sensor when the device reads humidity
+type sensor struct {
+	device      thermostat.ThermostatDevice
+	accessory   *accessory.Accessory
+	temperature *service.TemperatureSensor
+	humidity    *service.HumiditySensor
+}
+
+func newSensor(info accessory.Info, device thermostat.ThermostatDevice) *sensor {
+	thermometer := accessory.NewTemperatureSensor(info, 0, -40, 100, 0.1)
+	s := &sensor{
+		device:      device,
+		accessory:   thermometer.Accessory,
+		temperature: thermometer.TempSensor,
+	}
+	if _, ok := device.(thermostat.HumiditySensor); ok {
+		s.humidity = service.NewHumiditySensor()
+		s.accessory.AddService(s.humidity.Service)
+	}
+	return s
+}
+
+func (s *sensor) refresh() {
+	if temp, err := s.device.CurrentTemp(); err == nil {
+		s.temperature.CurrentTemperature.SetValue(toCelsius(*temp))
+	}
+	if s.humidity != nil {
+		if humidity, err := s.device.(thermostat.HumiditySensor).CurrentHumidity(); err == nil {
+			s.humidity.CurrentRelativeHumidity.SetValue(*humidity)
+		}
+	}
+}
+
+//relay is a switch device as a switch or an outlet
+type relay struct {
+	bridge    *Bridge
+	name      string
+	device    switcher.SwitchDevice
+	accessory *accessory.Accessory
+	on        *characteristic.On
+}
+
+func newRelay(bridge *Bridge, info accessory.Info, name string, device switcher.SwitchDevice, outlet bool) *relay {
+	r := &relay{bridge: bridge, name: name, device: device}
+	if outlet {
+		acc := accessory.NewOutlet(info)
+		r.accessory = acc.Accessory
+		r.on = acc.Outlet.On
+	} else {
+		acc := accessory.NewSwitch(info)
+		r.accessory = acc.Accessory
+		r.on = acc.Switch.On
+	}
+	r.on.OnValueRemoteUpdate(r.switchTo)
+	return r
+}
+
+//switchTo turns the switch on or off from the iPhone
+func (r *relay) switchTo(on bool) {
+	var err error
+	state := "OFF"
+	if on {
+		state = "ON"
+		err = r.device.TurnOn()
+	} else {
+		err = r.device.TurnOff()
+	}
+	r.bridge.Audit.Record(audit.Command(audit.SourceHomeKit, "homeKit", "switch", r.name, state, err, switcher.ReadBack(r.device)))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"switch": r.name,
+			"on":     on,
+			"err":    err,
+		}).Error("HomeKit switch command failed")
+		r.refresh()
+	}
+}
+
+func (r *relay) refresh() {
+	if status, err := r.device.UpdateStatus(); err == nil {
+		r.set(*status)
+	}
+}
+
+func (r *relay) set(status string) {
+	r.on.SetValue(strings.EqualFold(status, "ON"))
+}
+
+//zone is an HVAC controller as a thermostat
+type zone struct {
+	bridge     *Bridge
+	name       string
+	controller *hvac.Controller
+	accessory  *accessory.Thermostat
+}
+
+func newZone(bridge *Bridge, info accessory.Info, name string, controller *hvac.Controller) *zone {
+	acc := accessory.NewThermostat(info, toCelsius(controller.Status().Setpoint), 10, 32, 0.1)
+	acc.Thermostat.CurrentTemperature.SetMinValue(-40)
+	acc.Thermostat.CurrentTemperature.SetMaxValue(100)
+	acc.Thermostat.TemperatureDisplayUnits.SetValue(characteristic.TemperatureDisplayUnitsFahrenheit)
+	z := &zone{bridge: bridge, name: name, controller: controller, accessory: acc}
+	acc.Thermostat.TargetTemperature.OnValueRemoteUpdate(z.setSetpoint)
+	acc.Thermostat.TargetHeatingCoolingState.OnValueRemoteUpdate(z.setMode)
+	return z
+}
+
+//setSetpoint changes the setpoint from the iPhone, one
+// outside the limits of the controller is put back
+func (z *zone) setSetpoint(celsius float64) {
+	setpoint := toFahrenheit(celsius)
+	err := z.controller.SetSetpoint(setpoint)
+	z.bridge.Audit.Record(audit.Command(audit.SourceHomeKit, "homeKit", "setpoint", z.name, strconv.FormatFloat(setpoint, 'f', -1, 64), err, hvac.ReadBack(z.controller, "setpoint")))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"zone":     z.name,
+			"setpoint": setpoint,
+			"err":      err,
+		}).Error("HomeKit setpoint change failed")
+		z.refresh()
+	}
+}
+
+//setMode changes the controller mode from the iPhone, HomeKit offers
+// every mode so one the equipment cannot run is put back
+func (z *zone) setMode(state int) {
+	mode := hvac.ModeOff
+	switch state {
+	case characteristic.TargetHeatingCoolingStateHeat:
+		mode = hvac.ModeHeat
+	case characteristic.TargetHeatingCoolingStateCool:
+		mode = hvac.ModeCool
+	case characteristic.TargetHeatingCoolingStateAuto:
+		mode = hvac.ModeAuto
+	}
+	err := z.controller.SetMode(mode)
+	z.bridge.Audit.Record(audit.Command(audit.SourceHomeKit, "homeKit", "mode", z.name, string(mode), err, hvac.ReadBack(z.controller, "mode")))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"zone": z.name,
+			"mode": mode,
+			"err":  err,
+		}).Error("HomeKit mode change failed")
+		z.refresh()
+	}
+}
+
+func (z *zone) refresh() {
+	status := z.controller.Status()
+	state := z.accessory.Thermostat
+	state.TargetTemperature.SetValue(toCelsius(status.Setpoint))
+	if !status.LastDecision.Time.IsZero() && status.LastDecision.Error == "" {
+		state.CurrentTemperature.SetValue(toCelsius(status.LastDecision.Temperature))
+	}
+	// HomeKit has no fan only mode, the fan alone shows as off
+	target := characteristic.TargetHeatingCoolingStateOff
+	switch status.Mode {
+	case hvac.ModeHeat:
+		target = characteristic.TargetHeatingCoolingStateHeat
+	case hvac.ModeCool:
+		target = characteristic.TargetHeatingCoolingStateCool
+	case hvac.ModeAuto:
+		target = characteristic.TargetHeatingCoolingStateAuto
+	}
+	state.TargetHeatingCoolingState.SetValue(target)
+	current := characteristic.CurrentHeatingCoolingStateOff
+	switch call := status.LastDecision.Call; {
+	case call.Heating():
+		current = characteristic.CurrentHeatingCoolingStateHeat
+	case call.Cool:
+		current = characteristic.CurrentHeatingCoolingStateCool
+	}
+	state.CurrentHeatingCoolingState.SetValue(current)
+}
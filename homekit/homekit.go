@@ -0,0 +1,234 @@
+package homekit
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultName          = "mi-casa"
+	defaultDirectory     = "homekit"
+	defaultRefreshPeriod = time.Minute
+)
+
+//Config is the homeKit section of the mi-casa YAML config. Pin is the
+// 8 digit setup code entered on the iPhone when pairing. The pairings and
+// keys are kept in Directory so the bridge stays paired across restarts.
+// Switches named in Outlets show up as outlets rather than switches.
+type Config struct {
+	Pin       string        `yaml:"pin"`
+	Name      string        `yaml:"name,omitempty"`
+	Port      string        `yaml:"port,omitempty"`
+	Directory string        `yaml:"directory,omitempty"`
+	Outlets   []string      `yaml:"outlets,omitempty"`
+	Refresh   time.Duration `yaml:"refresh,omitempty"`
+}
+
+//Bridge is a HomeKit Accessory Protocol bridge, HVAC controllers show
+// up as thermostats, thermostat devices as temperature sensors and
+// switches as switches or outlets
+type Bridge struct {
+	Config    Config
+	Accessory *accessory.Bridge
+	//Audit records every command from HomeKit when set
+	Audit   *audit.Trail
+	sensors []*sensor
+	relays  []*relay
+	zones   []*zone
+	ids     map[uint64]bool
+}
+
+//New builds an accessory for every device and controller,
+// nothing is announced on the network until Start
+func New(conf Config, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice, controllers []*hvac.Controller) (*Bridge, error) {
+	if conf.Pin == "" {
+		return nil, fmt.Errorf("homeKit pin not set")
+	}
+	if _, err := hc.ValidatePin(conf.Pin); err != nil {
+		return nil, fmt.Errorf("homeKit pin: %v", err)
+	}
+	if conf.Name == "" {
+		conf.Name = defaultName
+	}
+	if conf.Directory == "" {
+		conf.Directory = defaultDirectory
+	}
+	if conf.Refresh <= 0 {
+		conf.Refresh = defaultRefreshPeriod
+	}
+	outlets := map[string]bool{}
+	for _, name := range conf.Outlets {
+		if _, ok := switches[name]; !ok {
+			return nil, fmt.Errorf("homeKit outlet %s is not a configured switch", name)
+		}
+		outlets[name] = true
+	}
+	bridge := &Bridge{
+		Config: conf,
+		Accessory: accessory.NewBridge(accessory.Info{
+			Name:         conf.Name,
+			Manufacturer: "mi-casa",
+			Model:        "bridge",
+			ID:           1,
+		}),
+		ids: map[uint64]bool{1: true},
+	}
+	thermostatNames := []string{}
+	for name := range thermostats {
+		thermostatNames = append(thermostatNames, name)
+	}
+	sort.Strings(thermostatNames)
+	for _, name := range thermostatNames {
+		bridge.sensors = append(bridge.sensors, newSensor(bridge.info(name, "sensor"), thermostats[name]))
+	}
+	switchNames := []string{}
+	for name := range switches {
+		switchNames = append(switchNames, name)
+	}
+	sort.Strings(switchNames)
+	for _, name := range switchNames {
+		model := "switch"
+		if outlets[name] {
+			model = "outlet"
+		}
+		bridge.relays = append(bridge.relays, newRelay(bridge, bridge.info(name, model), name, switches[name], outlets[name]))
+	}
+	for _, controller := range controllers {
+		name := zoneName(controller)
+		if bridge.zone(name) != nil {
+			return nil, fmt.Errorf("homeKit thermostat %s configured twice", name)
+		}
+		bridge.zones = append(bridge.zones, newZone(bridge, bridge.info(name, "thermostat"), name, controller))
+	}
+	return bridge, nil
+}
+
+//info describes an accessory, its ID is derived from the name so
+// HomeKit keeps rooms and automations for it across restarts
+func (bridge *Bridge) info(name string, model string) accessory.Info {
+	hash := fnv.New64a()
+	hash.Write([]byte(model + "/" + name))
+	id := hash.Sum64()
+	for id <= 1 || bridge.ids[id] {
+		id++
+	}
+	bridge.ids[id] = true
+	return accessory.Info{
+		Name:         name,
+		Manufacturer: "mi-casa",
+		Model:        model,
+		SerialNumber: fmt.Sprintf("%x", id),
+		ID:           id,
+	}
+}
+
+//Accessories are every accessory of the bridge, the bridge first
+func (bridge *Bridge) Accessories() []*accessory.Accessory {
+	accessories := []*accessory.Accessory{bridge.Accessory.Accessory}
+	for _, sensor := range bridge.sensors {
+		accessories = append(accessories, sensor.accessory)
+	}
+	for _, relay := range bridge.relays {
+		accessories = append(accessories, relay.accessory)
+	}
+	for _, zone := range bridge.zones {
+		accessories = append(accessories, zone.accessory.Accessory)
+	}
+	return accessories
+}
+
+//Refresh reads every device and controller into its accessory
+func (bridge *Bridge) Refresh() {
+	for _, sensor := range bridge.sensors {
+		sensor.refresh()
+	}
+	for _, relay := range bridge.relays {
+		relay.refresh()
+	}
+	for _, zone := range bridge.zones {
+		zone.refresh()
+	}
+}
+
+//Start announces the bridge and serves HomeKit until stop is closed,
+// switch and controller changes published to bus reach iPhones at once
+// while sensors are read every Refresh
+func (bridge *Bridge) Start(bus *events.Bus, stop <-chan struct{}) error {
+	accessories := bridge.Accessories()
+	transport, err := hc.NewIPTransport(hc.Config{
+		Pin:         bridge.Config.Pin,
+		Port:        bridge.Config.Port,
+		StoragePath: bridge.Config.Directory,
+	}, accessories[0], accessories[1:]...)
+	if err != nil {
+		return err
+	}
+	bridge.Refresh()
+	go transport.Start()
+	log.WithFields(log.Fields{
+		"name":        bridge.Config.Name,
+		"accessories": len(accessories) - 1,
+	}).Printf("HomeKit bridge started")
+
+	var received <-chan events.Event
+	if bus != nil {
+		var unsubscribe func()
+		received, unsubscribe = bus.Subscribe(64)
+		defer unsubscribe()
+	}
+	ticker := time.NewTicker(bridge.Config.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			<-transport.Stop()
+			return nil
+		case <-ticker.C:
+			bridge.Refresh()
+		case event := <-received:
+			bridge.handle(event)
+		}
+	}
+}
+
+func (bridge *Bridge) handle(event events.Event) {
+	switch event.Kind {
+	case events.KindSwitch:
+		for _, relay := range bridge.relays {
+			if relay.name == event.Device {
+				relay.set(event.State)
+			}
+		}
+	case events.KindDecision:
+		if zone := bridge.zone(event.Device); zone != nil {
+			zone.refresh()
+		}
+	}
+}
+
+func zoneName(controller *hvac.Controller) string {
+	if controller.Name == "" {
+		return "hvac"
+	}
+	return controller.Name
+}
+
+func (bridge *Bridge) zone(name string) *zone {
+	for _, zone := range bridge.zones {
+		if zone.name == name {
+			return zone
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package homekit_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHomeKit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HomeKit Suite")
+}
@@ -0,0 +1,152 @@
+package homekit_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/homekit"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//find returns the characteristic of type typ on the accessory named name
+func find(accessories []*accessory.Accessory, name string, typ string) *characteristic.Characteristic {
+	for _, acc := range accessories {
+		if acc.Info.Name.GetValue() != name {
+			continue
+		}
+		for _, svc := range acc.Services {
+			for _, char := range svc.Characteristics {
+				if char.Type == typ {
+					return char
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var _ = Describe("HomeKit", func() {
+	var (
+		conf        Config
+		office      *thermostat.MockThermostat
+		porch       *switcher.MockSwitch
+		heater      *switcher.MockSwitch
+		furnace     *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		controller  *hvac.Controller
+		bridge      *Bridge
+		iPhone      net.Conn
+	)
+	BeforeEach(func() {
+		conf = Config{Pin: "03145154", Outlets: []string{"space heater"}}
+		office = &thermostat.MockThermostat{Temperature: 68, Humidity: 40}
+		porch = &switcher.MockSwitch{Status: "OFF"}
+		heater = &switcher.MockSwitch{Status: "OFF"}
+		furnace = &switcher.MockSwitch{Status: "OFF"}
+		thermostats = map[string]thermostat.ThermostatDevice{"office": office}
+		switches = map[string]switcher.SwitchDevice{"porch light": porch, "space heater": heater}
+		var err error
+		controller, err = hvac.NewController(
+			hvac.Config{Name: "upstairs", Mode: "heat", Setpoint: 70, Sensor: "office", Heat: []string{"furnace"}},
+			thermostats,
+			map[string]switcher.SwitchDevice{"furnace": furnace},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		iPhone, _ = net.Pipe()
+	})
+	JustBeforeEach(func() {
+		var err error
+		bridge, err = New(conf, thermostats, switches, []*hvac.Controller{controller})
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Describe("configuring", func() {
+		It("should need a pin HomeKit accepts", func() {
+			_, err := New(Config{}, thermostats, switches, nil)
+			Expect(err).Should(HaveOccurred())
+			_, err = New(Config{Pin: "12345678"}, thermostats, switches, nil)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should only make configured switches outlets", func() {
+			_, err := New(Config{Pin: "03145154", Outlets: []string{"garage"}}, thermostats, switches, nil)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("accessories", func() {
+		It("should put the bridge first and give every device an accessory", func() {
+			accessories := bridge.Accessories()
+			Expect(accessories).Should(HaveLen(5))
+			Expect(accessories[0].Type).Should(Equal(accessory.TypeBridge))
+			types := map[string]accessory.AccessoryType{}
+			for _, acc := range accessories[1:] {
+				types[acc.Info.Name.GetValue()] = acc.Type
+			}
+			Expect(types).Should(Equal(map[string]accessory.AccessoryType{
+				"office":       accessory.TypeThermostat,
+				"porch light":  accessory.TypeSwitch,
+				"space heater": accessory.TypeOutlet,
+				"upstairs":     accessory.TypeThermostat,
+			}))
+		})
+		It("should keep accessory IDs across restarts", func() {
+			again, err := New(conf, thermostats, switches, []*hvac.Controller{controller})
+			Expect(err).ShouldNot(HaveOccurred())
+			ids := map[uint64]bool{}
+			for i, acc := range bridge.Accessories() {
+				Expect(again.Accessories()[i].ID).Should(Equal(acc.ID))
+				ids[acc.ID] = true
+			}
+			Expect(ids).Should(HaveLen(5))
+		})
+	})
+
+	Describe("reading", func() {
+		It("should report readings in Celsius", func() {
+			bridge.Refresh()
+			accessories := bridge.Accessories()
+			Expect(find(accessories, "office", characteristic.TypeCurrentTemperature).Value).Should(BeNumerically("~", 20, 0.01))
+			Expect(find(accessories, "office", characteristic.TypeCurrentRelativeHumidity).Value).Should(BeNumerically("==", 40))
+		})
+		It("should report what the controller is doing", func() {
+			office.Temperature = 65
+			controller.Step(time.Now())
+			bridge.Refresh()
+			accessories := bridge.Accessories()
+			Expect(find(accessories, "upstairs", characteristic.TypeTargetTemperature).Value).Should(BeNumerically("~", 21.11, 0.01))
+			Expect(find(accessories, "upstairs", characteristic.TypeCurrentTemperature).Value).Should(BeNumerically("~", 18.33, 0.01))
+			Expect(find(accessories, "upstairs", characteristic.TypeTargetHeatingCoolingState).Value).Should(Equal(characteristic.TargetHeatingCoolingStateHeat))
+			Expect(find(accessories, "upstairs", characteristic.TypeCurrentHeatingCoolingState).Value).Should(Equal(characteristic.CurrentHeatingCoolingStateHeat))
+		})
+	})
+
+	Describe("commands from an iPhone", func() {
+		It("should switch switches and outlets", func() {
+			accessories := bridge.Accessories()
+			find(accessories, "porch light", characteristic.TypeOn).UpdateValueFromConnection(true, iPhone)
+			Expect(porch.Status).Should(Equal("ON"))
+			find(accessories, "space heater", characteristic.TypeOn).UpdateValueFromConnection(true, iPhone)
+			Expect(heater.Status).Should(Equal("ON"))
+		})
+		It("should change the setpoint in whole Fahrenheit", func() {
+			find(bridge.Accessories(), "upstairs", characteristic.TypeTargetTemperature).UpdateValueFromConnection(22.2, iPhone)
+			Expect(controller.Status().Setpoint).Should(Equal(72.0))
+		})
+		It("should put back a mode the equipment cannot run", func() {
+			state := find(bridge.Accessories(), "upstairs", characteristic.TypeTargetHeatingCoolingState)
+			state.UpdateValueFromConnection(characteristic.TargetHeatingCoolingStateCool, iPhone)
+			Expect(controller.Status().Mode).Should(Equal(hvac.ModeHeat))
+			Expect(state.Value).Should(Equal(characteristic.TargetHeatingCoolingStateHeat))
+			state.UpdateValueFromConnection(characteristic.TargetHeatingCoolingStateOff, iPhone)
+			Expect(controller.Status().Mode).Should(Equal(hvac.ModeOff))
+		})
+	})
+})
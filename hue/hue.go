@@ -0,0 +1,394 @@
+package hue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/switcher"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultName    = "mi-casa"
+	defaultAddress = ":80"
+	apiVersion     = "1.17.0"
+	softwareVer    = "1935144020"
+)
+
+//Config is the hue section of the mi-casa YAML config. Only the
+// switches named in Devices are exposed, in that order. Alexa only
+// looks for bridges on port 80. Advertise is the host:port voice
+// assistants should call back on, found from the network when empty.
+type Config struct {
+	Name      string   `yaml:"name,omitempty"`
+	Address   string   `yaml:"address,omitempty"`
+	Advertise string   `yaml:"advertise,omitempty"`
+	SSDP      string   `yaml:"ssdp,omitempty"`
+	Devices   []string `yaml:"devices"`
+}
+
+//light is a switch exposed as an on/off Hue light, its number
+// is its position in Devices starting from 1
+type light struct {
+	id       string
+	name     string
+	uniqueID string
+	device   switcher.SwitchDevice
+}
+
+//Emulator pretends to be a Philips Hue bridge so voice assistants
+// discover the exposed switches locally and toggle them as lights
+type Emulator struct {
+	Config Config
+	//Audit records every command to the bridge when set
+	Audit     *audit.Trail
+	lights    []*light
+	serial    string
+	bridgeID  string
+	uuid      string
+	listener  net.Listener
+	responder *net.UDPConn
+	advertise string
+}
+
+//New exposes the whitelisted switches, every name in Devices has to
+// be a configured switch
+func New(conf Config, switches map[string]switcher.SwitchDevice) (*Emulator, error) {
+	if len(conf.Devices) == 0 {
+		return nil, fmt.Errorf("hue devices not set, nothing to expose")
+	}
+	if conf.Name == "" {
+		conf.Name = defaultName
+	}
+	if conf.Address == "" {
+		conf.Address = defaultAddress
+	}
+	if conf.SSDP == "" {
+		conf.SSDP = ssdpAddress
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(conf.Name))
+	serial := fmt.Sprintf("%012x", hash.Sum64()&0xffffffffffff)
+	emulator := &Emulator{
+		Config:   conf,
+		serial:   serial,
+		bridgeID: strings.ToUpper(serial[:6] + "FFFE" + serial[6:]),
+		uuid:     "2f402f80-da50-11e1-9b23-" + serial,
+	}
+	exposed := map[string]bool{}
+	for i, name := range conf.Devices {
+		device, ok := switches[name]
+		if !ok {
+			return nil, fmt.Errorf("hue device %s is not a configured switch", name)
+		}
+		if exposed[name] {
+			return nil, fmt.Errorf("hue device %s listed twice", name)
+		}
+		exposed[name] = true
+		hash := fnv.New32a()
+		hash.Write([]byte(name))
+		id := hash.Sum32()
+		emulator.lights = append(emulator.lights, &light{
+			id:       fmt.Sprintf("%d", i+1),
+			name:     name,
+			uniqueID: fmt.Sprintf("00:17:88:01:%02x:%02x:%02x:%02x-0b", byte(id>>24), byte(id>>16), byte(id>>8), byte(id)),
+			device:   device,
+		})
+	}
+	return emulator, nil
+}
+
+//Router returns the handler for the description and the Hue API
+// subset voice assistants use. Any username is accepted, as with the
+// link button of a real bridge always pressed.
+func (emulator *Emulator) Router() http.Handler {
+	router := chi.NewRouter()
+	router.Use(middleware.RealIP)
+	router.Use(middleware.Logger)
+	router.Use(middleware.Recoverer)
+	router.Get("/description.xml", emulator.handleDescription)
+	router.Post("/api", handleCreateUser)
+	router.Route("/api/{user}", func(router chi.Router) {
+		router.Get("/", emulator.handleFullState)
+		router.Get("/config", emulator.handleConfig)
+		router.Get("/lights", emulator.handleLights)
+		router.Get("/lights/{id}", emulator.withLight(emulator.handleLight))
+		router.Put("/lights/{id}/state", emulator.withLight(emulator.handleLightState))
+	})
+	return router
+}
+
+//Listen binds the Hue API and joins SSDP discovery, so an address
+// which cannot be served is known before Start
+func (emulator *Emulator) Listen() error {
+	listener, err := net.Listen("tcp", emulator.Config.Address)
+	if err != nil {
+		return err
+	}
+	advertise := emulator.Config.Advertise
+	if advertise == "" {
+		advertise, err = localAddress(listener.Addr())
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	responder, err := listenSSDP(emulator.Config.SSDP)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	emulator.listener, emulator.responder, emulator.advertise = listener, responder, advertise
+	return nil
+}
+
+//Start serves the Hue API and answers SSDP discovery until stop is
+// closed, listening first unless Listen was called already
+func (emulator *Emulator) Start(stop <-chan struct{}) error {
+	if emulator.listener == nil {
+		if err := emulator.Listen(); err != nil {
+			return err
+		}
+	}
+	listener, responder, advertise := emulator.listener, emulator.responder, emulator.advertise
+	go emulator.answer(responder, advertise)
+
+	webServer := &http.Server{
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      emulator.Router(),
+	}
+	go func() {
+		<-stop
+		responder.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := webServer.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Printf("hue emulator did not shut down cleanly")
+		}
+	}()
+	log.WithFields(log.Fields{
+		"address":   listener.Addr().String(),
+		"advertise": advertise,
+		"lights":    len(emulator.lights),
+	}).Printf("hue emulator listening")
+	if err := webServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+//localAddress is the address of this host on the network
+// voice assistants are on, with the port being listened on
+func localAddress(listening net.Addr) (string, error) {
+	_, port, err := net.SplitHostPort(listening.String())
+	if err != nil {
+		return "", err
+	}
+	probe, err := net.Dial("udp4", ssdpAddress)
+	if err != nil {
+		return "", fmt.Errorf("could not find the local address to advertise, set hue advertise: %v", err)
+	}
+	defer probe.Close()
+	host, _, err := net.SplitHostPort(probe.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (emulator *Emulator) handleDescription(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(resp, `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<URLBase>http://%s/</URLBase>
+<device>
+<deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
+<friendlyName>%s (%s)</friendlyName>
+<manufacturer>Royal Philips Electronics</manufacturer>
+<manufacturerURL>http://www.philips.com</manufacturerURL>
+<modelDescription>Philips hue Personal Wireless Lighting</modelDescription>
+<modelName>Philips hue bridge 2015</modelName>
+<modelNumber>BSB002</modelNumber>
+<modelURL>http://www.meethue.com</modelURL>
+<serialNumber>%s</serialNumber>
+<UDN>uuid:%s</UDN>
+<presentationURL>index.html</presentationURL>
+</device>
+</root>
+`, html.EscapeString(req.Host), html.EscapeString(emulator.Config.Name), html.EscapeString(req.Host), emulator.serial, emulator.uuid)
+}
+
+func handleCreateUser(resp http.ResponseWriter, req *http.Request) {
+	username := make([]byte, 16)
+	if _, err := rand.Read(username); err != nil {
+		writeJSON(resp, http.StatusInternalServerError, []interface{}{hueError(901, "/", err.Error())})
+		return
+	}
+	writeJSON(resp, http.StatusOK, []interface{}{
+		map[string]interface{}{"success": map[string]string{"username": hex.EncodeToString(username)}},
+	})
+}
+
+func (emulator *Emulator) config() map[string]interface{} {
+	mac := []string{}
+	for i := 0; i < len(emulator.serial); i += 2 {
+		mac = append(mac, emulator.serial[i:i+2])
+	}
+	return map[string]interface{}{
+		"name":             emulator.Config.Name,
+		"bridgeid":         emulator.bridgeID,
+		"mac":              strings.Join(mac, ":"),
+		"modelid":          "BSB002",
+		"apiversion":       apiVersion,
+		"swversion":        softwareVer,
+		"linkbutton":       true,
+		"factorynew":       false,
+		"replacesbridgeid": nil,
+	}
+}
+
+func (emulator *Emulator) handleConfig(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, http.StatusOK, emulator.config())
+}
+
+func (emulator *Emulator) handleFullState(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, http.StatusOK, map[string]interface{}{
+		"lights": emulator.lightsState(),
+		"config": emulator.config(),
+		"groups": map[string]interface{}{},
+	})
+}
+
+func (emulator *Emulator) handleLights(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, http.StatusOK, emulator.lightsState())
+}
+
+func (emulator *Emulator) lightsState() map[string]interface{} {
+	lights := map[string]interface{}{}
+	for _, light := range emulator.lights {
+		lights[light.id] = light.state()
+	}
+	return lights
+}
+
+//state is the light as the Hue API describes it, a switch
+// which cannot be reached is an unreachable light
+func (light *light) state() map[string]interface{} {
+	on := false
+	status, err := light.device.UpdateStatus()
+	if err == nil {
+		on = strings.EqualFold(*status, "ON")
+	}
+	return map[string]interface{}{
+		"state": map[string]interface{}{
+			"on":        on,
+			"bri":       254,
+			"alert":     "none",
+			"mode":      "homeautomation",
+			"reachable": err == nil,
+		},
+		"type":             "On/Off plug-in unit",
+		"name":             light.name,
+		"modelid":          "LOM001",
+		"manufacturername": "Philips",
+		"productname":      "Hue Smart plug",
+		"uniqueid":         light.uniqueID,
+		"swversion":        "1.65.9_hB3217DF4",
+	}
+}
+
+func (emulator *Emulator) withLight(handler func(http.ResponseWriter, *http.Request, *light)) func(http.ResponseWriter, *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		id := chi.URLParam(req, "id")
+		for _, light := range emulator.lights {
+			if light.id == id {
+				handler(resp, req, light)
+				return
+			}
+		}
+		writeJSON(resp, http.StatusOK, []interface{}{hueError(3, "/lights/"+id, "resource, /lights/"+id+", not available")})
+	}
+}
+
+func (emulator *Emulator) handleLight(resp http.ResponseWriter, req *http.Request, light *light) {
+	writeJSON(resp, http.StatusOK, light.state())
+}
+
+//handleLightState switches the light on or off, brightness and colour
+// are acknowledged so assistants do not report a failure, but ignored
+func (emulator *Emulator) handleLightState(resp http.ResponseWriter, req *http.Request, light *light) {
+	var change map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+		writeJSON(resp, http.StatusOK, []interface{}{hueError(2, "/lights/"+light.id+"/state", "body contains invalid json")})
+		return
+	}
+	results := []interface{}{}
+	for attribute, value := range change {
+		address := fmt.Sprintf("/lights/%s/state/%s", light.id, attribute)
+		if attribute == "on" {
+			on, ok := value.(bool)
+			if !ok {
+				results = append(results, hueError(7, address, "invalid value for parameter, on"))
+				continue
+			}
+			var err error
+			state := "OFF"
+			if on {
+				state = "ON"
+				err = light.device.TurnOn()
+			} else {
+				err = light.device.TurnOff()
+			}
+			// the actor is the assistant, known only by its address
+			actor, _, _ := net.SplitHostPort(req.RemoteAddr)
+			emulator.Audit.Record(audit.Command(audit.SourceHue, actor, "switch", light.name, state, err, switcher.ReadBack(light.device)))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"switch": light.name,
+					"on":     on,
+					"err":    err,
+				}).Error("hue switch command failed")
+				results = append(results, hueError(901, address, err.Error()))
+				continue
+			}
+		}
+		results = append(results, map[string]interface{}{"success": map[string]interface{}{address: value}})
+	}
+	writeJSON(resp, http.StatusOK, results)
+}
+
+//hueError is an error as the Hue API reports it, always with a 200
+func hueError(kind int, address string, description string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{
+		"type":        kind,
+		"address":     address,
+		"description": description,
+	}}
+}
+
+func writeJSON(resp http.ResponseWriter, status int, value interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(value); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not write hue response")
+	}
+}
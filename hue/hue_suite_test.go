@@ -0,0 +1,13 @@
+package hue_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Hue Suite")
+}
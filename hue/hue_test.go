@@ -0,0 +1,152 @@
+package hue_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hue"
+	"github.com/oskoss/mi-casa/switcher"
+)
+
+var _ = Describe("Hue emulator", func() {
+	var (
+		porch    *switcher.MockSwitch
+		furnace  *switcher.MockSwitch
+		switches map[string]switcher.SwitchDevice
+		emulator *Emulator
+		server   *httptest.Server
+	)
+	BeforeEach(func() {
+		porch = &switcher.MockSwitch{Status: "OFF"}
+		furnace = &switcher.MockSwitch{Status: "OFF"}
+		switches = map[string]switcher.SwitchDevice{"porch light": porch, "furnace": furnace}
+		var err error
+		emulator, err = New(Config{Devices: []string{"porch light"}}, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+		server = httptest.NewServer(emulator.Router())
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	request := func(method string, path string, body string) interface{} {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		Expect(err).ShouldNot(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		var decoded interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&decoded)).Should(Succeed())
+		return decoded
+	}
+
+	Describe("configuring", func() {
+		It("should only expose configured switches", func() {
+			_, err := New(Config{}, switches)
+			Expect(err).Should(HaveOccurred())
+			_, err = New(Config{Devices: []string{"garage"}}, switches)
+			Expect(err).Should(HaveOccurred())
+			_, err = New(Config{Devices: []string{"furnace", "furnace"}}, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("the API", func() {
+		It("should hand out a username", func() {
+			created := request(http.MethodPost, "/api", `{"devicetype":"Echo"}`).([]interface{})
+			Expect(created[0]).Should(HaveKeyWithValue("success", HaveKey("username")))
+		})
+		It("should list only the whitelisted switches as lights", func() {
+			porch.Status = "ON"
+			lights := request(http.MethodGet, "/api/echo/lights", "").(map[string]interface{})
+			Expect(lights).Should(HaveLen(1))
+			light := lights["1"].(map[string]interface{})
+			Expect(light["name"]).Should(Equal("porch light"))
+			Expect(light["state"]).Should(HaveKeyWithValue("on", true))
+			Expect(light["state"]).Should(HaveKeyWithValue("reachable", true))
+			Expect(light["uniqueid"]).Should(MatchRegexp(`^00:17:88:01:([0-9a-f]{2}:){3}[0-9a-f]{2}-0b$`))
+		})
+		It("should switch a light", func() {
+			changed := request(http.MethodPut, "/api/echo/lights/1/state", `{"on":true,"bri":128}`).([]interface{})
+			Expect(changed).Should(ContainElement(HaveKeyWithValue("success", HaveKeyWithValue("/lights/1/state/on", true))))
+			Expect(porch.Status).Should(Equal("ON"))
+			Expect(furnace.Status).Should(Equal("OFF"))
+		})
+		It("should report a light which is not exposed", func() {
+			missing := request(http.MethodPut, "/api/echo/lights/2/state", `{"on":true}`).([]interface{})
+			Expect(missing[0]).Should(HaveKeyWithValue("error", HaveKeyWithValue("type", BeNumerically("==", 3))))
+			Expect(furnace.Status).Should(Equal("OFF"))
+		})
+		It("should describe itself as a Hue bridge", func() {
+			resp, err := http.Get(server.URL + "/description.xml")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			description, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(description)).Should(ContainSubstring("<modelName>Philips hue bridge 2015</modelName>"))
+			Expect(string(description)).Should(ContainSubstring("<UDN>uuid:2f402f80-da50-11e1-9b23-"))
+		})
+	})
+
+	Describe("listening", func() {
+		It("should fail at once when the address is in use", func() {
+			taken, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer taken.Close()
+			emulator, err := New(Config{
+				Address:   taken.Addr().String(),
+				Advertise: "192.168.1.20:80",
+				Devices:   []string{"porch light"},
+			}, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(emulator.Listen()).ShouldNot(Succeed())
+		})
+	})
+
+	Describe("discovery", func() {
+		It("should answer SSDP searches with where to find the bridge", func() {
+			free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ShouldNot(HaveOccurred())
+			ssdp := free.LocalAddr().String()
+			free.Close()
+			announced, err := New(Config{
+				Address:   "127.0.0.1:0",
+				Advertise: "192.168.1.20:80",
+				SSDP:      ssdp,
+				Devices:   []string{"porch light"},
+			}, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			stop := make(chan struct{})
+			defer close(stop)
+			go announced.Start(stop)
+
+			search, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ShouldNot(HaveOccurred())
+			defer search.Close()
+			to, err := net.ResolveUDPAddr("udp4", ssdp)
+			Expect(err).ShouldNot(HaveOccurred())
+			response := make([]byte, 2048)
+			Eventually(func() string {
+				search.WriteToUDP([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: urn:schemas-upnp-org:device:basic:1\r\n\r\n"), to)
+				search.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, _, err := search.ReadFromUDP(response)
+				if err != nil {
+					return ""
+				}
+				return string(response[:n])
+			}).Should(And(
+				ContainSubstring("LOCATION: http://192.168.1.20:80/description.xml"),
+				ContainSubstring("hue-bridgeid: "),
+				ContainSubstring("ST: urn:schemas-upnp-org:device:basic:1"),
+			))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package hue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ssdpAddress = "239.255.255.250:1900"
+
+//searchTargets are the M-SEARCH targets a Hue bridge answers
+var searchTargets = []string{"ssdp:all", "upnp:rootdevice", "urn:schemas-upnp-org:device:basic:1"}
+
+//listenSSDP joins the SSDP multicast group, an address
+// which is not multicast is listened on directly
+func listenSSDP(address string) (*net.UDPConn, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddress.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", nil, udpAddress)
+	}
+	return net.ListenUDP("udp4", udpAddress)
+}
+
+//answer replies to every M-SEARCH for a Hue bridge until conn is closed
+func (emulator *Emulator) answer(conn *net.UDPConn, advertise string) {
+	buffer := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		target, ok := searching(buffer[:n])
+		if !ok {
+			continue
+		}
+		// answer on a fresh socket, replies from the multicast
+		// group address are dropped by some assistants
+		reply, err := net.DialUDP("udp4", nil, from)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"to":  from.String(),
+				"err": err,
+			}).Warn("could not answer SSDP search")
+			continue
+		}
+		reply.Write(emulator.searchResponse(target, advertise))
+		reply.Close()
+	}
+}
+
+//searching returns the search target of an M-SEARCH looking for a bridge
+func searching(datagram []byte) (string, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(datagram)))
+	if err != nil || req.Method != "M-SEARCH" {
+		return "", false
+	}
+	target := req.Header.Get("ST")
+	for _, wanted := range searchTargets {
+		if strings.EqualFold(target, wanted) {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+func (emulator *Emulator) searchResponse(target string, advertise string) []byte {
+	usn := "uuid:" + emulator.uuid
+	if !strings.EqualFold(target, "ssdp:all") {
+		usn += "::" + target
+	}
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+		"HOST: 239.255.255.250:1900\r\n"+
+		"EXT:\r\n"+
+		"CACHE-CONTROL: max-age=100\r\n"+
+		"LOCATION: http://%s/description.xml\r\n"+
+		"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/%s\r\n"+
+		"hue-bridgeid: %s\r\n"+
+		"ST: %s\r\n"+
+		"USN: %s\r\n"+
+		"\r\n", advertise, apiVersion, emulator.bridgeID, target, usn))
+}
@@ -0,0 +1,181 @@
+package hvac
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultLead = 10 * time.Minute
+	//learningRate is the weight given to each new observation
+	learningRate = 0.2
+	//maxTracking is how long after shutting off an overshoot is watched for
+	maxTracking = time.Hour
+	//maxRecovery is how long the first heat stage may take to reach the setpoint
+	maxRecovery = time.Hour
+)
+
+//Rates is what Adaptive has learned about the room, rates are in
+// degrees per hour and overshoots in degrees past the shut off point
+type Rates struct {
+	HeatRate      float64 `json:"heatRate" yaml:"heatRate"`
+	CoolRate      float64 `json:"coolRate" yaml:"coolRate"`
+	DriftRate     float64 `json:"driftRate" yaml:"driftRate"`
+	HeatOvershoot float64 `json:"heatOvershoot" yaml:"heatOvershoot"`
+	CoolOvershoot float64 `json:"coolOvershoot" yaml:"coolOvershoot"`
+}
+
+//Adaptive is hysteresis which learns how the room responds. It shuts
+// heat off early by the overshoot seen after previous heat cycles (and
+// cooling likewise) and starts early when the idle drift rate says the
+// temperature will leave the band within Lead. The second heat stage is
+// also added when the first is learned to be too slow to recover in time.
+type Adaptive struct {
+	Padding     float64
+	StageOffset float64
+	Lead        time.Duration
+	Rates       Rates
+	lastTemp    float64
+	lastTime    time.Time
+	lastCall    Call
+	tracking    string
+	offTemp     float64
+	peak        float64
+	offTime     time.Time
+}
+
+func (adaptive *Adaptive) Decide(input Input) (Call, string) {
+	adaptive.learn(input)
+	setpoint := input.Setpoint
+	temp := input.Temperature
+	padding := adaptive.Padding
+	heatOffAt := setpoint - math.Min(adaptive.Rates.HeatOvershoot, padding)
+	coolOffAt := setpoint + math.Min(adaptive.Rates.CoolOvershoot, padding)
+	predicted := temp + adaptive.Rates.DriftRate*adaptive.Lead.Hours()
+	previous := input.Previous
+
+	var call Call
+	reason := "within setpoint band"
+	switch {
+	case input.HeatAllowed() && previous.Heating() && temp < heatOffAt:
+		call.HeatStages = 1
+		reason = fmt.Sprintf("heating until %.1f to allow for %.1f overshoot", heatOffAt, setpoint-heatOffAt)
+	case input.HeatAllowed() && temp <= setpoint-padding:
+		call.HeatStages = 1
+		reason = "below setpoint"
+	case input.HeatAllowed() && !previous.Cool && temp < heatOffAt && predicted <= setpoint-padding:
+		call.HeatStages = 1
+		reason = fmt.Sprintf("predicted to fall to %.1f within %v", predicted, adaptive.Lead)
+	case input.CoolAllowed() && previous.Cool && temp > coolOffAt:
+		call.Cool = true
+		reason = fmt.Sprintf("cooling until %.1f to allow for %.1f overshoot", coolOffAt, coolOffAt-setpoint)
+	case input.CoolAllowed() && temp >= setpoint+padding:
+		call.Cool = true
+		reason = "above setpoint"
+	case input.CoolAllowed() && !previous.Heating() && temp > coolOffAt && predicted >= setpoint+padding:
+		call.Cool = true
+		reason = fmt.Sprintf("predicted to rise to %.1f within %v", predicted, adaptive.Lead)
+	}
+	if call.HeatStages == 0 {
+		return call, reason
+	}
+	call, reason = stage(input, setpoint-padding, adaptive.StageOffset, reason)
+	heatRate := adaptive.Rates.HeatRate
+	if call.HeatStages == 1 && len(input.Equipment.Heat) > 1 && heatRate > 0 && (heatOffAt-temp)/heatRate > maxRecovery.Hours() {
+		call.HeatStages = 2
+		reason = fmt.Sprintf("first stage heats %.1f degrees per hour, adding second stage", heatRate)
+	}
+	return call, reason
+}
+
+//learn updates the rates from the change since the previous step
+// and watches for the overshoot after heat or cooling shuts off
+func (adaptive *Adaptive) learn(input Input) {
+	temp := input.Temperature
+	if !adaptive.lastTime.IsZero() {
+		hours := input.Now.Sub(adaptive.lastTime).Hours()
+		if hours > 0 {
+			rate := (temp - adaptive.lastTemp) / hours
+			learned := &adaptive.Rates
+			switch {
+			case input.Previous.Heating():
+				learned.HeatRate = blend(learned.HeatRate, rate)
+			case input.Previous.Cool:
+				learned.CoolRate = blend(learned.CoolRate, rate)
+			case adaptive.tracking == "":
+				// drift is only meaningful once the equipment has settled
+				learned.DriftRate = blend(learned.DriftRate, rate)
+			}
+		}
+	}
+
+	switch {
+	case adaptive.lastCall.Heating() && !input.Previous.Heating():
+		adaptive.startTracking("heat", input)
+	case adaptive.lastCall.Cool && !input.Previous.Cool:
+		adaptive.startTracking("cool", input)
+	case adaptive.tracking == "":
+	case input.Previous.Heating() || input.Previous.Cool:
+		// running again before the peak passed, the peak so far will do
+		adaptive.finishTracking()
+	case adaptive.tracking == "heat":
+		adaptive.peak = math.Max(adaptive.peak, temp)
+		if temp < adaptive.peak || input.Now.Sub(adaptive.offTime) > maxTracking {
+			adaptive.finishTracking()
+		}
+	case adaptive.tracking == "cool":
+		adaptive.peak = math.Min(adaptive.peak, temp)
+		if temp > adaptive.peak || input.Now.Sub(adaptive.offTime) > maxTracking {
+			adaptive.finishTracking()
+		}
+	}
+	adaptive.lastTemp = temp
+	adaptive.lastTime = input.Now
+	adaptive.lastCall = input.Previous
+}
+
+func (adaptive *Adaptive) startTracking(kind string, input Input) {
+	adaptive.tracking = kind
+	adaptive.offTemp = adaptive.lastTemp
+	adaptive.peak = input.Temperature
+	adaptive.offTime = input.Now
+}
+
+func (adaptive *Adaptive) finishTracking() {
+	if adaptive.tracking == "heat" {
+		adaptive.Rates.HeatOvershoot = blend(adaptive.Rates.HeatOvershoot, math.Max(0, adaptive.peak-adaptive.offTemp))
+	} else {
+		adaptive.Rates.CoolOvershoot = blend(adaptive.Rates.CoolOvershoot, math.Max(0, adaptive.offTemp-adaptive.peak))
+	}
+	adaptive.tracking = ""
+}
+
+func blend(learned float64, observed float64) float64 {
+	if learned == 0 {
+		return observed
+	}
+	return learned + learningRate*(observed-learned)
+}
+
+//Learned returns the learned rates keyed by their yaml names
+func (adaptive *Adaptive) Learned() map[string]float64 {
+	rates := adaptive.Rates
+	return map[string]float64{
+		"heatRate":      rates.HeatRate,
+		"coolRate":      rates.CoolRate,
+		"driftRate":     rates.DriftRate,
+		"heatOvershoot": rates.HeatOvershoot,
+		"coolOvershoot": rates.CoolOvershoot,
+	}
+}
+
+func (adaptive *Adaptive) Relearn(learned map[string]float64) {
+	adaptive.Rates = Rates{
+		HeatRate:      learned["heatRate"],
+		CoolRate:      learned["coolRate"],
+		DriftRate:     learned["driftRate"],
+		HeatOvershoot: learned["heatOvershoot"],
+		CoolOvershoot: learned["coolOvershoot"],
+	}
+}
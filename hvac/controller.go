@@ -0,0 +1,589 @@
+package hvac
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/state"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//Mode is what the controller is allowed to run
+type Mode string
+
+const (
+	ModeOff  Mode = "off"
+	ModeHeat Mode = "heat"
+	ModeCool Mode = "cool"
+	ModeAuto Mode = "auto"
+	ModeFan  Mode = "fan"
+)
+
+//ParseMode checks mode is one of the known modes
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case ModeOff, ModeHeat, ModeCool, ModeAuto, ModeFan:
+		return Mode(mode), nil
+	}
+	return "", fmt.Errorf("mode %q must be one of off, heat, cool, auto or fan", mode)
+}
+
+const (
+	defaultControlInterval = 30 * time.Second
+	defaultPadding         = 2.0
+	defaultStageOffset     = 3.0
+	defaultMinSetpoint     = 45.0
+	defaultMaxSetpoint     = 90.0
+	//noReading is the reason for running nothing without a temperature
+	noReading = "no temperature reading"
+)
+
+//Config describes the HVAC system, or one zone of it. Sensor and
+// Sensors are thermostat names, the temperature is the mean of them all,
+// and Heat, Aux, Cool and Fan are switch names
+type Config struct {
+	Name        string          `yaml:"name,omitempty"`
+	Interval    time.Duration   `yaml:"interval,omitempty"`
+	Mode        string          `yaml:"mode"`
+	Setpoint    float64         `yaml:"setpoint"`
+	MinSetpoint float64         `yaml:"minSetpoint,omitempty"`
+	MaxSetpoint float64         `yaml:"maxSetpoint,omitempty"`
+	Schedule    []SchedulePoint `yaml:"schedule,omitempty"`
+	Padding     float64         `yaml:"padding,omitempty"`
+	StageOffset float64         `yaml:"stageOffset,omitempty"`
+	Strategy    StrategyConfig  `yaml:"strategy,omitempty"`
+	FanWithHeat bool            `yaml:"fanWithHeat,omitempty"`
+	Protection  Protection      `yaml:"protection,omitempty"`
+	Sensor      string          `yaml:"sensor,omitempty"`
+	Sensors     []string        `yaml:"sensors,omitempty"`
+	Heat        []string        `yaml:"heat,omitempty"`
+	Aux         string          `yaml:"aux,omitempty"`
+	Cool        string          `yaml:"cool,omitempty"`
+	Fan         string          `yaml:"fan,omitempty"`
+}
+
+//Decision is the outcome of one control step
+type Decision struct {
+	Time        time.Time `json:"time"`
+	Mode        Mode      `json:"mode"`
+	Setpoint    float64   `json:"setpoint"`
+	Temperature float64   `json:"temperature"`
+	Requested   Call      `json:"requested"`
+	Call        Call      `json:"call"`
+	Reason      string    `json:"reason"`
+	Deferred    []string  `json:"deferred,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+//Status is a snapshot of the controller
+type Status struct {
+	Name         string   `json:"name,omitempty"`
+	Mode         Mode     `json:"mode"`
+	Setpoint     float64  `json:"setpoint"`
+	LastDecision Decision `json:"lastDecision"`
+	Modes        []Mode   `json:"modes"`
+	Devices      []string `json:"devices"`
+}
+
+//Controller keeps the temperature read from Sensor near the setpoint
+// by driving Equipment with whatever its Strategy decides.
+// Protection can hold back part of that call, the reasons are kept on
+// the Decision so they show up in the logs and Status. Every change of
+// call is published to Events and recorded to Audit when they are set.
+type Controller struct {
+	Name         string
+	Sensor       thermostat.ThermostatDevice
+	Equipment    *Equipment
+	Interval     time.Duration
+	Strategy     Strategy
+	FanWithHeat  bool
+	Protection   Protection
+	Schedule     []SchedulePoint
+	MinSetpoint  float64
+	MaxSetpoint  float64
+	Events       *events.Bus
+	Audit        *audit.Trail
+	mode         Mode
+	setpoint     float64
+	call         Call
+	last         Decision
+	poweredAt    time.Time
+	coolGuard    *guard
+	heatGuard    *guard
+	scheduledAt  time.Time
+	arbiter      *arbiter
+	strategyType string
+	devices      []string
+	store        *state.Store
+	savedCore    []byte
+	savedAt      time.Time
+	handedOver   bool
+	lock         sync.Mutex
+}
+
+//NewController builds a controller from config, looking up
+// the sensor and relays by name
+func NewController(conf Config, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice) (*Controller, error) {
+	mode, err := ParseMode(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	sensor, err := lookupSensor(conf, thermostats)
+	if err != nil {
+		return nil, err
+	}
+	for _, point := range conf.Schedule {
+		if err := point.validate(); err != nil {
+			return nil, err
+		}
+	}
+	lookup := func(role string, name string) (switcher.SwitchDevice, error) {
+		device, ok := switches[name]
+		if !ok {
+			return nil, fmt.Errorf("hvac %s switch %s not found", role, name)
+		}
+		return device, nil
+	}
+	equipment := &Equipment{}
+	used := map[string]string{}
+	assign := func(role string, name string) (switcher.SwitchDevice, error) {
+		if other, ok := used[name]; ok {
+			return nil, fmt.Errorf("hvac switch %s cannot be both %s and %s", name, other, role)
+		}
+		used[name] = role
+		return lookup(role, name)
+	}
+	for i, name := range conf.Heat {
+		stage, err := assign(fmt.Sprintf("heat stage %d", i+1), name)
+		if err != nil {
+			return nil, err
+		}
+		equipment.Heat = append(equipment.Heat, stage)
+	}
+	if conf.Aux != "" {
+		if equipment.Aux, err = assign("aux", conf.Aux); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Cool != "" {
+		if equipment.Cool, err = assign("cool", conf.Cool); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Fan != "" {
+		if equipment.Fan, err = assign("fan", conf.Fan); err != nil {
+			return nil, err
+		}
+	}
+	strategy, err := NewStrategy(conf.Strategy, conf.Padding, conf.StageOffset)
+	if err != nil {
+		return nil, err
+	}
+	strategyType := conf.Strategy.Type
+	if strategyType == "" {
+		strategyType = StrategyHysteresis
+	}
+	controller := &Controller{
+		Name:         conf.Name,
+		Sensor:       sensor,
+		Equipment:    equipment,
+		Interval:     conf.Interval,
+		Strategy:     strategy,
+		FanWithHeat:  conf.FanWithHeat,
+		Protection:   conf.Protection,
+		Schedule:     conf.Schedule,
+		MinSetpoint:  conf.MinSetpoint,
+		MaxSetpoint:  conf.MaxSetpoint,
+		strategyType: strategyType,
+		devices:      conf.devices(),
+		setpoint:     conf.Setpoint,
+		coolGuard:    newGuard("compressor"),
+		heatGuard:    newGuard("heat"),
+	}
+	if min, max := controller.SetpointLimits(); min >= max {
+		return nil, fmt.Errorf("minSetpoint %g must be below maxSetpoint %g", min, max)
+	}
+	if err := controller.checkSetpoint(conf.Setpoint); err != nil {
+		return nil, err
+	}
+	for _, point := range conf.Schedule {
+		if err := controller.checkSetpoint(point.Setpoint); err != nil {
+			return nil, fmt.Errorf("schedule at %s: %v", point.At, err)
+		}
+	}
+	if err := controller.SetMode(mode); err != nil {
+		return nil, err
+	}
+	for _, point := range conf.Schedule {
+		if point.Mode == "" {
+			continue
+		}
+		if err := controller.checkMode(Mode(point.Mode)); err != nil {
+			return nil, fmt.Errorf("schedule at %s: %v", point.At, err)
+		}
+	}
+	return controller, nil
+}
+
+func lookupSensor(conf Config, thermostats map[string]thermostat.ThermostatDevice) (thermostat.ThermostatDevice, error) {
+	names := conf.Sensors
+	if conf.Sensor != "" {
+		names = append([]string{conf.Sensor}, names...)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("hvac sensor not set")
+	}
+	average := &averageSensor{}
+	for _, name := range names {
+		sensor, ok := thermostats[name]
+		if !ok {
+			return nil, fmt.Errorf("hvac sensor %s not found", name)
+		}
+		average.names = append(average.names, name)
+		average.sensors = append(average.sensors, sensor)
+	}
+	if len(average.sensors) == 1 {
+		return average.sensors[0], nil
+	}
+	return average, nil
+}
+
+//SetMode changes the mode, taking effect at the next step
+func (controller *Controller) SetMode(mode Mode) error {
+	if err := controller.checkMode(mode); err != nil {
+		return err
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.mode = mode
+	controller.save(time.Now())
+	return nil
+}
+
+//Modes returns every mode the equipment can run
+func (controller *Controller) Modes() []Mode {
+	modes := []Mode{}
+	for _, mode := range []Mode{ModeOff, ModeHeat, ModeCool, ModeAuto, ModeFan} {
+		if controller.checkMode(mode) == nil {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+//Devices names the sensors and switches the controller uses
+func (controller *Controller) Devices() []string {
+	return append([]string{}, controller.devices...)
+}
+
+//checkMode reports whether the equipment can run mode
+func (controller *Controller) checkMode(mode Mode) error {
+	if _, err := ParseMode(string(mode)); err != nil {
+		return err
+	}
+	equipment := controller.Equipment
+	switch {
+	case (mode == ModeHeat || mode == ModeAuto) && len(equipment.Heat) == 0 && equipment.Aux == nil:
+		return fmt.Errorf("mode %s requires heat to be configured", mode)
+	case (mode == ModeCool || mode == ModeAuto) && equipment.Cool == nil:
+		return fmt.Errorf("mode %s requires cool to be configured", mode)
+	case mode == ModeFan && equipment.Fan == nil:
+		return fmt.Errorf("mode %s requires a fan to be configured", mode)
+	}
+	return nil
+}
+
+//SetpointLimits returns the lowest and highest setpoint SetSetpoint takes
+func (controller *Controller) SetpointLimits() (float64, float64) {
+	min, max := controller.MinSetpoint, controller.MaxSetpoint
+	if min == 0 {
+		min = defaultMinSetpoint
+	}
+	if max == 0 {
+		max = defaultMaxSetpoint
+	}
+	return min, max
+}
+
+func (controller *Controller) checkSetpoint(setpoint float64) error {
+	if min, max := controller.SetpointLimits(); setpoint < min || setpoint > max {
+		return fmt.Errorf("setpoint %g must be between %g and %g", setpoint, min, max)
+	}
+	return nil
+}
+
+//clampSetpoint returns setpoint brought within SetpointLimits
+func (controller *Controller) clampSetpoint(setpoint float64) float64 {
+	min, max := controller.SetpointLimits()
+	return math.Max(min, math.Min(max, setpoint))
+}
+
+//SetSetpoint changes the target temperature, taking effect at the
+// next step, refusing one outside SetpointLimits
+func (controller *Controller) SetSetpoint(setpoint float64) error {
+	if err := controller.checkSetpoint(setpoint); err != nil {
+		return err
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.setpoint = setpoint
+	controller.save(time.Now())
+	return nil
+}
+
+//Status returns the current mode, setpoint and last decision,
+// with the modes the equipment can run and the devices it uses
+func (controller *Controller) Status() Status {
+	modes := controller.Modes()
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return Status{
+		Name:         controller.Name,
+		Mode:         controller.mode,
+		Setpoint:     controller.setpoint,
+		LastDecision: controller.last,
+		Modes:        modes,
+		Devices:      controller.Devices(),
+	}
+}
+
+//ReadBack returns a read of the setting of controller a command changed,
+// "mode" or the setpoint as "setpoint" or "temperature", to record what
+// the command came to
+func ReadBack(controller *Controller, setting string) func() (string, error) {
+	return func() (string, error) {
+		status := controller.Status()
+		switch setting {
+		case "mode":
+			return string(status.Mode), nil
+		case "setpoint", "temperature":
+			return strconv.FormatFloat(status.Setpoint, 'f', -1, 64), nil
+		}
+		return "", fmt.Errorf("unknown setting %s", setting)
+	}
+}
+
+//Run steps the controller every Interval until stop is closed,
+// leaving the equipment idle when stopping unless it was handed over
+func (controller *Controller) Run(stop <-chan struct{}) {
+	interval := controller.Interval
+	if interval <= 0 {
+		interval = defaultControlInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	controller.lock.Lock()
+	controller.handedOver = false
+	controller.lock.Unlock()
+	controller.Step(time.Now())
+	for {
+		select {
+		case <-stop:
+			controller.lock.Lock()
+			handedOver := controller.handedOver
+			controller.lock.Unlock()
+			if handedOver {
+				return
+			}
+			if err := controller.Equipment.Apply(Call{}); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("could not idle HVAC equipment while stopping")
+			}
+			return
+		case now := <-ticker.C:
+			controller.Step(now)
+		}
+	}
+}
+
+//Step reads the sensor, decides what to call for and applies
+// as much of that call as the protection timers allow
+func (controller *Controller) Step(now time.Time) Decision {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	if controller.poweredAt.IsZero() {
+		controller.poweredAt = now
+	}
+	controller.followSchedule(now)
+	decision := Decision{
+		Time:     now,
+		Mode:     controller.mode,
+		Setpoint: controller.setpoint,
+	}
+	temp, err := controller.Sensor.CurrentTemp()
+	if err != nil {
+		// without a reading the safest call is to run nothing
+		decision.Requested = controller.withFan(Call{})
+		decision.Reason = noReading
+		decision.Error = err.Error()
+	} else {
+		decision.Temperature = *temp
+		requested, reason := controller.Strategy.Decide(Input{
+			Now:         now,
+			Mode:        controller.mode,
+			Setpoint:    controller.setpoint,
+			Temperature: *temp,
+			Previous:    controller.call,
+			Equipment:   controller.Equipment,
+		})
+		decision.Reason = reason
+		if controller.mode == ModeOff {
+			decision.Reason = "mode off"
+		}
+		if controller.mode == ModeFan {
+			decision.Reason = "fan only"
+		}
+		decision.Requested = controller.withFan(requested)
+	}
+	decision.Call, decision.Deferred = controller.protect(decision.Requested, now)
+	if controller.arbiter != nil {
+		var waiting []string
+		decision.Call, waiting = controller.arbiter.claim(controller.Name, decision.Call)
+		decision.Call = controller.withFan(decision.Call)
+		decision.Deferred = append(decision.Deferred, waiting...)
+	}
+	if err := controller.Equipment.Apply(decision.Call); err != nil {
+		decision.Error = err.Error()
+		if decision.Call != controller.call && controller.last.Error == "" {
+			controller.audit(decision)
+		}
+		// relays which cannot be reached may well have lost power,
+		// so assume they are off and hold them off once they return
+		controller.poweredAt = time.Time{}
+		controller.coolGuard.record(controller.Name, false, now)
+		controller.heatGuard.record(controller.Name, false, now)
+		if controller.arbiter != nil {
+			controller.arbiter.release(controller.Name)
+		}
+		log.WithFields(log.Fields{
+			"err":  err,
+			"call": decision.Call.String(),
+		}).Error("failed to apply HVAC call")
+	} else {
+		controller.coolGuard.record(controller.Name, decision.Call.Cool, now)
+		controller.heatGuard.record(controller.Name, decision.Call.Heating(), now)
+		if decision.Call != controller.call {
+			log.WithFields(log.Fields{
+				"zone":        controller.Name,
+				"temperature": decision.Temperature,
+				"setpoint":    decision.Setpoint,
+				"mode":        decision.Mode,
+				"call":        decision.Call.String(),
+				"reason":      decision.Reason,
+			}).Printf("HVAC call changed")
+			controller.Events.Publish(events.Event{
+				Time:   now,
+				Kind:   events.KindDecision,
+				Device: controller.device(),
+				Value:  decision.Temperature,
+				State:  decision.Call.String(),
+				Reason: decision.Reason,
+			})
+			controller.audit(decision)
+		}
+		controller.call = decision.Call
+	}
+	if len(decision.Deferred) > 0 && !sameDeferrals(decision.Deferred, controller.last.Deferred) {
+		log.WithFields(log.Fields{
+			"requested": decision.Requested.String(),
+			"call":      decision.Call.String(),
+			"deferred":  decision.Deferred,
+		}).Printf("HVAC call deferred by equipment protection")
+	}
+	controller.last = decision
+	controller.save(now)
+	return decision
+}
+
+//followSchedule applies the schedule point in effect at now
+// the first time it is seen, leaving manual changes alone until then
+func (controller *Controller) followSchedule(now time.Time) {
+	point, started, ok := scheduled(controller.Schedule, now)
+	if !ok || started.Equal(controller.scheduledAt) {
+		return
+	}
+	controller.scheduledAt = started
+	controller.setpoint = controller.clampSetpoint(point.Setpoint)
+	if point.Mode != "" {
+		controller.mode = Mode(point.Mode)
+	}
+	log.WithFields(log.Fields{
+		"zone":     controller.Name,
+		"at":       point.At,
+		"setpoint": controller.setpoint,
+		"mode":     controller.mode,
+	}).Printf("HVAC schedule applied")
+	requested := fmt.Sprintf("setpoint %g", point.Setpoint)
+	if point.Mode != "" {
+		requested += " mode " + point.Mode
+	}
+	controller.Audit.Record(audit.Entry{
+		Time:      now,
+		Source:    audit.SourceSchedule,
+		Actor:     "schedule " + point.At,
+		Action:    "schedule",
+		Target:    controller.device(),
+		Requested: requested,
+		Result:    fmt.Sprintf("setpoint %g mode %s", controller.setpoint, controller.mode),
+	})
+}
+
+//audit records a change of call with why it was made, what
+// protection held back and whether the equipment took it
+func (controller *Controller) audit(decision Decision) {
+	reason := fmt.Sprintf("%s, setpoint %.1f in mode %s", decision.Reason, decision.Setpoint, decision.Mode)
+	if decision.Reason != noReading {
+		reason = fmt.Sprintf("%s, %.1f against setpoint %.1f in mode %s", decision.Reason, decision.Temperature, decision.Setpoint, decision.Mode)
+	}
+	if len(decision.Deferred) > 0 {
+		reason += ", held back by " + strings.Join(decision.Deferred, "; ")
+	}
+	controller.Audit.Record(audit.Entry{
+		Time:      decision.Time,
+		Source:    audit.SourceController,
+		Actor:     controller.device(),
+		Action:    "call",
+		Target:    controller.device(),
+		Requested: decision.Requested.String(),
+		Result:    decision.Call.String(),
+		Reason:    reason,
+		Error:     decision.Error,
+	})
+}
+
+//device is the name the controller publishes and records as
+func (controller *Controller) device() string {
+	if controller.Name == "" {
+		return "hvac"
+	}
+	return controller.Name
+}
+
+func sameDeferrals(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// the remaining time changes every step so compare the cause only
+		if strings.SplitN(a[i], ",", 2)[0] != strings.SplitN(b[i], ",", 2)[0] {
+			return false
+		}
+	}
+	return true
+}
+
+//withFan runs the fan for fan only mode, cooling and optionally heating
+func (controller *Controller) withFan(call Call) Call {
+	call.Fan = controller.Equipment.Fan != nil &&
+		(controller.mode == ModeFan || call.Cool || (call.Heating() && controller.FanWithHeat))
+	return call
+}
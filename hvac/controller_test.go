@@ -0,0 +1,242 @@
+package hvac_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		sensor      *thermostat.MockThermostat
+		heat1       *switcher.MockSwitch
+		heat2       *switcher.MockSwitch
+		aux         *switcher.MockSwitch
+		cool        *switcher.MockSwitch
+		fan         *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		conf        Config
+		controller  *Controller
+		now         time.Time
+	)
+	BeforeEach(func() {
+		sensor = &thermostat.MockThermostat{Temperature: 70}
+		heat1 = &switcher.MockSwitch{Status: "OFF"}
+		heat2 = &switcher.MockSwitch{Status: "OFF"}
+		aux = &switcher.MockSwitch{Status: "OFF"}
+		cool = &switcher.MockSwitch{Status: "OFF"}
+		fan = &switcher.MockSwitch{Status: "OFF"}
+		thermostats = map[string]thermostat.ThermostatDevice{"office": sensor}
+		switches = map[string]switcher.SwitchDevice{
+			"heat1": heat1, "heat2": heat2, "aux": aux, "cool": cool, "fan": fan,
+		}
+		conf = Config{
+			Mode:     "heat",
+			Setpoint: 70,
+			Sensor:   "office",
+			Heat:     []string{"heat1", "heat2"},
+			Aux:      "aux",
+			Cool:     "cool",
+			Fan:      "fan",
+		}
+		now = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	})
+	JustBeforeEach(func() {
+		var err error
+		controller, err = NewController(conf, thermostats, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	step := func(temp float64) Decision {
+		sensor.Temperature = temp
+		now = now.Add(time.Minute)
+		return controller.Step(now)
+	}
+	Describe("creating a controller", func() {
+		It("should reject a switch used for two roles", func() {
+			conf.Cool = "heat1"
+			_, err := NewController(conf, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should reject an unknown mode", func() {
+			conf.Mode = "turbo"
+			_, err := NewController(conf, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should list the modes the equipment can run", func() {
+			conf.Cool = ""
+			controller, err := NewController(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(controller.Modes()).Should(Equal([]Mode{ModeOff, ModeHeat, ModeFan}))
+		})
+		It("should list the sensors and switches it uses", func() {
+			controller, err := NewController(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(controller.Devices()).Should(Equal([]string{"office", "aux", "cool", "fan", "heat1", "heat2"}))
+		})
+		It("should reject cooling without a cool relay", func() {
+			conf.Mode = "cool"
+			conf.Cool = ""
+			_, err := NewController(conf, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("heating", func() {
+		It("should heat below the band and stop above it", func() {
+			Expect(step(69).Call).Should(Equal(Call{}))
+			Expect(step(68).Call).Should(Equal(Call{HeatStages: 1}))
+			Expect(heat1.Status).Should(Equal("ON"))
+			Expect(step(71).Call).Should(Equal(Call{HeatStages: 1}))
+			Expect(step(72).Call).Should(Equal(Call{}))
+			Expect(heat1.Status).Should(Equal("OFF"))
+		})
+		It("should add the second stage and aux heat as the gap grows", func() {
+			Expect(step(65).Call).Should(Equal(Call{HeatStages: 2}))
+			Expect(step(62).Call).Should(Equal(Call{HeatStages: 2, Aux: true}))
+			Expect(step(67).Call).Should(Equal(Call{HeatStages: 2, Aux: true}))
+			Expect(step(68).Call).Should(Equal(Call{HeatStages: 1}))
+		})
+		It("should never cool", func() {
+			Expect(step(80).Call).Should(Equal(Call{}))
+		})
+		Context("with the fan running with heat", func() {
+			BeforeEach(func() {
+				conf.FanWithHeat = true
+			})
+			It("should run the fan", func() {
+				Expect(step(68).Call).Should(Equal(Call{HeatStages: 1, Fan: true}))
+			})
+		})
+	})
+	Describe("auto", func() {
+		BeforeEach(func() {
+			conf.Mode = "auto"
+		})
+		It("should switch between heating and cooling without overlap", func() {
+			Expect(step(68).Call).Should(Equal(Call{HeatStages: 1}))
+			Expect(step(73).Call).Should(Equal(Call{Cool: true, Fan: true}))
+			Expect(heat1.Status).Should(Equal("OFF"))
+			Expect(cool.Status).Should(Equal("ON"))
+			Expect(step(69).Call).Should(Equal(Call{Cool: true, Fan: true}))
+			Expect(step(68).Call).Should(Equal(Call{HeatStages: 1}))
+		})
+	})
+	Describe("fan only", func() {
+		BeforeEach(func() {
+			conf.Mode = "fan"
+		})
+		It("should only run the fan", func() {
+			Expect(step(60).Call).Should(Equal(Call{Fan: true}))
+		})
+	})
+	Describe("changing the setpoint and mode", func() {
+		It("should use them at the next step", func() {
+			Expect(controller.SetSetpoint(65)).Should(Succeed())
+			Expect(step(64).Call).Should(Equal(Call{}))
+			Expect(controller.SetMode(ModeCool)).Should(Succeed())
+			Expect(step(68).Call).Should(Equal(Call{Cool: true, Fan: true}))
+			Expect(controller.Status().Mode).Should(Equal(ModeCool))
+			Expect(controller.Status().Setpoint).Should(Equal(65.0))
+		})
+		It("should read back the setting changed", func() {
+			Expect(controller.SetSetpoint(65.5)).Should(Succeed())
+			Expect(ReadBack(controller, "setpoint")()).Should(Equal("65.5"))
+			Expect(ReadBack(controller, "temperature")()).Should(Equal("65.5"))
+			Expect(controller.SetMode(ModeCool)).Should(Succeed())
+			Expect(ReadBack(controller, "mode")()).Should(Equal("cool"))
+		})
+		It("should refuse a setpoint outside the default limits", func() {
+			Expect(controller.SetSetpoint(95)).ShouldNot(Succeed())
+			Expect(controller.SetSetpoint(40)).ShouldNot(Succeed())
+			Expect(controller.Status().Setpoint).Should(Equal(conf.Setpoint))
+		})
+		Context("with limits configured", func() {
+			BeforeEach(func() {
+				conf.MinSetpoint = 60
+				conf.MaxSetpoint = 75
+			})
+			It("should refuse a setpoint outside them", func() {
+				Expect(controller.SetSetpoint(76)).ShouldNot(Succeed())
+				Expect(controller.SetSetpoint(60)).Should(Succeed())
+				min, max := controller.SetpointLimits()
+				Expect(min).Should(Equal(60.0))
+				Expect(max).Should(Equal(75.0))
+			})
+			It("should reject limits the wrong way round", func() {
+				conf.MinSetpoint = 80
+				_, err := NewController(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+			It("should reject a configured setpoint outside them", func() {
+				conf.Setpoint = 80
+				_, err := NewController(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+			It("should reject a schedule point outside them", func() {
+				conf.Schedule = []SchedulePoint{{At: "06:00", Setpoint: 55}}
+				_, err := NewController(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+	Describe("publishing decisions", func() {
+		It("should publish each change of call", func() {
+			bus := events.NewBus()
+			received, unsubscribe := bus.Subscribe(10)
+			defer unsubscribe()
+			controller.Events = bus
+			step(68)
+			step(68)
+			event := <-received
+			Expect(event.Kind).Should(Equal(events.KindDecision))
+			Expect(event.Device).Should(Equal("hvac"))
+			Expect(event.State).Should(Equal("heat stage 1"))
+			Expect(event.Value).Should(Equal(68.0))
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+	Describe("auditing", func() {
+		var directory string
+		BeforeEach(func() {
+			var err error
+			directory, err = ioutil.TempDir("", "hvac")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.RemoveAll(directory)
+		})
+		It("should record each change of call with why", func() {
+			controller.Audit = audit.Open(audit.Config{File: filepath.Join(directory, "audit.jsonl")})
+			step(68)
+			step(68)
+			entries, err := controller.Audit.Query(audit.Query{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Source).Should(Equal(audit.SourceController))
+			Expect(entries[0].Target).Should(Equal("hvac"))
+			Expect(entries[0].Result).Should(Equal("heat stage 1"))
+			Expect(entries[0].Reason).Should(ContainSubstring("68.0 against setpoint 70.0 in mode heat"))
+		})
+	})
+	Describe("losing the sensor", func() {
+		It("should idle the equipment", func() {
+			Expect(step(60).Call.Heating()).Should(BeTrue())
+			sensor.Err = errors.New("unreachable")
+			decision := step(60)
+			Expect(decision.Call).Should(Equal(Call{}))
+			Expect(decision.Error).ShouldNot(BeEmpty())
+			Expect(heat1.Status).Should(Equal("OFF"))
+		})
+	})
+})
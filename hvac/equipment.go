@@ -0,0 +1,166 @@
+package hvac
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/oskoss/mi-casa/switcher"
+	log "github.com/sirupsen/logrus"
+)
+
+//Call is what the equipment is asked to run, HeatStages is the number
+// of heat stages energized (0 is no heat), Aux the auxiliary heat strip
+type Call struct {
+	HeatStages int  `json:"heatStages"`
+	Aux        bool `json:"aux"`
+	Cool       bool `json:"cool"`
+	Fan        bool `json:"fan"`
+}
+
+//Heating reports whether any heat is being called for
+func (call Call) Heating() bool {
+	return call.HeatStages > 0 || call.Aux
+}
+
+func (call Call) String() string {
+	parts := []string{}
+	if call.HeatStages > 0 {
+		parts = append(parts, fmt.Sprintf("heat stage %d", call.HeatStages))
+	}
+	if call.Aux {
+		parts = append(parts, "aux heat")
+	}
+	if call.Cool {
+		parts = append(parts, "cool")
+	}
+	if call.Fan {
+		parts = append(parts, "fan")
+	}
+	if len(parts) == 0 {
+		return "idle"
+	}
+	return strings.Join(parts, ", ")
+}
+
+//Equipment is the set of relays driving the HVAC system, Heat holds the
+// heat stages in order. Any relay may be nil when the system lacks it.
+// Heat (including Aux) and Cool relays are never energized together.
+type Equipment struct {
+	Heat []switcher.SwitchDevice
+	Aux  switcher.SwitchDevice
+	Cool switcher.SwitchDevice
+	Fan  switcher.SwitchDevice
+}
+
+type relay struct {
+	name   string
+	device switcher.SwitchDevice
+	on     bool
+}
+
+//Apply drives the relays to match call. Every relay which should be off
+// is turned off first and nothing is energized unless that succeeded,
+// so heat and cool can never overlap even if a relay was changed by hand.
+func (equipment *Equipment) Apply(call Call) error {
+	if err := equipment.check(call); err != nil {
+		return err
+	}
+	relays := []relay{}
+	for i, stage := range equipment.Heat {
+		relays = append(relays, relay{fmt.Sprintf("heat stage %d", i+1), stage, i < call.HeatStages})
+	}
+	relays = append(relays,
+		relay{"aux heat", equipment.Aux, call.Aux},
+		relay{"cool", equipment.Cool, call.Cool},
+		relay{"fan", equipment.Fan, call.Fan},
+	)
+	for _, r := range relays {
+		if r.device == nil || r.on {
+			continue
+		}
+		if err := setRelay(r); err != nil {
+			return fmt.Errorf("interlock: could not turn off %s, not energizing anything: %v", r.name, err)
+		}
+	}
+	for _, r := range relays {
+		if r.device == nil || !r.on {
+			continue
+		}
+		if err := setRelay(r); err != nil {
+			return fmt.Errorf("could not turn on %s: %v", r.name, err)
+		}
+	}
+	return nil
+}
+
+func (equipment *Equipment) check(call Call) error {
+	if call.Heating() && call.Cool {
+		return fmt.Errorf("interlock: heat and cool cannot be called together")
+	}
+	if call.HeatStages < 0 || call.HeatStages > len(equipment.Heat) {
+		return fmt.Errorf("%d heat stages called but only %d are configured", call.HeatStages, len(equipment.Heat))
+	}
+	if call.Aux && equipment.Aux == nil {
+		return fmt.Errorf("aux heat called but not configured")
+	}
+	if call.Cool && equipment.Cool == nil {
+		return fmt.Errorf("cool called but not configured")
+	}
+	return nil
+}
+
+//setRelay only sends a command when the relay is not already in state
+func setRelay(r relay) error {
+	want := "OFF"
+	if r.on {
+		want = "ON"
+	}
+	status, err := r.device.UpdateStatus()
+	if err == nil && strings.EqualFold(*status, want) {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"relay": r.name,
+		"state": want,
+	}).Printf("switching HVAC relay")
+	if r.on {
+		return r.device.TurnOn()
+	}
+	return r.device.TurnOff()
+}
+
+//Current reads the relays back into the Call they are running
+func (equipment *Equipment) Current() (Call, error) {
+	var call Call
+	for i, stage := range equipment.Heat {
+		on, err := isOn(stage)
+		if err != nil {
+			return call, fmt.Errorf("reading heat stage %d: %v", i+1, err)
+		}
+		if on {
+			call.HeatStages = i + 1
+		}
+	}
+	var err error
+	if call.Aux, err = isOn(equipment.Aux); err != nil {
+		return call, fmt.Errorf("reading aux heat: %v", err)
+	}
+	if call.Cool, err = isOn(equipment.Cool); err != nil {
+		return call, fmt.Errorf("reading cool: %v", err)
+	}
+	if call.Fan, err = isOn(equipment.Fan); err != nil {
+		return call, fmt.Errorf("reading fan: %v", err)
+	}
+	return call, nil
+}
+
+func isOn(device switcher.SwitchDevice) (bool, error) {
+	if device == nil {
+		return false, nil
+	}
+	status, err := device.UpdateStatus()
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(*status, "ON"), nil
+}
@@ -0,0 +1,72 @@
+package hvac_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+)
+
+var _ = Describe("Equipment", func() {
+	var (
+		heat1     *switcher.MockSwitch
+		heat2     *switcher.MockSwitch
+		aux       *switcher.MockSwitch
+		cool      *switcher.MockSwitch
+		fan       *switcher.MockSwitch
+		equipment *Equipment
+	)
+	BeforeEach(func() {
+		heat1 = &switcher.MockSwitch{Status: "OFF"}
+		heat2 = &switcher.MockSwitch{Status: "OFF"}
+		aux = &switcher.MockSwitch{Status: "OFF"}
+		cool = &switcher.MockSwitch{Status: "OFF"}
+		fan = &switcher.MockSwitch{Status: "OFF"}
+		equipment = &Equipment{
+			Heat: []switcher.SwitchDevice{heat1, heat2},
+			Aux:  aux,
+			Cool: cool,
+			Fan:  fan,
+		}
+	})
+	Describe("applying a call", func() {
+		It("should energize the called stages only", func() {
+			Expect(equipment.Apply(Call{HeatStages: 1, Fan: true})).Should(Succeed())
+			Expect(heat1.Status).Should(Equal("ON"))
+			Expect(heat2.Status).Should(Equal("OFF"))
+			Expect(fan.Status).Should(Equal("ON"))
+			current, err := equipment.Current()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current).Should(Equal(Call{HeatStages: 1, Fan: true}))
+		})
+		It("should refuse heat and cool together", func() {
+			Expect(equipment.Apply(Call{HeatStages: 1, Cool: true})).ShouldNot(Succeed())
+			Expect(heat1.Status).Should(Equal("OFF"))
+			Expect(cool.Status).Should(Equal("OFF"))
+		})
+		It("should refuse more stages than configured", func() {
+			Expect(equipment.Apply(Call{HeatStages: 3})).ShouldNot(Succeed())
+		})
+		It("should turn heat off before cooling", func() {
+			Expect(equipment.Apply(Call{HeatStages: 2, Aux: true})).Should(Succeed())
+			Expect(equipment.Apply(Call{Cool: true})).Should(Succeed())
+			Expect(heat1.Status).Should(Equal("OFF"))
+			Expect(heat2.Status).Should(Equal("OFF"))
+			Expect(aux.Status).Should(Equal("OFF"))
+			Expect(cool.Status).Should(Equal("ON"))
+		})
+		Context("when the heat relay was turned on by hand and cannot be turned off", func() {
+			BeforeEach(func() {
+				heat1.Status = "ON"
+				heat1.Err = errors.New("unreachable")
+			})
+			It("should not energize cooling", func() {
+				Expect(equipment.Apply(Call{Cool: true})).ShouldNot(Succeed())
+				Expect(cool.Status).Should(Equal("OFF"))
+			})
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package hvac_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHVAC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HVAC Suite")
+}
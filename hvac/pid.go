@@ -0,0 +1,92 @@
+package hvac
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultKp     = 0.4
+	defaultKi     = 0.1
+	defaultWindow = 15 * time.Minute
+	//minimumDuty is the smallest fraction of a window worth running for
+	minimumDuty = 0.05
+)
+
+//PID computes an output between -1 (full cooling) and 1 (full heat)
+// and turns it into a duty cycle for time proportional relay control:
+// the relay is on for duty*Window at the start of every Window.
+// The integral only accumulates while the output is not saturated,
+// so a long cold start does not wind it up into a large overshoot.
+type PID struct {
+	Kp          float64
+	Ki          float64
+	Kd          float64
+	Window      time.Duration
+	StageOffset float64
+	integral    float64
+	lastTemp    float64
+	lastTime    time.Time
+	windowStart time.Time
+	duty        float64
+}
+
+func (pid *PID) Decide(input Input) (Call, string) {
+	err := input.Setpoint - input.Temperature
+	low, high := -1.0, 1.0
+	if !input.HeatAllowed() {
+		high = 0
+	}
+	if !input.CoolAllowed() {
+		low = 0
+	}
+
+	derivative := 0.0
+	hours := 0.0
+	if !pid.lastTime.IsZero() {
+		hours = input.Now.Sub(pid.lastTime).Hours()
+	}
+	if hours > 0 {
+		// derivative on measurement avoids a kick when the setpoint changes
+		derivative = -(input.Temperature - pid.lastTemp) / hours
+	}
+	pid.lastTemp = input.Temperature
+	pid.lastTime = input.Now
+
+	integral := pid.integral + err*hours
+	output := pid.Kp*err + pid.Ki*integral + pid.Kd*derivative
+	saturated := (output > high && err > 0) || (output < low && err < 0)
+	if !saturated {
+		pid.integral = integral
+	}
+	if pid.Ki > 0 {
+		// keep the integral term alone within the output range
+		pid.integral = math.Max(low/pid.Ki, math.Min(high/pid.Ki, pid.integral))
+	}
+	output = math.Max(low, math.Min(high, pid.Kp*err+pid.Ki*pid.integral+pid.Kd*derivative))
+
+	if pid.windowStart.IsZero() || input.Now.Sub(pid.windowStart) >= pid.Window {
+		pid.windowStart = input.Now
+		pid.duty = output
+	}
+	duty := math.Abs(pid.duty)
+	on := duty >= minimumDuty && float64(input.Now.Sub(pid.windowStart)) < duty*float64(pid.Window)
+	reason := fmt.Sprintf("pid output %.0f%%", pid.duty*100)
+	switch {
+	case on && pid.duty > 0 && input.HeatAllowed():
+		return stage(input, input.Setpoint, pid.StageOffset, reason)
+	case on && pid.duty < 0 && input.CoolAllowed():
+		return Call{Cool: true}, reason
+	}
+	return Call{}, reason
+}
+
+//Learned returns the integral, the only part of a PID worth keeping
+func (pid *PID) Learned() map[string]float64 {
+	return map[string]float64{"integral": pid.integral}
+}
+
+func (pid *PID) Relearn(learned map[string]float64) {
+	pid.integral = learned["integral"]
+}
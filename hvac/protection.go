@@ -0,0 +1,164 @@
+package hvac
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Protection guards the compressor (cool) and the first heat stage
+// against short cycling. StartupDelay holds off any call after the
+// controller starts or after the relays come back from being unreachable,
+// as either usually means the power was lost.
+type Protection struct {
+	MinOnTime        time.Duration `yaml:"minOnTime,omitempty" json:"minOnTime,omitempty"`
+	MinOffTime       time.Duration `yaml:"minOffTime,omitempty" json:"minOffTime,omitempty"`
+	MaxCyclesPerHour int           `yaml:"maxCyclesPerHour,omitempty" json:"maxCyclesPerHour,omitempty"`
+	StartupDelay     time.Duration `yaml:"startupDelay,omitempty" json:"startupDelay,omitempty"`
+}
+
+//guard tracks the on/off history of one protected piece of equipment.
+// Zones sharing the equipment share its guard, each with its own
+// demand, so the equipment is on while any of them wants it and its
+// timers count every start and stop whichever zone caused it.
+type guard struct {
+	name    string
+	on      bool
+	changed time.Time
+	starts  []time.Time
+	demand  map[string]bool
+	lock    sync.Mutex
+}
+
+func newGuard(name string) *guard {
+	return &guard{name: name, demand: map[string]bool{}}
+}
+
+//wanted is whether zone has the equipment on
+func (g *guard) wanted(zone string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.demand[zone]
+}
+
+//allow returns an empty reason when zone may have the equipment as want
+// at now, otherwise the reason the change has to wait. Only starting or
+// stopping the equipment itself is held back, joining or leaving while
+// another zone keeps it running is not.
+func (g *guard) allow(zone string, want bool, protection Protection, poweredAt time.Time, now time.Time) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if want == g.demand[zone] {
+		return ""
+	}
+	if !want {
+		if g.others(zone) {
+			return ""
+		}
+		if protection.MinOnTime > 0 && now.Sub(g.changed) < protection.MinOnTime {
+			return fmt.Sprintf("%s minimum on time, %v remaining", g.name, remaining(g.changed.Add(protection.MinOnTime), now))
+		}
+		return ""
+	}
+	if g.on {
+		return ""
+	}
+	if protection.StartupDelay > 0 && now.Sub(poweredAt) < protection.StartupDelay {
+		return fmt.Sprintf("%s startup delay, %v remaining", g.name, remaining(poweredAt.Add(protection.StartupDelay), now))
+	}
+	if protection.MinOffTime > 0 && !g.changed.IsZero() && now.Sub(g.changed) < protection.MinOffTime {
+		return fmt.Sprintf("%s minimum off time, %v remaining", g.name, remaining(g.changed.Add(protection.MinOffTime), now))
+	}
+	if protection.MaxCyclesPerHour > 0 {
+		recent := g.recentStarts(now)
+		if len(recent) >= protection.MaxCyclesPerHour {
+			return fmt.Sprintf("%s reached %d cycles per hour, %v remaining", g.name, protection.MaxCyclesPerHour, remaining(recent[0].Add(time.Hour), now))
+		}
+	}
+	return ""
+}
+
+//others is whether a zone other than zone wants the equipment on
+func (g *guard) others(zone string) bool {
+	for other, on := range g.demand {
+		if other != zone && on {
+			return true
+		}
+	}
+	return false
+}
+
+//record notes zone now wants the equipment on or off
+func (g *guard) record(zone string, on bool, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.demand[zone] = on
+	g.update(now)
+}
+
+//update turns the equipment on or off as the zones want, counting
+// a start when it goes on
+func (g *guard) update(now time.Time) {
+	on := false
+	for _, wanted := range g.demand {
+		on = on || wanted
+	}
+	if on == g.on {
+		return
+	}
+	g.on = on
+	g.changed = now
+	if on {
+		g.starts = append(g.recentStarts(now), now)
+	}
+}
+
+func (g *guard) recentStarts(now time.Time) []time.Time {
+	recent := []time.Time{}
+	for _, start := range g.starts {
+		if now.Sub(start) < time.Hour {
+			recent = append(recent, start)
+		}
+	}
+	return recent
+}
+
+func remaining(until time.Time, now time.Time) time.Duration {
+	return until.Sub(now).Round(time.Second)
+}
+
+//protect holds back any part of call the protection timers do not allow
+// yet, returning the call to apply and the reasons for each deferral
+func (controller *Controller) protect(call Call, now time.Time) (Call, []string) {
+	deferred := []string{}
+	protection := controller.Protection
+	if reason := controller.coolGuard.allow(controller.Name, call.Cool, protection, controller.poweredAt, now); reason != "" {
+		deferred = append(deferred, reason)
+		call.Cool = controller.coolGuard.wanted(controller.Name)
+	}
+	if call.Cool {
+		// the compressor held on by its minimum on time keeps heat off
+		if call.Heating() {
+			deferred = append(deferred, "heat waiting for cool to finish")
+		}
+		call.HeatStages = 0
+		call.Aux = false
+	}
+	if reason := controller.heatGuard.allow(controller.Name, call.Heating(), protection, controller.poweredAt, now); reason != "" {
+		deferred = append(deferred, reason)
+		if controller.heatGuard.wanted(controller.Name) {
+			call.HeatStages = 1
+			if len(controller.Equipment.Heat) == 0 {
+				call.HeatStages = 0
+				call.Aux = true
+			}
+		} else {
+			call.HeatStages = 0
+			call.Aux = false
+		}
+	}
+	if call.Heating() && call.Cool {
+		call.Cool = false
+	}
+	return controller.withFan(call), deferred
+}
@@ -0,0 +1,117 @@
+package hvac_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Protection", func() {
+	var (
+		sensor     *thermostat.MockThermostat
+		heat       *switcher.MockSwitch
+		cool       *switcher.MockSwitch
+		conf       Config
+		controller *Controller
+		start      time.Time
+	)
+	BeforeEach(func() {
+		sensor = &thermostat.MockThermostat{Temperature: 70}
+		heat = &switcher.MockSwitch{Status: "OFF"}
+		cool = &switcher.MockSwitch{Status: "OFF"}
+		conf = Config{
+			Mode:     "auto",
+			Setpoint: 70,
+			Sensor:   "office",
+			Heat:     []string{"heat"},
+			Cool:     "cool",
+		}
+		start = time.Date(2021, time.July, 1, 12, 0, 0, 0, time.UTC)
+	})
+	JustBeforeEach(func() {
+		var err error
+		controller, err = NewController(conf,
+			map[string]thermostat.ThermostatDevice{"office": sensor},
+			map[string]switcher.SwitchDevice{"heat": heat, "cool": cool},
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	stepAt := func(after time.Duration, temp float64) Decision {
+		sensor.Temperature = temp
+		return controller.Step(start.Add(after))
+	}
+	Context("with a startup delay", func() {
+		BeforeEach(func() {
+			conf.Protection.StartupDelay = 3 * time.Minute
+		})
+		It("should defer cooling until the delay has passed", func() {
+			decision := stepAt(0, 75)
+			Expect(decision.Requested.Cool).Should(BeTrue())
+			Expect(decision.Call.Cool).Should(BeFalse())
+			Expect(decision.Deferred).Should(ConsistOf(ContainSubstring("startup delay")))
+			Expect(controller.Status().LastDecision.Deferred).Should(HaveLen(1))
+			Expect(stepAt(3*time.Minute, 75).Call.Cool).Should(BeTrue())
+		})
+		It("should restart the delay once unreachable relays come back", func() {
+			stepAt(0, 75)
+			Expect(stepAt(3*time.Minute, 75).Call.Cool).Should(BeTrue())
+			cool.Err = errors.New("unreachable")
+			stepAt(4*time.Minute, 75)
+			cool.Err = nil
+			cool.Status = "OFF"
+			decision := stepAt(5*time.Minute, 75)
+			Expect(decision.Call.Cool).Should(BeFalse())
+			Expect(decision.Deferred).Should(ConsistOf(ContainSubstring("startup delay")))
+		})
+	})
+	Context("with a minimum on time", func() {
+		BeforeEach(func() {
+			conf.Protection.MinOnTime = 5 * time.Minute
+		})
+		It("should keep the compressor running until it has run long enough", func() {
+			Expect(stepAt(0, 75).Call.Cool).Should(BeTrue())
+			decision := stepAt(time.Minute, 67)
+			Expect(decision.Call.Cool).Should(BeTrue())
+			Expect(decision.Call.Heating()).Should(BeFalse())
+			Expect(heat.Status).Should(Equal("OFF"))
+			Expect(decision.Deferred).Should(ContainElement(ContainSubstring("compressor minimum on time")))
+			Expect(stepAt(5*time.Minute, 67).Call).Should(Equal(Call{HeatStages: 1}))
+		})
+	})
+	Context("with a minimum off time", func() {
+		BeforeEach(func() {
+			conf.Mode = "cool"
+			conf.Protection.MinOffTime = 5 * time.Minute
+		})
+		It("should not restart the compressor too soon", func() {
+			Expect(stepAt(0, 75).Call.Cool).Should(BeTrue())
+			Expect(stepAt(time.Minute, 67).Call.Cool).Should(BeFalse())
+			decision := stepAt(2*time.Minute, 75)
+			Expect(decision.Call.Cool).Should(BeFalse())
+			Expect(decision.Deferred).Should(ConsistOf(ContainSubstring("compressor minimum off time")))
+			Expect(stepAt(6*time.Minute, 75).Call.Cool).Should(BeTrue())
+		})
+	})
+	Context("with a maximum number of cycles per hour", func() {
+		BeforeEach(func() {
+			conf.Mode = "cool"
+			conf.Protection.MaxCyclesPerHour = 2
+		})
+		It("should defer starts beyond the limit", func() {
+			Expect(stepAt(0, 75).Call.Cool).Should(BeTrue())
+			stepAt(10*time.Minute, 67)
+			Expect(stepAt(20*time.Minute, 75).Call.Cool).Should(BeTrue())
+			stepAt(30*time.Minute, 67)
+			decision := stepAt(40*time.Minute, 75)
+			Expect(decision.Call.Cool).Should(BeFalse())
+			Expect(decision.Deferred).Should(ConsistOf(ContainSubstring("cycles per hour")))
+			Expect(stepAt(61*time.Minute, 75).Call.Cool).Should(BeTrue())
+		})
+	})
+})
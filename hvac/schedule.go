@@ -0,0 +1,92 @@
+package hvac
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//SchedulePoint changes the setpoint, and the mode when set, at At
+// (HH:MM) every day or only on Days ("mon", "tue", ...) when given.
+// A setpoint changed by hand holds until the next point is reached.
+type SchedulePoint struct {
+	At       string   `yaml:"at" json:"at"`
+	Days     []string `yaml:"days,omitempty" json:"days,omitempty"`
+	Setpoint float64  `yaml:"setpoint" json:"setpoint"`
+	Mode     string   `yaml:"mode,omitempty" json:"mode,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (point SchedulePoint) validate() error {
+	if _, err := parseClock(point.At); err != nil {
+		return err
+	}
+	for _, day := range point.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("schedule day %q must be one of sun, mon, tue, wed, thu, fri or sat", day)
+		}
+	}
+	if point.Mode != "" {
+		if _, err := ParseMode(point.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (point SchedulePoint) runsOn(day time.Weekday) bool {
+	if len(point.Days) == 0 {
+		return true
+	}
+	for _, name := range point.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+//scheduled returns the schedule point in effect at now and when it
+// started, looking back up to a week for the most recent one
+func scheduled(schedule []SchedulePoint, now time.Time) (SchedulePoint, time.Time, bool) {
+	var current SchedulePoint
+	var started time.Time
+	for back := 0; back <= 7; back++ {
+		day := time.Date(now.Year(), now.Month(), now.Day()-back, 0, 0, 0, 0, now.Location())
+		for _, point := range schedule {
+			if !point.runsOn(day.Weekday()) {
+				continue
+			}
+			at, err := parseClock(point.At)
+			if err != nil {
+				continue
+			}
+			start := day.Add(at)
+			if !start.After(now) && start.After(started) {
+				current = point
+				started = start
+			}
+		}
+		if !started.IsZero() {
+			return current, started, true
+		}
+	}
+	return current, started, false
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("schedule time %q must be formatted as HH:MM", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,78 @@
+package hvac
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/switcher"
+)
+
+//SimulatedRoom is a simple thermal model of a room with a heater and a
+// cooler, used to exercise control strategies without real equipment.
+// The heater and cooler warm up and cool down over Lag, which is what
+// makes naive control overshoot. It is a thermostat.ThermostatDevice and
+// Heat and Cool are the relays driving it.
+type SimulatedRoom struct {
+	Temperature float64
+	Outside     float64
+	//Loss is the fraction of the inside/outside difference lost per hour
+	Loss float64
+	//HeatPower and CoolPower are degrees per hour at full output
+	HeatPower float64
+	CoolPower float64
+	Lag       time.Duration
+	Heat      *switcher.MockSwitch
+	Cool      *switcher.MockSwitch
+	output    float64
+	lock      sync.Mutex
+}
+
+//NewSimulatedRoom returns a room at temperature which loses heat to
+// outside, with a heater and cooler that take lag to reach full output
+func NewSimulatedRoom(temperature float64, outside float64, lag time.Duration) *SimulatedRoom {
+	return &SimulatedRoom{
+		Temperature: temperature,
+		Outside:     outside,
+		Loss:        0.1,
+		HeatPower:   8,
+		CoolPower:   8,
+		Lag:         lag,
+		Heat:        &switcher.MockSwitch{Status: "OFF"},
+		Cool:        &switcher.MockSwitch{Status: "OFF"},
+	}
+}
+
+func (room *SimulatedRoom) CurrentTemp() (temp *float64, err error) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	current := room.Temperature
+	return &current, nil
+}
+
+func (room *SimulatedRoom) Connect() (err error) {
+	return nil
+}
+
+//Advance moves the simulation forward by duration in ten second steps
+func (room *SimulatedRoom) Advance(duration time.Duration) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	const step = 10 * time.Second
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		target := 0.0
+		if strings.EqualFold(room.Heat.Status, "ON") {
+			target += room.HeatPower
+		}
+		if strings.EqualFold(room.Cool.Status, "ON") {
+			target -= room.CoolPower
+		}
+		if room.Lag > 0 {
+			room.output += (target - room.output) * step.Seconds() / room.Lag.Seconds()
+		} else {
+			room.output = target
+		}
+		hours := step.Hours()
+		room.Temperature += (room.output + room.Loss*(room.Outside-room.Temperature)) * hours
+	}
+}
@@ -0,0 +1,198 @@
+package hvac
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/oskoss/mi-casa/state"
+	log "github.com/sirupsen/logrus"
+)
+
+//stateSaveInterval limits how often state is saved when only
+// what the strategy has learned changed, as that changes every step
+const stateSaveInterval = 5 * time.Minute
+
+//Stateful is implemented by strategies which learn as they run,
+// so what they learned is kept across restarts
+type Stateful interface {
+	Learned() map[string]float64
+	Relearn(learned map[string]float64)
+}
+
+//GuardState is the protection history of one piece of equipment
+type GuardState struct {
+	On      bool        `json:"on"`
+	Changed time.Time   `json:"changed,omitempty"`
+	Starts  []time.Time `json:"starts,omitempty"`
+}
+
+//ControllerState is everything about a Controller worth keeping across
+// a restart. ScheduledAt is when the schedule point in effect started,
+// so a setpoint changed by hand still holds after a restart.
+type ControllerState struct {
+	Mode        Mode               `json:"mode"`
+	Setpoint    float64            `json:"setpoint"`
+	ScheduledAt time.Time          `json:"scheduledAt,omitempty"`
+	Call        Call               `json:"call"`
+	Compressor  GuardState         `json:"compressor"`
+	Heat        GuardState         `json:"heat"`
+	Strategy    string             `json:"strategy"`
+	Learned     map[string]float64 `json:"learned,omitempty"`
+}
+
+//State returns a snapshot of the controller
+func (controller *Controller) State() ControllerState {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.snapshot()
+}
+
+//HandOver returns a snapshot of the controller for the one replacing
+// it to Restore, and leaves the equipment as it is once Run stops, so
+// what is running stays protected by the guards of the new controller
+func (controller *Controller) HandOver() ControllerState {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.handedOver = true
+	return controller.snapshot()
+}
+
+func (controller *Controller) snapshot() ControllerState {
+	current := ControllerState{
+		Mode:        controller.mode,
+		Setpoint:    controller.setpoint,
+		ScheduledAt: controller.scheduledAt,
+		Call:        controller.call,
+		Compressor:  controller.coolGuard.state(controller.Name),
+		Heat:        controller.heatGuard.state(controller.Name),
+		Strategy:    controller.strategyType,
+	}
+	if stateful, ok := controller.Strategy.(Stateful); ok {
+		current.Learned = stateful.Learned()
+	}
+	return current
+}
+
+//Restore puts the controller back as it was, a mode the equipment can
+// no longer run and learning from a different strategy are ignored and
+// a setpoint outside the limits now configured is brought within them
+func (controller *Controller) Restore(saved ControllerState) {
+	if err := controller.checkMode(saved.Mode); err != nil {
+		log.WithFields(log.Fields{
+			"zone": controller.Name,
+			"err":  err,
+		}).Warn("not restoring HVAC mode")
+		saved.Mode = controller.Status().Mode
+	}
+	if err := controller.checkSetpoint(saved.Setpoint); err != nil {
+		log.WithFields(log.Fields{
+			"zone": controller.Name,
+			"err":  err,
+		}).Warn("clamping restored HVAC setpoint")
+		saved.Setpoint = controller.clampSetpoint(saved.Setpoint)
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.mode = saved.Mode
+	controller.setpoint = saved.Setpoint
+	controller.scheduledAt = saved.ScheduledAt
+	controller.call = saved.Call
+	controller.coolGuard.restore(controller.Name, saved.Compressor)
+	controller.heatGuard.restore(controller.Name, saved.Heat)
+	if stateful, ok := controller.Strategy.(Stateful); ok && saved.Strategy == controller.strategyType && saved.Learned != nil {
+		stateful.Relearn(saved.Learned)
+	}
+}
+
+//Persist restores the controller from store, when it was saved
+// there before, and saves it there from now on
+func (controller *Controller) Persist(store *state.Store) error {
+	var saved ControllerState
+	found, err := store.Get(controller.stateSection(), &saved)
+	if err != nil {
+		return err
+	}
+	if found {
+		controller.Restore(saved)
+		log.WithFields(log.Fields{
+			"zone":     controller.Name,
+			"mode":     saved.Mode,
+			"setpoint": saved.Setpoint,
+			"call":     saved.Call.String(),
+		}).Printf("HVAC state restored")
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.store = store
+	return nil
+}
+
+func (controller *Controller) stateSection() string {
+	if controller.Name == "" {
+		return "hvac"
+	}
+	return "hvac/" + controller.Name
+}
+
+//save writes the state when anything but the learning changed,
+// or at most every stateSaveInterval when only the learning did
+func (controller *Controller) save(now time.Time) {
+	if controller.store == nil {
+		return
+	}
+	current := controller.snapshot()
+	learned := current.Learned
+	current.Learned = nil
+	core, err := json.Marshal(current)
+	if err != nil {
+		return
+	}
+	if string(core) == string(controller.savedCore) && now.Sub(controller.savedAt) < stateSaveInterval {
+		return
+	}
+	current.Learned = learned
+	if err := controller.store.Set(controller.stateSection(), current); err != nil {
+		log.WithFields(log.Fields{
+			"zone": controller.Name,
+			"err":  err,
+		}).Error("could not save HVAC state")
+		return
+	}
+	controller.savedCore = core
+	controller.savedAt = now
+}
+
+//state is zone's demand with the history of the equipment
+func (g *guard) state(zone string) GuardState {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return GuardState{On: g.demand[zone], Changed: g.changed, Starts: append([]time.Time{}, g.starts...)}
+}
+
+//restore brings back zone's demand, merging the history with what
+// the zones sharing the equipment already restored
+func (g *guard) restore(zone string, saved GuardState) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.demand[zone] = saved.On
+	on := false
+	for _, wanted := range g.demand {
+		on = on || wanted
+	}
+	g.on = on
+	if saved.Changed.After(g.changed) {
+		g.changed = saved.Changed
+	}
+	known := map[time.Time]bool{}
+	for _, start := range g.starts {
+		known[start] = true
+	}
+	for _, start := range saved.Starts {
+		if !known[start] {
+			g.starts = append(g.starts, start)
+			known[start] = true
+		}
+	}
+	sort.Slice(g.starts, func(i, j int) bool { return g.starts[i].Before(g.starts[j]) })
+}
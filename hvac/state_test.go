@@ -0,0 +1,142 @@
+package hvac_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/state"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("State", func() {
+	var (
+		directory   string
+		store       *state.Store
+		sensor      *thermostat.MockThermostat
+		heat        *switcher.MockSwitch
+		cool        *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		conf        Config
+		now         time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "state")
+		Expect(err).ShouldNot(HaveOccurred())
+		store, err = state.Open(filepath.Join(directory, "state.json"))
+		Expect(err).ShouldNot(HaveOccurred())
+		sensor = &thermostat.MockThermostat{Temperature: 70}
+		heat = &switcher.MockSwitch{Status: "OFF"}
+		cool = &switcher.MockSwitch{Status: "OFF"}
+		thermostats = map[string]thermostat.ThermostatDevice{"office": sensor}
+		switches = map[string]switcher.SwitchDevice{"heat": heat, "cool": cool}
+		conf = Config{
+			Mode:       "heat",
+			Setpoint:   70,
+			Sensor:     "office",
+			Heat:       []string{"heat"},
+			Cool:       "cool",
+			Protection: Protection{MinOnTime: 10 * time.Minute},
+			Strategy:   StrategyConfig{Type: StrategyPID},
+		}
+		now = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	restart := func() *Controller {
+		reopened, err := state.Open(store.Path)
+		Expect(err).ShouldNot(HaveOccurred())
+		controller, err := NewController(conf, thermostats, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(controller.Persist(reopened)).Should(Succeed())
+		return controller
+	}
+	It("should restore the mode and setpoint", func() {
+		controller := restart()
+		Expect(controller.SetSetpoint(66)).Should(Succeed())
+		Expect(controller.SetMode(ModeAuto)).Should(Succeed())
+		restarted := restart()
+		Expect(restarted.Status().Mode).Should(Equal(ModeAuto))
+		Expect(restarted.Status().Setpoint).Should(Equal(66.0))
+	})
+	It("should restore what the strategy learned", func() {
+		controller := restart()
+		sensor.Temperature = 69
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Minute)
+			controller.Step(now)
+		}
+		Expect(controller.SetMode(ModeHeat)).Should(Succeed())
+		learned := controller.State().Learned
+		Expect(learned["integral"]).ShouldNot(BeZero())
+		Expect(restart().State().Learned).Should(Equal(learned))
+	})
+	It("should not carry learning over to a different strategy", func() {
+		controller := restart()
+		sensor.Temperature = 65
+		now = now.Add(time.Minute)
+		controller.Step(now)
+		conf.Strategy = StrategyConfig{Type: StrategyAdaptive}
+		Expect(restart().State().Learned["heatRate"]).Should(BeZero())
+	})
+	It("should keep protecting equipment which was running", func() {
+		controller := restart()
+		sensor.Temperature = 65
+		now = now.Add(time.Minute)
+		Expect(controller.Step(now).Call.Heating()).Should(BeTrue())
+
+		restarted := restart()
+		sensor.Temperature = 75
+		now = now.Add(time.Minute)
+		decision := restarted.Step(now)
+		Expect(decision.Call.Heating()).Should(BeTrue())
+		Expect(decision.Deferred).ShouldNot(BeEmpty())
+		Expect(heat.Status).Should(Equal("ON"))
+	})
+	It("should leave the equipment to the controller it is handed over to", func() {
+		controller, err := NewController(conf, thermostats, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+		sensor.Temperature = 65
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			controller.Run(stop)
+		}()
+		Eventually(func() bool { return controller.State().Call.Heating() }).Should(BeTrue())
+		saved := controller.HandOver()
+		close(stop)
+		<-done
+		Expect(heat.Status).Should(Equal("ON"))
+
+		replacement, err := NewController(conf, thermostats, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+		replacement.Restore(saved)
+		sensor.Temperature = 75
+		decision := replacement.Step(time.Now().Add(time.Minute))
+		Expect(decision.Call.Heating()).Should(BeTrue())
+		Expect(decision.Deferred).ShouldNot(BeEmpty())
+		Expect(heat.Status).Should(Equal("ON"))
+	})
+	It("should ignore a mode the equipment can no longer run", func() {
+		controller := restart()
+		Expect(controller.SetMode(ModeCool)).Should(Succeed())
+		conf.Cool = ""
+		Expect(restart().Status().Mode).Should(Equal(ModeHeat))
+	})
+	It("should bring a setpoint within limits configured since", func() {
+		controller := restart()
+		Expect(controller.SetSetpoint(66)).Should(Succeed())
+		conf.MinSetpoint = 68
+		Expect(restart().Status().Setpoint).Should(Equal(68.0))
+	})
+})
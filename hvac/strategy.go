@@ -0,0 +1,150 @@
+package hvac
+
+import (
+	"fmt"
+	"time"
+)
+
+//Input is everything a Strategy sees for one control step
+type Input struct {
+	Now         time.Time
+	Mode        Mode
+	Setpoint    float64
+	Temperature float64
+	Previous    Call
+	Equipment   *Equipment
+}
+
+//HeatAllowed reports whether the mode may call for heat
+func (input Input) HeatAllowed() bool {
+	return input.Mode == ModeHeat || input.Mode == ModeAuto
+}
+
+//CoolAllowed reports whether the mode may call for cooling
+func (input Input) CoolAllowed() bool {
+	return input.Mode == ModeCool || input.Mode == ModeAuto
+}
+
+//Strategy decides what to call for at each control step, the fan
+// and the protection timers are handled by the Controller afterwards
+type Strategy interface {
+	Decide(input Input) (call Call, reason string)
+}
+
+const (
+	StrategyHysteresis = "hysteresis"
+	StrategyPID        = "pid"
+	StrategyAdaptive   = "adaptive"
+)
+
+//StrategyConfig selects and tunes the control strategy, the PID gains
+// are per degree of error (Kp), degree hour (Ki) and degree per hour (Kd)
+type StrategyConfig struct {
+	Type   string        `yaml:"type,omitempty"`
+	Kp     float64       `yaml:"kp,omitempty"`
+	Ki     float64       `yaml:"ki,omitempty"`
+	Kd     float64       `yaml:"kd,omitempty"`
+	Window time.Duration `yaml:"window,omitempty"`
+	Lead   time.Duration `yaml:"lead,omitempty"`
+}
+
+//NewStrategy builds the strategy named by conf, padding and stageOffset
+// are shared by every strategy for the band and heat staging
+func NewStrategy(conf StrategyConfig, padding float64, stageOffset float64) (Strategy, error) {
+	if padding <= 0 {
+		padding = defaultPadding
+	}
+	if stageOffset <= 0 {
+		stageOffset = defaultStageOffset
+	}
+	switch conf.Type {
+	case "", StrategyHysteresis:
+		return &Hysteresis{Padding: padding, StageOffset: stageOffset}, nil
+	case StrategyPID:
+		pid := &PID{
+			Kp:          conf.Kp,
+			Ki:          conf.Ki,
+			Kd:          conf.Kd,
+			Window:      conf.Window,
+			StageOffset: stageOffset,
+		}
+		if pid.Kp == 0 && pid.Ki == 0 && pid.Kd == 0 {
+			pid.Kp = defaultKp
+			pid.Ki = defaultKi
+		}
+		if pid.Window <= 0 {
+			pid.Window = defaultWindow
+		}
+		return pid, nil
+	case StrategyAdaptive:
+		adaptive := &Adaptive{
+			Padding:     padding,
+			StageOffset: stageOffset,
+			Lead:        conf.Lead,
+		}
+		if adaptive.Lead <= 0 {
+			adaptive.Lead = defaultLead
+		}
+		return adaptive, nil
+	}
+	return nil, fmt.Errorf("strategy %q must be one of hysteresis, pid or adaptive", conf.Type)
+}
+
+//Hysteresis is bang-bang control, heat runs from Padding degrees below
+// the setpoint until Padding degrees above it and cooling the reverse
+type Hysteresis struct {
+	Padding     float64
+	StageOffset float64
+}
+
+func (hysteresis *Hysteresis) Decide(input Input) (Call, string) {
+	setpoint := input.Setpoint
+	temp := input.Temperature
+	padding := hysteresis.Padding
+	previous := input.Previous
+	var call Call
+	reason := "within setpoint band"
+	switch {
+	case input.HeatAllowed() && temp <= setpoint-padding:
+		call.HeatStages = 1
+		reason = "below setpoint"
+	case input.HeatAllowed() && previous.Heating() && temp < setpoint+padding:
+		call.HeatStages = 1
+		reason = "heating to setpoint"
+	case input.CoolAllowed() && temp >= setpoint+padding:
+		call.Cool = true
+		reason = "above setpoint"
+	case input.CoolAllowed() && previous.Cool && temp > setpoint-padding:
+		call.Cool = true
+		reason = "cooling to setpoint"
+	}
+	if call.HeatStages > 0 {
+		return stage(input, setpoint-padding, hysteresis.StageOffset, reason)
+	}
+	return call, reason
+}
+
+//stage adds heat stages and aux heat to a call for heat, the second
+// stage once the temperature is stageOffset below onAt and aux heat once
+// it is a further stageOffset below, each staying on until onAt is reached
+func stage(input Input, onAt float64, stageOffset float64, reason string) (Call, string) {
+	temp := input.Temperature
+	previous := input.Previous
+	stages := len(input.Equipment.Heat)
+	stageTwoAt := onAt - stageOffset
+	call := Call{HeatStages: 1}
+	switch {
+	case stages == 0:
+		// aux is the only source of heat
+		call.HeatStages = 0
+		call.Aux = true
+	case input.Equipment.Aux != nil && (temp <= stageTwoAt-stageOffset || (previous.Aux && temp < onAt)):
+		call.HeatStages = stages
+		call.Aux = true
+		reason = "far below setpoint, adding aux heat"
+	case stages > 1 && (temp <= stageTwoAt || (previous.HeatStages > 1 && temp < onAt)):
+		call.HeatStages = 2
+		reason = "well below setpoint, adding second stage"
+	}
+	return call, reason
+}
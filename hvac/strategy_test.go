@@ -0,0 +1,112 @@
+package hvac_test
+
+import (
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//simulation is the result of running a strategy against a simulated room
+type simulation struct {
+	overshoot float64
+	meanError float64
+	settled   float64
+}
+
+func simulate(strategy StrategyConfig, start float64, hours int) simulation {
+	room := NewSimulatedRoom(start, 40, 15*time.Minute)
+	controller, err := NewController(
+		Config{Mode: "heat", Setpoint: 70, Sensor: "room", Heat: []string{"heater"}, Strategy: strategy},
+		map[string]thermostat.ThermostatDevice{"room": room},
+		map[string]switcher.SwitchDevice{"heater": room.Heat},
+	)
+	Expect(err).ShouldNot(HaveOccurred())
+	now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var result simulation
+	reached := false
+	steps := 0
+	for elapsed := time.Duration(0); elapsed < time.Duration(hours)*time.Hour; elapsed += 30 * time.Second {
+		controller.Step(now.Add(elapsed))
+		room.Advance(30 * time.Second)
+		temp, _ := room.CurrentTemp()
+		if *temp >= 70 {
+			reached = true
+		}
+		if reached {
+			result.overshoot = math.Max(result.overshoot, *temp-70)
+		}
+		if elapsed >= time.Duration(hours-2)*time.Hour {
+			result.meanError += math.Abs(*temp - 70)
+			steps++
+		}
+	}
+	result.meanError /= float64(steps)
+	temp, _ := room.CurrentTemp()
+	result.settled = *temp
+	return result
+}
+
+var _ = Describe("Strategy", func() {
+	Describe("choosing a strategy", func() {
+		It("should default to hysteresis", func() {
+			strategy, err := NewStrategy(StrategyConfig{}, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(strategy).Should(BeAssignableToTypeOf(&Hysteresis{}))
+		})
+		It("should reject an unknown strategy", func() {
+			_, err := NewStrategy(StrategyConfig{Type: "fuzzy"}, 0, 0)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("controlling a simulated room with a slow heater", func() {
+		var hysteresis simulation
+		BeforeEach(func() {
+			hysteresis = simulate(StrategyConfig{Type: StrategyHysteresis}, 66, 8)
+		})
+		It("should overshoot with hysteresis", func() {
+			Expect(hysteresis.overshoot).Should(BeNumerically(">", 2))
+		})
+		It("should overshoot less with pid", func() {
+			pid := simulate(StrategyConfig{Type: StrategyPID}, 66, 8)
+			Expect(pid.overshoot).Should(BeNumerically("<", hysteresis.overshoot))
+			Expect(pid.meanError).Should(BeNumerically("<", hysteresis.meanError))
+		})
+		It("should overshoot less with adaptive once it has learned the room", func() {
+			adaptive := simulate(StrategyConfig{Type: StrategyAdaptive}, 66, 8)
+			Expect(adaptive.overshoot).Should(BeNumerically("<", hysteresis.overshoot))
+			Expect(adaptive.meanError).Should(BeNumerically("<", hysteresis.meanError))
+		})
+	})
+	Describe("learning the room", func() {
+		It("should learn the heat rate, drift and overshoot", func() {
+			room := NewSimulatedRoom(66, 40, 15*time.Minute)
+			adaptive := &Adaptive{Padding: 2, StageOffset: 3, Lead: 10 * time.Minute}
+			equipment := &Equipment{Heat: []switcher.SwitchDevice{room.Heat}}
+			now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+			var call Call
+			for step := 0; step < 4*120; step++ {
+				temp, _ := room.CurrentTemp()
+				call, _ = adaptive.Decide(Input{Now: now, Mode: ModeHeat, Setpoint: 70, Temperature: *temp, Previous: call, Equipment: equipment})
+				Expect(equipment.Apply(call)).Should(Succeed())
+				room.Advance(30 * time.Second)
+				now = now.Add(30 * time.Second)
+			}
+			Expect(adaptive.Rates.HeatRate).Should(BeNumerically(">", 0))
+			Expect(adaptive.Rates.DriftRate).Should(BeNumerically("<", 0))
+			Expect(adaptive.Rates.HeatOvershoot).Should(BeNumerically(">", 0.25))
+		})
+	})
+	Describe("recovering from a cold start with pid", func() {
+		It("should not wind up into a large overshoot", func() {
+			pid := simulate(StrategyConfig{Type: StrategyPID}, 50, 10)
+			Expect(pid.overshoot).Should(BeNumerically("<", 1.5))
+			Expect(pid.settled).Should(BeNumerically("~", 70, 1))
+		})
+	})
+})
@@ -0,0 +1,339 @@
+package hvac
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//Zones runs one Controller per zone. A switch named by more than one
+// zone (a central blower, or the furnace and compressor of a zoned
+// system) is shared: it stays on while any zone calls for it and zones
+// sharing heat or cool equipment never call for heat and cool together.
+type Zones struct {
+	Controllers []*Controller
+	arbiter     *arbiter
+}
+
+//NewZones builds a controller for every zone, each zone must be named
+func NewZones(confs []Config, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice) (*Zones, error) {
+	zones := &Zones{arbiter: &arbiter{peers: map[string]map[string]bool{}, sides: map[string]string{}}}
+	names := map[string]bool{}
+	roles := map[string]string{}
+	users := map[string][]string{}
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return nil, fmt.Errorf("every zone must have a name")
+		}
+		if names[conf.Name] {
+			return nil, fmt.Errorf("zone %s is defined twice", conf.Name)
+		}
+		names[conf.Name] = true
+		for name, role := range conf.switchRoles() {
+			if other, ok := roles[name]; ok && other != role {
+				return nil, fmt.Errorf("zone %s uses switch %s as %s but another zone uses it as %s", conf.Name, name, role, other)
+			}
+			roles[name] = role
+			users[name] = append(users[name], conf.Name)
+		}
+	}
+
+	shared := map[string]*sharedSwitch{}
+	for name := range roles {
+		if len(users[name]) < 2 {
+			continue
+		}
+		device, ok := switches[name]
+		if !ok {
+			return nil, fmt.Errorf("hvac switch %s not found", name)
+		}
+		shared[name] = &sharedSwitch{name: name, device: device, demand: map[string]bool{}}
+		if roles[name] == "fan" {
+			// a shared blower runs for heat and cool alike
+			continue
+		}
+		for _, zone := range users[name] {
+			for _, peer := range users[name] {
+				if zone != peer {
+					zones.arbiter.peer(zone, peer)
+				}
+			}
+		}
+	}
+
+	// protection timers belong to the equipment, not the zone
+	guards := map[string]*guard{}
+	sharedGuard := func(name string, kind string) *guard {
+		if _, ok := shared[name]; !ok {
+			return nil
+		}
+		if guards[name] == nil {
+			guards[name] = newGuard(kind)
+		}
+		return guards[name]
+	}
+
+	for _, conf := range confs {
+		zoneSwitches := map[string]switcher.SwitchDevice{}
+		for name, device := range switches {
+			zoneSwitches[name] = device
+		}
+		for name, sharedDevice := range shared {
+			zoneSwitches[name] = &zoneSwitch{zone: conf.Name, shared: sharedDevice}
+		}
+		controller, err := NewController(conf, thermostats, zoneSwitches)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %v", conf.Name, err)
+		}
+		controller.arbiter = zones.arbiter
+		if g := sharedGuard(conf.Cool, "compressor"); g != nil {
+			controller.coolGuard = g
+		}
+		firstHeat := conf.Aux
+		if len(conf.Heat) > 0 {
+			firstHeat = conf.Heat[0]
+		}
+		if g := sharedGuard(firstHeat, "heat"); g != nil {
+			controller.heatGuard = g
+		}
+		zones.Controllers = append(zones.Controllers, controller)
+	}
+	return zones, nil
+}
+
+//Zone returns the controller for the named zone, nil if there is none
+func (zones *Zones) Zone(name string) *Controller {
+	for _, controller := range zones.Controllers {
+		if controller.Name == name {
+			return controller
+		}
+	}
+	return nil
+}
+
+//Status returns the status of every zone in config order
+func (zones *Zones) Status() []Status {
+	statuses := []Status{}
+	for _, controller := range zones.Controllers {
+		statuses = append(statuses, controller.Status())
+	}
+	return statuses
+}
+
+//Run runs every zone until stop is closed
+func (zones *Zones) Run(stop <-chan struct{}) {
+	var running sync.WaitGroup
+	for _, controller := range zones.Controllers {
+		running.Add(1)
+		go func(controller *Controller) {
+			defer running.Done()
+			controller.Run(stop)
+		}(controller)
+	}
+	running.Wait()
+}
+
+//Step steps every zone once, in config order
+func (zones *Zones) Step(now time.Time) []Decision {
+	decisions := []Decision{}
+	for _, controller := range zones.Controllers {
+		decisions = append(decisions, controller.Step(now))
+	}
+	return decisions
+}
+
+//devices names the sensors and then the switches of the zone
+func (conf Config) devices() []string {
+	names := []string{}
+	if conf.Sensor != "" {
+		names = append(names, conf.Sensor)
+	}
+	names = append(names, conf.Sensors...)
+	switches := []string{}
+	for name := range conf.switchRoles() {
+		switches = append(switches, name)
+	}
+	sort.Strings(switches)
+	return append(names, switches...)
+}
+
+//switchRoles maps every switch the zone uses to its role
+func (conf Config) switchRoles() map[string]string {
+	roles := map[string]string{}
+	for _, name := range conf.Heat {
+		roles[name] = "heat"
+	}
+	if conf.Aux != "" {
+		roles[conf.Aux] = "aux"
+	}
+	if conf.Cool != "" {
+		roles[conf.Cool] = "cool"
+	}
+	if conf.Fan != "" {
+		roles[conf.Fan] = "fan"
+	}
+	return roles
+}
+
+//arbiter stops zones sharing heat or cool equipment
+// from calling for heat and cool at the same time
+type arbiter struct {
+	peers map[string]map[string]bool
+	sides map[string]string
+	lock  sync.Mutex
+}
+
+func (a *arbiter) peer(zone string, peer string) {
+	if a.peers[zone] == nil {
+		a.peers[zone] = map[string]bool{}
+	}
+	a.peers[zone][peer] = true
+}
+
+//claim holds back heat or cool while a peer zone is running the other,
+// otherwise it records the side zone is now running
+func (a *arbiter) claim(zone string, call Call) (Call, []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	deferred := []string{}
+	peers := []string{}
+	for peer := range a.peers[zone] {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		side := a.sides[peer]
+		if call.Heating() && side == "cool" {
+			deferred = append(deferred, fmt.Sprintf("heat waiting for zone %s to finish cooling", peer))
+			call.HeatStages = 0
+			call.Aux = false
+		}
+		if call.Cool && side == "heat" {
+			deferred = append(deferred, fmt.Sprintf("cool waiting for zone %s to finish heating", peer))
+			call.Cool = false
+		}
+	}
+	a.sides[zone] = side(call)
+	return call, deferred
+}
+
+//release notes zone is running nothing
+func (a *arbiter) release(zone string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.sides, zone)
+}
+
+func side(call Call) string {
+	switch {
+	case call.Heating():
+		return "heat"
+	case call.Cool:
+		return "cool"
+	}
+	return ""
+}
+
+//sharedSwitch is a switch used by several zones, it is on
+// while any zone wants it on
+type sharedSwitch struct {
+	name   string
+	device switcher.SwitchDevice
+	demand map[string]bool
+	lock   sync.Mutex
+}
+
+func (shared *sharedSwitch) wanted() bool {
+	for _, on := range shared.demand {
+		if on {
+			return true
+		}
+	}
+	return false
+}
+
+//zoneSwitch is one zone's view of a sharedSwitch
+type zoneSwitch struct {
+	zone   string
+	shared *sharedSwitch
+}
+
+//UpdateStatus reports ON only while this zone wants the switch on and it
+// is, or when it is on with nobody wanting it so it gets turned off.
+// PENDING means the zone wants it on but it is not, so any call re-sends.
+func (handle *zoneSwitch) UpdateStatus() (status *string, err error) {
+	shared := handle.shared
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	physical, err := shared.device.UpdateStatus()
+	if err != nil {
+		return nil, err
+	}
+	on := strings.EqualFold(*physical, "ON")
+	view := "OFF"
+	switch {
+	case shared.demand[handle.zone] && on:
+		view = "ON"
+	case shared.demand[handle.zone]:
+		view = "PENDING"
+	case on && !shared.wanted():
+		view = "ON"
+	}
+	return &view, nil
+}
+
+func (handle *zoneSwitch) TurnOn() (err error) {
+	shared := handle.shared
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	shared.demand[handle.zone] = true
+	return shared.device.TurnOn()
+}
+
+func (handle *zoneSwitch) TurnOff() (err error) {
+	shared := handle.shared
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	shared.demand[handle.zone] = false
+	if shared.wanted() {
+		return nil
+	}
+	return shared.device.TurnOff()
+}
+
+//averageSensor reads the mean temperature of several sensors,
+// ignoring any which cannot be read as long as one can
+type averageSensor struct {
+	names   []string
+	sensors []thermostat.ThermostatDevice
+}
+
+func (average *averageSensor) CurrentTemp() (temp *float64, err error) {
+	total := 0.0
+	read := 0
+	failures := []string{}
+	for i, sensor := range average.sensors {
+		reading, err := sensor.CurrentTemp()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", average.names[i], err))
+			continue
+		}
+		total += *reading
+		read++
+	}
+	if read == 0 {
+		return nil, fmt.Errorf("no sensor could be read: %s", strings.Join(failures, ", "))
+	}
+	mean := total / float64(read)
+	return &mean, nil
+}
+
+//Connect does nothing, the sensors are connected by their owner
+func (average *averageSensor) Connect() (err error) {
+	return nil
+}
@@ -0,0 +1,269 @@
+package hvac_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Zones", func() {
+	var (
+		upstairs    *thermostat.MockThermostat
+		downstairs  *thermostat.MockThermostat
+		basement    *thermostat.MockThermostat
+		furnace     *switcher.MockSwitch
+		compressor  *switcher.MockSwitch
+		blower      *switcher.MockSwitch
+		heater      *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		confs       []Config
+		zones       *Zones
+		now         time.Time
+	)
+	BeforeEach(func() {
+		upstairs = &thermostat.MockThermostat{Temperature: 70}
+		downstairs = &thermostat.MockThermostat{Temperature: 70}
+		basement = &thermostat.MockThermostat{Temperature: 70}
+		furnace = &switcher.MockSwitch{Status: "OFF"}
+		compressor = &switcher.MockSwitch{Status: "OFF"}
+		blower = &switcher.MockSwitch{Status: "OFF"}
+		heater = &switcher.MockSwitch{Status: "OFF"}
+		thermostats = map[string]thermostat.ThermostatDevice{
+			"upstairs": upstairs, "downstairs": downstairs, "basement": basement,
+		}
+		switches = map[string]switcher.SwitchDevice{
+			"furnace": furnace, "compressor": compressor, "blower": blower, "heater": heater,
+		}
+		confs = []Config{
+			{
+				Name:     "upstairs",
+				Mode:     "auto",
+				Setpoint: 70,
+				Sensor:   "upstairs",
+				Heat:     []string{"furnace"},
+				Cool:     "compressor",
+				Fan:      "blower",
+			},
+			{
+				Name:     "downstairs",
+				Mode:     "auto",
+				Setpoint: 70,
+				Sensor:   "downstairs",
+				Heat:     []string{"furnace"},
+				Cool:     "compressor",
+				Fan:      "blower",
+			},
+		}
+		now = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	})
+	JustBeforeEach(func() {
+		var err error
+		zones, err = NewZones(confs, thermostats, switches)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	step := func() []Decision {
+		now = now.Add(time.Minute)
+		return zones.Step(now)
+	}
+	Describe("creating zones", func() {
+		It("should reject a zone without a name", func() {
+			confs[1].Name = ""
+			_, err := NewZones(confs, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should reject two zones with the same name", func() {
+			confs[1].Name = "upstairs"
+			_, err := NewZones(confs, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should reject a switch shared in different roles", func() {
+			confs[1].Cool = "furnace"
+			confs[1].Heat = []string{"heater"}
+			_, err := NewZones(confs, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should look zones up by name", func() {
+			Expect(zones.Zone("downstairs").Status().Name).Should(Equal("downstairs"))
+			Expect(zones.Zone("attic")).Should(BeNil())
+			Expect(zones.Status()).Should(HaveLen(2))
+		})
+	})
+	Describe("sharing the blower", func() {
+		BeforeEach(func() {
+			confs[0].Mode = "cool"
+			confs[1].Mode = "cool"
+		})
+		It("should keep it running until no zone needs it", func() {
+			upstairs.Temperature = 75
+			downstairs.Temperature = 75
+			step()
+			Expect(compressor.Status).Should(Equal("ON"))
+			Expect(blower.Status).Should(Equal("ON"))
+
+			upstairs.Temperature = 67
+			decisions := step()
+			Expect(decisions[0].Call).Should(Equal(Call{}))
+			Expect(compressor.Status).Should(Equal("ON"))
+			Expect(blower.Status).Should(Equal("ON"))
+
+			downstairs.Temperature = 67
+			step()
+			Expect(compressor.Status).Should(Equal("OFF"))
+			Expect(blower.Status).Should(Equal("OFF"))
+		})
+		It("should turn it back on when it was switched off by hand", func() {
+			upstairs.Temperature = 75
+			step()
+			blower.Status = "OFF"
+			step()
+			Expect(blower.Status).Should(Equal("ON"))
+		})
+	})
+	Describe("sharing protected equipment", func() {
+		BeforeEach(func() {
+			for i := range confs {
+				confs[i].Mode = "cool"
+				confs[i].Protection = Protection{MinOnTime: 5 * time.Minute, MinOffTime: 5 * time.Minute}
+			}
+		})
+		It("should hold another zone to the minimum off time", func() {
+			upstairs.Temperature = 75
+			step()
+			Expect(compressor.Status).Should(Equal("ON"))
+
+			upstairs.Temperature = 67
+			for i := 0; i < 5; i++ {
+				step()
+			}
+			Expect(compressor.Status).Should(Equal("OFF"))
+
+			downstairs.Temperature = 75
+			decisions := step()
+			Expect(decisions[1].Call.Cool).Should(BeFalse())
+			Expect(decisions[1].Deferred).Should(ContainElement("compressor minimum off time, 4m0s remaining"))
+			Expect(compressor.Status).Should(Equal("OFF"))
+		})
+		It("should let a zone join or leave while another keeps it running", func() {
+			upstairs.Temperature = 75
+			step()
+			downstairs.Temperature = 75
+			decisions := step()
+			Expect(decisions[1].Call.Cool).Should(BeTrue())
+
+			downstairs.Temperature = 67
+			decisions = step()
+			Expect(decisions[1].Call.Cool).Should(BeFalse())
+			Expect(decisions[1].Deferred).Should(BeEmpty())
+			Expect(compressor.Status).Should(Equal("ON"))
+		})
+	})
+	Describe("zones wanting heat and cool", func() {
+		BeforeEach(func() {
+			confs[0].Mode = "cool"
+			confs[1].Mode = "heat"
+		})
+		It("should hold the second zone back until the first finishes", func() {
+			upstairs.Temperature = 75
+			downstairs.Temperature = 65
+			decisions := step()
+			Expect(decisions[0].Call).Should(Equal(Call{Cool: true, Fan: true}))
+			Expect(decisions[1].Call).Should(Equal(Call{}))
+			Expect(decisions[1].Deferred).Should(ContainElement("heat waiting for zone upstairs to finish cooling"))
+			Expect(furnace.Status).Should(Equal("OFF"))
+
+			upstairs.Temperature = 67
+			decisions = step()
+			Expect(decisions[0].Call).Should(Equal(Call{}))
+			Expect(decisions[1].Call).Should(Equal(Call{HeatStages: 1}))
+			Expect(compressor.Status).Should(Equal("OFF"))
+			Expect(furnace.Status).Should(Equal("ON"))
+		})
+		Context("with a zone on its own equipment", func() {
+			BeforeEach(func() {
+				confs = append(confs, Config{
+					Name:     "basement",
+					Mode:     "heat",
+					Setpoint: 70,
+					Sensor:   "basement",
+					Heat:     []string{"heater"},
+				})
+			})
+			It("should not hold it back", func() {
+				upstairs.Temperature = 75
+				basement.Temperature = 65
+				decisions := step()
+				Expect(decisions[0].Call.Cool).Should(BeTrue())
+				Expect(decisions[2].Call).Should(Equal(Call{HeatStages: 1}))
+				Expect(heater.Status).Should(Equal("ON"))
+			})
+		})
+	})
+	Describe("averaging sensors", func() {
+		BeforeEach(func() {
+			confs = confs[:1]
+			confs[0].Sensors = []string{"downstairs"}
+		})
+		It("should use the mean temperature", func() {
+			upstairs.Temperature = 66
+			downstairs.Temperature = 70
+			decisions := step()
+			Expect(decisions[0].Temperature).Should(Equal(68.0))
+			Expect(decisions[0].Call.Heating()).Should(BeTrue())
+		})
+		It("should ignore a sensor which cannot be read", func() {
+			upstairs.Err = errors.New("unreachable")
+			downstairs.Temperature = 65
+			decisions := step()
+			Expect(decisions[0].Temperature).Should(Equal(65.0))
+			Expect(decisions[0].Error).Should(BeEmpty())
+		})
+	})
+	Describe("schedules", func() {
+		BeforeEach(func() {
+			confs = confs[:1]
+			confs[0].Schedule = []SchedulePoint{
+				{At: "06:30", Setpoint: 70},
+				{At: "22:00", Setpoint: 64},
+				{At: "09:00", Days: []string{"sat", "sun"}, Setpoint: 72, Mode: "heat"},
+			}
+		})
+		It("should reject an invalid time", func() {
+			confs[0].Schedule[0].At = "6.30"
+			_, err := NewZones(confs, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should reject an invalid day", func() {
+			confs[0].Schedule[2].Days = []string{"someday"}
+			_, err := NewZones(confs, thermostats, switches)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should follow the schedule", func() {
+			zone := zones.Zone("upstairs")
+			// Monday
+			zone.Step(time.Date(2021, time.March, 1, 5, 0, 0, 0, time.UTC))
+			Expect(zone.Status().Setpoint).Should(Equal(64.0))
+			zone.Step(time.Date(2021, time.March, 1, 7, 0, 0, 0, time.UTC))
+			Expect(zone.Status().Setpoint).Should(Equal(70.0))
+			// Saturday
+			zone.Step(time.Date(2021, time.March, 6, 10, 0, 0, 0, time.UTC))
+			Expect(zone.Status().Setpoint).Should(Equal(72.0))
+			Expect(zone.Status().Mode).Should(Equal(ModeHeat))
+		})
+		It("should keep a manual setpoint until the next point", func() {
+			zone := zones.Zone("upstairs")
+			zone.Step(time.Date(2021, time.March, 1, 7, 0, 0, 0, time.UTC))
+			Expect(zone.SetSetpoint(68)).Should(Succeed())
+			zone.Step(time.Date(2021, time.March, 1, 8, 0, 0, 0, time.UTC))
+			Expect(zone.Status().Setpoint).Should(Equal(68.0))
+			zone.Step(time.Date(2021, time.March, 1, 22, 30, 0, 0, time.UTC))
+			Expect(zone.Status().Setpoint).Should(Equal(64.0))
+		})
+	})
+})
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//Namespace prefixes every mi-casa metric name
+const Namespace = "micasa"
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "device_request_duration_seconds",
+		Help:      "How long requests to devices took, by protocol (http or mqtt), device and request.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"protocol", "device", "request"})
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "device_request_errors_total",
+		Help:      "Requests to devices which failed, by protocol (http or mqtt), device and request.",
+	}, []string{"protocol", "device", "request"})
+)
+
+//ObserveRequest records a request to device which started at started,
+// counting it as an error when err is not nil
+func ObserveRequest(protocol string, device string, request string, started time.Time, err error) {
+	requestDuration.WithLabelValues(protocol, device, request).Observe(time.Since(started).Seconds())
+	if err != nil {
+		requestErrors.WithLabelValues(protocol, device, request).Inc()
+	}
+}
+
+//Collectors returns the device request metrics for registering
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{requestDuration, requestErrors}
+}
@@ -0,0 +1,41 @@
+package metrics_test
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/oskoss/mi-casa/metrics"
+)
+
+var _ = Describe("Metrics", func() {
+	var registry *prometheus.Registry
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		for _, collector := range Collectors() {
+			registry.MustRegister(collector)
+		}
+	})
+	It("should time every request and count the failures", func() {
+		ObserveRequest("http", "porch", "state", time.Now(), nil)
+		ObserveRequest("http", "porch", "state", time.Now(), errors.New("timeout"))
+		expected := `
+# HELP micasa_device_request_errors_total Requests to devices which failed, by protocol (http or mqtt), device and request.
+# TYPE micasa_device_request_errors_total counter
+micasa_device_request_errors_total{device="porch",protocol="http",request="state"} 1
+`
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(expected), "micasa_device_request_errors_total")).Should(Succeed())
+		families, err := registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == "micasa_device_request_duration_seconds" {
+				Expect(family.GetMetric()[0].GetHistogram().GetSampleCount()).Should(Equal(uint64(2)))
+			}
+		}
+	})
+})
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/oskoss/mi-casa/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+const notifyUsage = `usage: micasa notify test [--sink name]
+
+sends a test notification to the named sink, or to every sink`
+
+//notifyCommand checks the sinks of the notify section deliver
+func notifyCommand(opts *options, args []string) int {
+	flags := newFlagSet("notify", opts)
+	sink := flags.String("sink", "", "only send to this sink")
+	args, ok := commandArgs(flags, args, notifyUsage)
+	if !ok {
+		return exitUsage
+	}
+	if len(args) != 1 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, notifyUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, err := loadConfig(opts)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	if micasaConfig.Notify == nil || len(micasaConfig.Notify.Sinks) == 0 {
+		return failed(opts, exitNotFound, fmt.Errorf("no sinks are configured, add them to notify.sinks"))
+	}
+	found := *sink == ""
+	for _, sinkConfig := range micasaConfig.Notify.Sinks {
+		found = found || sinkConfig.Name == *sink
+	}
+	if !found {
+		return failed(opts, exitNotFound, fmt.Errorf("no sink is named %s", *sink))
+	}
+	notifier, err := notify.New(*micasaConfig.Notify)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	if err := notifier.Test(*sink, time.Now()); err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	sent := "every sink"
+	if *sink != "" {
+		sent = *sink
+	}
+	output(opts, map[string]interface{}{"sent": sent}, func() {
+		fmt.Printf("test notification sent to %s\n", sent)
+	})
+	return exitOK
+}
@@ -0,0 +1,466 @@
+package notify
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oskoss/mi-casa/events"
+	log "github.com/sirupsen/logrus"
+)
+
+//checkInterval is how often alerts are evaluated while running
+const checkInterval = 30 * time.Second
+
+//Config is the notify section of the mi-casa YAML config. A firing
+// alert is sent once, again every Repeat while it keeps firing when
+// Repeat is set, and once more when it clears. Alerts which are not
+// Urgent are held during QuietHours and sent when they end if still due.
+type Config struct {
+	Sinks      []SinkConfig  `yaml:"sinks"`
+	Alerts     []Alert       `yaml:"alerts"`
+	Repeat     time.Duration `yaml:"repeat,omitempty"`
+	QuietHours *QuietHours   `yaml:"quietHours,omitempty"`
+}
+
+//Alert must have exactly one of Offline, Temperature, HVACRunning and Vcc
+// set. Devices limits it to those devices, or zones for HVACRunning, and
+// Sinks to those sinks, every one when empty.
+type Alert struct {
+	Name        string        `yaml:"name"`
+	Offline     time.Duration `yaml:"offline,omitempty"`
+	Temperature *Bounds       `yaml:"temperature,omitempty"`
+	HVACRunning time.Duration `yaml:"hvacRunning,omitempty"`
+	Vcc         *Bounds       `yaml:"vcc,omitempty"`
+	Devices     []string      `yaml:"devices,omitempty"`
+	Sinks       []string      `yaml:"sinks,omitempty"`
+	Urgent      bool          `yaml:"urgent,omitempty"`
+}
+
+//Bounds fire while a reading is below Below or above Above
+type Bounds struct {
+	Below *float64 `yaml:"below,omitempty"`
+	Above *float64 `yaml:"above,omitempty"`
+}
+
+//QuietHours run from From to To ("22:00" to "07:00"), in local time
+type QuietHours struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+//Notification is what a sink is given to deliver
+type Notification struct {
+	Time     time.Time `json:"time"`
+	Alert    string    `json:"alert"`
+	Device   string    `json:"device,omitempty"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Resolved bool      `json:"resolved,omitempty"`
+	Urgent   bool      `json:"urgent,omitempty"`
+}
+
+func (alert Alert) kind() string {
+	kinds := []string{}
+	if alert.Offline != 0 {
+		kinds = append(kinds, "offline")
+	}
+	if alert.Temperature != nil {
+		kinds = append(kinds, "temperature")
+	}
+	if alert.HVACRunning != 0 {
+		kinds = append(kinds, "hvacRunning")
+	}
+	if alert.Vcc != nil {
+		kinds = append(kinds, "vcc")
+	}
+	return strings.Join(kinds, ", ")
+}
+
+func (bounds Bounds) String() string {
+	parts := []string{}
+	if bounds.Below != nil {
+		parts = append(parts, fmt.Sprintf("below %g", *bounds.Below))
+	}
+	if bounds.Above != nil {
+		parts = append(parts, fmt.Sprintf("above %g", *bounds.Above))
+	}
+	return strings.Join(parts, " or ")
+}
+
+//outside is how value breaks the bounds, empty when it does not
+func (bounds Bounds) outside(value float64) string {
+	if bounds.Below != nil && value < *bounds.Below {
+		return fmt.Sprintf("below %g", *bounds.Below)
+	}
+	if bounds.Above != nil && value > *bounds.Above {
+		return fmt.Sprintf("above %g", *bounds.Above)
+	}
+	return ""
+}
+
+//holds is whether now falls within the quiet hours,
+// which may wrap midnight
+func (quiet QuietHours) holds(now time.Time) bool {
+	from, _ := parseClock(quiet.From)
+	to, _ := parseClock(quiet.To)
+	sinceMidnight := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	if from <= to {
+		return sinceMidnight >= from && sinceMidnight < to
+	}
+	return sinceMidnight >= from || sinceMidnight < to
+}
+
+//parseClock parses "15:04" into an offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time %q must be formatted as HH:MM", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+//Notifier watches the events of the house and sends alerts to the sinks
+type Notifier struct {
+	Config   Config
+	sinks    map[string]Sink
+	down     map[string]events.Event
+	running  map[string]events.Event
+	readings map[string]map[string]float64
+	firing   map[string]*firing
+	lock     sync.Mutex
+}
+
+//firing is an alert firing for a device
+type firing struct {
+	alert    Alert
+	device   string
+	since    time.Time
+	message  string
+	notified time.Time
+	cleared  bool
+}
+
+//New checks conf and builds its sinks
+func New(conf Config) (*Notifier, error) {
+	notifier := &Notifier{
+		Config:   conf,
+		sinks:    map[string]Sink{},
+		down:     map[string]events.Event{},
+		running:  map[string]events.Event{},
+		readings: map[string]map[string]float64{},
+		firing:   map[string]*firing{},
+	}
+	for _, sinkConfig := range conf.Sinks {
+		if sinkConfig.Name == "" {
+			return nil, fmt.Errorf("sink name not set")
+		}
+		if _, ok := notifier.sinks[sinkConfig.Name]; ok {
+			return nil, fmt.Errorf("sink %s is defined more than once", sinkConfig.Name)
+		}
+		sink, err := NewSink(sinkConfig)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", sinkConfig.Name, err)
+		}
+		notifier.sinks[sinkConfig.Name] = sink
+	}
+	names := map[string]bool{}
+	for _, alert := range conf.Alerts {
+		if alert.Name == "" {
+			return nil, fmt.Errorf("alert name not set")
+		}
+		if names[alert.Name] {
+			return nil, fmt.Errorf("alert %s is defined more than once", alert.Name)
+		}
+		names[alert.Name] = true
+		if err := notifier.validate(alert); err != nil {
+			return nil, fmt.Errorf("alert %s: %v", alert.Name, err)
+		}
+	}
+	if conf.Repeat < 0 {
+		return nil, fmt.Errorf("repeat must not be negative")
+	}
+	if quiet := conf.QuietHours; quiet != nil {
+		for _, clock := range []string{quiet.From, quiet.To} {
+			if _, err := parseClock(clock); err != nil {
+				return nil, fmt.Errorf("quietHours: %v", err)
+			}
+		}
+	}
+	return notifier, nil
+}
+
+func (notifier *Notifier) validate(alert Alert) error {
+	switch kind := alert.kind(); {
+	case kind == "":
+		return fmt.Errorf("set one of offline, temperature, hvacRunning or vcc")
+	case strings.Contains(kind, ","):
+		return fmt.Errorf("sets %s, only one may be set", kind)
+	}
+	if alert.Offline < 0 || alert.HVACRunning < 0 {
+		return fmt.Errorf("%s must not be negative", alert.kind())
+	}
+	for _, bounds := range []*Bounds{alert.Temperature, alert.Vcc} {
+		if bounds != nil && bounds.Below == nil && bounds.Above == nil {
+			return fmt.Errorf("%s needs below or above", alert.kind())
+		}
+	}
+	for _, name := range alert.Sinks {
+		if _, ok := notifier.sinks[name]; !ok {
+			return fmt.Errorf("sink %s not found", name)
+		}
+	}
+	if len(alert.Sinks) == 0 && len(notifier.sinks) == 0 {
+		return fmt.Errorf("no sinks to send it to")
+	}
+	return nil
+}
+
+//Observe takes note of what event says about the house
+func (notifier *Notifier) Observe(event events.Event) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	switch event.Kind {
+	case events.KindHealth:
+		if event.State == "up" {
+			delete(notifier.down, event.Device)
+			break
+		}
+		if _, ok := notifier.down[event.Device]; !ok {
+			notifier.down[event.Device] = event
+		}
+		notifier.forget(event.Device)
+	case events.KindDecision:
+		if event.State == "idle" {
+			delete(notifier.running, event.Device)
+		} else if _, ok := notifier.running[event.Device]; !ok {
+			notifier.running[event.Device] = event
+		}
+	case events.KindReading:
+		if notifier.readings[event.Device] == nil {
+			notifier.readings[event.Device] = map[string]float64{}
+		}
+		notifier.readings[event.Device][event.Metric] = event.Value
+	}
+}
+
+//forget drops the readings of device once it is down, as they no longer
+// say how it is, along with the alerts they fired without resolving them.
+// Its next readings start over.
+func (notifier *Notifier) forget(device string) {
+	delete(notifier.readings, device)
+	for key, state := range notifier.firing {
+		if state.device == device && (state.alert.Temperature != nil || state.alert.Vcc != nil) {
+			delete(notifier.firing, key)
+		}
+	}
+}
+
+//Check sends what is due at now: alerts which started firing, those
+// to repeat and those which cleared, unless held by quiet hours
+func (notifier *Notifier) Check(now time.Time) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	for _, alert := range notifier.Config.Alerts {
+		holding := notifier.evaluate(alert, now)
+		for device, message := range holding {
+			key := alert.Name + "/" + device
+			state, ok := notifier.firing[key]
+			if !ok {
+				state = &firing{alert: alert, device: device, since: now}
+				notifier.firing[key] = state
+			}
+			state.message = message
+			state.cleared = false
+		}
+		for key, state := range notifier.firing {
+			if _, ok := holding[state.device]; !ok && state.alert.Name == alert.Name {
+				state.cleared = true
+				if state.notified.IsZero() {
+					delete(notifier.firing, key)
+				}
+			}
+		}
+	}
+	keys := []string{}
+	for key := range notifier.firing {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		state := notifier.firing[key]
+		if notifier.quiet(state.alert, now) {
+			continue
+		}
+		switch {
+		case state.cleared:
+			notifier.send(state, true, now)
+			delete(notifier.firing, key)
+		case state.notified.IsZero(),
+			notifier.Config.Repeat > 0 && now.Sub(state.notified) >= notifier.Config.Repeat:
+			notifier.send(state, false, now)
+			state.notified = now
+		}
+	}
+}
+
+//evaluate returns a message for every device alert fires for at now
+func (notifier *Notifier) evaluate(alert Alert, now time.Time) map[string]string {
+	holding := map[string]string{}
+	wanted := func(device string) bool {
+		if len(alert.Devices) == 0 {
+			return true
+		}
+		for _, name := range alert.Devices {
+			if name == device {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case alert.Offline != 0:
+		for device, event := range notifier.down {
+			if wanted(device) && now.Sub(event.Time) >= alert.Offline {
+				holding[device] = fmt.Sprintf("%s has been offline for %s: %s", device, since(event.Time, now), event.Reason)
+			}
+		}
+	case alert.HVACRunning != 0:
+		for zone, event := range notifier.running {
+			if wanted(zone) && now.Sub(event.Time) >= alert.HVACRunning {
+				holding[zone] = fmt.Sprintf("%s has been running for %s, calling for %s", zone, since(event.Time, now), event.State)
+			}
+		}
+	case alert.Temperature != nil, alert.Vcc != nil:
+		metric, bounds, unit := "temperature", alert.Temperature, "°F"
+		if alert.Vcc != nil {
+			metric, bounds, unit = "vcc", alert.Vcc, "V"
+		}
+		for device, values := range notifier.readings {
+			value, ok := values[metric]
+			if !ok || !wanted(device) {
+				continue
+			}
+			if outside := bounds.outside(value); outside != "" {
+				holding[device] = fmt.Sprintf("%s %s is %g%s, %s", device, metric, value, unit, outside)
+			}
+		}
+	}
+	return holding
+}
+
+func since(start time.Time, now time.Time) time.Duration {
+	return now.Sub(start).Truncate(time.Minute)
+}
+
+//quiet is whether alert is held at now
+func (notifier *Notifier) quiet(alert Alert, now time.Time) bool {
+	return !alert.Urgent && notifier.Config.QuietHours != nil && notifier.Config.QuietHours.holds(now)
+}
+
+//send delivers state to the sinks of its alert, a sink which
+// fails is logged and not tried again for this notification
+func (notifier *Notifier) send(state *firing, resolved bool, now time.Time) {
+	notification := Notification{
+		Time:     now,
+		Alert:    state.alert.Name,
+		Device:   state.device,
+		Title:    fmt.Sprintf("%s: %s", state.alert.Name, state.device),
+		Message:  state.message,
+		Resolved: resolved,
+		Urgent:   state.alert.Urgent,
+	}
+	if resolved {
+		notification.Title = "resolved " + notification.Title
+		notification.Message = fmt.Sprintf("%s is back to normal after %s", state.device, since(state.since, now))
+	}
+	log.WithFields(log.Fields{
+		"alert":    notification.Alert,
+		"device":   notification.Device,
+		"resolved": resolved,
+	}).Printf("sending notification")
+	for _, name := range notifier.sinkNames(state.alert) {
+		if err := notifier.sinks[name].Send(notification); err != nil {
+			log.WithFields(log.Fields{
+				"sink":  name,
+				"alert": notification.Alert,
+				"err":   err,
+			}).Error("could not send notification")
+		}
+	}
+}
+
+func (notifier *Notifier) sinkNames(alert Alert) []string {
+	if len(alert.Sinks) > 0 {
+		return alert.Sinks
+	}
+	names := []string{}
+	for _, sinkConfig := range notifier.Config.Sinks {
+		names = append(names, sinkConfig.Name)
+	}
+	return names
+}
+
+//Test sends a test notification to the named sink, or every sink
+// when name is empty, returning the first failure
+func (notifier *Notifier) Test(name string, now time.Time) error {
+	notification := Notification{
+		Time:    now,
+		Alert:   "test",
+		Title:   "mi-casa test",
+		Message: "notifications from mi-casa reach you here",
+	}
+	found := false
+	for _, sinkConfig := range notifier.Config.Sinks {
+		if name != "" && sinkConfig.Name != name {
+			continue
+		}
+		found = true
+		if err := notifier.sinks[sinkConfig.Name].Send(notification); err != nil {
+			return fmt.Errorf("sink %s: %v", sinkConfig.Name, err)
+		}
+	}
+	if !found {
+		return fmt.Errorf("sink %s not found", name)
+	}
+	return nil
+}
+
+//Run observes every event published to bus and checks the alerts
+// until stop is closed. The events the bus still keeps are observed
+// first, so devices already down when it starts are known.
+func (notifier *Notifier) Run(bus *events.Bus, stop <-chan struct{}) {
+	received, unsubscribe := bus.Subscribe(1024)
+	defer unsubscribe()
+	kept, _ := bus.Since(0)
+	for _, event := range kept {
+		notifier.Observe(event)
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-received:
+			notifier.Observe(event)
+		case now := <-ticker.C:
+			notifier.Check(now)
+		}
+	}
+}
+
+//validURL checks raw is an absolute http or https URL
+func validURL(raw string) error {
+	if raw == "" {
+		return fmt.Errorf("url is required")
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return nil
+}
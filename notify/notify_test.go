@@ -0,0 +1,177 @@
+package notify_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/events"
+	. "github.com/oskoss/mi-casa/notify"
+)
+
+var _ = Describe("Notifier", func() {
+	var (
+		server   *httptest.Server
+		received chan Notification
+		conf     Config
+		notifier *Notifier
+		start    time.Time
+	)
+	BeforeEach(func() {
+		received = make(chan Notification, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			var notification Notification
+			Expect(json.NewDecoder(req.Body).Decode(&notification)).To(Succeed())
+			received <- notification
+		}))
+		conf = Config{Sinks: []SinkConfig{{Name: "hook", Webhook: &Webhook{URL: server.URL}}}}
+		start = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	JustBeforeEach(func() {
+		var err error
+		notifier, err = New(conf)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	below := func(value float64) *Bounds {
+		return &Bounds{Below: &value}
+	}
+	Describe("a device offline", func() {
+		BeforeEach(func() {
+			conf.Alerts = []Alert{{Name: "offline", Offline: 10 * time.Minute}}
+		})
+		It("should notify once it has been down long enough, once, and when it is back", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindHealth, Device: "blower", State: "down", Reason: "unreachable"})
+			notifier.Check(start.Add(5 * time.Minute))
+			Consistently(received).ShouldNot(Receive())
+			notifier.Check(start.Add(11 * time.Minute))
+			notification := <-received
+			Expect(notification.Alert).To(Equal("offline"))
+			Expect(notification.Device).To(Equal("blower"))
+			Expect(notification.Message).To(Equal("blower has been offline for 11m0s: unreachable"))
+			notifier.Check(start.Add(20 * time.Minute))
+			Consistently(received).ShouldNot(Receive())
+
+			notifier.Observe(events.Event{Time: start.Add(25 * time.Minute), Kind: events.KindHealth, Device: "blower", State: "up"})
+			notifier.Check(start.Add(26 * time.Minute))
+			notification = <-received
+			Expect(notification.Resolved).To(BeTrue())
+			Expect(notification.Device).To(Equal("blower"))
+		})
+		It("should say nothing of a device back before it was due", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindHealth, Device: "blower", State: "down"})
+			notifier.Check(start.Add(5 * time.Minute))
+			notifier.Observe(events.Event{Time: start.Add(6 * time.Minute), Kind: events.KindHealth, Device: "blower", State: "up"})
+			notifier.Check(start.Add(11 * time.Minute))
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+	Describe("a temperature out of bounds", func() {
+		BeforeEach(func() {
+			conf.Alerts = []Alert{{Name: "cold", Temperature: below(50), Devices: []string{"office"}}}
+			conf.Repeat = time.Hour
+		})
+		It("should notify and remind every repeat", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindReading, Device: "garage", Metric: "temperature", Value: 40})
+			notifier.Observe(events.Event{Time: start, Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 49.5})
+			notifier.Check(start)
+			notification := <-received
+			Expect(notification.Device).To(Equal("office"))
+			Expect(notification.Message).To(Equal("office temperature is 49.5°F, below 50"))
+			notifier.Check(start.Add(30 * time.Minute))
+			Consistently(received).ShouldNot(Receive())
+			notifier.Check(start.Add(time.Hour))
+			Expect((<-received).Resolved).To(BeFalse())
+		})
+		It("should forget the readings of a device which goes down", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 49.5})
+			notifier.Check(start)
+			Expect((<-received).Device).To(Equal("office"))
+
+			notifier.Observe(events.Event{Time: start.Add(time.Minute), Kind: events.KindHealth, Device: "office", State: "down"})
+			notifier.Check(start.Add(2 * time.Hour))
+			Consistently(received).ShouldNot(Receive())
+
+			notifier.Observe(events.Event{Time: start.Add(3 * time.Hour), Kind: events.KindHealth, Device: "office", State: "up"})
+			notifier.Observe(events.Event{Time: start.Add(3 * time.Hour), Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 45})
+			notifier.Check(start.Add(3 * time.Hour))
+			notification := <-received
+			Expect(notification.Resolved).To(BeFalse())
+			Expect(notification.Message).To(Equal("office temperature is 45°F, below 50"))
+		})
+	})
+	Describe("the HVAC running", func() {
+		BeforeEach(func() {
+			conf.Alerts = []Alert{{Name: "stuck", HVACRunning: 4 * time.Hour}}
+		})
+		It("should notify when it has called for too long", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindDecision, Device: "upstairs", State: "heat stage 1"})
+			notifier.Observe(events.Event{Time: start.Add(time.Hour), Kind: events.KindDecision, Device: "upstairs", State: "heat stage 2"})
+			notifier.Check(start.Add(3 * time.Hour))
+			Consistently(received).ShouldNot(Receive())
+			notifier.Check(start.Add(4 * time.Hour))
+			Expect((<-received).Message).To(Equal("upstairs has been running for 4h0m0s, calling for heat stage 1"))
+		})
+		It("should start counting again when it idles", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindDecision, Device: "upstairs", State: "cool"})
+			notifier.Observe(events.Event{Time: start.Add(3 * time.Hour), Kind: events.KindDecision, Device: "upstairs", State: "idle"})
+			notifier.Observe(events.Event{Time: start.Add(3*time.Hour + time.Minute), Kind: events.KindDecision, Device: "upstairs", State: "cool"})
+			notifier.Check(start.Add(5 * time.Hour))
+			Consistently(received).ShouldNot(Receive())
+		})
+	})
+	Describe("a Tasmota supply voltage", func() {
+		BeforeEach(func() {
+			conf.Alerts = []Alert{{Name: "brownout", Vcc: below(3.1)}}
+		})
+		It("should notify when it sags", func() {
+			notifier.Observe(events.Event{Time: start, Kind: events.KindReading, Device: "blower", Metric: "vcc", Value: 2.9})
+			notifier.Check(start)
+			Expect((<-received).Message).To(Equal("blower vcc is 2.9V, below 3.1"))
+		})
+	})
+	Describe("quiet hours", func() {
+		BeforeEach(func() {
+			conf.Alerts = []Alert{
+				{Name: "cold", Temperature: below(50)},
+				{Name: "offline", Offline: time.Minute, Urgent: true},
+			}
+			conf.QuietHours = &QuietHours{From: "22:00", To: "07:00"}
+		})
+		It("should hold alerts until they end, unless urgent", func() {
+			night := time.Date(2021, time.March, 1, 23, 0, 0, 0, time.UTC)
+			notifier.Observe(events.Event{Time: night, Kind: events.KindReading, Device: "office", Metric: "temperature", Value: 45})
+			notifier.Observe(events.Event{Time: night, Kind: events.KindHealth, Device: "blower", State: "down"})
+			notifier.Check(night.Add(time.Minute))
+			notification := <-received
+			Expect(notification.Alert).To(Equal("offline"))
+			Expect(notification.Urgent).To(BeTrue())
+			Consistently(received).ShouldNot(Receive())
+			notifier.Check(time.Date(2021, time.March, 2, 7, 0, 0, 0, time.UTC))
+			Expect((<-received).Alert).To(Equal("cold"))
+		})
+	})
+	Describe("creating a notifier", func() {
+		It("should reject an alert sent nowhere that exists", func() {
+			conf.Alerts = []Alert{{Name: "cold", Temperature: below(50), Sinks: []string{"phone"}}}
+			_, err := New(conf)
+			Expect(err).To(MatchError("alert cold: sink phone not found"))
+		})
+		It("should reject an alert of two kinds", func() {
+			conf.Alerts = []Alert{{Name: "both", Offline: time.Minute, Vcc: below(3)}}
+			_, err := New(conf)
+			Expect(err).To(MatchError("alert both: sets offline, vcc, only one may be set"))
+		})
+		It("should reject quiet hours it cannot read", func() {
+			conf.QuietHours = &QuietHours{From: "10pm", To: "07:00"}
+			_, err := New(conf)
+			Expect(err).To(MatchError(`quietHours: time "10pm" must be formatted as HH:MM`))
+		})
+	})
+})
@@ -0,0 +1,255 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/secret"
+)
+
+//sendTimeout bounds how long a sink may take to deliver
+const sendTimeout = 10 * time.Second
+
+var client = &http.Client{Timeout: sendTimeout}
+
+//Sink delivers notifications somewhere a person will see them
+type Sink interface {
+	Send(notification Notification) error
+}
+
+//SinkConfig must have exactly one of its kinds set
+type SinkConfig struct {
+	Name    string   `yaml:"name"`
+	Webhook *Webhook `yaml:"webhook,omitempty"`
+	Ntfy    *Ntfy    `yaml:"ntfy,omitempty"`
+	Gotify  *Gotify  `yaml:"gotify,omitempty"`
+	SMTP    *SMTP    `yaml:"smtp,omitempty"`
+}
+
+//NewSink checks conf and returns the sink it sets
+func NewSink(conf SinkConfig) (Sink, error) {
+	sinks := []Sink{}
+	kinds := []string{}
+	if conf.Webhook != nil {
+		sinks, kinds = append(sinks, conf.Webhook), append(kinds, "webhook")
+	}
+	if conf.Ntfy != nil {
+		sinks, kinds = append(sinks, conf.Ntfy), append(kinds, "ntfy")
+	}
+	if conf.Gotify != nil {
+		sinks, kinds = append(sinks, conf.Gotify), append(kinds, "gotify")
+	}
+	if conf.SMTP != nil {
+		sinks, kinds = append(sinks, conf.SMTP), append(kinds, "smtp")
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("set one of webhook, ntfy, gotify or smtp")
+	case 1:
+	default:
+		return nil, fmt.Errorf("sets %s, only one may be set", strings.Join(kinds, ", "))
+	}
+	var err error
+	switch sink := sinks[0].(type) {
+	case *Webhook:
+		err = validURL(sink.URL)
+	case *Ntfy:
+		err = validURL(sink.URL)
+	case *Gotify:
+		err = validURL(sink.URL)
+	case *SMTP:
+		err = sink.validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sinks[0], nil
+}
+
+//Webhook posts every notification as JSON to URL with Headers,
+// which may hold a secret such as an Authorization header
+type Webhook struct {
+	URL     string                   `yaml:"url"`
+	Headers map[string]secret.String `yaml:"headers,omitempty"`
+}
+
+//Send posts notification as JSON
+func (webhook *Webhook) Send(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value.Reveal())
+	}
+	return do(req)
+}
+
+//Ntfy publishes to the ntfy topic at URL, e.g. https://ntfy.sh/my-casa,
+// with Token as the access token when the topic is protected
+type Ntfy struct {
+	URL   string        `yaml:"url"`
+	Token secret.String `yaml:"token,omitempty"`
+}
+
+//Send publishes notification with its title and a priority
+func (ntfy *Ntfy) Send(notification Notification) error {
+	req, err := http.NewRequest(http.MethodPost, ntfy.URL, strings.NewReader(notification.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notification.Title)
+	switch {
+	case notification.Resolved:
+		req.Header.Set("Tags", "white_check_mark")
+	case notification.Urgent:
+		req.Header.Set("Priority", "urgent")
+		req.Header.Set("Tags", "rotating_light")
+	default:
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	if ntfy.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ntfy.Token.Reveal())
+	}
+	return do(req)
+}
+
+//Gotify sends to the Gotify server at URL as the application of Token
+type Gotify struct {
+	URL   string        `yaml:"url"`
+	Token secret.String `yaml:"token"`
+}
+
+//Send creates a Gotify message of notification
+func (gotify *Gotify) Send(notification Notification) error {
+	priority := 5
+	switch {
+	case notification.Resolved:
+		priority = 2
+	case notification.Urgent:
+		priority = 8
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    notification.Title,
+		"message":  notification.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(gotify.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", gotify.Token.Reveal())
+	return do(req)
+}
+
+//do sends req, failing unless it gets a 2xx
+func do(req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+//SMTP mails every notification from From to To through the server at
+// Address (host:port), logging in as Username when it is set. Go only
+// sends the password over TLS, or to a server on this host.
+type SMTP struct {
+	Address  string        `yaml:"address"`
+	Username string        `yaml:"username,omitempty"`
+	Password secret.String `yaml:"password,omitempty"`
+	From     string        `yaml:"from"`
+	To       []string      `yaml:"to"`
+}
+
+func (mail *SMTP) validate() error {
+	if _, _, err := net.SplitHostPort(mail.Address); err != nil {
+		return fmt.Errorf("address %q must be host:port, e.g. smtp.example.com:587", mail.Address)
+	}
+	if mail.From == "" {
+		return fmt.Errorf("from is required")
+	}
+	if len(mail.To) == 0 {
+		return fmt.Errorf("to is required")
+	}
+	return nil
+}
+
+//Send mails notification, upgrading to TLS when the server offers it
+func (mail *SMTP) Send(notification Notification) error {
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", mail.From)
+	fmt.Fprintf(message, "To: %s\r\n", strings.Join(mail.To, ", "))
+	fmt.Fprintf(message, "Subject: %s\r\n", notification.Title)
+	fmt.Fprintf(message, "Date: %s\r\n", notification.Time.Format(time.RFC1123Z))
+	if notification.Urgent && !notification.Resolved {
+		fmt.Fprintf(message, "Importance: high\r\n")
+	}
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", notification.Message)
+	// smtp.SendMail would wait on a stuck server forever
+	conn, err := net.DialTimeout("tcp", mail.Address, sendTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	host, _, _ := net.SplitHostPort(mail.Address)
+	mailer, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer mailer.Close()
+	if ok, _ := mailer.Extension("STARTTLS"); ok {
+		if err := mailer.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if mail.Username != "" {
+		if err := mailer.Auth(smtp.PlainAuth("", mail.Username, mail.Password.Reveal(), host)); err != nil {
+			return err
+		}
+	}
+	if err := mailer.Mail(mail.From); err != nil {
+		return err
+	}
+	for _, to := range mail.To {
+		if err := mailer.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	data, err := mailer.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message.Bytes()); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return mailer.Quit()
+}
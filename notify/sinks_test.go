@@ -0,0 +1,157 @@
+package notify_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/notify"
+	"github.com/oskoss/mi-casa/secret"
+)
+
+var _ = Describe("Sinks", func() {
+	var (
+		notification Notification
+		requests     chan *http.Request
+		bodies       chan string
+		server       *httptest.Server
+		status       int
+	)
+	BeforeEach(func() {
+		notification = Notification{
+			Time:    time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC),
+			Alert:   "cold",
+			Device:  "office",
+			Title:   "cold: office",
+			Message: "office temperature is 49.5°F, below 50",
+			Urgent:  true,
+		}
+		requests = make(chan *http.Request, 1)
+		bodies = make(chan string, 1)
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			requests <- req
+			bodies <- string(body)
+			resp.WriteHeader(status)
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	Describe("creating a sink", func() {
+		It("should need exactly one kind", func() {
+			_, err := NewSink(SinkConfig{Name: "none"})
+			Expect(err).To(MatchError("set one of webhook, ntfy, gotify or smtp"))
+			_, err = NewSink(SinkConfig{Name: "two", Webhook: &Webhook{URL: server.URL}, Ntfy: &Ntfy{URL: server.URL}})
+			Expect(err).To(MatchError("sets webhook, ntfy, only one may be set"))
+		})
+		It("should check the URL", func() {
+			_, err := NewSink(SinkConfig{Name: "phone", Ntfy: &Ntfy{URL: "ntfy.sh/casa"}})
+			Expect(err).To(MatchError(`"ntfy.sh/casa" is not an http or https URL`))
+		})
+	})
+	Describe("a webhook", func() {
+		It("should post the notification with its headers", func() {
+			webhook := &Webhook{URL: server.URL + "/hook", Headers: map[string]secret.String{"Authorization": "Bearer hook-token"}}
+			Expect(webhook.Send(notification)).To(Succeed())
+			req := <-requests
+			Expect(req.URL.Path).To(Equal("/hook"))
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer hook-token"))
+			var sent Notification
+			Expect(json.Unmarshal([]byte(<-bodies), &sent)).To(Succeed())
+			Expect(sent).To(Equal(notification))
+		})
+		It("should fail when the server does", func() {
+			status = http.StatusBadGateway
+			err := (&Webhook{URL: server.URL}).Send(notification)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("502 Bad Gateway"))
+		})
+	})
+	Describe("ntfy", func() {
+		It("should publish the message to the topic", func() {
+			Expect((&Ntfy{URL: server.URL + "/casa", Token: "tk_123"}).Send(notification)).To(Succeed())
+			req := <-requests
+			Expect(req.URL.Path).To(Equal("/casa"))
+			Expect(req.Header.Get("Title")).To(Equal("cold: office"))
+			Expect(req.Header.Get("Priority")).To(Equal("urgent"))
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer tk_123"))
+			Expect(<-bodies).To(Equal(notification.Message))
+		})
+	})
+	Describe("gotify", func() {
+		It("should create a message as the application", func() {
+			Expect((&Gotify{URL: server.URL + "/", Token: "app-token"}).Send(notification)).To(Succeed())
+			req := <-requests
+			Expect(req.URL.Path).To(Equal("/message"))
+			Expect(req.Header.Get("X-Gotify-Key")).To(Equal("app-token"))
+			Expect(<-bodies).To(MatchJSON(`{"title": "cold: office", "message": "office temperature is 49.5°F, below 50", "priority": 8}`))
+		})
+	})
+	Describe("smtp", func() {
+		It("should mail the notification to every recipient", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Close()
+			mailed := make(chan []string, 1)
+			go serveSMTP(listener, mailed)
+			mail := &SMTP{Address: listener.Addr().String(), From: "micasa@example.com", To: []string{"me@example.com", "you@example.com"}}
+			Expect(mail.Send(notification)).To(Succeed())
+			var commands []string
+			Eventually(mailed).Should(Receive(&commands))
+			Expect(commands).To(ContainElement("MAIL FROM:<micasa@example.com>"))
+			Expect(commands).To(ContainElement("RCPT TO:<you@example.com>"))
+			Expect(commands).To(ContainElement("Subject: cold: office"))
+			Expect(commands).To(ContainElement("office temperature is 49.5°F, below 50"))
+		})
+	})
+})
+
+//serveSMTP answers one client as a mail server would, sending
+// every line it was given once the client quits
+func serveSMTP(listener net.Listener, mailed chan<- []string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	lines := []string{}
+	data := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		switch {
+		case data && line == ".":
+			data = false
+			fmt.Fprint(conn, "250 queued\r\n")
+		case data:
+		case strings.HasPrefix(line, "EHLO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case line == "DATA":
+			data = true
+			fmt.Fprint(conn, "354 go ahead\r\n")
+		case line == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			mailed <- lines
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultInterval = 10 * time.Second
+
+//Engine evaluates the configured rules against the devices
+// of the house, it is not safe for concurrent use
+type Engine struct {
+	Config         Config
+	Thermostats    map[string]thermostat.ThermostatDevice
+	Switches       map[string]switcher.SwitchDevice
+	Audit          *audit.Trail
+	states         []ruleState
+	lastEvaluation time.Time
+}
+
+type ruleState struct {
+	triggers  []triggerState
+	lastFired time.Time
+}
+
+type triggerState struct {
+	active      bool
+	activeSince time.Time
+	fired       bool
+	observed    bool
+	lastStatus  string
+}
+
+//NewEngine validates the rules against the devices they reference
+func NewEngine(conf Config, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice) (*Engine, error) {
+	engine := &Engine{
+		Config:      conf,
+		Thermostats: thermostats,
+		Switches:    switches,
+	}
+	if err := engine.validate(); err != nil {
+		return nil, err
+	}
+	engine.states = make([]ruleState, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		engine.states[i].triggers = make([]triggerState, len(rule.Triggers))
+	}
+	return engine, nil
+}
+
+func (engine *Engine) validate() error {
+	names := map[string]bool{}
+	for _, rule := range engine.Config.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule name not set")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule %s is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if len(rule.Triggers) == 0 {
+			return fmt.Errorf("rule %s has no triggers", rule.Name)
+		}
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("rule %s has no actions", rule.Name)
+		}
+		for _, trigger := range rule.Triggers {
+			if err := engine.validateTrigger(trigger); err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		for _, condition := range rule.Conditions {
+			if err := engine.validateCondition(condition); err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		for _, action := range rule.Actions {
+			if err := engine.validateAction(action); err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (engine *Engine) validateTrigger(trigger Trigger) error {
+	set := 0
+	if trigger.Sensor != nil {
+		set++
+		if err := engine.validateSensor(*trigger.Sensor); err != nil {
+			return err
+		}
+	}
+	if trigger.Switch != nil {
+		set++
+		if _, ok := engine.Switches[trigger.Switch.Device]; !ok {
+			return fmt.Errorf("switch %s not found", trigger.Switch.Device)
+		}
+	}
+	if trigger.Time != "" {
+		set++
+		if _, err := parseClock(trigger.Time); err != nil {
+			return err
+		}
+	}
+	if trigger.Sun != nil {
+		set++
+		if trigger.Sun.Event != "sunrise" && trigger.Sun.Event != "sunset" {
+			return fmt.Errorf("sun event %q must be sunrise or sunset", trigger.Sun.Event)
+		}
+		if engine.Config.Location == nil {
+			return fmt.Errorf("sun triggers require the automation location to be set")
+		}
+	}
+	if trigger.Offline != "" {
+		set++
+		_, isThermostat := engine.Thermostats[trigger.Offline]
+		_, isSwitch := engine.Switches[trigger.Offline]
+		if !isThermostat && !isSwitch {
+			return fmt.Errorf("device %s not found", trigger.Offline)
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("trigger must set exactly one of sensor, switch, time, sun or offline")
+	}
+	return nil
+}
+
+func (engine *Engine) validateCondition(condition Condition) error {
+	set := 0
+	if condition.Sensor != nil {
+		set++
+		if err := engine.validateSensor(*condition.Sensor); err != nil {
+			return err
+		}
+	}
+	if condition.Switch != nil {
+		set++
+		if _, ok := engine.Switches[condition.Switch.Device]; !ok {
+			return fmt.Errorf("switch %s not found", condition.Switch.Device)
+		}
+		if condition.Switch.State == "" {
+			return fmt.Errorf("switch condition on %s requires a state", condition.Switch.Device)
+		}
+	}
+	if condition.Time != nil {
+		set++
+		if _, err := condition.Time.holds(time.Now()); err != nil {
+			return err
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("condition must set exactly one of sensor, switch or time")
+	}
+	return nil
+}
+
+func (engine *Engine) validateSensor(sensor SensorThreshold) error {
+	device, ok := engine.Thermostats[sensor.Device]
+	if !ok {
+		return fmt.Errorf("thermostat %s not found", sensor.Device)
+	}
+	switch sensor.metric() {
+	case "temperature":
+	case "humidity":
+		if _, ok := device.(thermostat.HumiditySensor); !ok {
+			return fmt.Errorf("thermostat %s does not report humidity", sensor.Device)
+		}
+	default:
+		return fmt.Errorf("metric %q must be temperature or humidity", sensor.Metric)
+	}
+	if sensor.Above == nil && sensor.Below == nil {
+		return fmt.Errorf("sensor %s requires above and/or below", sensor.Device)
+	}
+	return nil
+}
+
+func (engine *Engine) validateAction(action Action) error {
+	switch {
+	case action.Switch != nil && action.Dyson != nil:
+		return fmt.Errorf("action must set exactly one of switch or dyson")
+	case action.Switch != nil:
+		if _, ok := engine.Switches[action.Switch.Device]; !ok {
+			return fmt.Errorf("switch %s not found", action.Switch.Device)
+		}
+		state := strings.ToLower(action.Switch.State)
+		if state != "on" && state != "off" {
+			return fmt.Errorf("switch action state %q must be on or off", action.Switch.State)
+		}
+	case action.Dyson != nil:
+		device, ok := engine.Thermostats[action.Dyson.Device]
+		if !ok {
+			return fmt.Errorf("thermostat %s not found", action.Dyson.Device)
+		}
+		if _, ok := device.(thermostat.Commander); !ok {
+			return fmt.Errorf("thermostat %s does not accept commands", action.Dyson.Device)
+		}
+		if len(action.Dyson.State) == 0 {
+			return fmt.Errorf("dyson action on %s has no state", action.Dyson.Device)
+		}
+	default:
+		return fmt.Errorf("action must set exactly one of switch or dyson")
+	}
+	return nil
+}
+
+//Run evaluates the rules every Config.Interval until stop is closed
+func (engine *Engine) Run(stop <-chan struct{}) {
+	interval := engine.Config.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	engine.Evaluate(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			engine.Evaluate(now)
+		}
+	}
+}
+
+//Evaluate checks every rule at now, running the actions of
+// those which fire, and returns the names of the fired rules
+func (engine *Engine) Evaluate(now time.Time) (fired []string) {
+	for i, rule := range engine.Config.Rules {
+		state := &engine.states[i]
+		var triggeredBy *Trigger
+		for j := range rule.Triggers {
+			// every trigger is checked so each one keeps its state current
+			if engine.checkTrigger(rule, rule.Triggers[j], &state.triggers[j], now) && triggeredBy == nil {
+				triggeredBy = &rule.Triggers[j]
+			}
+		}
+		if triggeredBy == nil {
+			continue
+		}
+		if !state.lastFired.IsZero() && now.Sub(state.lastFired) < rule.Cooldown {
+			log.WithFields(log.Fields{
+				"rule":      rule.Name,
+				"trigger":   triggeredBy.String(),
+				"lastFired": state.lastFired,
+			}).Debugf("rule triggered during cooldown")
+			continue
+		}
+		if !engine.conditionsHold(rule, now) {
+			continue
+		}
+		state.lastFired = now
+		engine.fire(rule, *triggeredBy, now)
+		fired = append(fired, rule.Name)
+	}
+	engine.lastEvaluation = now
+	return fired
+}
+
+func (engine *Engine) checkTrigger(rule Rule, trigger Trigger, state *triggerState, now time.Time) bool {
+	switch {
+	case trigger.Sensor != nil:
+		value, err := engine.read(*trigger.Sensor)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"rule": rule.Name,
+			}).Debugf("could not read sensor for trigger")
+		}
+		return state.level(err == nil && trigger.Sensor.holds(value), rule.Debounce, now)
+	case trigger.Switch != nil:
+		status, err := engine.Switches[trigger.Switch.Device].UpdateStatus()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"rule": rule.Name,
+			}).Debugf("could not read switch for trigger")
+			return false
+		}
+		firstObservation := !state.observed
+		changed := state.observed && *status != state.lastStatus
+		state.observed = true
+		state.lastStatus = *status
+		if trigger.Switch.State == "" {
+			return changed
+		}
+		active := strings.EqualFold(*status, trigger.Switch.State)
+		if firstObservation {
+			// a switch already in the state at start up has not changed
+			state.active = active
+			state.fired = active
+			state.activeSince = now
+			return false
+		}
+		return state.level(active, rule.Debounce, now)
+	case trigger.Time != "":
+		at, _ := parseClock(trigger.Time)
+		today := midnight(now).Add(at)
+		yesterday := midnight(now).AddDate(0, 0, -1).Add(at)
+		return engine.passed(today, now) || engine.passed(yesterday, now)
+	case trigger.Sun != nil:
+		for _, day := range []time.Time{now, now.AddDate(0, 0, -1)} {
+			sunrise, sunset, ok := SunTimes(day, *engine.Config.Location)
+			if !ok {
+				continue
+			}
+			at := sunset
+			if trigger.Sun.Event == "sunrise" {
+				at = sunrise
+			}
+			if engine.passed(at.Add(trigger.Sun.Offset), now) {
+				return true
+			}
+		}
+		return false
+	case trigger.Offline != "":
+		err := engine.probe(trigger.Offline)
+		return state.level(err != nil, rule.Debounce, now)
+	}
+	return false
+}
+
+//level fires once per activation after being active for debounce
+func (state *triggerState) level(active bool, debounce time.Duration, now time.Time) bool {
+	if !active {
+		state.active = false
+		state.fired = false
+		return false
+	}
+	if !state.active {
+		state.active = true
+		state.activeSince = now
+	}
+	if state.fired || now.Sub(state.activeSince) < debounce {
+		return false
+	}
+	state.fired = true
+	return true
+}
+
+//passed reports whether at falls after the previous evaluation and no later than now
+func (engine *Engine) passed(at time.Time, now time.Time) bool {
+	if engine.lastEvaluation.IsZero() {
+		return false
+	}
+	return at.After(engine.lastEvaluation) && !at.After(now)
+}
+
+func (engine *Engine) conditionsHold(rule Rule, now time.Time) bool {
+	for _, condition := range rule.Conditions {
+		holds := false
+		switch {
+		case condition.Sensor != nil:
+			value, err := engine.read(*condition.Sensor)
+			holds = err == nil && condition.Sensor.holds(value)
+		case condition.Switch != nil:
+			status, err := engine.Switches[condition.Switch.Device].UpdateStatus()
+			holds = err == nil && strings.EqualFold(*status, condition.Switch.State)
+		case condition.Time != nil:
+			holds, _ = condition.Time.holds(now)
+		}
+		if !holds {
+			log.WithFields(log.Fields{
+				"rule":      rule.Name,
+				"condition": fmt.Sprintf("%+v", condition),
+			}).Debugf("rule triggered but condition does not hold")
+			return false
+		}
+	}
+	return true
+}
+
+func (engine *Engine) read(sensor SensorThreshold) (float64, error) {
+	device := engine.Thermostats[sensor.Device]
+	var value *float64
+	var err error
+	if sensor.metric() == "humidity" {
+		value, err = device.(thermostat.HumiditySensor).CurrentHumidity()
+	} else {
+		value, err = device.CurrentTemp()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return *value, nil
+}
+
+func (engine *Engine) probe(name string) error {
+	if device, ok := engine.Thermostats[name]; ok {
+		_, err := device.CurrentTemp()
+		return err
+	}
+	_, err := engine.Switches[name].UpdateStatus()
+	return err
+}
+
+func (engine *Engine) fire(rule Rule, trigger Trigger, now time.Time) {
+	dryRun := engine.Config.DryRun || rule.DryRun
+	for _, action := range rule.Actions {
+		fields := log.Fields{
+			"rule":    rule.Name,
+			"trigger": trigger.String(),
+			"action":  action.String(),
+		}
+		if dryRun {
+			log.WithFields(fields).Infof("dry run: rule would have fired")
+			continue
+		}
+		err := engine.run(action)
+		engine.audit(rule, trigger, action, err, now)
+		if err != nil {
+			fields["err"] = err
+			log.WithFields(fields).Error("rule action failed")
+			continue
+		}
+		log.WithFields(fields).Infof("rule fired")
+	}
+}
+
+//audit records an action the rule ran and how it went
+func (engine *Engine) audit(rule Rule, trigger Trigger, action Action, err error, now time.Time) {
+	var entry audit.Entry
+	if action.Dyson != nil {
+		entry = audit.Command(audit.SourceRule, rule.Name, "dyson", action.Dyson.Device, fmt.Sprintf("%v", action.Dyson.State), err, engine.readDyson(action.Dyson))
+	} else {
+		entry = audit.Command(audit.SourceRule, rule.Name, "switch", action.Switch.Device, strings.ToUpper(action.Switch.State), err, switcher.ReadBack(engine.Switches[action.Switch.Device]))
+	}
+	entry.Time = now
+	entry.Reason = trigger.String()
+	engine.Audit.Record(entry)
+}
+
+//readDyson returns a read of the settings of the Dyson an action
+// changed, only those the action set
+func (engine *Engine) readDyson(action *DysonAction) func() (string, error) {
+	return func() (string, error) {
+		reporter, ok := engine.Thermostats[action.Device].(thermostat.StateReporter)
+		if !ok {
+			return "", fmt.Errorf("thermostat %s cannot report its state", action.Device)
+		}
+		state, err := reporter.CurrentState()
+		if err != nil {
+			return "", err
+		}
+		changed := map[string]string{}
+		for key := range action.State {
+			changed[key] = state[key]
+		}
+		return fmt.Sprintf("%v", changed), nil
+	}
+}
+
+func (engine *Engine) run(action Action) error {
+	if action.Dyson != nil {
+		return engine.Thermostats[action.Dyson.Device].(thermostat.Commander).SendCommand(action.Dyson.State)
+	}
+	device := engine.Switches[action.Switch.Device]
+	if strings.EqualFold(action.Switch.State, "on") {
+		return device.TurnOn()
+	}
+	return device.TurnOff()
+}
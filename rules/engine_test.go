@@ -0,0 +1,285 @@
+package rules_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/oskoss/mi-casa/audit"
+	. "github.com/oskoss/mi-casa/rules"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Engine", func() {
+	var (
+		office      *thermostat.MockThermostat
+		fan         *switcher.MockSwitch
+		lamp        *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		conf        Config
+		start       time.Time
+	)
+	above := func(value float64) *float64 { return &value }
+	BeforeEach(func() {
+		office = &thermostat.MockThermostat{Temperature: 70}
+		fan = &switcher.MockSwitch{Status: "OFF"}
+		lamp = &switcher.MockSwitch{Status: "OFF"}
+		thermostats = map[string]thermostat.ThermostatDevice{"office": office}
+		switches = map[string]switcher.SwitchDevice{"fan": fan, "lamp": lamp}
+		start = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+		conf = Config{
+			Rules: []Rule{
+				{
+					Name: "fan-when-hot",
+					Triggers: []Trigger{
+						{Sensor: &SensorThreshold{Device: "office", Above: above(78)}},
+					},
+					Actions: []Action{
+						{Switch: &SwitchAction{Device: "fan", State: "on"}},
+					},
+				},
+			},
+		}
+	})
+	Describe("creating an engine", func() {
+		Context("when a rule references an unknown device", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Actions[0].Switch.Device = "doesnotexist"
+			})
+			It("should return an error", func() {
+				_, err := NewEngine(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+		Context("when a trigger sets more than one kind", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Triggers[0].Time = "07:00"
+			})
+			It("should return an error", func() {
+				_, err := NewEngine(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+		Context("when a sun trigger has no location", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Triggers[0] = Trigger{Sun: &SunEvent{Event: "sunset"}}
+			})
+			It("should return an error", func() {
+				_, err := NewEngine(conf, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+	Describe("evaluating a sensor threshold", func() {
+		var engine *Engine
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should fire once when the threshold is crossed", func() {
+			Expect(engine.Evaluate(start)).Should(BeEmpty())
+			office.Temperature = 80
+			Expect(engine.Evaluate(start.Add(time.Minute))).Should(ConsistOf("fan-when-hot"))
+			Expect(fan.Status).Should(Equal("ON"))
+			fan.Status = "OFF"
+			Expect(engine.Evaluate(start.Add(2 * time.Minute))).Should(BeEmpty())
+			Expect(fan.Status).Should(Equal("OFF"))
+		})
+		It("should fire again after the threshold is crossed a second time", func() {
+			office.Temperature = 80
+			Expect(engine.Evaluate(start)).Should(HaveLen(1))
+			office.Temperature = 75
+			Expect(engine.Evaluate(start.Add(time.Minute))).Should(BeEmpty())
+			office.Temperature = 80
+			Expect(engine.Evaluate(start.Add(2 * time.Minute))).Should(HaveLen(1))
+		})
+		Context("with a debounce", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Debounce = 5 * time.Minute
+			})
+			It("should only fire once the threshold has held for the debounce", func() {
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(BeEmpty())
+				Expect(engine.Evaluate(start.Add(4 * time.Minute))).Should(BeEmpty())
+				Expect(engine.Evaluate(start.Add(5 * time.Minute))).Should(HaveLen(1))
+			})
+			It("should restart the debounce when the threshold stops holding", func() {
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(BeEmpty())
+				office.Temperature = 75
+				Expect(engine.Evaluate(start.Add(3 * time.Minute))).Should(BeEmpty())
+				office.Temperature = 80
+				Expect(engine.Evaluate(start.Add(6 * time.Minute))).Should(BeEmpty())
+				Expect(engine.Evaluate(start.Add(11 * time.Minute))).Should(HaveLen(1))
+			})
+		})
+		Context("with a cooldown", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Cooldown = time.Hour
+			})
+			It("should not fire again within the cooldown", func() {
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(HaveLen(1))
+				office.Temperature = 75
+				engine.Evaluate(start.Add(time.Minute))
+				office.Temperature = 80
+				Expect(engine.Evaluate(start.Add(2 * time.Minute))).Should(BeEmpty())
+			})
+		})
+		Context("with a time window condition", func() {
+			BeforeEach(func() {
+				conf.Rules[0].Conditions = []Condition{
+					{Time: &TimeWindow{After: "22:00", Before: "06:00"}},
+				}
+			})
+			It("should only fire within the window", func() {
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(BeEmpty())
+				office.Temperature = 70
+				engine.Evaluate(start.Add(time.Minute))
+				office.Temperature = 80
+				Expect(engine.Evaluate(start.Add(11 * time.Hour))).Should(HaveLen(1))
+			})
+		})
+		Context("with an audit log", func() {
+			var directory string
+			BeforeEach(func() {
+				var err error
+				directory, err = ioutil.TempDir("", "rules")
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+			AfterEach(func() {
+				os.RemoveAll(directory)
+			})
+			It("should record each action with the rule and its trigger", func() {
+				engine.Audit = audit.Open(audit.Config{File: filepath.Join(directory, "audit.jsonl")})
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(HaveLen(1))
+				entries, err := engine.Audit.Query(audit.Query{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(entries).To(Equal([]audit.Entry{{
+					Time:      start,
+					Source:    audit.SourceRule,
+					Actor:     "fan-when-hot",
+					Action:    "switch",
+					Target:    "fan",
+					Requested: "ON",
+					Result:    "ON",
+					Reason:    "sensor office temperature above 78",
+				}}))
+			})
+		})
+		Context("in dry run mode", func() {
+			BeforeEach(func() {
+				conf.DryRun = true
+			})
+			It("should report the rule fired without touching the switch", func() {
+				office.Temperature = 80
+				Expect(engine.Evaluate(start)).Should(HaveLen(1))
+				Expect(fan.Status).Should(Equal("OFF"))
+			})
+		})
+	})
+	Describe("evaluating a switch state change", func() {
+		var engine *Engine
+		BeforeEach(func() {
+			conf.Rules[0].Triggers = []Trigger{{Switch: &SwitchState{Device: "lamp", State: "ON"}}}
+		})
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should fire when the switch changes into the state", func() {
+			Expect(engine.Evaluate(start)).Should(BeEmpty())
+			lamp.Status = "ON"
+			Expect(engine.Evaluate(start.Add(time.Minute))).Should(HaveLen(1))
+			Expect(fan.Status).Should(Equal("ON"))
+		})
+		It("should not fire when the switch was already in the state at start up", func() {
+			lamp.Status = "ON"
+			Expect(engine.Evaluate(start)).Should(BeEmpty())
+			Expect(engine.Evaluate(start.Add(time.Minute))).Should(BeEmpty())
+		})
+	})
+	Describe("evaluating a time of day", func() {
+		var engine *Engine
+		BeforeEach(func() {
+			conf.Rules[0].Triggers = []Trigger{{Time: "12:30"}}
+		})
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should fire when the time is passed", func() {
+			Expect(engine.Evaluate(start)).Should(BeEmpty())
+			Expect(engine.Evaluate(start.Add(29 * time.Minute))).Should(BeEmpty())
+			Expect(engine.Evaluate(start.Add(31 * time.Minute))).Should(HaveLen(1))
+			Expect(engine.Evaluate(start.Add(32 * time.Minute))).Should(BeEmpty())
+		})
+	})
+	Describe("evaluating sunset", func() {
+		var engine *Engine
+		BeforeEach(func() {
+			conf.Location = &Location{Latitude: 39.7392, Longitude: -104.9903}
+			conf.Rules[0].Triggers = []Trigger{{Sun: &SunEvent{Event: "sunset", Offset: -30 * time.Minute}}}
+		})
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should fire once around the offset sunset", func() {
+			_, sunset, ok := SunTimes(start, *conf.Location)
+			Expect(ok).Should(BeTrue())
+			at := sunset.Add(-30 * time.Minute)
+			Expect(engine.Evaluate(at.Add(-time.Minute))).Should(BeEmpty())
+			Expect(engine.Evaluate(at.Add(time.Minute))).Should(HaveLen(1))
+			Expect(engine.Evaluate(at.Add(2 * time.Minute))).Should(BeEmpty())
+		})
+	})
+	Describe("evaluating a device going offline", func() {
+		var engine *Engine
+		BeforeEach(func() {
+			conf.Rules[0].Triggers = []Trigger{{Offline: "lamp"}}
+			conf.Rules[0].Debounce = 10 * time.Minute
+		})
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should fire once the device has been unreachable for the debounce", func() {
+			lamp.Err = errors.New("unreachable")
+			Expect(engine.Evaluate(start)).Should(BeEmpty())
+			Expect(engine.Evaluate(start.Add(10 * time.Minute))).Should(HaveLen(1))
+		})
+	})
+	Describe("running a dyson action", func() {
+		var engine *Engine
+		BeforeEach(func() {
+			conf.Rules[0].Actions = []Action{
+				{Dyson: &DysonAction{Device: "office", State: map[string]string{"fmod": "FAN"}}},
+			}
+		})
+		JustBeforeEach(func() {
+			var err error
+			engine, err = NewEngine(conf, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should send the state to the device", func() {
+			office.Temperature = 80
+			Expect(engine.Evaluate(start)).Should(HaveLen(1))
+			Expect(office.Commands).Should(ConsistOf(map[string]string{"fmod": "FAN"}))
+		})
+	})
+})
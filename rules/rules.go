@@ -0,0 +1,188 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//Config is the automation section of the mi-casa YAML config
+type Config struct {
+	DryRun   bool          `yaml:"dryRun"`
+	Interval time.Duration `yaml:"interval"`
+	Location *Location     `yaml:"location,omitempty"`
+	Rules    []Rule        `yaml:"rules"`
+}
+
+//Location is where the house is, needed for sunrise/sunset triggers
+type Location struct {
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+}
+
+//Rule fires its Actions when any of its Triggers fire
+// and all of its Conditions hold at that moment.
+// Debounce is how long a trigger must be continuously active
+// before it fires and Cooldown is the minimum time between firings.
+type Rule struct {
+	Name       string        `yaml:"name"`
+	Triggers   []Trigger     `yaml:"triggers"`
+	Conditions []Condition   `yaml:"conditions,omitempty"`
+	Actions    []Action      `yaml:"actions"`
+	Debounce   time.Duration `yaml:"debounce,omitempty"`
+	Cooldown   time.Duration `yaml:"cooldown,omitempty"`
+	DryRun     bool          `yaml:"dryRun,omitempty"`
+}
+
+//Trigger must have exactly one of its fields set
+type Trigger struct {
+	Sensor  *SensorThreshold `yaml:"sensor,omitempty"`
+	Switch  *SwitchState     `yaml:"switch,omitempty"`
+	Time    string           `yaml:"time,omitempty"`
+	Sun     *SunEvent        `yaml:"sun,omitempty"`
+	Offline string           `yaml:"offline,omitempty"`
+}
+
+//Condition must have exactly one of its fields set
+type Condition struct {
+	Sensor *SensorThreshold `yaml:"sensor,omitempty"`
+	Switch *SwitchState     `yaml:"switch,omitempty"`
+	Time   *TimeWindow      `yaml:"time,omitempty"`
+}
+
+//Action must have exactly one of its fields set
+type Action struct {
+	Switch *SwitchAction `yaml:"switch,omitempty"`
+	Dyson  *DysonAction  `yaml:"dyson,omitempty"`
+}
+
+//SensorThreshold is active while the Metric ("temperature" or "humidity")
+// of Device is above Above and/or below Below
+type SensorThreshold struct {
+	Device string   `yaml:"device"`
+	Metric string   `yaml:"metric,omitempty"`
+	Above  *float64 `yaml:"above,omitempty"`
+	Below  *float64 `yaml:"below,omitempty"`
+}
+
+//SwitchState is active while Device reports State, as a trigger
+// an empty State fires on any change of the switch
+type SwitchState struct {
+	Device string `yaml:"device"`
+	State  string `yaml:"state,omitempty"`
+}
+
+//SunEvent fires at "sunrise" or "sunset" shifted by Offset
+type SunEvent struct {
+	Event  string        `yaml:"event"`
+	Offset time.Duration `yaml:"offset,omitempty"`
+}
+
+//TimeWindow holds between After and Before ("15:04"),
+// a window wrapping midnight such as 22:00-06:00 is allowed
+type TimeWindow struct {
+	After  string `yaml:"after,omitempty"`
+	Before string `yaml:"before,omitempty"`
+}
+
+//SwitchAction turns Device "on" or "off"
+type SwitchAction struct {
+	Device string `yaml:"device"`
+	State  string `yaml:"state"`
+}
+
+//DysonAction sends raw product State to a Dyson device
+type DysonAction struct {
+	Device string            `yaml:"device"`
+	State  map[string]string `yaml:"state"`
+}
+
+func (t Trigger) String() string {
+	switch {
+	case t.Sensor != nil:
+		return "sensor " + t.Sensor.String()
+	case t.Switch != nil:
+		return fmt.Sprintf("switch %s %s", t.Switch.Device, t.Switch.State)
+	case t.Time != "":
+		return "time " + t.Time
+	case t.Sun != nil:
+		return fmt.Sprintf("%s %+v", t.Sun.Event, t.Sun.Offset)
+	case t.Offline != "":
+		return "offline " + t.Offline
+	}
+	return "empty trigger"
+}
+
+func (s SensorThreshold) String() string {
+	description := fmt.Sprintf("%s %s", s.Device, s.metric())
+	if s.Above != nil {
+		description += fmt.Sprintf(" above %v", *s.Above)
+	}
+	if s.Below != nil {
+		description += fmt.Sprintf(" below %v", *s.Below)
+	}
+	return description
+}
+
+func (s SensorThreshold) metric() string {
+	if s.Metric == "" {
+		return "temperature"
+	}
+	return s.Metric
+}
+
+func (s SensorThreshold) holds(value float64) bool {
+	if s.Above != nil && value <= *s.Above {
+		return false
+	}
+	if s.Below != nil && value >= *s.Below {
+		return false
+	}
+	return true
+}
+
+func (a Action) String() string {
+	switch {
+	case a.Switch != nil:
+		return fmt.Sprintf("turn %s %s", a.Switch.Device, strings.ToLower(a.Switch.State))
+	case a.Dyson != nil:
+		return fmt.Sprintf("send %s %v", a.Dyson.Device, a.Dyson.State)
+	}
+	return "empty action"
+}
+
+//parseClock parses "15:04" into an offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time %q must be formatted as HH:MM", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func (w TimeWindow) holds(now time.Time) (bool, error) {
+	sinceMidnight := now.Sub(midnight(now))
+	after := time.Duration(0)
+	before := 24 * time.Hour
+	var err error
+	if w.After != "" {
+		after, err = parseClock(w.After)
+		if err != nil {
+			return false, err
+		}
+	}
+	if w.Before != "" {
+		before, err = parseClock(w.Before)
+		if err != nil {
+			return false, err
+		}
+	}
+	if after <= before {
+		return sinceMidnight >= after && sinceMidnight < before, nil
+	}
+	return sinceMidnight >= after || sinceMidnight < before, nil
+}
@@ -0,0 +1,47 @@
+package rules
+
+import (
+	"math"
+	"time"
+)
+
+const julianUnixEpoch = 2440587.5
+const julian2000 = 2451545.0
+
+//SunTimes returns sunrise and sunset for the calendar day of date
+// at location using the sunrise equation, results are in date's time zone.
+// ok is false during polar day or night when the sun does not rise or set.
+func SunTimes(date time.Time, location Location) (sunrise time.Time, sunset time.Time, ok bool) {
+	noonUTC := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	julianDate := float64(noonUTC.Unix())/86400 + julianUnixEpoch
+	day := math.Round(julianDate - julian2000)
+
+	meanSolarTime := day - location.Longitude/360
+	meanAnomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	anomalyRad := radians(meanAnomaly)
+	center := 1.9148*math.Sin(anomalyRad) + 0.0200*math.Sin(2*anomalyRad) + 0.0003*math.Sin(3*anomalyRad)
+	eclipticLongitude := radians(math.Mod(meanAnomaly+center+180+102.9372, 360))
+	transit := julian2000 + meanSolarTime + 0.0053*math.Sin(anomalyRad) - 0.0069*math.Sin(2*eclipticLongitude)
+
+	sinDeclination := math.Sin(eclipticLongitude) * math.Sin(radians(23.44))
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	latitude := radians(location.Latitude)
+	cosHourAngle := (math.Sin(radians(-0.833)) - math.Sin(latitude)*sinDeclination) / (math.Cos(latitude) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	sunrise = fromJulian(transit - hourAngle/360).In(date.Location())
+	sunset = fromJulian(transit + hourAngle/360).In(date.Location())
+	return sunrise, sunset, true
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func fromJulian(julianDate float64) time.Time {
+	seconds := (julianDate - julianUnixEpoch) * 86400
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
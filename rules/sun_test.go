@@ -0,0 +1,33 @@
+package rules_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/rules"
+)
+
+var _ = Describe("Sun", func() {
+	Describe("calculating sunrise and sunset", func() {
+		Context("in New York on the summer solstice", func() {
+			It("should match the published times within a few minutes", func() {
+				newYork, err := time.LoadLocation("America/New_York")
+				Expect(err).ShouldNot(HaveOccurred())
+				day := time.Date(2021, time.June, 21, 0, 0, 0, 0, newYork)
+				sunrise, sunset, ok := SunTimes(day, Location{Latitude: 40.7128, Longitude: -74.0060})
+				Expect(ok).Should(BeTrue())
+				Expect(sunrise).Should(BeTemporally("~", time.Date(2021, time.June, 21, 5, 25, 0, 0, newYork), 3*time.Minute))
+				Expect(sunset).Should(BeTemporally("~", time.Date(2021, time.June, 21, 20, 31, 0, 0, newYork), 3*time.Minute))
+			})
+		})
+		Context("north of the arctic circle in midsummer", func() {
+			It("should report the sun never sets", func() {
+				day := time.Date(2021, time.June, 21, 0, 0, 0, 0, time.UTC)
+				_, _, ok := SunTimes(day, Location{Latitude: 78.22, Longitude: 15.65})
+				Expect(ok).Should(BeFalse())
+			})
+		})
+	})
+})
@@ -0,0 +1,166 @@
+package scene
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+//deviceChange is one device of a scene being applied
+type deviceChange struct {
+	device   string
+	isSwitch bool
+	want     map[string]string
+	previous map[string]string
+	result   Result
+}
+
+//Apply sets every device of the scene as close to atomically as the
+// hardware allows: every device is read first and nothing is changed if
+// any are unreachable, the changes are then sent concurrently and if any
+// fail the devices already changed are rolled back to their previous state
+func (manager *Manager) Apply(name string) ([]Result, error) {
+	scene, ok := manager.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("scene %s not found", name)
+	}
+	changes := []*deviceChange{}
+	for device, state := range scene.Switches {
+		changes = append(changes, &deviceChange{
+			device:   device,
+			isSwitch: true,
+			want:     map[string]string{"POWER": strings.ToUpper(state)},
+		})
+	}
+	for device, state := range scene.Thermostats {
+		changes = append(changes, &deviceChange{device: device, want: state})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].device < changes[j].device })
+
+	unreachable := 0
+	for _, change := range changes {
+		previous, err := manager.read(change)
+		if err != nil {
+			unreachable++
+			change.result = Result{Device: change.device, Status: StatusFailed, Error: err.Error()}
+			continue
+		}
+		change.previous = previous
+	}
+	if unreachable > 0 {
+		for _, change := range changes {
+			if change.result.Status == "" {
+				change.result = Result{Device: change.device, Status: StatusSkipped}
+			}
+		}
+		return results(changes), fmt.Errorf("scene %s not applied, %d device(s) unreachable", name, unreachable)
+	}
+
+	var wait sync.WaitGroup
+	for _, change := range changes {
+		if change.previous != nil && contains(change.previous, change.want) {
+			change.result = Result{Device: change.device, Status: StatusUnchanged}
+			continue
+		}
+		wait.Add(1)
+		go func(change *deviceChange) {
+			defer wait.Done()
+			change.result = Result{Device: change.device, Status: StatusApplied}
+			if err := manager.write(change, change.want); err != nil {
+				change.result = Result{Device: change.device, Status: StatusFailed, Error: err.Error()}
+			}
+		}(change)
+	}
+	wait.Wait()
+
+	failed := 0
+	for _, change := range changes {
+		if change.result.Status == StatusFailed {
+			failed++
+		}
+	}
+	if failed == 0 {
+		log.WithFields(log.Fields{
+			"scene": name,
+		}).Printf("scene applied")
+		return results(changes), nil
+	}
+	for _, change := range changes {
+		if change.result.Status != StatusApplied {
+			continue
+		}
+		if change.previous == nil {
+			change.result.Error = "previous state unknown, not rolled back"
+			continue
+		}
+		if err := manager.write(change, change.previous); err != nil {
+			change.result.Error = fmt.Sprintf("rolling back: %v", err)
+			continue
+		}
+		change.result.Status = StatusRolledBack
+	}
+	log.WithFields(log.Fields{
+		"scene":  name,
+		"failed": failed,
+	}).Error("scene failed to apply and was rolled back")
+	return results(changes), fmt.Errorf("scene %s not applied, %d device(s) failed", name, failed)
+}
+
+func (manager *Manager) read(change *deviceChange) (map[string]string, error) {
+	if change.isSwitch {
+		status, err := manager.Switches[change.device].UpdateStatus()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"POWER": strings.ToUpper(*status)}, nil
+	}
+	device := manager.Thermostats[change.device]
+	reporter, ok := device.(thermostat.StateReporter)
+	if !ok {
+		// still check the device is reachable even though its state is unknown
+		_, err := device.CurrentTemp()
+		return nil, err
+	}
+	state, err := reporter.CurrentState()
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]string{}
+	for key := range change.want {
+		if value, ok := state[key]; ok {
+			previous[key] = value
+		}
+	}
+	return previous, nil
+}
+
+func (manager *Manager) write(change *deviceChange, state map[string]string) error {
+	if change.isSwitch {
+		if state["POWER"] == "ON" {
+			return manager.Switches[change.device].TurnOn()
+		}
+		return manager.Switches[change.device].TurnOff()
+	}
+	return manager.Thermostats[change.device].(thermostat.Commander).SendCommand(state)
+}
+
+func contains(current map[string]string, want map[string]string) bool {
+	for key, value := range want {
+		if current[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func results(changes []*deviceChange) []Result {
+	applied := make([]Result, len(changes))
+	for i, change := range changes {
+		applied[i] = change.result
+	}
+	return applied
+}
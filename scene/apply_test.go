@@ -0,0 +1,112 @@
+package scene_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+//failingSwitch reads fine but fails to change
+type failingSwitch struct {
+	switcher.MockSwitch
+}
+
+func (device *failingSwitch) TurnOn() error {
+	return errors.New("relay stuck")
+}
+
+func (device *failingSwitch) TurnOff() error {
+	return errors.New("relay stuck")
+}
+
+var _ = Describe("Apply", func() {
+	var (
+		dyson   *thermostat.MockThermostat
+		lamp    *switcher.MockSwitch
+		tv      *switcher.MockSwitch
+		heater  *failingSwitch
+		manager *Manager
+		scenes  []Scene
+	)
+	BeforeEach(func() {
+		dyson = &thermostat.MockThermostat{State: map[string]string{"fmod": "HEAT", "hmax": "2950"}}
+		lamp = &switcher.MockSwitch{Status: "ON"}
+		tv = &switcher.MockSwitch{Status: "OFF"}
+		heater = &failingSwitch{switcher.MockSwitch{Status: "OFF"}}
+		scenes = []Scene{
+			{
+				Name:        "movie-night",
+				Switches:    map[string]string{"lamp": "OFF", "tv": "ON"},
+				Thermostats: map[string]map[string]string{"dyson": {"fmod": "FAN"}},
+			},
+			{
+				Name:     "warm-up",
+				Switches: map[string]string{"lamp": "OFF", "heater": "ON"},
+			},
+		}
+	})
+	JustBeforeEach(func() {
+		var err error
+		manager, err = NewManager(scenes, "", map[string]thermostat.ThermostatDevice{"dyson": dyson}, map[string]switcher.SwitchDevice{
+			"lamp":   lamp,
+			"tv":     tv,
+			"heater": heater,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	Context("when every device is reachable", func() {
+		It("should set every device and report per device results", func() {
+			results, err := manager.Apply("movie-night")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(results).Should(Equal([]Result{
+				{Device: "dyson", Status: StatusApplied},
+				{Device: "lamp", Status: StatusApplied},
+				{Device: "tv", Status: StatusApplied},
+			}))
+			Expect(lamp.Status).Should(Equal("OFF"))
+			Expect(tv.Status).Should(Equal("ON"))
+			Expect(dyson.State["fmod"]).Should(Equal("FAN"))
+		})
+		It("should leave devices already in the scene alone", func() {
+			lamp.Status = "OFF"
+			results, err := manager.Apply("movie-night")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(results).Should(ContainElement(Result{Device: "lamp", Status: StatusUnchanged}))
+		})
+	})
+	Context("when a device is unreachable", func() {
+		BeforeEach(func() {
+			tv.Err = errors.New("unreachable")
+		})
+		It("should not change anything", func() {
+			results, err := manager.Apply("movie-night")
+			Expect(err).Should(HaveOccurred())
+			Expect(lamp.Status).Should(Equal("ON"))
+			Expect(dyson.Commands).Should(BeEmpty())
+			Expect(results).Should(ContainElement(Result{Device: "lamp", Status: StatusSkipped}))
+			Expect(results).Should(ContainElement(Result{Device: "tv", Status: StatusFailed, Error: "unreachable"}))
+		})
+	})
+	Context("when a device fails to change", func() {
+		It("should roll back the devices which changed", func() {
+			results, err := manager.Apply("warm-up")
+			Expect(err).Should(HaveOccurred())
+			Expect(lamp.Status).Should(Equal("ON"))
+			Expect(results).Should(Equal([]Result{
+				{Device: "heater", Status: StatusFailed, Error: "relay stuck"},
+				{Device: "lamp", Status: StatusRolledBack},
+			}))
+		})
+	})
+	Context("when the scene does not exist", func() {
+		It("should return an error", func() {
+			_, err := manager.Apply("doesnotexist")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,255 @@
+package scene
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+//Scene is a named snapshot of several devices, Switches holds
+// "ON"/"OFF" per switch and Thermostats the raw state per thermostat
+type Scene struct {
+	Name        string                       `yaml:"name" json:"name"`
+	Switches    map[string]string            `yaml:"switches,omitempty" json:"switches,omitempty"`
+	Thermostats map[string]map[string]string `yaml:"thermostats,omitempty" json:"thermostats,omitempty"`
+}
+
+//Result is the outcome of applying a scene to a single device
+type Result struct {
+	Device string `json:"device"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	StatusApplied    = "applied"
+	StatusUnchanged  = "unchanged"
+	StatusFailed     = "failed"
+	StatusRolledBack = "rolled back"
+	StatusSkipped    = "skipped"
+)
+
+//Manager holds the scenes from config alongside those captured at
+// runtime, captured scenes are persisted to StoreLocation
+type Manager struct {
+	Thermostats   map[string]thermostat.ThermostatDevice
+	Switches      map[string]switcher.SwitchDevice
+	StoreLocation string
+	configured    map[string]Scene
+	captured      map[string]Scene
+	lock          sync.Mutex
+}
+
+//NewManager validates the configured scenes and loads
+// any previously captured scenes from storeLocation
+func NewManager(configured []Scene, storeLocation string, thermostats map[string]thermostat.ThermostatDevice, switches map[string]switcher.SwitchDevice) (*Manager, error) {
+	manager := &Manager{
+		Thermostats:   thermostats,
+		Switches:      switches,
+		StoreLocation: storeLocation,
+		configured:    map[string]Scene{},
+		captured:      map[string]Scene{},
+	}
+	for _, scene := range configured {
+		if err := manager.validate(scene); err != nil {
+			return nil, err
+		}
+		if _, ok := manager.configured[scene.Name]; ok {
+			return nil, fmt.Errorf("scene %s is defined more than once", scene.Name)
+		}
+		manager.configured[scene.Name] = scene
+	}
+	if storeLocation == "" {
+		return manager, nil
+	}
+	content, err := ioutil.ReadFile(storeLocation)
+	if os.IsNotExist(err) {
+		return manager, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []Scene
+	if err := yaml.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("reading scenes from %s: %v", storeLocation, err)
+	}
+	for _, scene := range stored {
+		if _, ok := manager.configured[scene.Name]; ok {
+			log.WithFields(log.Fields{
+				"scene": scene.Name,
+			}).Warn("ignoring stored scene which is also defined in config")
+			continue
+		}
+		if err := manager.validate(scene); err != nil {
+			log.WithFields(log.Fields{
+				"err":   err,
+				"scene": scene.Name,
+			}).Warn("ignoring stored scene")
+			continue
+		}
+		manager.captured[scene.Name] = scene
+	}
+	return manager, nil
+}
+
+func (manager *Manager) validate(scene Scene) error {
+	if scene.Name == "" {
+		return fmt.Errorf("scene name not set")
+	}
+	if len(scene.Switches)+len(scene.Thermostats) == 0 {
+		return fmt.Errorf("scene %s has no devices", scene.Name)
+	}
+	for name, state := range scene.Switches {
+		if _, ok := manager.Switches[name]; !ok {
+			return fmt.Errorf("scene %s: switch %s not found", scene.Name, name)
+		}
+		if !strings.EqualFold(state, "ON") && !strings.EqualFold(state, "OFF") {
+			return fmt.Errorf("scene %s: switch %s state %q must be ON or OFF", scene.Name, name, state)
+		}
+	}
+	for name := range scene.Thermostats {
+		device, ok := manager.Thermostats[name]
+		if !ok {
+			return fmt.Errorf("scene %s: thermostat %s not found", scene.Name, name)
+		}
+		if _, ok := device.(thermostat.Commander); !ok {
+			return fmt.Errorf("scene %s: thermostat %s does not accept commands", scene.Name, name)
+		}
+	}
+	return nil
+}
+
+//List returns every scene sorted by name
+func (manager *Manager) List() []Scene {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	scenes := []Scene{}
+	for _, scene := range manager.configured {
+		scenes = append(scenes, scene)
+	}
+	for _, scene := range manager.captured {
+		scenes = append(scenes, scene)
+	}
+	sort.Slice(scenes, func(i, j int) bool { return scenes[i].Name < scenes[j].Name })
+	return scenes
+}
+
+//Get returns the scene called name
+func (manager *Manager) Get(name string) (Scene, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.get(name)
+}
+
+func (manager *Manager) get(name string) (Scene, bool) {
+	if scene, ok := manager.configured[name]; ok {
+		return scene, true
+	}
+	scene, ok := manager.captured[name]
+	return scene, ok
+}
+
+//Capture snapshots the current state of devices and stores it as name,
+// replacing any previously captured scene of the same name
+func (manager *Manager) Capture(name string, devices []string) (Scene, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if _, ok := manager.configured[name]; ok {
+		return Scene{}, fmt.Errorf("scene %s is defined in config and cannot be replaced", name)
+	}
+	scene := Scene{Name: name}
+	for _, device := range devices {
+		if mySwitch, ok := manager.Switches[device]; ok {
+			status, err := mySwitch.UpdateStatus()
+			if err != nil {
+				return Scene{}, fmt.Errorf("capturing switch %s: %v", device, err)
+			}
+			if scene.Switches == nil {
+				scene.Switches = map[string]string{}
+			}
+			scene.Switches[device] = strings.ToUpper(*status)
+			continue
+		}
+		myThermostat, ok := manager.Thermostats[device]
+		if !ok {
+			return Scene{}, fmt.Errorf("device %s not found", device)
+		}
+		reporter, ok := myThermostat.(thermostat.StateReporter)
+		if !ok {
+			return Scene{}, fmt.Errorf("thermostat %s cannot report its state", device)
+		}
+		state, err := reporter.CurrentState()
+		if err != nil {
+			return Scene{}, fmt.Errorf("capturing thermostat %s: %v", device, err)
+		}
+		if scene.Thermostats == nil {
+			scene.Thermostats = map[string]map[string]string{}
+		}
+		scene.Thermostats[device] = state
+	}
+	if err := manager.validate(scene); err != nil {
+		return Scene{}, err
+	}
+	previous, replaced := manager.captured[name]
+	manager.captured[name] = scene
+	if err := manager.save(); err != nil {
+		if replaced {
+			manager.captured[name] = previous
+		} else {
+			delete(manager.captured, name)
+		}
+		return Scene{}, err
+	}
+	log.WithFields(log.Fields{
+		"scene":   name,
+		"devices": devices,
+	}).Printf("scene captured")
+	return scene, nil
+}
+
+//Delete removes a captured scene, scenes from config cannot be deleted
+func (manager *Manager) Delete(name string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if _, ok := manager.configured[name]; ok {
+		return fmt.Errorf("scene %s is defined in config and cannot be deleted", name)
+	}
+	scene, ok := manager.captured[name]
+	if !ok {
+		return fmt.Errorf("scene %s not found", name)
+	}
+	delete(manager.captured, name)
+	if err := manager.save(); err != nil {
+		manager.captured[name] = scene
+		return err
+	}
+	return nil
+}
+
+func (manager *Manager) save() error {
+	if manager.StoreLocation == "" {
+		return nil
+	}
+	stored := []Scene{}
+	for _, scene := range manager.captured {
+		stored = append(stored, scene)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Name < stored[j].Name })
+	content, err := yaml.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmpLocation := manager.StoreLocation + ".tmp"
+	if err := ioutil.WriteFile(tmpLocation, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpLocation, manager.StoreLocation)
+}
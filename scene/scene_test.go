@@ -0,0 +1,122 @@
+package scene_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/switcher"
+	"github.com/oskoss/mi-casa/thermostat"
+)
+
+var _ = Describe("Manager", func() {
+	var (
+		dyson       *thermostat.MockThermostat
+		lamp        *switcher.MockSwitch
+		thermostats map[string]thermostat.ThermostatDevice
+		switches    map[string]switcher.SwitchDevice
+		configured  []Scene
+		storeDir    string
+		store       string
+	)
+	BeforeEach(func() {
+		dyson = &thermostat.MockThermostat{State: map[string]string{"fmod": "HEAT", "hmax": "2950"}}
+		lamp = &switcher.MockSwitch{Status: "ON"}
+		thermostats = map[string]thermostat.ThermostatDevice{"dyson": dyson}
+		switches = map[string]switcher.SwitchDevice{"lamp": lamp}
+		configured = []Scene{
+			{Name: "away", Switches: map[string]string{"lamp": "OFF"}},
+		}
+		var err error
+		storeDir, err = ioutil.TempDir("", "scenes")
+		Expect(err).ShouldNot(HaveOccurred())
+		store = filepath.Join(storeDir, "scenes.yaml")
+	})
+	AfterEach(func() {
+		os.RemoveAll(storeDir)
+	})
+	Describe("creating a manager", func() {
+		Context("when a configured scene references an unknown device", func() {
+			BeforeEach(func() {
+				configured[0].Switches["doesnotexist"] = "ON"
+			})
+			It("should return an error", func() {
+				_, err := NewManager(configured, store, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+		Context("when a configured scene has an invalid switch state", func() {
+			BeforeEach(func() {
+				configured[0].Switches["lamp"] = "DIM"
+			})
+			It("should return an error", func() {
+				_, err := NewManager(configured, store, thermostats, switches)
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+	Describe("capturing a scene", func() {
+		var manager *Manager
+		BeforeEach(func() {
+			var err error
+			manager, err = NewManager(configured, store, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should snapshot the current state of each device", func() {
+			captured, err := manager.Capture("movie-night", []string{"lamp", "dyson"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(captured.Switches).Should(Equal(map[string]string{"lamp": "ON"}))
+			Expect(captured.Thermostats["dyson"]).Should(Equal(map[string]string{"fmod": "HEAT", "hmax": "2950"}))
+			Expect(manager.List()).Should(HaveLen(2))
+		})
+		It("should persist the scene for the next manager", func() {
+			_, err := manager.Capture("movie-night", []string{"lamp"})
+			Expect(err).ShouldNot(HaveOccurred())
+			reloaded, err := NewManager(configured, store, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, ok := reloaded.Get("movie-night")
+			Expect(ok).Should(BeTrue())
+		})
+		It("should not replace a scene from config", func() {
+			_, err := manager.Capture("away", []string{"lamp"})
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should fail for an unknown device", func() {
+			_, err := manager.Capture("movie-night", []string{"doesnotexist"})
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should keep the scene it replaces when saving fails", func() {
+			_, err := manager.Capture("movie-night", []string{"lamp"})
+			Expect(err).ShouldNot(HaveOccurred())
+			lamp.Status = "OFF"
+			os.RemoveAll(storeDir)
+			_, err = manager.Capture("movie-night", []string{"lamp"})
+			Expect(err).Should(HaveOccurred())
+			kept, ok := manager.Get("movie-night")
+			Expect(ok).Should(BeTrue())
+			Expect(kept.Switches).Should(Equal(map[string]string{"lamp": "ON"}))
+		})
+	})
+	Describe("deleting a scene", func() {
+		var manager *Manager
+		BeforeEach(func() {
+			var err error
+			manager, err = NewManager(configured, store, thermostats, switches)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = manager.Capture("movie-night", []string{"lamp"})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("should remove a captured scene", func() {
+			Expect(manager.Delete("movie-night")).Should(Succeed())
+			_, ok := manager.Get("movie-night")
+			Expect(ok).Should(BeFalse())
+		})
+		It("should not remove a scene from config", func() {
+			Expect(manager.Delete("away")).ShouldNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/thermostat"
+	log "github.com/sirupsen/logrus"
+)
+
+const sceneUsage = `usage:
+  micasa scene list
+  micasa scene capture <name> <device>...
+  micasa scene apply <name>
+  micasa scene delete <name>`
+
+//sceneCommand runs the scene sub commands directly against
+// the devices, returning the process exit code
+func sceneCommand(opts *options, args []string) int {
+	flags := newFlagSet("scene", opts)
+	args, ok := commandArgs(flags, args, sceneUsage)
+	if !ok {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, sceneUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	micasaConfig, myHome, code := loadHome(opts)
+	if code != exitOK {
+		return code
+	}
+	scenes, err := scene.NewManager(micasaConfig.Scenes, micasaConfig.ScenesFile, myHome.Thermostats, myHome.Switches)
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		output(opts, scenes.List(), func() {
+			for _, myScene := range scenes.List() {
+				fmt.Printf("%s\tswitches=%v\tthermostats=%v\n", myScene.Name, myScene.Switches, myScene.Thermostats)
+			}
+		})
+		return exitOK
+	case args[0] == "capture" && len(args) > 2:
+		if err := connectThermostats(myHome, args[2:], true); err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		myScene, err := scenes.Capture(args[1], args[2:])
+		audited(micasaConfig, "scene capture", args[1], strings.Join(args[2:], " "), err, known(fmt.Sprintf("switches=%v thermostats=%v", myScene.Switches, myScene.Thermostats)))
+		if err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		output(opts, myScene, func() {
+			fmt.Printf("captured %s\tswitches=%v\tthermostats=%v\n", myScene.Name, myScene.Switches, myScene.Thermostats)
+		})
+		return exitOK
+	case args[0] == "apply" && len(args) == 2:
+		myScene, ok := scenes.Get(args[1])
+		if !ok {
+			return failed(opts, exitNotFound, fmt.Errorf("scene %s not found", args[1]))
+		}
+		devices := []string{}
+		for device := range myScene.Thermostats {
+			devices = append(devices, device)
+		}
+		if err := connectThermostats(myHome, devices, true); err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		results, err := scenes.Apply(args[1])
+		outcomes := []string{}
+		for _, result := range results {
+			outcomes = append(outcomes, result.Device+" "+result.Status)
+		}
+		audited(micasaConfig, "scene apply", args[1], "", err, known(strings.Join(outcomes, ", ")))
+		output(opts, results, func() {
+			for _, result := range results {
+				fmt.Printf("%s\t%s\t%s\n", result.Device, result.Status, result.Error)
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "micasa: %v\n", err)
+			return exitFailure
+		}
+		return exitOK
+	case args[0] == "delete" && len(args) == 2:
+		if _, ok := scenes.Get(args[1]); !ok {
+			return failed(opts, exitNotFound, fmt.Errorf("scene %s not found", args[1]))
+		}
+		err := scenes.Delete(args[1])
+		audited(micasaConfig, "scene delete", args[1], "", err, known("deleted"))
+		if err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, sceneUsage)
+	return exitUsage
+}
+
+//connectThermostats connects any of devices which are thermostats
+// and optionally waits up to 30 seconds for them to report their state
+func connectThermostats(myHome *home.Home, devices []string, waitForState bool) error {
+	for _, name := range devices {
+		device, ok := myHome.Thermostats[name]
+		if !ok {
+			continue
+		}
+		if err := device.Connect(); err != nil {
+			return fmt.Errorf("connecting %s: %v", name, err)
+		}
+		reporter, ok := device.(thermostat.StateReporter)
+		if !waitForState || !ok {
+			continue
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			if _, err := reporter.CurrentState(); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("thermostat %s did not report its state", name)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
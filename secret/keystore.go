@@ -0,0 +1,152 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+//KeystoreVersion is the keystore format written by this build
+const KeystoreVersion = 1
+
+// scrypt parameters recommended for interactive use, unlocking
+// takes a fraction of a second and a brute force far longer
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	keyLength = 32
+	saltSize  = 16
+)
+
+//keystoreFile is the keystore on disk, Sealed is the secrets as JSON
+// encrypted with AES-GCM under a key derived from the passphrase
+type keystoreFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Sealed  []byte `json:"sealed"`
+}
+
+//Keystore is a local file of secrets encrypted with a passphrase.
+// Every Set or Delete rewrites the file atomically with a new salt.
+type Keystore struct {
+	Location   string
+	passphrase String
+	secrets    map[string]String
+}
+
+//OpenKeystore unlocks the keystore at location, a missing file is
+// an empty keystore which is created on the first Set
+func OpenKeystore(location string, passphrase String) (*Keystore, error) {
+	keystore := &Keystore{Location: location, passphrase: passphrase, secrets: map[string]String{}}
+	content, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return keystore, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored keystoreFile
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("keystore %s is unreadable: %v", location, err)
+	}
+	if stored.Version > KeystoreVersion {
+		return nil, fmt.Errorf("keystore %s is version %d but only version %d is understood", location, stored.Version, KeystoreVersion)
+	}
+	sealer, err := newSealer(passphrase, stored.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := sealer.Open(nil, stored.Nonce, stored.Sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s could not be unlocked, is the passphrase right?", location)
+	}
+	if err := json.Unmarshal(plain, &keystore.secrets); err != nil {
+		return nil, fmt.Errorf("keystore %s is unreadable: %v", location, err)
+	}
+	return keystore, nil
+}
+
+func newSealer(passphrase String, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase.Reveal()), salt, scryptN, scryptR, scryptP, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Get returns the secret stored as name
+func (keystore *Keystore) Get(name string) (String, bool) {
+	secret, ok := keystore.secrets[name]
+	return secret, ok
+}
+
+//Names lists what is stored, never the secrets
+func (keystore *Keystore) Names() []string {
+	names := []string{}
+	for name := range keystore.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Set stores secret as name and writes the keystore
+func (keystore *Keystore) Set(name string, secret String) error {
+	keystore.secrets[name] = secret
+	return keystore.save()
+}
+
+//Delete removes name, returning false when it was not stored
+func (keystore *Keystore) Delete(name string) (bool, error) {
+	if _, ok := keystore.secrets[name]; !ok {
+		return false, nil
+	}
+	delete(keystore.secrets, name)
+	return true, keystore.save()
+}
+
+func (keystore *Keystore) save() error {
+	plain := map[string]string{}
+	for name, secret := range keystore.secrets {
+		plain[name] = secret.Reveal()
+	}
+	content, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	stored := keystoreFile{Version: KeystoreVersion, Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(stored.Salt); err != nil {
+		return err
+	}
+	sealer, err := newSealer(keystore.passphrase, stored.Salt)
+	if err != nil {
+		return err
+	}
+	stored.Nonce = make([]byte, sealer.NonceSize())
+	if _, err := rand.Read(stored.Nonce); err != nil {
+		return err
+	}
+	stored.Sealed = sealer.Seal(nil, stored.Nonce, content, nil)
+	content, err = json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpLocation := keystore.Location + ".tmp"
+	if err := ioutil.WriteFile(tmpLocation, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpLocation, keystore.Location)
+}
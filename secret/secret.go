@@ -0,0 +1,144 @@
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Redacted is what a String shows wherever it is printed or encoded
+const Redacted = "*****"
+
+//PassphraseEnv is where the keystore passphrase is read from
+// when the config does not set one
+const PassphraseEnv = "MICASA_KEYSTORE_PASSPHRASE"
+
+//String is a password or token. It prints and encodes as Redacted so it
+// cannot end up in a log line or API response by accident, Reveal is
+// the only way to the value.
+type String string
+
+//Reveal is the secret itself, for handing to whatever needs it
+func (secret String) Reveal() string {
+	return string(secret)
+}
+
+func (secret String) String() string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func (secret String) GoString() string {
+	return fmt.Sprintf("secret.String(%q)", secret.String())
+}
+
+func (secret String) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", secret.String())), nil
+}
+
+func (secret String) MarshalYAML() (interface{}, error) {
+	return secret.String(), nil
+}
+
+//Config is where the keystore is, its passphrase may itself
+// be a reference to the environment or a file
+type Config struct {
+	File       string `yaml:"file"`
+	Passphrase String `yaml:"passphrase,omitempty"`
+}
+
+//Resolver replaces references with the secrets they refer to:
+//
+//	${env:NAME}      the environment variable NAME
+//	file:/path       the content of a file, e.g. a docker secret
+//	keystore:name    a secret stored with micasa secret set
+//
+// ${file:/path} and ${keystore:name} may be written too, anything
+// else is taken to be the secret itself.
+type Resolver struct {
+	Keystore Config
+	opened   *Keystore
+	err      error
+}
+
+//Reference splits value into the kind of secret and its name,
+// ok is false when it is not a reference
+func Reference(value String) (kind string, name string, ok bool) {
+	reference := string(value)
+	if strings.HasPrefix(reference, "${") && strings.HasSuffix(reference, "}") {
+		reference = reference[2 : len(reference)-1]
+	} else if !strings.HasPrefix(reference, "file:") && !strings.HasPrefix(reference, "keystore:") {
+		return "", "", false
+	}
+	i := strings.Index(reference, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	kind, name = reference[:i], reference[i+1:]
+	switch kind {
+	case "env", "file", "keystore":
+		return kind, name, name != ""
+	}
+	return "", "", false
+}
+
+//Resolve returns the secret value refers to, or value itself
+// when it is not a reference
+func (resolver *Resolver) Resolve(value String) (String, error) {
+	kind, name, ok := Reference(value)
+	if !ok {
+		return value, nil
+	}
+	switch kind {
+	case "env":
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return String(secret), nil
+	case "file":
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		// secret files usually end with a newline the secret does not
+		return String(strings.TrimRight(string(content), "\r\n")), nil
+	default:
+		keystore, err := resolver.keystore()
+		if err != nil {
+			return "", err
+		}
+		secret, ok := keystore.Get(name)
+		if !ok {
+			return "", fmt.Errorf("secret %s is not in keystore %s", name, keystore.Location)
+		}
+		return secret, nil
+	}
+}
+
+//keystore opens the keystore the first time it is needed
+func (resolver *Resolver) keystore() (*Keystore, error) {
+	if resolver.opened == nil && resolver.err == nil {
+		resolver.opened, resolver.err = resolver.Keystore.Open()
+	}
+	return resolver.opened, resolver.err
+}
+
+//Open opens the keystore of conf, with the passphrase from
+// PassphraseEnv when conf has none
+func (conf Config) Open() (*Keystore, error) {
+	if conf.File == "" {
+		return nil, fmt.Errorf("no keystore is configured")
+	}
+	passphrase := conf.Passphrase
+	if passphrase == "" {
+		passphrase = String(os.Getenv(PassphraseEnv))
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("keystore %s needs a passphrase, set keystore.passphrase or %s", conf.File, PassphraseEnv)
+	}
+	return OpenKeystore(conf.File, passphrase)
+}
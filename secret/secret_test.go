@@ -0,0 +1,137 @@
+package secret_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	. "github.com/oskoss/mi-casa/secret"
+)
+
+var _ = Describe("String", func() {
+	password := String("hunter2")
+	It("should never print the secret", func() {
+		for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x"} {
+			Expect(fmt.Sprintf(format, password)).NotTo(ContainSubstring("hunter2"))
+		}
+		Expect(fmt.Sprintf("%+v", struct{ Password String }{password})).To(ContainSubstring(Redacted))
+	})
+	It("should never encode the secret", func() {
+		content, err := json.Marshal(map[string]String{"password": password})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal(`{"password":"*****"}`))
+		content, err = yaml.Marshal(map[string]String{"password": password})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).NotTo(ContainSubstring("hunter2"))
+	})
+	It("should never log the secret", func() {
+		entry, err := log.WithFields(log.Fields{"password": password}).String()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entry).NotTo(ContainSubstring("hunter2"))
+	})
+	It("should reveal the secret when asked", func() {
+		Expect(password.Reveal()).To(Equal("hunter2"))
+	})
+})
+
+var _ = Describe("Resolver", func() {
+	var directory string
+	var resolver *Resolver
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "secret")
+		Expect(err).ShouldNot(HaveOccurred())
+		resolver = &Resolver{Keystore: Config{File: filepath.Join(directory, "keystore"), Passphrase: "correct horse"}}
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	It("should take anything but a reference as the secret", func() {
+		Expect(resolver.Resolve("hunter2")).To(Equal(String("hunter2")))
+		Expect(resolver.Resolve("${hunter2}")).To(Equal(String("${hunter2}")))
+	})
+	It("should read the environment", func() {
+		os.Setenv("MICASA_TEST_SECRET", "hunter2")
+		defer os.Unsetenv("MICASA_TEST_SECRET")
+		Expect(resolver.Resolve("${env:MICASA_TEST_SECRET}")).To(Equal(String("hunter2")))
+		_, err := resolver.Resolve("${env:MICASA_TEST_UNSET}")
+		Expect(err).Should(MatchError("environment variable MICASA_TEST_UNSET is not set"))
+	})
+	It("should read files without their trailing newline", func() {
+		location := filepath.Join(directory, "dyson")
+		Expect(ioutil.WriteFile(location, []byte("hunter2\n"), 0600)).Should(Succeed())
+		Expect(resolver.Resolve(String("file:" + location))).To(Equal(String("hunter2")))
+		Expect(resolver.Resolve(String("${file:" + location + "}"))).To(Equal(String("hunter2")))
+	})
+	It("should read the keystore", func() {
+		keystore, err := resolver.Keystore.Open()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Set("dyson", "hunter2")).Should(Succeed())
+		Expect(resolver.Resolve("keystore:dyson")).To(Equal(String("hunter2")))
+		_, err = resolver.Resolve("keystore:hue")
+		Expect(err).Should(HaveOccurred())
+	})
+	Context("without a keystore", func() {
+		It("should fail keystore references", func() {
+			resolver.Keystore = Config{}
+			_, err := resolver.Resolve("keystore:dyson")
+			Expect(err).Should(MatchError("no keystore is configured"))
+		})
+	})
+})
+
+var _ = Describe("Keystore", func() {
+	var directory, location string
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "keystore")
+		Expect(err).ShouldNot(HaveOccurred())
+		location = filepath.Join(directory, "keystore")
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	It("should keep secrets encrypted across opens", func() {
+		keystore, err := OpenKeystore(location, "correct horse")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Names()).To(BeEmpty())
+		Expect(keystore.Set("dyson", "hunter2")).Should(Succeed())
+		Expect(keystore.Set("homeAssistant", "swordfish")).Should(Succeed())
+		content, err := ioutil.ReadFile(location)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).NotTo(ContainSubstring("hunter2"))
+		Expect(string(content)).NotTo(ContainSubstring("dyson"))
+
+		keystore, err = OpenKeystore(location, "correct horse")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Names()).To(Equal([]string{"dyson", "homeAssistant"}))
+		dyson, ok := keystore.Get("dyson")
+		Expect(ok).To(BeTrue())
+		Expect(dyson).To(Equal(String("hunter2")))
+	})
+	It("should delete secrets", func() {
+		keystore, err := OpenKeystore(location, "correct horse")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Set("dyson", "hunter2")).Should(Succeed())
+		Expect(keystore.Delete("dyson")).To(BeTrue())
+		Expect(keystore.Delete("dyson")).To(BeFalse())
+		keystore, err = OpenKeystore(location, "correct horse")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Names()).To(BeEmpty())
+	})
+	It("should refuse the wrong passphrase", func() {
+		keystore, err := OpenKeystore(location, "correct horse")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keystore.Set("dyson", "hunter2")).Should(Succeed())
+		_, err = OpenKeystore(location, "battery staple")
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).NotTo(ContainSubstring("hunter2"))
+	})
+})
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/secret"
+	log "github.com/sirupsen/logrus"
+)
+
+const secretUsage = `usage:
+  micasa secret list
+  micasa secret set <name>      reads the secret from stdin
+  micasa secret delete <name>
+
+refer to a stored secret within the config as keystore:<name>`
+
+//secretCommand manages the keystore named by the config,
+// which need not be valid otherwise
+func secretCommand(opts *options, args []string) int {
+	flags := newFlagSet("secret", opts)
+	args, ok := commandArgs(flags, args, secretUsage)
+	if !ok {
+		return exitUsage
+	}
+	if len(args) == 0 || (args[0] == "list") != (len(args) == 1) {
+		fmt.Fprintln(os.Stderr, secretUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	configFile := layers(opts)
+	doc, err := configFile.Read()
+	if err != nil {
+		return failed(opts, exitConfig, fmt.Errorf("reading config %s: %v", config.RedactURL(opts.config), err))
+	}
+	if doc.Config == nil {
+		return failed(opts, exitConfig, fmt.Errorf("reading config %s: %v", config.RedactURL(opts.config), doc.Problems))
+	}
+	keystore, err := doc.Config.Keystore.Open()
+	if err != nil {
+		return failed(opts, exitConfig, err)
+	}
+	switch args[0] {
+	case "list":
+		names := keystore.Names()
+		output(opts, names, func() {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		})
+		return exitOK
+	case "set":
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			if err == nil {
+				err = fmt.Errorf("the secret is empty")
+			}
+			return failed(opts, exitUsage, fmt.Errorf("reading secret %s from stdin: %v", args[1], err))
+		}
+		if err := keystore.Set(args[1], secret.String(value)); err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		output(opts, map[string]string{"set": args[1]}, func() {
+			fmt.Printf("%s stored in %s, refer to it as keystore:%s\n", args[1], keystore.Location, args[1])
+		})
+		return exitOK
+	case "delete":
+		deleted, err := keystore.Delete(args[1])
+		if err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		if !deleted {
+			return failed(opts, exitNotFound, fmt.Errorf("secret %s not found", args[1]))
+		}
+		output(opts, map[string]string{"deleted": args[1]}, func() {
+			fmt.Printf("%s deleted\n", args[1])
+		})
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, secretUsage)
+	return exitUsage
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oskoss/mi-casa/api"
+	"github.com/oskoss/mi-casa/audit"
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/broker"
+	"github.com/oskoss/mi-casa/certs"
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/events"
+	"github.com/oskoss/mi-casa/history"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/homeassistant"
+	"github.com/oskoss/mi-casa/homekit"
+	"github.com/oskoss/mi-casa/hue"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/notify"
+	"github.com/oskoss/mi-casa/rules"
+	"github.com/oskoss/mi-casa/scene"
+	"github.com/oskoss/mi-casa/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const serveUsage = `usage: micasa serve [--config file] [--verbose]`
+
+const (
+	//defaultSampleInterval is how often thermostats are read for
+	// the event stream when no history sets an interval
+	defaultSampleInterval = time.Minute
+	//configPollInterval is how often the config file is checked for edits
+	configPollInterval = 2 * time.Second
+)
+
+//Services which use the devices, in the order they are started.
+// A reload stops them in the reverse order.
+const (
+	serviceWatch         = "watch"
+	serviceNotify        = "notify"
+	serviceAutomation    = "automation"
+	serviceHVAC          = "hvac"
+	serviceHomeAssistant = "homeAssistant"
+	serviceHomeKit       = "homeKit"
+	serviceHue           = "hue"
+	serviceAPI           = "api"
+)
+
+var serviceOrder = []string{
+	serviceWatch,
+	serviceNotify,
+	serviceAutomation,
+	serviceHVAC,
+	serviceHomeAssistant,
+	serviceHomeKit,
+	serviceHue,
+	serviceAPI,
+}
+
+//runtime is everything serve runs, a reload restarts
+// only the services the new config changes
+type runtime struct {
+	config     *config.CasaConfig
+	home       *home.Home
+	bus        *events.Bus
+	state      *state.Store
+	store      *history.Store
+	scenes     *scene.Manager
+	audit      *audit.Trail
+	controller *hvac.Controller
+	zones      *hvac.Zones
+	services   map[string]*service
+	running    sync.WaitGroup
+	// the state of the controllers a reload is replacing, by name
+	handedOver map[string]hvac.ControllerState
+}
+
+//service is a part of serve which runs until its stop is closed
+type service struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+//serveCommand connects every device and runs whatever the config
+// enables until interrupted, reloading the config when it is edited
+// or on SIGHUP
+func serveCommand(opts *options, args []string) int {
+	flags := newFlagSet("serve", opts)
+	if !flagsOnly(flags, args, serveUsage) {
+		return exitUsage
+	}
+	setLogLevel(opts, log.InfoLevel)
+	// read before loading, so edits made while connecting are reloaded
+	configFile := layers(opts)
+	watcher := configFile.Watcher()
+	micasaConfig, myHome, code := loadHome(opts)
+	if code != exitOK {
+		return code
+	}
+	r := &runtime{
+		config:   micasaConfig,
+		home:     myHome,
+		bus:      events.NewBus(),
+		audit:    audit.Open(micasaConfig.Audit),
+		services: map[string]*service{},
+	}
+	defer r.audit.Close()
+	myHome.Instrument(r.bus)
+	myHome.Audit = r.audit
+	if err := myHome.Connect(); err != nil {
+		return failed(opts, exitFailure, err)
+	}
+	var err error
+	if micasaConfig.StateFile != "" {
+		r.state, err = state.Open(micasaConfig.StateFile)
+		if err != nil {
+			return failed(opts, exitFailure, err)
+		}
+	}
+
+	stop := make(chan struct{})
+	shutdown := func() {
+		r.stop(serviceOrder...)
+		close(stop)
+		r.running.Wait()
+	}
+	if micasaConfig.Broker != nil {
+		mqttBroker, err := broker.New(*micasaConfig.Broker)
+		if err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		// listen before anything below tries to connect
+		if err := mqttBroker.Listen(); err != nil {
+			return failed(opts, exitFailure, err)
+		}
+		r.running.Add(1)
+		go func() {
+			defer r.running.Done()
+			mqttBroker.Serve(stop)
+		}()
+	}
+	if micasaConfig.History.Directory != "" {
+		r.store, err = history.Open(micasaConfig.History)
+		if err != nil {
+			shutdown()
+			return failed(opts, exitFailure, err)
+		}
+		r.running.Add(1)
+		go func() {
+			defer r.running.Done()
+			r.store.Run(r.bus, stop)
+		}()
+	}
+	if err := r.startAll(serviceOrder); err != nil {
+		shutdown()
+		return failed(opts, exitFailure, err)
+	}
+
+	reload := make(chan struct{}, 1)
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		watcher.Run(configPollInterval, reload, stop)
+	}()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	for {
+		select {
+		case <-reload:
+			r.reload(configFile)
+		case <-hangup:
+			r.reload(configFile)
+		case <-interrupted:
+			shutdown()
+			return exitOK
+		}
+	}
+}
+
+//run starts a service, which runs until stop is called for it
+func (r *runtime) run(name string, run func(stop <-chan struct{})) {
+	running := &service{stop: make(chan struct{}), done: make(chan struct{})}
+	r.services[name] = running
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		defer close(running.done)
+		run(running.stop)
+	}()
+}
+
+//serve starts a service like run, logging the error it stops with
+func (r *runtime) serve(name string, serve func(stop <-chan struct{}) error) {
+	r.run(name, func(stop <-chan struct{}) {
+		if err := serve(stop); err != nil {
+			log.WithFields(log.Fields{
+				"service": name,
+				"err":     err,
+			}).Error("service stopped")
+		}
+	})
+}
+
+//startAll starts the named services in order, stopping at the
+// first which cannot start
+func (r *runtime) startAll(names []string) error {
+	for _, name := range names {
+		if err := r.start(name); err != nil {
+			return fmt.Errorf("starting %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+//stop stops the named services in reverse order, waiting for each
+func (r *runtime) stop(names ...string) {
+	for i := len(names) - 1; i >= 0; i-- {
+		running, ok := r.services[names[i]]
+		if !ok {
+			continue
+		}
+		close(running.stop)
+		<-running.done
+		delete(r.services, names[i])
+	}
+}
+
+//start starts the named service if the config enables it
+func (r *runtime) start(name string) error {
+	micasaConfig := r.config
+	switch name {
+	case serviceWatch:
+		// readings reach the history, the API event stream and the alerts
+		// by sampling, and switches changed outside mi-casa are noticed by it
+		if r.store == nil && micasaConfig.API.Address == "" && r.audit == nil && micasaConfig.Notify == nil {
+			return nil
+		}
+		interval := defaultSampleInterval
+		if r.store != nil {
+			interval = r.store.Config.Interval
+		}
+		r.run(name, func(stop <-chan struct{}) {
+			r.home.Watch(interval, stop)
+		})
+	case serviceNotify:
+		if micasaConfig.Notify == nil {
+			return nil
+		}
+		notifier, err := notify.New(*micasaConfig.Notify)
+		if err != nil {
+			return err
+		}
+		r.run(name, func(stop <-chan struct{}) {
+			notifier.Run(r.bus, stop)
+		})
+	case serviceAutomation:
+		if len(micasaConfig.Automation.Rules) == 0 {
+			return nil
+		}
+		engine, err := rules.NewEngine(micasaConfig.Automation, r.home.Thermostats, r.home.Switches)
+		if err != nil {
+			return err
+		}
+		engine.Audit = r.audit
+		r.run(name, engine.Run)
+	case serviceHVAC:
+		return r.startHVAC()
+	case serviceHomeAssistant:
+		if micasaConfig.HomeAssistant.Broker == "" {
+			return nil
+		}
+		client, err := homeassistant.Dial(micasaConfig.HomeAssistant)
+		if err != nil {
+			return err
+		}
+		bridge := homeassistant.NewBridge(micasaConfig.HomeAssistant, client, r.home.Thermostats, r.home.Switches, r.controllers())
+		bridge.Audit = r.audit
+		if err := bridge.Start(); err != nil {
+			client.Close()
+			return err
+		}
+		r.run(name, func(stop <-chan struct{}) {
+			bridge.Run(r.bus, stop)
+		})
+	case serviceHomeKit:
+		if micasaConfig.HomeKit == nil {
+			return nil
+		}
+		homeKit, err := homekit.New(*micasaConfig.HomeKit, r.home.Thermostats, r.home.Switches, r.controllers())
+		if err != nil {
+			return err
+		}
+		homeKit.Audit = r.audit
+		r.serve(name, func(stop <-chan struct{}) error {
+			return homeKit.Start(r.bus, stop)
+		})
+	case serviceHue:
+		if micasaConfig.Hue == nil {
+			return nil
+		}
+		emulator, err := hue.New(*micasaConfig.Hue, r.home.Switches)
+		if err != nil {
+			return err
+		}
+		emulator.Audit = r.audit
+		if err := emulator.Listen(); err != nil {
+			return fmt.Errorf("hue: %v", err)
+		}
+		r.serve(name, emulator.Start)
+	case serviceAPI:
+		var err error
+		r.scenes, err = scene.NewManager(micasaConfig.Scenes, micasaConfig.ScenesFile, r.home.Thermostats, r.home.Switches)
+		if err != nil {
+			return err
+		}
+		if micasaConfig.API.Address == "" {
+			return nil
+		}
+		authenticator, err := auth.New(micasaConfig.API.Auth)
+		if err != nil {
+			return fmt.Errorf("api auth: %v", err)
+		}
+		if authenticator.Open() {
+			log.WithFields(log.Fields{
+				"address": micasaConfig.API.Address,
+			}).Warn("API has no tokens or users, anyone who can reach it can control the home")
+		}
+		var tlsConfig *tls.Config
+		if micasaConfig.API.TLS != nil {
+			tlsConfig, err = serverTLS(*micasaConfig.API.TLS)
+			if err != nil {
+				return err
+			}
+		}
+		server := &api.Server{
+			Address: micasaConfig.API.Address,
+			Home:    r.home,
+			HVAC:    r.controller,
+			Zones:   r.zones,
+			Scenes:  r.scenes,
+			History: r.store,
+			Events:  r.bus,
+			Auth:    authenticator,
+			TLS:     tlsConfig,
+			Audit:   r.audit,
+		}
+		if err := server.Listen(); err != nil {
+			return fmt.Errorf("api: %v", err)
+		}
+		r.serve(name, server.Start)
+	}
+	return nil
+}
+
+//serverTLS loads or generates the certificates of the API, telling
+// where to find the local CA clients must trust when there is one
+func serverTLS(conf certs.Config) (*tls.Config, error) {
+	manager, err := certs.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("api %v", err)
+	}
+	tlsConfig, err := manager.TLSConfig(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("api tls: %v", err)
+	}
+	if manager.Generated() || (conf.Clients != "" && conf.ClientCA == "") {
+		authority, err := certs.OpenAuthority(manager.Config.Directory, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("api tls: %v", err)
+		}
+		log.WithFields(log.Fields{
+			"ca":          filepath.Join(authority.Directory, certs.AuthorityFile),
+			"fingerprint": certs.Fingerprint(authority.Certificate),
+			"hosts":       manager.Hosts(),
+		}).Printf("API certificates are signed by the local CA, install it on clients to trust them")
+	}
+	return tlsConfig, nil
+}
+
+//startHVAC builds and runs the controller or zones, restoring
+// their runtime state
+func (r *runtime) startHVAC() error {
+	micasaConfig := r.config
+	r.controller, r.zones = nil, nil
+	if micasaConfig.HVAC != nil && len(micasaConfig.Zones) > 0 {
+		return fmt.Errorf("configure either hvac or zones, not both")
+	}
+	if micasaConfig.HVAC != nil {
+		controller, err := hvac.NewController(*micasaConfig.HVAC, r.home.Thermostats, r.home.Switches)
+		if err != nil {
+			return err
+		}
+		controller.Events = r.bus
+		controller.Audit = r.audit
+		if r.state != nil {
+			if err := controller.Persist(r.state); err != nil {
+				return err
+			}
+		}
+		r.takeOver(controller)
+		r.controller = controller
+		r.run(serviceHVAC, controller.Run)
+	}
+	if len(micasaConfig.Zones) > 0 {
+		zones, err := hvac.NewZones(micasaConfig.Zones, r.home.Thermostats, r.home.Switches)
+		if err != nil {
+			return err
+		}
+		for _, zone := range zones.Controllers {
+			zone.Events = r.bus
+			zone.Audit = r.audit
+			if r.state != nil {
+				if err := zone.Persist(r.state); err != nil {
+					return err
+				}
+			}
+			r.takeOver(zone)
+		}
+		r.zones = zones
+		r.run(serviceHVAC, zones.Run)
+	}
+	return nil
+}
+
+//takeOver restores controller from the one of the same name a reload
+// replaced, so the equipment it left running stays protected
+func (r *runtime) takeOver(controller *hvac.Controller) {
+	saved, ok := r.handedOver[controller.Name]
+	if !ok {
+		return
+	}
+	controller.Restore(saved)
+	delete(r.handedOver, controller.Name)
+}
+
+func (r *runtime) controllers() []*hvac.Controller {
+	controllers := []*hvac.Controller{}
+	if r.controller != nil {
+		controllers = append(controllers, r.controller)
+	}
+	if r.zones != nil {
+		controllers = append(controllers, r.zones.Controllers...)
+	}
+	return controllers
+}
+
+//reload reads the config again and applies what changed,
+// an invalid config is rejected and the running one kept
+func (r *runtime) reload(configFile *config.Layered) {
+	location := config.RedactURL(configFile.FileLocation)
+	doc, err := configFile.Read()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"config": location,
+			"err":    err,
+		}).Error("could not read config, keeping the running config")
+		return
+	}
+	validate(doc)
+	if len(doc.Problems) > 0 {
+		for _, problem := range doc.Problems {
+			log.WithFields(log.Fields{
+				"config": location,
+				"line":   problem.Line,
+				"column": problem.Column,
+				"path":   problem.Path,
+			}).Error(problem.Message)
+		}
+		log.WithFields(log.Fields{
+			"config":   location,
+			"problems": len(doc.Problems),
+		}).Error("config is invalid, keeping the running config")
+		return
+	}
+	next := doc.Config
+	r.keepRunning(next)
+	update, err := r.home.Prepare(next)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"config": location,
+			"err":    err,
+		}).Error("could not apply config, keeping the running config")
+		return
+	}
+	restart := r.changed(next, update.Changes)
+	if len(restart) == 0 {
+		// the devices are the same, and still in use
+		r.config = next
+		log.WithFields(log.Fields{
+			"config": location,
+		}).Printf("config reloaded, nothing changed")
+		return
+	}
+	restarted := map[string]bool{}
+	for _, name := range restart {
+		_, restarted[name] = r.services[name]
+	}
+	previous := r.config
+	retired := r.handOver(restart)
+	r.stop(restart...)
+	r.home.Apply(update)
+	r.config = next
+	if err := r.startAll(restart); err != nil {
+		log.WithFields(log.Fields{
+			"config": location,
+			"err":    err,
+		}).Error("could not restart after reloading config, going back to the running config")
+		r.rollBack(previous, restart, retired)
+		return
+	}
+	for _, name := range restart {
+		if _, ok := r.services[name]; ok {
+			restarted[name] = true
+		}
+	}
+	r.idleRetired(retired)
+	services := []string{}
+	for _, name := range restart {
+		if restarted[name] {
+			services = append(services, name)
+		}
+	}
+	log.WithFields(log.Fields{
+		"config":    location,
+		"added":     update.Added,
+		"removed":   update.Removed,
+		"changed":   update.Changed,
+		"restarted": services,
+	}).Printf("config reloaded")
+}
+
+//rollBack goes back to the devices and services of previous after
+// restart could not start with a new config, retired are the
+// controllers the new config replaced
+func (r *runtime) rollBack(previous *config.CasaConfig, restart []string, retired []*hvac.Controller) {
+	// whatever did start hands over again, to the controllers of before
+	retired = append(retired, r.handOver(restart)...)
+	defer r.idleRetired(retired)
+	r.stop(restart...)
+	update, err := r.home.Prepare(previous)
+	if err != nil {
+		// start what can with the new devices rather than nothing
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not go back to the devices of the running config")
+	} else {
+		r.home.Apply(update)
+		r.config = previous
+	}
+	for _, name := range restart {
+		if err := r.start(name); err != nil {
+			log.WithFields(log.Fields{
+				"service": name,
+				"err":     err,
+			}).Error("could not restart service")
+		}
+	}
+}
+
+//handOver has the controllers which restart hand their state over to
+// those replacing them rather than idling the equipment, returning them
+func (r *runtime) handOver(restart []string) []*hvac.Controller {
+	if r.handedOver == nil {
+		r.handedOver = map[string]hvac.ControllerState{}
+	}
+	for _, name := range restart {
+		if _, ok := r.services[name]; !ok || name != serviceHVAC {
+			continue
+		}
+		retired := r.controllers()
+		for _, controller := range retired {
+			r.handedOver[controller.Name] = controller.HandOver()
+		}
+		return retired
+	}
+	return nil
+}
+
+//idleRetired idles the equipment of the controllers handed over
+// which no new controller took over, as nothing runs it anymore
+func (r *runtime) idleRetired(retired []*hvac.Controller) {
+	for _, controller := range retired {
+		if _, ok := r.handedOver[controller.Name]; !ok {
+			continue
+		}
+		if err := controller.Equipment.Apply(hvac.Call{}); err != nil {
+			log.WithFields(log.Fields{
+				"zone": controller.Name,
+				"err":  err,
+			}).Error("could not idle HVAC equipment no longer configured")
+		}
+	}
+	r.handedOver = nil
+}
+
+//keepRunning keeps the settings which cannot change without
+// restarting micasa as they are, warning they were edited
+func (r *runtime) keepRunning(next *config.CasaConfig) {
+	if !reflect.DeepEqual(next.Broker, r.config.Broker) {
+		warnRestart("broker")
+		next.Broker = r.config.Broker
+	}
+	if !reflect.DeepEqual(next.History, r.config.History) {
+		warnRestart("history")
+		next.History = r.config.History
+	}
+	if next.StateFile != r.config.StateFile {
+		warnRestart("stateFile")
+		next.StateFile = r.config.StateFile
+	}
+	if next.Audit != r.config.Audit {
+		warnRestart("audit")
+		next.Audit = r.config.Audit
+	}
+}
+
+func warnRestart(section string) {
+	log.WithFields(log.Fields{
+		"section": section,
+	}).Warn("restart micasa to apply changes to this section")
+}
+
+//changed are the services which must restart to apply next, every
+// service handed the devices when they changed, otherwise only those
+// whose settings or controllers did. The HVAC looks its devices up
+// once, so it only restarts when those it uses changed.
+func (r *runtime) changed(next *config.CasaConfig, changes home.Changes) []string {
+	previous := r.config
+	devices := !changes.Empty()
+	hvacChanged := !reflect.DeepEqual(previous.HVAC, next.HVAC) || !reflect.DeepEqual(previous.Zones, next.Zones)
+	touched := map[string]bool{}
+	for _, name := range append(append(append([]string{}, changes.Added...), changes.Removed...), changes.Changed...) {
+		touched[name] = true
+	}
+	for _, controller := range r.controllers() {
+		for _, name := range controller.Devices() {
+			hvacChanged = hvacChanged || touched[name]
+		}
+	}
+	settings := map[string]bool{
+		serviceWatch: (previous.API.Address == "") != (next.API.Address == "") ||
+			(previous.Notify == nil) != (next.Notify == nil),
+		serviceNotify:        !reflect.DeepEqual(previous.Notify, next.Notify),
+		serviceAutomation:    !reflect.DeepEqual(previous.Automation, next.Automation),
+		serviceHVAC:          hvacChanged,
+		serviceHomeAssistant: hvacChanged || !reflect.DeepEqual(previous.HomeAssistant, next.HomeAssistant),
+		serviceHomeKit:       hvacChanged || !reflect.DeepEqual(previous.HomeKit, next.HomeKit),
+		serviceHue:           !reflect.DeepEqual(previous.Hue, next.Hue),
+		serviceAPI: hvacChanged || !reflect.DeepEqual(previous.API, next.API) ||
+			!reflect.DeepEqual(previous.Scenes, next.Scenes) || previous.ScenesFile != next.ScenesFile,
+	}
+	restart := []string{}
+	for _, name := range serviceOrder {
+		if (devices && name != serviceHVAC) || settings[name] {
+			restart = append(restart, name)
+		}
+	}
+	return restart
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Version is the state file format written by this build
+const Version = 1
+
+//document is the state file on disk, each subsystem
+// keeps its own section so they can change independently
+type document struct {
+	Version  int                        `json:"version"`
+	Saved    time.Time                  `json:"saved"`
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+//Store is the runtime state file, what mi-casa has changed or learned
+// while running as opposed to the YAML config it was started with.
+// Every Set rewrites the whole file atomically.
+type Store struct {
+	Path     string
+	sections map[string]json.RawMessage
+	lock     sync.Mutex
+}
+
+//Open loads the state file at path, a missing file is an empty
+// state. An unreadable file is moved aside so the next save does
+// not lose it, a file from a newer version is refused outright.
+func Open(path string) (*Store, error) {
+	store := &Store{Path: path, sections: map[string]json.RawMessage{}}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved document
+	if err := json.Unmarshal(content, &saved); err != nil {
+		aside := path + ".corrupt"
+		log.WithFields(log.Fields{
+			"path":  path,
+			"aside": aside,
+			"err":   err,
+		}).Error("state file unreadable, starting from config")
+		if err := os.Rename(path, aside); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	if saved.Version > Version {
+		return nil, fmt.Errorf("state file %s is version %d but only version %d is understood", path, saved.Version, Version)
+	}
+	if saved.Sections != nil {
+		store.sections = saved.Sections
+	}
+	return store, nil
+}
+
+//Get decodes section into value, returning false when it was never saved
+func (store *Store) Get(section string, value interface{}) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	raw, ok := store.sections[section]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return false, fmt.Errorf("state section %s: %v", section, err)
+	}
+	return true, nil
+}
+
+//Set saves value as section and writes the file
+func (store *Store) Set(section string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.sections[section] = raw
+	content, err := json.MarshalIndent(document{
+		Version:  Version,
+		Saved:    time.Now(),
+		Sections: store.sections,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpLocation := store.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpLocation, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpLocation, store.Path)
+}
@@ -0,0 +1,69 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/state"
+)
+
+var _ = Describe("Store", func() {
+	type section struct {
+		Mode     string  `json:"mode"`
+		Setpoint float64 `json:"setpoint"`
+	}
+	var (
+		directory string
+		path      string
+	)
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("", "state")
+		Expect(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(directory, "state.json")
+	})
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+	It("should start empty without a file", func() {
+		store, err := Open(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		var saved section
+		found, err := store.Get("hvac", &saved)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(found).Should(BeFalse())
+	})
+	It("should keep sections across opens", func() {
+		store, err := Open(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(store.Set("hvac", section{Mode: "heat", Setpoint: 68})).Should(Succeed())
+		Expect(store.Set("other", section{Mode: "cool"})).Should(Succeed())
+		Expect(path + ".tmp").ShouldNot(BeAnExistingFile())
+
+		reopened, err := Open(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		var saved section
+		found, err := reopened.Get("hvac", &saved)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(found).Should(BeTrue())
+		Expect(saved).Should(Equal(section{Mode: "heat", Setpoint: 68}))
+	})
+	It("should move an unreadable file aside", func() {
+		Expect(ioutil.WriteFile(path, []byte(`{"version": 1, "sect`), 0600)).Should(Succeed())
+		store, err := Open(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(path + ".corrupt").Should(BeAnExistingFile())
+		var saved section
+		found, _ := store.Get("hvac", &saved)
+		Expect(found).Should(BeFalse())
+	})
+	It("should refuse a file from a newer version", func() {
+		Expect(ioutil.WriteFile(path, []byte(`{"version": 99, "sections": {}}`), 0600)).Should(Succeed())
+		_, err := Open(path)
+		Expect(err).Should(HaveOccurred())
+	})
+})
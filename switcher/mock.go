@@ -0,0 +1,31 @@
+package switcher
+
+//MockSwitch is an in-memory SwitchDevice used for testing
+// anything which drives switches without real hardware
+type MockSwitch struct {
+	Status string
+	Err    error
+}
+
+func (device *MockSwitch) UpdateStatus() (status *string, err error) {
+	if device.Err != nil {
+		return nil, device.Err
+	}
+	return &device.Status, nil
+}
+
+func (device *MockSwitch) TurnOn() (err error) {
+	if device.Err != nil {
+		return device.Err
+	}
+	device.Status = "ON"
+	return nil
+}
+
+func (device *MockSwitch) TurnOff() (err error) {
+	if device.Err != nil {
+		return device.Err
+	}
+	device.Status = "OFF"
+	return nil
+}
@@ -0,0 +1,40 @@
+package switcher_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/oskoss/mi-casa/switcher"
+)
+
+var _ = Describe("Mock", func() {
+	var testMockSwitch MockSwitch
+	BeforeEach(func() {
+		testMockSwitch = MockSwitch{Status: "OFF"}
+	})
+	Describe("turning on and off", func() {
+		It("should report the new status", func() {
+			Expect(testMockSwitch.TurnOn()).Should(Succeed())
+			status, err := testMockSwitch.UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(*status).Should(Equal("ON"))
+			Expect(testMockSwitch.TurnOff()).Should(Succeed())
+			status, err = testMockSwitch.UpdateStatus()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(*status).Should(Equal("OFF"))
+		})
+	})
+	Describe("when the switch is failing", func() {
+		BeforeEach(func() {
+			testMockSwitch.Err = errors.New("unreachable")
+		})
+		It("should return the error", func() {
+			_, err := testMockSwitch.UpdateStatus()
+			Expect(err).Should(HaveOccurred())
+			Expect(testMockSwitch.TurnOn()).ShouldNot(Succeed())
+			Expect(testMockSwitch.Status).Should(Equal("OFF"))
+		})
+	})
+})
@@ -1,9 +1,40 @@
 package switcher
 
+import "strings"
+
 //SwitchDevice represents a basic switch usually in an "on"/"off" state
 // but able to be in any number of states the implementations require
 type SwitchDevice interface {
-	CurrentStatus() (status *string, err error)
+	UpdateStatus() (status *string, err error)
 	TurnOn() (err error)
 	TurnOff() (err error)
 }
+
+//Wrapper is implemented by switches which decorate another switch,
+// such as one publishing events for every transition
+type Wrapper interface {
+	Unwrap() SwitchDevice
+}
+
+//Unwrap returns the device beneath any wrappers around device
+func Unwrap(device SwitchDevice) SwitchDevice {
+	for {
+		wrapper, ok := device.(Wrapper)
+		if !ok {
+			return device
+		}
+		device = wrapper.Unwrap()
+	}
+}
+
+//ReadBack returns a read of the status device reports, to
+// record what a command to it came to
+func ReadBack(device SwitchDevice) func() (string, error) {
+	return func() (string, error) {
+		status, err := device.UpdateStatus()
+		if err != nil {
+			return "", err
+		}
+		return strings.ToUpper(*status), nil
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/oskoss/mi-casa/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,11 +18,13 @@ import (
 // a specific switch from the T1 since multiple are present
 // within the device.
 type TasmotaT1 struct {
-	SwitchNumber   int
-	URI            string
-	CurrentStatus  string
-	UpdateWindow   time.Duration
-	PhysicalDevice TasmotaT1Status
+	Name           string          `yaml:"name"`
+	SwitchNumber   int             `yaml:"switchNumber"`
+	URI            string          `yaml:"uri"`
+	UpdateWindow   time.Duration   `yaml:"updateWindow"`
+	CurrentStatus  string          `yaml:"-"`
+	PhysicalDevice TasmotaT1Status `yaml:"-"`
+	lock           sync.Mutex
 }
 
 //TasmotaT1Status is the JSON payload received from the device directly
@@ -49,6 +53,12 @@ type TasmotaT1Status struct {
 // Notice for the Tasmota T1 we have 3 switches which can have status'
 // therefore we only return which switch is specified within the Tasmota T1 struct
 func (t *TasmotaT1) UpdateStatus() (*string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.updateStatus()
+}
+
+func (t *TasmotaT1) updateStatus() (*string, error) {
 	checkAgain := true
 	layout := "2006.01.02 15:04:05" //Format from Sonoff --> https://github.com/arendst/Sonoff-Tasmota/wiki/JSON-Status-Responses
 	lastCheckedTime, err := time.Parse(layout, t.PhysicalDevice.Time)
@@ -65,16 +75,7 @@ func (t *TasmotaT1) UpdateStatus() (*string, error) {
 		log.WithFields(log.Fields{
 			"switch": t,
 		}).Debugf("Checking Tasmota status")
-		timeout := time.Duration(5 * time.Second)
-		client := http.Client{
-			Timeout: timeout,
-		}
-		resp, err := client.Get(t.URI + "/cm?cmnd=state")
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		respBytes, err := ioutil.ReadAll(resp.Body)
+		respBytes, err := t.get("state", t.URI+"/cm?cmnd=state")
 		if err != nil {
 			return nil, err
 		}
@@ -100,18 +101,22 @@ func (t *TasmotaT1) UpdateStatus() (*string, error) {
 			}).Error(errorString)
 			return nil, fmt.Errorf(errorString)
 		}
-		return &t.CurrentStatus, nil
+		status := t.CurrentStatus
+		return &status, nil
 	}
 	log.WithFields(log.Fields{
 		"switch":              t,
 		"data last retrieved": t.PhysicalDevice.Time,
 	}).Warn("Using cached data from Tasmota")
-	return &t.CurrentStatus, nil
+	status := t.CurrentStatus
+	return &status, nil
 }
 
 //TurnOn attempts to turn the switch "ON"
 func (t *TasmotaT1) TurnOn() error {
-	_, err := t.UpdateStatus()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, err := t.updateStatus()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -119,16 +124,7 @@ func (t *TasmotaT1) TurnOn() error {
 		return err
 	}
 
-	timeout := time.Duration(5 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
-	}
-	resp, err := client.Get(fmt.Sprintf("%s/cm?cmnd=POWER%d%%20ON", t.URI, t.SwitchNumber))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	respBytes, err := t.get("power on", fmt.Sprintf("%s/cm?cmnd=POWER%d%%20ON", t.URI, t.SwitchNumber))
 	if err != nil {
 		return err
 	}
@@ -159,8 +155,9 @@ func (t *TasmotaT1) TurnOn() error {
 
 //TurnOff attempts to turn the switch "OFF"
 func (t *TasmotaT1) TurnOff() error {
-
-	_, err := t.UpdateStatus()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, err := t.updateStatus()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -168,16 +165,7 @@ func (t *TasmotaT1) TurnOff() error {
 		return err
 	}
 
-	timeout := time.Duration(5 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
-	}
-	resp, err := client.Get(fmt.Sprintf("%s/cm?cmnd=POWER%d%%20OFF", t.URI, t.SwitchNumber))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	respBytes, err := t.get("power off", fmt.Sprintf("%s/cm?cmnd=POWER%d%%20OFF", t.URI, t.SwitchNumber))
 	if err != nil {
 		return err
 	}
@@ -205,3 +193,33 @@ func (t *TasmotaT1) TurnOff() error {
 	}
 	return nil
 }
+
+//LastStatus returns the status last received from the device,
+// including its Wifi and power diagnostics
+func (t *TasmotaT1) LastStatus() TasmotaT1Status {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.PhysicalDevice
+}
+
+//get sends a command to the device and returns the response body,
+// recording how long it took for the metrics
+func (t *TasmotaT1) get(request string, uri string) ([]byte, error) {
+	started := time.Now()
+	body, err := fetch(uri)
+	metrics.ObserveRequest("http", t.Name, request, started, err)
+	return body, err
+}
+
+func fetch(uri string) ([]byte, error) {
+	timeout := time.Duration(5 * time.Second)
+	client := http.Client{
+		Timeout: timeout,
+	}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
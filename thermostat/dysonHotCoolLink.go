@@ -12,30 +12,61 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/oskoss/mi-casa/metrics"
+	"github.com/oskoss/mi-casa/secret"
 	log "github.com/sirupsen/logrus"
 )
 
 type DysonHotCoolLink struct {
-	Name                         string `yaml:"name"`
-	IP                           string `yaml:"ip"`
-	Port                         string `yaml:"port"`
-	Serial                       string `yaml:"serialNumber"`
-	DysonAPIEmail                string `yaml:"dysonAPIEmail"`
-	DysonAPIPassword             string `yaml:"dysonAPIPassword"`
-	DysonAPIEndpoint             string `yaml:"dysonAPIEndpoint,omitempty"`
-	DecryptedDevicePassword      string
+	Name                         string        `yaml:"name"`
+	IP                           string        `yaml:"ip"`
+	Port                         string        `yaml:"port"`
+	Serial                       string        `yaml:"serialNumber"`
+	DysonAPIEmail                string        `yaml:"dysonAPIEmail"`
+	DysonAPIPassword             secret.String `yaml:"dysonAPIPassword"`
+	DysonAPIEndpoint             string        `yaml:"dysonAPIEndpoint,omitempty"`
+	DecryptedDevicePassword      secret.String
 	DysonIntermediateCredentials DysonAuth
 	DysonAPIInfo                 DysonAPIInfo
 	ClimateStatus                DysonHotCoolLinkStatus
+	ProductState                 map[string]string
 	MQTT                         mqtt.Client
+	closed                       chan struct{}
+	//lock guards ClimateStatus and ProductState, which HandleStatus
+	// replaces from the MQTT client's goroutine
+	lock sync.Mutex
 }
 
+//climateStaleAfter is how old the sensor data may get, the device asks
+// every second so older data means it stopped answering
+const climateStaleAfter = 5 * time.Minute
+
+//climate returns a copy of the climate status, failing once
+// it is too old to say anything about the room
+func (device *DysonHotCoolLink) climate() (DysonHotCoolLinkStatus, error) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	status := device.ClimateStatus
+	if status.Time.IsZero() {
+		return status, fmt.Errorf("Climate Status Not Retrieved Yet")
+	}
+	if age := time.Since(status.Time); age > climateStaleAfter {
+		return status, fmt.Errorf("Climate Status Last Received %v Ago", age.Round(time.Second))
+	}
+	return status, nil
+}
+
+//settableProductState are the product state keys a HotCoolLink accepts
+// within STATE-SET, the rest (filter life, error codes...) are read only
+var settableProductState = []string{"fmod", "fnsp", "oson", "nmod", "ffoc", "hmod", "hmax", "qtar", "rhtm"}
+
 type DysonAuth struct {
-	Account  string `json:"Account"`
-	Password string `json:"Password"`
+	Account  string        `json:"Account"`
+	Password secret.String `json:"Password"`
 }
 
 type DysonAPIInfo struct {
@@ -63,10 +94,14 @@ type DysonHotCoolLinkStatus struct {
 }
 
 func (device *DysonHotCoolLink) CurrentTemp() (temp *float64, err error) {
-	if device.ClimateStatus.Data.Tact == "" {
+	status, err := device.climate()
+	if err != nil {
+		return nil, err
+	}
+	if status.Data.Tact == "" {
 		return nil, fmt.Errorf("Temperature Not Retrieved Yet")
 	}
-	curTemp, err := strconv.ParseFloat(device.ClimateStatus.Data.Tact, 64)
+	curTemp, err := strconv.ParseFloat(status.Data.Tact, 64)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +112,77 @@ func (device *DysonHotCoolLink) CurrentTemp() (temp *float64, err error) {
 	return &curTemp, nil
 }
 
+func (device *DysonHotCoolLink) CurrentHumidity() (humidity *float64, err error) {
+	status, err := device.climate()
+	if err != nil {
+		return nil, err
+	}
+	if status.Data.Hact == "" {
+		return nil, fmt.Errorf("Humidity Not Retrieved Yet")
+	}
+	curHumidity, err := strconv.ParseFloat(status.Data.Hact, 64)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"curHumidity": curHumidity,
+	}).Debugf("current humidity")
+	return &curHumidity, nil
+}
+
+//AirQuality returns the particulate (pact) and volatile organic
+// compound (vact) levels, both on the Dyson 0-9 scale
+func (device *DysonHotCoolLink) AirQuality() (quality map[string]float64, err error) {
+	status, err := device.climate()
+	if err != nil {
+		return nil, err
+	}
+	readings := map[string]string{
+		"particulates": status.Data.Pact,
+		"voc":          status.Data.Vact,
+	}
+	quality = map[string]float64{}
+	for metric, reading := range readings {
+		if reading == "" {
+			return nil, fmt.Errorf("Air Quality Not Retrieved Yet")
+		}
+		value, err := strconv.ParseFloat(reading, 64)
+		if err != nil {
+			return nil, err
+		}
+		quality[metric] = value
+	}
+	return quality, nil
+}
+
+//SendCommand publishes a STATE-SET message to the device, the keys
+// within state are the raw Dyson product state names such as
+// "fmod" (FAN, HEAT, AUTO, OFF) or "hmax" (target temperature in Kelvin*10)
+func (device *DysonHotCoolLink) SendCommand(state map[string]string) (err error) {
+	if device.MQTT == nil {
+		return fmt.Errorf("HotCoolLink device %s not connected", device.Serial)
+	}
+	command, err := json.Marshal(map[string]interface{}{
+		"msg":         "STATE-SET",
+		"time":        time.Now().UTC().Format(time.RFC3339),
+		"mode-reason": "LAPP",
+		"data":        state,
+	})
+	if err != nil {
+		return err
+	}
+	commandTopic := fmt.Sprintf("%s/%s/command", device.DysonAPIInfo.ProductType, device.DysonAPIInfo.Serial)
+	started := time.Now()
+	token := device.MQTT.Publish(commandTopic, 1, false, command)
+	if !token.WaitTimeout(5 * time.Second) {
+		err = fmt.Errorf("HotCoolLink device %s did not acknowledge command", device.Serial)
+	} else {
+		err = token.Error()
+	}
+	metrics.ObserveRequest("mqtt", device.Name, "command", started, err)
+	return err
+}
+
 func (device *DysonHotCoolLink) Connect() (err error) {
 	if device.DysonAPIEmail == "" {
 		return fmt.Errorf("HotCoolLink device DysonAPIEmail not set")
@@ -94,11 +200,15 @@ func (device *DysonHotCoolLink) Connect() (err error) {
 		return fmt.Errorf("HotCoolLink device Serial not set")
 	}
 
+	started := time.Now()
 	err = device.addDysonIntermediateCredentials()
+	metrics.ObserveRequest("http", device.Name, "authenticate", started, err)
 	if err != nil {
 		return err
 	}
+	started = time.Now()
 	err = device.addDysonAPIInfo()
+	metrics.ObserveRequest("http", device.Name, "manifest", started, err)
 	if err != nil {
 		return err
 	}
@@ -106,17 +216,20 @@ func (device *DysonHotCoolLink) Connect() (err error) {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(fmt.Sprintf("tcp://%s:%s", device.IP, device.Port))
 	opts.SetUsername(device.DysonAPIInfo.Serial)
-	opts.SetPassword(device.DecryptedDevicePassword)
+	opts.SetPassword(device.DecryptedDevicePassword.Reveal())
 
 	client := mqtt.NewClient(opts)
+	started = time.Now()
 	token := client.Connect()
 	for !token.WaitTimeout(3 * time.Second) {
 	}
+	metrics.ObserveRequest("mqtt", device.Name, "connect", started, token.Error())
 	if err := token.Error(); err != nil {
 		return err
 	}
 
 	device.MQTT = client
+	device.closed = make(chan struct{})
 	listenTopic := fmt.Sprintf("%s/%s/status/current", device.DysonAPIInfo.ProductType, device.DysonAPIInfo.Serial)
 	stateTopic := fmt.Sprintf("%s/%s/command", device.DysonAPIInfo.ProductType, device.DysonAPIInfo.Serial)
 	go device.SubscribeTemp(device.MQTT, listenTopic)
@@ -126,23 +239,105 @@ func (device *DysonHotCoolLink) Connect() (err error) {
 
 func (device *DysonHotCoolLink) RequestTemp(client mqtt.Client, topic string) {
 	timer := time.NewTicker(1 * time.Second)
-	for range timer.C {
-		client.Publish(topic, 0, false, "REQUEST-CURRENT-STATE")
+	defer timer.Stop()
+	closed := device.closed
+	for {
+		select {
+		case <-closed:
+			return
+		case <-timer.C:
+			client.Publish(topic, 0, false, "REQUEST-CURRENT-STATE")
+		}
 	}
 }
 
+//Close stops requesting the state and disconnects from the device
+func (device *DysonHotCoolLink) Close() (err error) {
+	if device.closed != nil {
+		select {
+		case <-device.closed:
+		default:
+			close(device.closed)
+		}
+	}
+	if device.MQTT != nil {
+		device.MQTT.Disconnect(250)
+		device.MQTT = nil
+	}
+	return nil
+}
+
 func (device *DysonHotCoolLink) SubscribeTemp(client mqtt.Client, topic string) {
 	client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		var currentStatus DysonHotCoolLinkStatus
 		message := msg.Payload()
-		if err := json.Unmarshal(message, &currentStatus); err != nil {
+		if err := device.HandleStatus(message); err != nil {
 			fmt.Printf("CurrentStatus %+v received from HotCoolLink %s is malformed", message, device.DysonAPIInfo.Serial)
-		} else {
-			device.ClimateStatus = currentStatus
 		}
 	})
 }
 
+//HandleStatus records a status message published by the device,
+// product state messages update ProductState and everything else
+// is treated as environmental sensor data
+func (device *DysonHotCoolLink) HandleStatus(message []byte) error {
+	var stateMessage struct {
+		Msg          string                     `json:"msg"`
+		ProductState map[string]json.RawMessage `json:"product-state"`
+	}
+	if err := json.Unmarshal(message, &stateMessage); err != nil {
+		return err
+	}
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if stateMessage.Msg == "CURRENT-STATE" || stateMessage.Msg == "STATE-CHANGE" {
+		productState := map[string]string{}
+		for key, value := range device.ProductState {
+			productState[key] = value
+		}
+		for key, raw := range stateMessage.ProductState {
+			var value string
+			if err := json.Unmarshal(raw, &value); err == nil {
+				productState[key] = value
+				continue
+			}
+			// STATE-CHANGE reports [previous, current]
+			var change []string
+			if err := json.Unmarshal(raw, &change); err != nil || len(change) == 0 {
+				return fmt.Errorf("product state %s is malformed", key)
+			}
+			productState[key] = change[len(change)-1]
+		}
+		device.ProductState = productState
+		return nil
+	}
+	var currentStatus DysonHotCoolLinkStatus
+	if err := json.Unmarshal(message, &currentStatus); err != nil {
+		return err
+	}
+	if currentStatus.Time.IsZero() {
+		currentStatus.Time = time.Now()
+	}
+	device.ClimateStatus = currentStatus
+	return nil
+}
+
+//CurrentState returns the settable product state of the device,
+// which can be handed back to SendCommand to restore it
+func (device *DysonHotCoolLink) CurrentState() (state map[string]string, err error) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if len(device.ProductState) == 0 {
+		return nil, fmt.Errorf("Product State Not Retrieved Yet")
+	}
+	state = map[string]string{}
+	for _, key := range settableProductState {
+		if value, ok := device.ProductState[key]; ok {
+			state[key] = value
+		}
+	}
+	return state, nil
+}
+
 func (device *DysonHotCoolLink) addDysonIntermediateCredentials() (err error) {
 
 	timeout := time.Duration(5 * time.Second)
@@ -156,7 +351,7 @@ func (device *DysonHotCoolLink) addDysonIntermediateCredentials() (err error) {
 
 	requestBody, err := json.Marshal(map[string]string{
 		"Email":    device.DysonAPIEmail,
-		"Password": device.DysonAPIPassword,
+		"Password": device.DysonAPIPassword.Reveal(),
 	})
 
 	if err != nil {
@@ -212,7 +407,7 @@ func (device *DysonHotCoolLink) addDysonAPIInfo() (err error) {
 	)
 	req.SetBasicAuth(
 		device.DysonIntermediateCredentials.Account,
-		device.DysonIntermediateCredentials.Password,
+		device.DysonIntermediateCredentials.Password.Reveal(),
 	)
 	resp, err := client.Do(req)
 	if err != nil {
@@ -220,7 +415,7 @@ func (device *DysonHotCoolLink) addDysonAPIInfo() (err error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Failed to login to dyson API with intermediate credentials Account: %s, Password: %s", device.DysonIntermediateCredentials.Account, device.DysonIntermediateCredentials.Password)
+		return fmt.Errorf("Failed to login to dyson API with intermediate credentials for account %s", device.DysonIntermediateCredentials.Account)
 	}
 	defer resp.Body.Close()
 	respBytes, err := ioutil.ReadAll(resp.Body)
@@ -240,7 +435,7 @@ func (device *DysonHotCoolLink) addDysonAPIInfo() (err error) {
 			if err != nil {
 				return err
 			}
-			device.DecryptedDevicePassword = decryptedDevicePassword
+			device.DecryptedDevicePassword = secret.String(decryptedDevicePassword)
 			fmt.Println("Added Dyson API Info")
 			return nil
 		}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -134,6 +135,115 @@ var _ = Describe("DysonHotCoolLink", func() {
 			})
 		})
 	})
+	Describe("obtaining the humidity", func() {
+		Context("when no status has been received", func() {
+			It("should return an error", func() {
+				myDysonHotCoolLink.ClimateStatus.Data.Hact = ""
+				_, err := myDysonHotCoolLink.CurrentHumidity()
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+		Context("when the last status is too old", func() {
+			It("should return an error", func() {
+				myDysonHotCoolLink.ClimateStatus.Time = time.Now().Add(-10 * time.Minute)
+				myDysonHotCoolLink.ClimateStatus.Data.Hact = "0045"
+				_, err := myDysonHotCoolLink.CurrentHumidity()
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+		Context("when a status has been received", func() {
+			It("should return the humidity as a percentage", func() {
+				myDysonHotCoolLink.ClimateStatus.Time = time.Now()
+				myDysonHotCoolLink.ClimateStatus.Data.Hact = "0045"
+				humidity, err := myDysonHotCoolLink.CurrentHumidity()
+				Expect(err).Should(BeNil())
+				Expect(*humidity).Should(Equal(45.0))
+			})
+		})
+	})
+	Describe("obtaining the air quality", func() {
+		Context("when no status has been received", func() {
+			It("should return an error", func() {
+				myDysonHotCoolLink.ClimateStatus.Data.Pact = ""
+				_, err := myDysonHotCoolLink.AirQuality()
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+		Context("when a status has been received", func() {
+			It("should return particulates and voc", func() {
+				myDysonHotCoolLink.ClimateStatus.Time = time.Now()
+				myDysonHotCoolLink.ClimateStatus.Data.Pact = "0003"
+				myDysonHotCoolLink.ClimateStatus.Data.Vact = "0001"
+				quality, err := myDysonHotCoolLink.AirQuality()
+				Expect(err).Should(BeNil())
+				Expect(quality).Should(Equal(map[string]float64{"particulates": 3, "voc": 1}))
+			})
+		})
+	})
+	Describe("handling a status message", func() {
+		BeforeEach(func() {
+			myDysonHotCoolLink.ProductState = nil
+			myDysonHotCoolLink.ClimateStatus = DysonHotCoolLinkStatus{}
+		})
+		It("should record environmental data as the climate status", func() {
+			err := myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"2950","hact":"0040"}}`))
+			Expect(err).Should(BeNil())
+			Expect(myDysonHotCoolLink.ClimateStatus.Data.Tact).Should(Equal("2950"))
+		})
+		It("should record product state without touching the climate status", func() {
+			err := myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"2950"}}`))
+			Expect(err).Should(BeNil())
+			err = myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"CURRENT-STATE","product-state":{"fmod":"HEAT","hmax":"2960","filf":"2159"}}`))
+			Expect(err).Should(BeNil())
+			Expect(myDysonHotCoolLink.ClimateStatus.Data.Tact).Should(Equal("2950"))
+			state, err := myDysonHotCoolLink.CurrentState()
+			Expect(err).Should(BeNil())
+			Expect(state).Should(Equal(map[string]string{"fmod": "HEAT", "hmax": "2960"}))
+		})
+		It("should take the new value from a state change", func() {
+			err := myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"STATE-CHANGE","product-state":{"fmod":["HEAT","FAN"]}}`))
+			Expect(err).Should(BeNil())
+			Expect(myDysonHotCoolLink.ProductState["fmod"]).Should(Equal("FAN"))
+		})
+		It("should reject a malformed message", func() {
+			err := myDysonHotCoolLink.HandleStatus([]byte(`not json`))
+			Expect(err).ShouldNot(BeNil())
+		})
+		It("should be safe to read while messages arrive", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"2950","hact":"0040"}}`))
+					myDysonHotCoolLink.HandleStatus([]byte(`{"msg":"STATE-CHANGE","product-state":{"fmod":["HEAT","FAN"]}}`))
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				myDysonHotCoolLink.CurrentTemp()
+				myDysonHotCoolLink.CurrentState()
+			}
+			Eventually(done).Should(BeClosed())
+			humidity, err := myDysonHotCoolLink.CurrentHumidity()
+			Expect(err).Should(BeNil())
+			Expect(*humidity).Should(Equal(40.0))
+		})
+	})
+	Describe("sending a command", func() {
+		Context("when the device is not connected", func() {
+			It("should return an error", func() {
+				err := myDysonHotCoolLink.SendCommand(map[string]string{"fmod": "HEAT"})
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+	})
+	Describe("closing the device", func() {
+		Context("when the device is not connected", func() {
+			It("should return no error, however often it is closed", func() {
+				Expect(myDysonHotCoolLink.Close()).Should(Succeed())
+				Expect(myDysonHotCoolLink.Close()).Should(Succeed())
+			})
+		})
+	})
 	Describe("obtaining the temperature", func() {
 		It("should return the temperature", func() {
 		})
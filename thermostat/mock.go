@@ -2,12 +2,63 @@ package thermostat
 
 type MockThermostat struct {
 	Temperature float64
+	Humidity    float64
+	Quality     map[string]float64
+	State       map[string]string
+	Commands    []map[string]string
+	Err         error
 }
 
 func (device *MockThermostat) CurrentTemp() (temp *float64, err error) {
+	if device.Err != nil {
+		return nil, device.Err
+	}
 	return &device.Temperature, nil
 }
 
+func (device *MockThermostat) CurrentHumidity() (humidity *float64, err error) {
+	if device.Err != nil {
+		return nil, device.Err
+	}
+	return &device.Humidity, nil
+}
+
+func (device *MockThermostat) AirQuality() (quality map[string]float64, err error) {
+	if device.Err != nil {
+		return nil, device.Err
+	}
+	quality = map[string]float64{}
+	for metric, value := range device.Quality {
+		quality[metric] = value
+	}
+	return quality, nil
+}
+
+func (device *MockThermostat) SendCommand(state map[string]string) (err error) {
+	if device.Err != nil {
+		return device.Err
+	}
+	device.Commands = append(device.Commands, state)
+	if device.State == nil {
+		device.State = map[string]string{}
+	}
+	for key, value := range state {
+		device.State[key] = value
+	}
+	return nil
+}
+
+func (device *MockThermostat) CurrentState() (state map[string]string, err error) {
+	if device.Err != nil {
+		return nil, device.Err
+	}
+	state = map[string]string{}
+	for key, value := range device.State {
+		state[key] = value
+	}
+	return state, nil
+}
+
 func (device *MockThermostat) Connect() (err error) {
 
 	return nil
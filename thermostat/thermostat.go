@@ -6,3 +6,33 @@ type ThermostatDevice interface {
 	CurrentTemp() (temp *float64, err error)
 	Connect() (err error)
 }
+
+//HumiditySensor is implemented by thermostat devices
+//which also report relative humidity as a percentage
+type HumiditySensor interface {
+	CurrentHumidity() (humidity *float64, err error)
+}
+
+//Commander is implemented by thermostat devices which
+//accept raw state changes, e.g. a Dyson "fmod" of "HEAT"
+type Commander interface {
+	SendCommand(state map[string]string) (err error)
+}
+
+//StateReporter is implemented by thermostat devices which can
+//report their current settable state in the form Commander accepts
+type StateReporter interface {
+	CurrentState() (state map[string]string, err error)
+}
+
+//AirQualitySensor is implemented by thermostat devices which also
+//report air quality, keyed by metric such as "particulates" or "voc"
+type AirQualitySensor interface {
+	AirQuality() (quality map[string]float64, err error)
+}
+
+//Closer is implemented by thermostat devices which hold a connection
+//open once connected, Close disconnects them for good
+type Closer interface {
+	Close() (err error)
+}
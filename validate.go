@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/oskoss/mi-casa/auth"
+	"github.com/oskoss/mi-casa/broker"
+	"github.com/oskoss/mi-casa/certs"
+	"github.com/oskoss/mi-casa/config"
+	"github.com/oskoss/mi-casa/home"
+	"github.com/oskoss/mi-casa/homekit"
+	"github.com/oskoss/mi-casa/hue"
+	"github.com/oskoss/mi-casa/hvac"
+	"github.com/oskoss/mi-casa/notify"
+	"github.com/oskoss/mi-casa/rules"
+	"github.com/oskoss/mi-casa/scene"
+	log "github.com/sirupsen/logrus"
+)
+
+const configUsage = `usage: micasa config validate
+       micasa config show [--effective]
+
+show lists every setting once conf.d, MICASA_ environment variables
+and --set are laid over the config file, --effective adds where each
+came from. Secrets are never shown, only references to them.`
+
+//validation is the outcome of checking a config
+type validation struct {
+	Config   string          `json:"config"`
+	Valid    bool            `json:"valid"`
+	Problems config.Problems `json:"problems"`
+}
+
+func configCommand(opts *options, args []string) int {
+	flags := newFlagSet("config", opts)
+	effective := flags.Bool("effective", false, "show where each setting came from")
+	args, ok := commandArgs(flags, args, configUsage)
+	if !ok || len(args) != 1 || (args[0] != "validate" && args[0] != "show") {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return exitUsage
+	}
+	setLogLevel(opts, log.WarnLevel)
+	doc, err := layers(opts).Read()
+	if err != nil {
+		return failed(opts, exitConfig, fmt.Errorf("reading config %s: %v", config.RedactURL(opts.config), err))
+	}
+	if args[0] == "show" {
+		return showSettings(opts, doc, *effective)
+	}
+	validate(doc)
+	result := validation{Config: config.RedactURL(opts.config), Problems: doc.Problems, Valid: len(doc.Problems) == 0}
+	if result.Problems == nil {
+		result.Problems = config.Problems{}
+	}
+	output(opts, result, func() {
+		if result.Valid {
+			fmt.Printf("%s is valid\n", result.Config)
+			return
+		}
+		for _, problem := range result.Problems {
+			location := problem.Source
+			if location == "" {
+				location = result.Config
+			}
+			if problem.Line > 0 {
+				location += fmt.Sprintf(":%d:%d", problem.Line, problem.Column)
+			}
+			if problem.Path != "" {
+				location += ": " + problem.Path
+			}
+			fmt.Printf("%s: %s\n", location, problem.Message)
+		}
+	})
+	if !result.Valid {
+		return exitConfig
+	}
+	return exitOK
+}
+
+//showSettings writes every setting of doc, and where
+// it came from when effective
+func showSettings(opts *options, doc *config.Document, effective bool) int {
+	if len(doc.Problems) > 0 {
+		return failed(opts, exitConfig, fmt.Errorf("reading config %s: %v", config.RedactURL(opts.config), doc.Problems))
+	}
+	settings := doc.Settings()
+	if !effective {
+		for i := range settings {
+			settings[i].Source, settings[i].Line, settings[i].Column = "", 0, 0
+		}
+	}
+	output(opts, settings, func() {
+		for _, setting := range settings {
+			if !effective {
+				fmt.Printf("%s = %s\n", setting.Path, setting.Value)
+				continue
+			}
+			source := setting.Source
+			if setting.Line > 0 {
+				source += fmt.Sprintf(":%d:%d", setting.Line, setting.Column)
+			}
+			fmt.Printf("%s = %s  (%s)\n", setting.Path, setting.Value, source)
+		}
+	})
+	return exitOK
+}
+
+//validate builds everything serve would from the config of doc, without
+// connecting to any device or listening, adding what is wrong to doc
+func validate(doc *config.Document) {
+	micasaConfig := doc.Config
+	if micasaConfig == nil {
+		return
+	}
+	myHome, err := home.New(micasaConfig)
+	if err != nil {
+		// everything else refers to the devices by name, and the
+		// config checks already explain why they could not be built
+		if len(doc.Problems) == 0 {
+			doc.Report("", err)
+		}
+		return
+	}
+	_, err = scene.NewManager(micasaConfig.Scenes, micasaConfig.ScenesFile, myHome.Thermostats, myHome.Switches)
+	report(doc, "scenes", err)
+	_, err = rules.NewEngine(micasaConfig.Automation, myHome.Thermostats, myHome.Switches)
+	report(doc, "automation", err)
+	controllers := []*hvac.Controller{}
+	if micasaConfig.HVAC != nil {
+		controller, err := hvac.NewController(*micasaConfig.HVAC, myHome.Thermostats, myHome.Switches)
+		report(doc, "hvac", err)
+		if controller != nil {
+			controllers = append(controllers, controller)
+		}
+	}
+	if len(micasaConfig.Zones) > 0 {
+		zones, err := hvac.NewZones(micasaConfig.Zones, myHome.Thermostats, myHome.Switches)
+		report(doc, "zones", err)
+		if zones != nil {
+			controllers = append(controllers, zones.Controllers...)
+		}
+	}
+	if micasaConfig.Broker != nil {
+		_, err = broker.New(*micasaConfig.Broker)
+		report(doc, "broker", err)
+	}
+	if micasaConfig.HomeKit != nil {
+		_, err = homekit.New(*micasaConfig.HomeKit, myHome.Thermostats, myHome.Switches, controllers)
+		report(doc, "homeKit", err)
+	}
+	if micasaConfig.Hue != nil {
+		_, err = hue.New(*micasaConfig.Hue, myHome.Switches)
+		report(doc, "hue", err)
+	}
+	if micasaConfig.Notify != nil {
+		_, err = notify.New(*micasaConfig.Notify)
+		report(doc, "notify", err)
+	}
+	if micasaConfig.API.TLS != nil {
+		_, err = certs.New(*micasaConfig.API.TLS)
+		report(doc, "api.tls", err)
+	}
+	_, err = auth.New(micasaConfig.API.Auth)
+	report(doc, "api.auth", err)
+}
+
+//report adds err to doc at section, dropping the section from the
+// message when the error already starts with it
+func report(doc *config.Document, section string, err error) {
+	if err == nil {
+		return
+	}
+	message := err.Error()
+	if strings.HasPrefix(strings.ToLower(message), strings.ToLower(section)) {
+		message = strings.TrimLeft(message[len(section):], ": ")
+		err = errors.New(message)
+	}
+	doc.Report(section, err)
+}